@@ -1,12 +1,38 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"log"
+	"os"
 
 	"github.com/oziev02/ImageProcessor/internal/app"
 )
 
 func main() {
+	migrateCheck := flag.Bool("migrate-check", false, "report schema version and pending migrations without applying them")
+	migrateDown := flag.Bool("migrate-down", false, "roll back migrations and exit")
+	steps := flag.Int("steps", 1, "number of migrations to roll back with --migrate-down")
+	flag.Parse()
+
+	if *migrateCheck {
+		if err := app.CheckMigrations(); err != nil {
+			if errors.Is(err, app.ErrPendingMigrations) {
+				log.Print(err)
+				os.Exit(1)
+			}
+			log.Fatalf("migration check failed: %v", err)
+		}
+		return
+	}
+
+	if *migrateDown {
+		if err := app.MigrateDown(*steps); err != nil {
+			log.Fatalf("migration rollback failed: %v", err)
+		}
+		return
+	}
+
 	application, err := app.New()
 	if err != nil {
 		log.Fatalf("failed to create app: %v", err)
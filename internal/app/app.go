@@ -5,31 +5,40 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"log/slog"
 
-	"github.com/golang-migrate/migrate/v4"
-	_ "github.com/golang-migrate/migrate/v4/database/postgres"
-	"github.com/golang-migrate/migrate/v4/source/iofs"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/oziev02/ImageProcessor/internal/config"
-	"github.com/oziev02/ImageProcessor/internal/migrations"
 	"github.com/oziev02/ImageProcessor/internal/observability"
 	"github.com/oziev02/ImageProcessor/internal/repo"
 	"github.com/oziev02/ImageProcessor/internal/service"
+	"github.com/oziev02/ImageProcessor/internal/transport/clamav"
 	httptransport "github.com/oziev02/ImageProcessor/internal/transport/http"
 	kafkatransport "github.com/oziev02/ImageProcessor/internal/transport/kafka"
+	"github.com/oziev02/ImageProcessor/internal/transport/webhook"
 )
 
 type App struct {
-	cfg           *config.Config
-	logger        *slog.Logger
-	db            *pgxpool.Pool
-	httpServer    *httptransport.Server
-	kafkaConsumer kafkatransport.Consumer
-	processorSvc  service.ProcessorService
+	cfg            *config.Config
+	logger         *slog.Logger
+	db             database
+	httpServer     *httptransport.Server
+	kafkaConsumers []kafkatransport.Consumer
+	processorSvc   service.ProcessorService
+	outboxRelay    service.OutboxRelay
+	retrySweeper   service.RetrySweeper
+	// shutdownTracing flushes pending spans
+	shutdownTracing func(context.Context) error
+}
+
+// database is the connection pool as App uses it: closed once nothing else
+// needs it
+type database interface {
+	Close()
 }
 
 func New() (*App, error) {
@@ -39,6 +48,12 @@ func New() (*App, error) {
 	}
 
 	logger := observability.NewLogger()
+	metrics := observability.NewMetrics()
+
+	shutdownTracing, err := observability.NewTracerProvider(context.Background(), cfg.Tracing)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize tracing: %w", err)
+	}
 
 	// Initialize database
 	db, err := initDB(cfg, logger)
@@ -48,47 +63,119 @@ func New() (*App, error) {
 
 	// Initialize repositories
 	imageRepo := repo.NewImageRepository(db)
-	storageRepo := repo.NewStorageRepository(cfg.Storage.BasePath)
+	eventRepo := repo.NewEventRepository(db)
+	outboxRepo := repo.NewOutboxRepository(db)
+	// Shared by every component so that their writes and deletes
+	// invalidate what the cache serves
+	storageRepo := repo.NewCachedStorage(repo.NewStorageRepository(cfg.Storage.BasePath), cfg.Storage.CacheSize)
 
 	// Initialize Kafka producer
-	producer := kafkatransport.NewProducer(cfg.Kafka.Brokers, cfg.Kafka.Topic)
+	producer := kafkatransport.NewProducer(cfg.Kafka.Brokers, kafkatransport.Topics{
+		Processing: cfg.Kafka.Topic,
+		Thumbnail:  cfg.Kafka.ThumbnailTopic,
+		Reprocess:  cfg.Kafka.ReprocessTopic,
+	})
+
+	// Initialize the upload malware scanner if enabled
+	var scanner clamav.Scanner
+	if cfg.Scan.Enabled {
+		scanner = clamav.NewScanner(cfg.Scan.Address, cfg.Scan.Timeout)
+	}
 
 	// Initialize services
-	imageSvc := service.NewImageService(imageRepo, storageRepo, producer, cfg)
-	processorSvc := service.NewProcessorService(imageRepo, storageRepo, cfg)
+	// Shared so that uploads and processing together stay within the limit
+	decodes := service.NewDecodeLimiter(cfg.Image.MaxConcurrentDecodes)
+	imageSvc := service.NewImageService(imageRepo, eventRepo, outboxRepo, storageRepo, producer, scanner, decodes, cfg, logger)
+	outboxRelay := service.NewOutboxRelay(outboxRepo, producer, cfg, logger)
+	retrySweeper := service.NewRetrySweeper(imageSvc, cfg, logger)
+	// Initialize the completion webhook if configured
+	var notifier webhook.Notifier
+	if cfg.Webhook.URL != "" {
+		notifier = webhook.NewNotifier(cfg.Webhook.URL, cfg.Webhook.Secret, cfg.Webhook.Timeout)
+	}
 
-	// Initialize Kafka consumer
-	kafkaConsumer := kafkatransport.NewConsumer(cfg.Kafka.Brokers, cfg.Kafka.Topic, cfg.Kafka.ConsumerGroup)
+	processorSvc := service.NewProcessorService(imageRepo, eventRepo, storageRepo, notifier, decodes, cfg, metrics, logger)
+
+	// Initialize Kafka consumers, with a dedicated one for thumbnails if
+	// configured. The reprocess topic shares the main consumer, whose queue
+	// orders its tasks and uploads by priority.
+	consumerOpts := kafkatransport.ConsumerOptions{
+		QueueSize:       cfg.Kafka.QueueSize,
+		Concurrency:     cfg.Kafka.Concurrency,
+		MaxAttempts:     cfg.Kafka.MaxAttempts,
+		RetryBackoff:    cfg.Kafka.RetryBackoff,
+		DLQTopic:        cfg.Kafka.DLQTopic,
+		FetchMaxBackoff: cfg.Kafka.FetchMaxBackoff,
+	}
+	topics := []string{cfg.Kafka.Topic}
+	if cfg.Kafka.ReprocessTopic != "" {
+		topics = append(topics, cfg.Kafka.ReprocessTopic)
+	}
+	kafkaConsumers := []kafkatransport.Consumer{
+		kafkatransport.NewConsumer(cfg.Kafka.Brokers, topics, cfg.Kafka.ConsumerGroup, consumerOpts, metrics, logger),
+	}
+	if cfg.Kafka.ThumbnailTopic != "" {
+		kafkaConsumers = append(kafkaConsumers,
+			kafkatransport.NewConsumer(cfg.Kafka.Brokers, []string{cfg.Kafka.ThumbnailTopic}, cfg.Kafka.ConsumerGroup, consumerOpts, metrics, logger))
+	}
 
 	// Initialize HTTP handler
-	handler := httptransport.NewHandler(imageSvc, storageRepo)
+	dependencies := map[string]httptransport.Pinger{
+		"database": db,
+		"kafka":    kafkatransport.NewProber(cfg.Kafka.Brokers),
+	}
+	handler := httptransport.NewHandler(imageSvc, processorSvc, storageRepo, dependencies, metrics, cfg, logger)
 
 	// Initialize HTTP server
 	addr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
 	httpServer := httptransport.NewServer(addr, handler)
 
 	return &App{
-		cfg:           cfg,
-		logger:        logger,
-		db:            db,
-		httpServer:    httpServer,
-		kafkaConsumer: kafkaConsumer,
-		processorSvc:  processorSvc,
+		cfg:             cfg,
+		logger:          logger,
+		db:              db,
+		httpServer:      httpServer,
+		kafkaConsumers:  kafkaConsumers,
+		processorSvc:    processorSvc,
+		outboxRelay:     outboxRelay,
+		retrySweeper:    retrySweeper,
+		shutdownTracing: shutdownTracing,
 	}, nil
 }
 
 func (a *App) Start() error {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	return a.run(sigChan)
+}
+
+// run starts the application and shuts it down once stop receives
+func (a *App) run(stop <-chan os.Signal) error {
 	a.logger.Info("starting application", "addr", a.httpServer.Addr())
 
-	// Start Kafka consumer in background
+	// Start Kafka consumers in background
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	go func() {
-		if err := a.kafkaConsumer.Start(ctx, a.processorSvc); err != nil {
-			a.logger.Error("kafka consumer error", "error", err)
-		}
-	}()
+	// Tracks the goroutines using the database, which must return before
+	// the pool is closed
+	var workers sync.WaitGroup
+
+	for _, consumer := range a.kafkaConsumers {
+		workers.Go(func() {
+			if err := consumer.Start(ctx, a.processorSvc); err != nil {
+				a.logger.Error("kafka consumer error", "error", err)
+			}
+		})
+	}
+
+	// Start relaying processing tasks uploads couldn't send
+	workers.Go(func() { a.outboxRelay.Run(ctx) })
+
+	// Start requeueing failed images if enabled
+	if a.cfg.Image.RetryInterval > 0 {
+		workers.Go(func() { a.retrySweeper.Run(ctx) })
+	}
 
 	// Start HTTP server
 	go func() {
@@ -98,9 +185,7 @@ func (a *App) Start() error {
 	}()
 
 	// Wait for interrupt signal
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	<-sigChan
+	<-stop
 
 	a.logger.Info("shutting down application")
 
@@ -108,18 +193,40 @@ func (a *App) Start() error {
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer shutdownCancel()
 
-	cancel() // Stop Kafka consumer
+	cancel() // Stop Kafka consumers
+
+	// Returns once no request is running, cancelling those left at the
+	// timeout, so that none uses the database after it's closed
+	httpErr := a.httpServer.Shutdown(shutdownCtx)
 
-	if err := a.httpServer.Shutdown(shutdownCtx); err != nil {
-		return fmt.Errorf("failed to shutdown http server: %w", err)
+	// Wait for consumers to finish the task in progress, and for the relay
+	// and sweeper to return, so that none uses the database after it's closed
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-shutdownCtx.Done():
+		a.logger.Warn("background workers did not stop before shutdown timeout")
 	}
 
-	if err := a.kafkaConsumer.Close(); err != nil {
-		return fmt.Errorf("failed to close kafka consumer: %w", err)
+	for _, consumer := range a.kafkaConsumers {
+		if err := consumer.Close(); err != nil {
+			return fmt.Errorf("failed to close kafka consumer: %w", err)
+		}
 	}
 
 	a.db.Close()
 
+	if err := a.shutdownTracing(shutdownCtx); err != nil {
+		a.logger.Error("failed to flush traces", "error", err)
+	}
+
+	if httpErr != nil {
+		return fmt.Errorf("failed to shutdown http server: %w", httpErr)
+	}
 	return nil
 }
 
@@ -139,49 +246,16 @@ func initDB(cfg *config.Config, logger *slog.Logger) (*pgxpool.Pool, error) {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	// Run migrations
-	if err := runMigrations(cfg, logger); err != nil {
-		return nil, fmt.Errorf("failed to run migrations: %w", err)
+	// Run migrations unless the schema is managed externally
+	if cfg.Database.AutoMigrate {
+		logger.Info("auto-migration enabled, applying migrations")
+		if err := runMigrations(context.Background(), db, cfg, logger); err != nil {
+			return nil, fmt.Errorf("failed to run migrations: %w", err)
+		}
+	} else {
+		logger.Info("auto-migration disabled, assuming schema is managed externally")
 	}
 
 	logger.Info("database initialized")
 	return db, nil
 }
-
-func runMigrations(cfg *config.Config, logger *slog.Logger) error {
-	// Create source driver from embedded filesystem
-	sourceDriver, err := iofs.New(migrations.Files, ".")
-	if err != nil {
-		return fmt.Errorf("failed to create source driver: %w", err)
-	}
-
-	// Build DSN for migrate
-	dsn := fmt.Sprintf(
-		"postgres://%s:%s@%s:%d/%s?sslmode=%s",
-		cfg.Database.User,
-		cfg.Database.Password,
-		cfg.Database.Host,
-		cfg.Database.Port,
-		cfg.Database.DBName,
-		cfg.Database.SSLMode,
-	)
-
-	// Create migrate instance
-	m, err := migrate.NewWithSourceInstance("iofs", sourceDriver, dsn)
-	if err != nil {
-		return fmt.Errorf("failed to create migrate instance: %w", err)
-	}
-	defer m.Close()
-
-	// Run migrations
-	if err := m.Up(); err != nil {
-		if err == migrate.ErrNoChange {
-			logger.Info("database schema is up to date")
-			return nil
-		}
-		return fmt.Errorf("failed to run migrations: %w", err)
-	}
-
-	logger.Info("database migrations completed successfully")
-	return nil
-}
@@ -0,0 +1,116 @@
+package app
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oziev02/ImageProcessor/internal/config"
+	"github.com/oziev02/ImageProcessor/internal/observability"
+	httptransport "github.com/oziev02/ImageProcessor/internal/transport/http"
+	kafkatransport "github.com/oziev02/ImageProcessor/internal/transport/kafka"
+)
+
+// fakeDB records when the pool is closed
+type fakeDB struct {
+	closed atomic.Bool
+}
+
+func (d *fakeDB) Close() { d.closed.Store(true) }
+
+// worker stands for a goroutine using the database: once stopped it takes a
+// while to finish what it was doing, then notes whether the pool was closed
+// under it
+type worker struct {
+	db         *fakeDB
+	finishing  time.Duration
+	finished   atomic.Bool
+	sawClosed  atomic.Bool
+	closedLast atomic.Bool
+}
+
+func (w *worker) work(ctx context.Context) {
+	<-ctx.Done()
+	time.Sleep(w.finishing)
+	if w.db.closed.Load() {
+		w.sawClosed.Store(true)
+	}
+	w.finished.Store(true)
+}
+
+type fakeConsumer struct{ *worker }
+
+func (c fakeConsumer) Start(ctx context.Context, processor kafkatransport.Processor) error {
+	c.work(ctx)
+	return nil
+}
+
+func (c fakeConsumer) Close() error {
+	c.closedLast.Store(c.finished.Load())
+	return nil
+}
+
+type fakeRunner struct{ *worker }
+
+func (r fakeRunner) Run(ctx context.Context) { r.work(ctx) }
+
+func TestShutdownClosesDatabaseLast(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Image.RetryInterval = time.Minute
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	handler := httptransport.NewHandler(nil, nil, nil, nil, observability.NewMetrics(), cfg, logger)
+
+	db := &fakeDB{}
+	consumer := &worker{db: db, finishing: 100 * time.Millisecond}
+	relay := &worker{db: db, finishing: 50 * time.Millisecond}
+	sweeper := &worker{db: db, finishing: 50 * time.Millisecond}
+	a := &App{
+		cfg:             cfg,
+		logger:          logger,
+		db:              db,
+		httpServer:      httptransport.NewServer("127.0.0.1:0", handler),
+		kafkaConsumers:  []kafkatransport.Consumer{fakeConsumer{consumer}},
+		outboxRelay:     fakeRunner{relay},
+		retrySweeper:    fakeRunner{sweeper},
+		shutdownTracing: func(context.Context) error { return nil },
+	}
+
+	stop := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() { done <- a.run(stop) }()
+	time.Sleep(20 * time.Millisecond)
+	stop <- os.Interrupt
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("run didn't return after the stop signal")
+	}
+
+	// The task in progress and the background loops finish on an open pool
+	for name, w := range map[string]*worker{"consumer": consumer, "outbox relay": relay, "retry sweeper": sweeper} {
+		if !w.finished.Load() {
+			t.Errorf("%s still running once run returned", name)
+		}
+		if w.sawClosed.Load() {
+			t.Errorf("%s saw the database closed before it finished", name)
+		}
+	}
+	if !consumer.closedLast.Load() {
+		t.Error("consumer closed before it finished its task")
+	}
+	if !db.closed.Load() {
+		t.Error("database not closed")
+	}
+}
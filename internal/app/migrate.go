@@ -0,0 +1,210 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+	_ "github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/oziev02/ImageProcessor/internal/config"
+	"github.com/oziev02/ImageProcessor/internal/migrations"
+	"github.com/oziev02/ImageProcessor/internal/observability"
+)
+
+// ErrPendingMigrations is returned by CheckMigrations when the schema is behind
+var ErrPendingMigrations = errors.New("database schema has pending migrations")
+
+// CheckMigrations reports the current schema version and the embedded
+// migrations not yet applied, without changing the database
+func CheckMigrations() error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	logger := observability.NewLogger()
+
+	m, sourceDriver, err := newMigrate(cfg)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	version, dirty, err := m.Version()
+	if err != nil && err != migrate.ErrNilVersion {
+		return fmt.Errorf("failed to get schema version: %w", err)
+	}
+	if dirty {
+		return fmt.Errorf("database schema is dirty at version %d", version)
+	}
+
+	pending, err := pendingVersions(sourceDriver, version)
+	if err != nil {
+		return fmt.Errorf("failed to list migrations: %w", err)
+	}
+
+	logger.Info("database schema version", "version", version, "pending", pending)
+	if len(pending) > 0 {
+		return ErrPendingMigrations
+	}
+	return nil
+}
+
+// MigrateDown rolls back the given number of applied migrations
+func MigrateDown(steps int) error {
+	if steps < 1 {
+		return fmt.Errorf("steps must be at least 1")
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	logger := observability.NewLogger()
+
+	m, _, err := newMigrate(cfg)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if err := m.Steps(-steps); err != nil {
+		return fmt.Errorf("failed to roll back migrations: %w", err)
+	}
+
+	version, _, err := m.Version()
+	if err != nil && err != migrate.ErrNilVersion {
+		return fmt.Errorf("failed to get schema version: %w", err)
+	}
+	logger.Info("database migrations rolled back", "steps", steps, "version", version)
+	return nil
+}
+
+// migrationLockKey identifies the advisory lock serializing startup
+// migrations across replicas
+const migrationLockKey int64 = 0x696d6770726f63 // "imgproc"
+
+// runMigrations applies pending migrations while holding a Postgres advisory
+// lock, so only one replica migrates at a time and the others wait for it
+func runMigrations(ctx context.Context, db *pgxpool.Pool, cfg *config.Config, logger *slog.Logger) error {
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	if err := acquireMigrationLock(ctx, conn, cfg.Database.MigrationLockTimeout, logger); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockKey); err != nil {
+			logger.Error("failed to release migration lock", "error", err)
+		}
+	}()
+
+	m, _, err := newMigrate(cfg)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	// The driver takes its own lock too; it's uncontended once we hold ours
+	m.LockTimeout = cfg.Database.MigrationLockTimeout
+
+	// Run migrations
+	if err := m.Up(); err != nil {
+		if err == migrate.ErrNoChange {
+			logger.Info("database schema is up to date")
+			return nil
+		}
+		return fmt.Errorf("failed to run migrations: %w", err)
+	}
+
+	logger.Info("database migrations completed successfully")
+	return nil
+}
+
+// acquireMigrationLock polls for the advisory lock until timeout, so a stuck
+// migration on another replica can't block startup forever
+func acquireMigrationLock(ctx context.Context, conn *pgxpool.Conn, timeout time.Duration, logger *slog.Logger) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	logged := false
+	for {
+		var locked bool
+		if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", migrationLockKey).Scan(&locked); err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("timed out after %s waiting for migration lock", timeout)
+			}
+			return fmt.Errorf("failed to acquire migration lock: %w", err)
+		}
+		if locked {
+			return nil
+		}
+
+		if !logged {
+			logger.Info("waiting for another instance to finish migrations")
+			logged = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out after %s waiting for migration lock", timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+func newMigrate(cfg *config.Config) (*migrate.Migrate, source.Driver, error) {
+	// Create source driver from embedded filesystem
+	sourceDriver, err := iofs.New(migrations.Files, ".")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create source driver: %w", err)
+	}
+
+	// Build DSN for migrate
+	dsn := fmt.Sprintf(
+		"postgres://%s:%s@%s:%d/%s?sslmode=%s",
+		cfg.Database.User,
+		cfg.Database.Password,
+		cfg.Database.Host,
+		cfg.Database.Port,
+		cfg.Database.DBName,
+		cfg.Database.SSLMode,
+	)
+
+	// Create migrate instance
+	m, err := migrate.NewWithSourceInstance("iofs", sourceDriver, dsn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create migrate instance: %w", err)
+	}
+
+	return m, sourceDriver, nil
+}
+
+// pendingVersions lists embedded migration versions newer than current
+func pendingVersions(sourceDriver source.Driver, current uint) ([]uint, error) {
+	var pending []uint
+
+	version, err := sourceDriver.First()
+	for err == nil {
+		if version > current {
+			pending = append(pending, version)
+		}
+		version, err = sourceDriver.Next(version)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	return pending, nil
+}
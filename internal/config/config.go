@@ -2,88 +2,603 @@ package config
 
 import (
 	"fmt"
+	"image/color"
+	"image/png"
+	"net/netip"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Server   ServerConfig
-	Database DatabaseConfig
-	Kafka    KafkaConfig
-	Storage  StorageConfig
-	Image    ImageConfig
+	Server    ServerConfig    `yaml:"server"`
+	Database  DatabaseConfig  `yaml:"database"`
+	Kafka     KafkaConfig     `yaml:"kafka"`
+	Storage   StorageConfig   `yaml:"storage"`
+	Image     ImageConfig     `yaml:"image"`
+	Scan      ScanConfig      `yaml:"scan"`
+	Webhook   WebhookConfig   `yaml:"webhook"`
+	Auth      AuthConfig      `yaml:"auth"`
+	CORS      CORSConfig      `yaml:"cors"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	Tracing   TracingConfig   `yaml:"tracing"`
 }
 
 type ServerConfig struct {
-	Host         string
-	Port         int
-	ReadTimeout  time.Duration
-	WriteTimeout time.Duration
+	Host         string        `yaml:"host"`
+	Port         int           `yaml:"port"`
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	// Request body limits: uploads vs. every other route
+	MaxUploadBodySize int64 `yaml:"max_upload_body_size"`
+	MaxBodySize       int64 `yaml:"max_body_size"`
+	// How long clients may cache processed images
+	CacheMaxAge time.Duration `yaml:"cache_max_age"`
+	// Compress gzips text and JSON responses of at least CompressMinSize bytes
+	Compress        bool `yaml:"compress"`
+	CompressMinSize int  `yaml:"compress_min_size"`
+	// How often status event streams check for changes
+	EventsPollInterval time.Duration `yaml:"events_poll_interval"`
+	// TrustedProxies are the IPs or CIDRs whose X-Forwarded-For and
+	// X-Real-IP headers are believed; from anyone else they're ignored
+	TrustedProxies []string `yaml:"trusted_proxies"`
 }
 
 type DatabaseConfig struct {
-	Host     string
-	Port     int
-	User     string
-	Password string
-	DBName   string
-	SSLMode  string
+	Host        string `yaml:"host"`
+	Port        int    `yaml:"port"`
+	User        string `yaml:"user"`
+	Password    string `yaml:"password"`
+	DBName      string `yaml:"db_name"`
+	SSLMode     string `yaml:"ssl_mode"`
+	AutoMigrate bool   `yaml:"auto_migrate"`
+	// MigrationLockTimeout bounds how long a replica waits for another
+	// replica's migrations to finish
+	MigrationLockTimeout time.Duration `yaml:"migration_lock_timeout"`
 }
 
 type KafkaConfig struct {
-	Brokers       []string
-	Topic         string
-	ConsumerGroup string
+	Brokers       []string `yaml:"brokers"`
+	Topic         string   `yaml:"topic"`
+	ConsumerGroup string   `yaml:"consumer_group"`
+	// ThumbnailTopic, when set, moves thumbnail generation to its own topic
+	// and consumer so it isn't queued behind full-resolution processing
+	ThumbnailTopic string `yaml:"thumbnail_topic"`
+	// ReprocessTopic, when set, takes the tasks of reprocessing and retries
+	// so that they don't queue ahead of fresh uploads
+	ReprocessTopic string `yaml:"reprocess_topic"`
+	// QueueSize bounds how many fetched messages wait in the consumer's
+	// priority queue
+	QueueSize int `yaml:"queue_size"`
+	// Concurrency is how many queued tasks each consumer processes at once
+	Concurrency int `yaml:"concurrency"`
+	// Processing failures are retried MaxAttempts times in total with
+	// exponential backoff, then the task goes to DLQTopic if set
+	MaxAttempts  int           `yaml:"max_attempts"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	DLQTopic     string        `yaml:"dlq_topic"`
+	// FetchMaxBackoff caps the exponential backoff between retries of
+	// failed fetches from the broker
+	FetchMaxBackoff time.Duration `yaml:"fetch_max_backoff"`
+	// Tasks an upload couldn't send stay in the outbox and are relayed
+	// every OutboxRelayInterval, OutboxBatchSize at a time. Sent tasks are
+	// kept for OutboxRetention.
+	OutboxRelayInterval time.Duration `yaml:"outbox_relay_interval"`
+	OutboxBatchSize     int           `yaml:"outbox_batch_size"`
+	OutboxRetention     time.Duration `yaml:"outbox_retention"`
+}
+
+// AuthConfig sets up API-key authentication. Disabled when APIKeys is empty;
+// otherwise mutating routes require a key, and reads too with RequireAll.
+type AuthConfig struct {
+	APIKeys    []string `yaml:"api_keys"`
+	RequireAll bool     `yaml:"require_all"`
+}
+
+// CORSConfig sets up cross-origin access from browsers. Disabled when
+// AllowedOrigins is empty; "*" allows any origin.
+type CORSConfig struct {
+	AllowedOrigins []string      `yaml:"allowed_origins"`
+	AllowedMethods []string      `yaml:"allowed_methods"`
+	AllowedHeaders []string      `yaml:"allowed_headers"`
+	MaxAge         time.Duration `yaml:"max_age"`
+}
+
+// RateLimitConfig limits uploads per client to RequestsPerSecond, with bursts
+// of up to Burst requests. Disabled when RequestsPerSecond is zero.
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Burst             int     `yaml:"burst"`
+}
+
+// TracingConfig sets up exporting OpenTelemetry traces over OTLP/HTTP to
+// Endpoint, a URL such as http://collector:4318. Disabled when it's empty.
+type TracingConfig struct {
+	Endpoint    string `yaml:"endpoint"`
+	ServiceName string `yaml:"service_name"`
+	// Fraction of traces started here that are sampled; those continued
+	// from a caller follow the caller's decision
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// WebhookConfig sets up notifying an external URL when processing of an
+// image completes or fails. Disabled when URL is empty.
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+	// Secret signs requests with HMAC-SHA256 when set
+	Secret  string        `yaml:"secret"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// ScanConfig sets up scanning uploads for malware with a clamd daemon
+type ScanConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	Address string        `yaml:"address"`
+	Timeout time.Duration `yaml:"timeout"`
+	// FailPolicy decides whether uploads are accepted when the scanner
+	// is unavailable
+	FailPolicy string `yaml:"fail_policy"`
 }
 
+// Scan failure policies
+const (
+	ScanFailClosed = "closed"
+	ScanFailOpen   = "open"
+)
+
 type StorageConfig struct {
-	BasePath string
+	BasePath   string `yaml:"base_path"`
+	CDNBaseURL string `yaml:"cdn_base_url"`
+	Layout     string `yaml:"layout"`
+	// PathSharding nests files under two directory levels taken from the ID
+	PathSharding bool `yaml:"path_sharding"`
+	// CacheSize is how many bytes of recently read files are kept in
+	// memory; zero disables the cache
+	CacheSize int64 `yaml:"cache_size"`
+	// CacheWarm reads freshly processed images into the cache so that the
+	// first request for them is served from memory
+	CacheWarm bool `yaml:"cache_warm"`
 }
 
+// Storage layouts
+const (
+	// StorageLayoutSplit keeps each kind of file in its own directory
+	StorageLayoutSplit = "split"
+	// StorageLayoutGrouped keeps all files of an image in one directory
+	StorageLayoutGrouped = "grouped"
+)
+
 type ImageConfig struct {
-	MaxFileSize      int64
-	ThumbnailWidth   int
-	ThumbnailHeight  int
-	ProcessedWidth   int
-	ProcessedHeight  int
-	WatermarkEnabled bool
-	WatermarkPath    string
+	MaxFileSize int64 `yaml:"max_file_size"`
+	MinWidth    int   `yaml:"min_width"`
+	MinHeight   int   `yaml:"min_height"`
+	// Upper bounds checked from the image header before decoding, so that
+	// decompression bombs are rejected before allocating their bitmap
+	MaxWidth             int   `yaml:"max_width"`
+	MaxHeight            int   `yaml:"max_height"`
+	MaxPixels            int64 `yaml:"max_pixels"`
+	ThumbnailWidth       int   `yaml:"thumbnail_width"`
+	ThumbnailHeight      int   `yaml:"thumbnail_height"`
+	ThumbnailConcurrency int   `yaml:"thumbnail_concurrency"`
+	// ThumbnailSizes are labelled thumbnail variants generated in addition
+	// to the default thumbnail
+	ThumbnailSizes       []ThumbnailSize `yaml:"thumbnail_sizes"`
+	ProcessedWidth       int             `yaml:"processed_width"`
+	ProcessedHeight      int             `yaml:"processed_height"`
+	JPEGQuality          int             `yaml:"jpeg_quality"`
+	ThumbnailJPEGQuality int             `yaml:"thumbnail_jpeg_quality"`
+	PNGCompression       string          `yaml:"png_compression"`
+	WatermarkEnabled     bool            `yaml:"watermark_enabled"`
+	WatermarkPath        string          `yaml:"watermark_path"`
+	WatermarkPosition    string          `yaml:"watermark_position"`
+	WatermarkOpacity     float64         `yaml:"watermark_opacity"`
+	WatermarkThumbnail   bool            `yaml:"watermark_thumbnail"`
+	IDScheme             string          `yaml:"id_scheme"`
+	FallbackOutputFormat string          `yaml:"fallback_output_format"`
+	// OutputFormat, when set, is the format of every derivative whatever
+	// the source format
+	OutputFormat        string   `yaml:"output_format"`
+	MultipleFilesPolicy string   `yaml:"multiple_files_policy"`
+	GIFMaxFrames        int      `yaml:"gif_max_frames"`
+	GIFMaxPixels        int64    `yaml:"gif_max_pixels"`
+	AllowedFormats      []string `yaml:"allowed_formats"`
+	FlattenBackground   string   `yaml:"flatten_background"`
+	PreserveAspect      bool     `yaml:"preserve_aspect"`
+	ResizeAlgorithm     string   `yaml:"resize_algorithm"`
+	// AnimatedWebP is what animated WebP uploads get: a rejection, or their
+	// first frame, since WebP can't be encoded back
+	AnimatedWebP string `yaml:"animated_webp"`
+	// LenientDecode retries images failing strict decoding with recovery
+	// strategies before giving up on them
+	LenientDecode bool `yaml:"lenient_decode"`
+	// SharpnessEnabled scores the sharpness of each processed image
+	SharpnessEnabled bool `yaml:"sharpness_enabled"`
+	// Grayscale converts every image's derivatives to grayscale; uploads
+	// may also ask for it individually
+	Grayscale bool `yaml:"grayscale"`
+	// KeepGPS keeps the GPS coordinates of uploads' EXIF in their metadata
+	KeepGPS bool `yaml:"keep_gps"`
+	// GeneratePlaceholder stores a tiny blurred preview on each record
+	GeneratePlaceholder bool `yaml:"generate_placeholder"`
+	// SharpenAmount is the strength of the unsharp mask applied to resized
+	// derivatives; zero disables sharpening
+	SharpenAmount float64 `yaml:"sharpen_amount"`
+	// DedupEnabled returns an existing image instead of storing an upload
+	// whose perceptual hash is within DedupMaxDistance bits of it
+	DedupEnabled     bool `yaml:"dedup_enabled"`
+	DedupMaxDistance int  `yaml:"dedup_max_distance"`
+	// MaxProcessingAttempts caps processing runs per image across
+	// redeliveries and reprocessing; zero means unlimited
+	MaxProcessingAttempts int `yaml:"max_processing_attempts"`
+	// Failed images created within RetryMaxAge are requeued every
+	// RetryInterval, at most RetryMax times; a zero interval disables it
+	RetryInterval time.Duration `yaml:"retry_interval"`
+	RetryMax      int           `yaml:"retry_max"`
+	RetryMaxAge   time.Duration `yaml:"retry_max_age"`
+	// CPUThrottle is the fraction of CPU time, in [0, 1), that resizing and
+	// encoding yield to other work; zero disables throttling
+	CPUThrottle float64 `yaml:"cpu_throttle"`
+	// MaxConcurrentDecodes bounds how many images uploads and processing
+	// decode at once, to bound memory; zero means no limit
+	MaxConcurrentDecodes int `yaml:"max_concurrent_decodes"`
+}
+
+// ImageFormats are the upload formats the service can decode
+var ImageFormats = []string{"jpeg", "png", "gif", "webp", "tiff", "bmp"}
+
+// ThumbnailSize is a labelled thumbnail variant
+type ThumbnailSize struct {
+	Label  string `yaml:"label"`
+	Width  int    `yaml:"width"`
+	Height int    `yaml:"height"`
 }
 
+// ParseThumbnailSizes parses a comma-separated list of label:WIDTHxHEIGHT
+// entries, e.g. "small:100x100,medium:300x300"
+func ParseThumbnailSizes(s string) ([]ThumbnailSize, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	var sizes []ThumbnailSize
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		label, dims, ok := strings.Cut(entry, ":")
+		if !ok || label == "" {
+			return nil, fmt.Errorf("invalid thumbnail size %q: expected label:WIDTHxHEIGHT", entry)
+		}
+		if strings.ContainsAny(label, `/\.`) {
+			return nil, fmt.Errorf("invalid thumbnail size label %q", label)
+		}
+		if seen[label] {
+			return nil, fmt.Errorf("duplicate thumbnail size label %q", label)
+		}
+
+		w, h, ok := strings.Cut(dims, "x")
+		width, errW := strconv.Atoi(w)
+		height, errH := strconv.Atoi(h)
+		if !ok || errW != nil || errH != nil || width <= 0 || height <= 0 {
+			return nil, fmt.Errorf("invalid thumbnail size %q: expected positive WIDTHxHEIGHT", entry)
+		}
+
+		seen[label] = true
+		sizes = append(sizes, ThumbnailSize{Label: label, Width: width, Height: height})
+	}
+	return sizes, nil
+}
+
+// Watermark positions
+const (
+	WatermarkTopLeft     = "top-left"
+	WatermarkTopRight    = "top-right"
+	WatermarkBottomLeft  = "bottom-left"
+	WatermarkBottomRight = "bottom-right"
+	WatermarkCenter      = "center"
+)
+
+// Resize interpolation algorithms, fastest first
+const (
+	ResizeNearest           = "nearest"
+	ResizeBilinear          = "bilinear"
+	ResizeBicubic           = "bicubic"
+	ResizeMitchellNetravali = "mitchell"
+	ResizeLanczos2          = "lanczos2"
+	ResizeLanczos3          = "lanczos3"
+)
+
+// Policies for uploads carrying several files under the image field
+const (
+	MultipleFilesReject = "reject"
+	MultipleFilesAll    = "all"
+)
+
+// Handling of animated WebP uploads
+const (
+	AnimatedWebPReject     = "reject"
+	AnimatedWebPFirstFrame = "first-frame"
+)
+
+// Load reads the configuration from environment variables. When CONFIG_FILE
+// is set, they are layered over that YAML file instead of the defaults.
 func Load() (*Config, error) {
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		return LoadFromFile(path)
+	}
+	return load(defaults())
+}
+
+// LoadFromFile reads the configuration from a YAML file, with environment
+// variables overriding its values. Settings missing from the file keep
+// their defaults.
+func LoadFromFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	base := defaults()
+	if err := yaml.Unmarshal(data, base); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	return load(base)
+}
+
+// defaults returns the configuration used when nothing overrides it
+func defaults() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Host:               "0.0.0.0",
+			Port:               8080,
+			ReadTimeout:        30 * time.Second,
+			WriteTimeout:       30 * time.Second,
+			MaxUploadBodySize:  50 * 1024 * 1024, // 50MB
+			MaxBodySize:        1024 * 1024,      // 1MB
+			CacheMaxAge:        24 * time.Hour,
+			Compress:           true,
+			CompressMinSize:    1024,
+			EventsPollInterval: time.Second,
+			TrustedProxies:     nil,
+		},
+		Database: DatabaseConfig{
+			Host:                 "localhost",
+			Port:                 5432,
+			User:                 "postgres",
+			Password:             "postgres",
+			DBName:               "imageprocessor",
+			SSLMode:              "disable",
+			AutoMigrate:          true,
+			MigrationLockTimeout: 2 * time.Minute,
+		},
+		Kafka: KafkaConfig{
+			Brokers:             []string{"localhost:9092"},
+			Topic:               "image-processing",
+			ConsumerGroup:       "image-processor-group",
+			ThumbnailTopic:      "",
+			ReprocessTopic:      "",
+			QueueSize:           32,
+			Concurrency:         1,
+			MaxAttempts:         3,
+			RetryBackoff:        time.Second,
+			DLQTopic:            "",
+			FetchMaxBackoff:     30 * time.Second,
+			OutboxRelayInterval: 10 * time.Second,
+			OutboxBatchSize:     100,
+			OutboxRetention:     24 * time.Hour,
+		},
+		Storage: StorageConfig{
+			BasePath:   "./storage",
+			CDNBaseURL: "",
+			Layout:     StorageLayoutSplit,
+		},
+		Image: ImageConfig{
+			MaxFileSize:           10 * 1024 * 1024, // 10MB
+			MinWidth:              0,
+			MinHeight:             0,
+			MaxWidth:              20000,
+			MaxHeight:             20000,
+			MaxPixels:             100_000_000,
+			ThumbnailWidth:        200,
+			ThumbnailHeight:       200,
+			ThumbnailConcurrency:  2,
+			ProcessedWidth:        800,
+			ProcessedHeight:       800,
+			JPEGQuality:           90,
+			ThumbnailJPEGQuality:  80,
+			PNGCompression:        "default",
+			WatermarkEnabled:      false,
+			WatermarkPath:         "",
+			WatermarkPosition:     WatermarkBottomRight,
+			WatermarkOpacity:      0.5,
+			WatermarkThumbnail:    false,
+			IDScheme:              "uuid",
+			PreserveAspect:        true,
+			ResizeAlgorithm:       ResizeLanczos3,
+			LenientDecode:         false,
+			SharpnessEnabled:      false,
+			Grayscale:             false,
+			KeepGPS:               false,
+			GeneratePlaceholder:   false,
+			SharpenAmount:         0,
+			DedupEnabled:          false,
+			DedupMaxDistance:      5,
+			MaxProcessingAttempts: 5,
+			RetryInterval:         10 * time.Minute,
+			RetryMax:              3,
+			RetryMaxAge:           24 * time.Hour,
+			CPUThrottle:           0,
+			FallbackOutputFormat:  "jpeg",
+			FlattenBackground:     "#ffffff",
+			GIFMaxFrames:          500,
+			GIFMaxPixels:          100_000_000,
+			AnimatedWebP:          AnimatedWebPReject,
+			AllowedFormats:        append([]string(nil), ImageFormats...),
+			MultipleFilesPolicy:   MultipleFilesReject,
+		},
+		Scan: ScanConfig{
+			Enabled:    false,
+			Address:    "localhost:3310",
+			Timeout:    30 * time.Second,
+			FailPolicy: ScanFailClosed,
+		},
+		Webhook: WebhookConfig{
+			Timeout: 5 * time.Second,
+		},
+		CORS: CORSConfig{
+			AllowedMethods: []string{"GET", "POST", "DELETE"},
+			AllowedHeaders: []string{"Content-Type", "Authorization", "X-API-Key", "X-Request-ID", "If-None-Match"},
+			MaxAge:         10 * time.Minute,
+		},
+		RateLimit: RateLimitConfig{
+			Burst: 10,
+		},
+		Tracing: TracingConfig{
+			ServiceName: "image-processor",
+			SampleRatio: 1,
+		},
+	}
+}
+
+// load applies environment variables over base and validates the result
+func load(base *Config) (*Config, error) {
+	thumbnailSizes := base.Image.ThumbnailSizes
+	if value := os.Getenv("IMAGE_THUMBNAIL_SIZES"); value != "" {
+		sizes, err := ParseThumbnailSizes(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse thumbnail sizes: %w", err)
+		}
+		thumbnailSizes = sizes
+	}
+
 	cfg := &Config{
 		Server: ServerConfig{
-			Host:         getEnv("SERVER_HOST", "0.0.0.0"),
-			Port:         getEnvInt("SERVER_PORT", 8080),
-			ReadTimeout:  getEnvDuration("SERVER_READ_TIMEOUT", 30*time.Second),
-			WriteTimeout: getEnvDuration("SERVER_WRITE_TIMEOUT", 30*time.Second),
+			Host:               getEnv("SERVER_HOST", base.Server.Host),
+			Port:               getEnvInt("SERVER_PORT", base.Server.Port),
+			ReadTimeout:        getEnvDuration("SERVER_READ_TIMEOUT", base.Server.ReadTimeout),
+			WriteTimeout:       getEnvDuration("SERVER_WRITE_TIMEOUT", base.Server.WriteTimeout),
+			MaxUploadBodySize:  getEnvInt64("SERVER_MAX_UPLOAD_BODY_SIZE", base.Server.MaxUploadBodySize),
+			MaxBodySize:        getEnvInt64("SERVER_MAX_BODY_SIZE", base.Server.MaxBodySize),
+			CacheMaxAge:        getEnvDuration("SERVER_CACHE_MAX_AGE", base.Server.CacheMaxAge),
+			Compress:           getEnvBool("SERVER_COMPRESS", base.Server.Compress),
+			CompressMinSize:    getEnvInt("SERVER_COMPRESS_MIN_SIZE", base.Server.CompressMinSize),
+			EventsPollInterval: getEnvDuration("SERVER_EVENTS_POLL_INTERVAL", base.Server.EventsPollInterval),
+			TrustedProxies:     getEnvSlice("SERVER_TRUSTED_PROXIES", base.Server.TrustedProxies),
 		},
 		Database: DatabaseConfig{
-			Host:     getEnv("DB_HOST", "localhost"),
-			Port:     getEnvInt("DB_PORT", 5432),
-			User:     getEnv("DB_USER", "postgres"),
-			Password: getEnv("DB_PASSWORD", "postgres"),
-			DBName:   getEnv("DB_NAME", "imageprocessor"),
-			SSLMode:  getEnv("DB_SSLMODE", "disable"),
+			Host:                 getEnv("DB_HOST", base.Database.Host),
+			Port:                 getEnvInt("DB_PORT", base.Database.Port),
+			User:                 getEnv("DB_USER", base.Database.User),
+			Password:             getEnv("DB_PASSWORD", base.Database.Password),
+			DBName:               getEnv("DB_NAME", base.Database.DBName),
+			SSLMode:              getEnv("DB_SSLMODE", base.Database.SSLMode),
+			AutoMigrate:          getEnvBool("DB_AUTO_MIGRATE", base.Database.AutoMigrate),
+			MigrationLockTimeout: getEnvDuration("DB_MIGRATION_LOCK_TIMEOUT", base.Database.MigrationLockTimeout),
 		},
 		Kafka: KafkaConfig{
-			Brokers:       getEnvSlice("KAFKA_BROKERS", []string{"localhost:9092"}),
-			Topic:         getEnv("KAFKA_TOPIC", "image-processing"),
-			ConsumerGroup: getEnv("KAFKA_CONSUMER_GROUP", "image-processor-group"),
+			Brokers:             getEnvSlice("KAFKA_BROKERS", base.Kafka.Brokers),
+			Topic:               getEnv("KAFKA_TOPIC", base.Kafka.Topic),
+			ConsumerGroup:       getEnv("KAFKA_CONSUMER_GROUP", base.Kafka.ConsumerGroup),
+			ThumbnailTopic:      getEnv("KAFKA_THUMBNAIL_TOPIC", base.Kafka.ThumbnailTopic),
+			ReprocessTopic:      getEnv("KAFKA_REPROCESS_TOPIC", base.Kafka.ReprocessTopic),
+			QueueSize:           getEnvInt("KAFKA_QUEUE_SIZE", base.Kafka.QueueSize),
+			Concurrency:         getEnvInt("KAFKA_CONCURRENCY", base.Kafka.Concurrency),
+			MaxAttempts:         getEnvInt("KAFKA_MAX_ATTEMPTS", base.Kafka.MaxAttempts),
+			RetryBackoff:        getEnvDuration("KAFKA_RETRY_BACKOFF", base.Kafka.RetryBackoff),
+			DLQTopic:            getEnv("KAFKA_DLQ_TOPIC", base.Kafka.DLQTopic),
+			FetchMaxBackoff:     getEnvDuration("KAFKA_FETCH_MAX_BACKOFF", base.Kafka.FetchMaxBackoff),
+			OutboxRelayInterval: getEnvDuration("KAFKA_OUTBOX_RELAY_INTERVAL", base.Kafka.OutboxRelayInterval),
+			OutboxBatchSize:     getEnvInt("KAFKA_OUTBOX_BATCH_SIZE", base.Kafka.OutboxBatchSize),
+			OutboxRetention:     getEnvDuration("KAFKA_OUTBOX_RETENTION", base.Kafka.OutboxRetention),
 		},
 		Storage: StorageConfig{
-			BasePath: getEnv("STORAGE_BASE_PATH", "./storage"),
+			BasePath:     getEnv("STORAGE_BASE_PATH", base.Storage.BasePath),
+			CDNBaseURL:   getEnv("CDN_BASE_URL", base.Storage.CDNBaseURL),
+			Layout:       getEnv("STORAGE_LAYOUT", base.Storage.Layout),
+			PathSharding: getEnvBool("IMAGE_PATH_SHARDING", base.Storage.PathSharding),
+			CacheSize:    getEnvInt64("STORAGE_CACHE_SIZE", base.Storage.CacheSize),
+			CacheWarm:    getEnvBool("STORAGE_CACHE_WARM", base.Storage.CacheWarm),
 		},
 		Image: ImageConfig{
-			MaxFileSize:      getEnvInt64("IMAGE_MAX_FILE_SIZE", 10*1024*1024), // 10MB
-			ThumbnailWidth:   getEnvInt("IMAGE_THUMBNAIL_WIDTH", 200),
-			ThumbnailHeight:  getEnvInt("IMAGE_THUMBNAIL_HEIGHT", 200),
-			ProcessedWidth:   getEnvInt("IMAGE_PROCESSED_WIDTH", 800),
-			ProcessedHeight:  getEnvInt("IMAGE_PROCESSED_HEIGHT", 800),
-			WatermarkEnabled: getEnvBool("IMAGE_WATERMARK_ENABLED", false),
-			WatermarkPath:    getEnv("IMAGE_WATERMARK_PATH", ""),
+			MaxFileSize:           getEnvInt64("IMAGE_MAX_FILE_SIZE", base.Image.MaxFileSize),
+			MinWidth:              getEnvInt("IMAGE_MIN_WIDTH", base.Image.MinWidth),
+			MinHeight:             getEnvInt("IMAGE_MIN_HEIGHT", base.Image.MinHeight),
+			MaxWidth:              getEnvInt("IMAGE_MAX_WIDTH", base.Image.MaxWidth),
+			MaxHeight:             getEnvInt("IMAGE_MAX_HEIGHT", base.Image.MaxHeight),
+			MaxPixels:             getEnvInt64("IMAGE_MAX_PIXELS", base.Image.MaxPixels),
+			ThumbnailWidth:        getEnvInt("IMAGE_THUMBNAIL_WIDTH", base.Image.ThumbnailWidth),
+			ThumbnailHeight:       getEnvInt("IMAGE_THUMBNAIL_HEIGHT", base.Image.ThumbnailHeight),
+			ThumbnailConcurrency:  getEnvInt("IMAGE_THUMBNAIL_CONCURRENCY", base.Image.ThumbnailConcurrency),
+			ThumbnailSizes:        thumbnailSizes,
+			ProcessedWidth:        getEnvInt("IMAGE_PROCESSED_WIDTH", base.Image.ProcessedWidth),
+			ProcessedHeight:       getEnvInt("IMAGE_PROCESSED_HEIGHT", base.Image.ProcessedHeight),
+			JPEGQuality:           getEnvInt("IMAGE_JPEG_QUALITY", base.Image.JPEGQuality),
+			ThumbnailJPEGQuality:  getEnvInt("IMAGE_THUMBNAIL_JPEG_QUALITY", base.Image.ThumbnailJPEGQuality),
+			PNGCompression:        getEnv("IMAGE_PNG_COMPRESSION", base.Image.PNGCompression),
+			WatermarkEnabled:      getEnvBool("IMAGE_WATERMARK_ENABLED", base.Image.WatermarkEnabled),
+			WatermarkPath:         getEnv("IMAGE_WATERMARK_PATH", base.Image.WatermarkPath),
+			WatermarkPosition:     getEnv("IMAGE_WATERMARK_POSITION", base.Image.WatermarkPosition),
+			WatermarkOpacity:      getEnvFloat("IMAGE_WATERMARK_OPACITY", base.Image.WatermarkOpacity),
+			WatermarkThumbnail:    getEnvBool("IMAGE_WATERMARK_THUMBNAIL", base.Image.WatermarkThumbnail),
+			IDScheme:              getEnv("ID_SCHEME", base.Image.IDScheme),
+			PreserveAspect:        getEnvBool("IMAGE_PRESERVE_ASPECT", base.Image.PreserveAspect),
+			ResizeAlgorithm:       getEnv("IMAGE_RESIZE_ALGORITHM", base.Image.ResizeAlgorithm),
+			LenientDecode:         getEnvBool("IMAGE_LENIENT_DECODE", base.Image.LenientDecode),
+			SharpnessEnabled:      getEnvBool("IMAGE_SHARPNESS_ENABLED", base.Image.SharpnessEnabled),
+			Grayscale:             getEnvBool("IMAGE_GRAYSCALE", base.Image.Grayscale),
+			KeepGPS:               getEnvBool("IMAGE_KEEP_GPS", base.Image.KeepGPS),
+			GeneratePlaceholder:   getEnvBool("IMAGE_GENERATE_PLACEHOLDER", base.Image.GeneratePlaceholder),
+			SharpenAmount:         getEnvFloat("IMAGE_SHARPEN_AMOUNT", base.Image.SharpenAmount),
+			DedupEnabled:          getEnvBool("IMAGE_DEDUP_ENABLED", base.Image.DedupEnabled),
+			DedupMaxDistance:      getEnvInt("IMAGE_DEDUP_MAX_DISTANCE", base.Image.DedupMaxDistance),
+			MaxProcessingAttempts: getEnvInt("PROCESSING_MAX_ATTEMPTS", base.Image.MaxProcessingAttempts),
+			RetryInterval:         getEnvDuration("PROCESSING_RETRY_INTERVAL", base.Image.RetryInterval),
+			RetryMax:              getEnvInt("PROCESSING_RETRY_MAX", base.Image.RetryMax),
+			RetryMaxAge:           getEnvDuration("PROCESSING_RETRY_MAX_AGE", base.Image.RetryMaxAge),
+			CPUThrottle:           getEnvFloat("PROCESSING_CPU_THROTTLE", base.Image.CPUThrottle),
+			MaxConcurrentDecodes:  getEnvInt("IMAGE_MAX_CONCURRENT_DECODES", base.Image.MaxConcurrentDecodes),
+			FallbackOutputFormat:  getEnv("IMAGE_FALLBACK_OUTPUT_FORMAT", base.Image.FallbackOutputFormat),
+			OutputFormat:          getEnv("IMAGE_OUTPUT_FORMAT", base.Image.OutputFormat),
+			FlattenBackground:     getEnv("IMAGE_FLATTEN_BACKGROUND", base.Image.FlattenBackground),
+			GIFMaxFrames:          getEnvInt("IMAGE_GIF_MAX_FRAMES", base.Image.GIFMaxFrames),
+			GIFMaxPixels:          getEnvInt64("IMAGE_GIF_MAX_PIXELS", base.Image.GIFMaxPixels),
+			AnimatedWebP:          getEnv("IMAGE_ANIMATED_WEBP", base.Image.AnimatedWebP),
+			AllowedFormats:        getEnvSlice("IMAGE_ALLOWED_FORMATS", base.Image.AllowedFormats),
+			MultipleFilesPolicy:   getEnv("IMAGE_UPLOAD_MULTIPLE_FILES", base.Image.MultipleFilesPolicy),
+		},
+		Scan: ScanConfig{
+			Enabled:    getEnvBool("UPLOAD_SCAN_ENABLED", base.Scan.Enabled),
+			Address:    getEnv("UPLOAD_SCAN_ADDRESS", base.Scan.Address),
+			Timeout:    getEnvDuration("UPLOAD_SCAN_TIMEOUT", base.Scan.Timeout),
+			FailPolicy: getEnv("UPLOAD_SCAN_FAIL_POLICY", base.Scan.FailPolicy),
+		},
+		Webhook: WebhookConfig{
+			URL:     getEnv("IMAGE_WEBHOOK_URL", base.Webhook.URL),
+			Secret:  getEnv("IMAGE_WEBHOOK_SECRET", base.Webhook.Secret),
+			Timeout: getEnvDuration("IMAGE_WEBHOOK_TIMEOUT", base.Webhook.Timeout),
+		},
+		Auth: AuthConfig{
+			APIKeys:    getEnvSlice("API_KEYS", base.Auth.APIKeys),
+			RequireAll: getEnvBool("API_AUTH_ALL", base.Auth.RequireAll),
+		},
+		CORS: CORSConfig{
+			AllowedOrigins: getEnvSlice("CORS_ALLOWED_ORIGINS", base.CORS.AllowedOrigins),
+			AllowedMethods: getEnvSlice("CORS_ALLOWED_METHODS", base.CORS.AllowedMethods),
+			AllowedHeaders: getEnvSlice("CORS_ALLOWED_HEADERS", base.CORS.AllowedHeaders),
+			MaxAge:         getEnvDuration("CORS_MAX_AGE", base.CORS.MaxAge),
+		},
+		RateLimit: RateLimitConfig{
+			RequestsPerSecond: getEnvFloat("RATE_LIMIT_RPS", base.RateLimit.RequestsPerSecond),
+			Burst:             getEnvInt("RATE_LIMIT_BURST", base.RateLimit.Burst),
+		},
+		Tracing: TracingConfig{
+			Endpoint:    getEnv("TRACING_ENDPOINT", base.Tracing.Endpoint),
+			ServiceName: getEnv("TRACING_SERVICE_NAME", base.Tracing.ServiceName),
+			SampleRatio: getEnvFloat("TRACING_SAMPLE_RATIO", base.Tracing.SampleRatio),
 		},
 	}
 
@@ -98,12 +613,276 @@ func (c *Config) Validate() error {
 	if c.Storage.BasePath == "" {
 		return fmt.Errorf("storage base path is required")
 	}
+	if c.Server.MaxUploadBodySize <= 0 || c.Server.MaxBodySize <= 0 {
+		return fmt.Errorf("server body size limits must be positive")
+	}
+	if c.Server.CacheMaxAge < 0 {
+		return fmt.Errorf("server cache max age must not be negative")
+	}
+	if c.Server.CompressMinSize < 0 {
+		return fmt.Errorf("server compress min size must not be negative")
+	}
+	if c.Server.EventsPollInterval <= 0 {
+		return fmt.Errorf("server events poll interval must be positive")
+	}
+	if _, err := ParseTrustedProxies(c.Server.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid server trusted proxies: %w", err)
+	}
+	switch c.Storage.Layout {
+	case StorageLayoutSplit, StorageLayoutGrouped:
+	default:
+		return fmt.Errorf("invalid storage layout %q: must be split or grouped", c.Storage.Layout)
+	}
+	if c.Storage.CacheSize < 0 {
+		return fmt.Errorf("storage cache size must not be negative")
+	}
+	if c.Storage.CacheWarm && c.Storage.CacheSize == 0 {
+		return fmt.Errorf("storage cache warming requires a storage cache size")
+	}
+	if c.Storage.CDNBaseURL != "" {
+		u, err := url.Parse(c.Storage.CDNBaseURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid cdn base url %q: must be an absolute URL", c.Storage.CDNBaseURL)
+		}
+	}
 	if len(c.Kafka.Brokers) == 0 {
 		return fmt.Errorf("kafka brokers are required")
 	}
+	if c.Kafka.ThumbnailTopic != "" && c.Kafka.ThumbnailTopic == c.Kafka.Topic {
+		return fmt.Errorf("kafka thumbnail topic must differ from the processing topic")
+	}
+	if c.Kafka.ReprocessTopic != "" && (c.Kafka.ReprocessTopic == c.Kafka.Topic || c.Kafka.ReprocessTopic == c.Kafka.ThumbnailTopic) {
+		return fmt.Errorf("kafka reprocess topic must differ from the processing and thumbnail topics")
+	}
+	if c.Kafka.QueueSize < 1 {
+		return fmt.Errorf("kafka queue size must be at least 1")
+	}
+	if c.Kafka.Concurrency < 1 {
+		return fmt.Errorf("kafka concurrency must be at least 1")
+	}
+	if c.Kafka.FetchMaxBackoff <= 0 {
+		return fmt.Errorf("kafka fetch max backoff must be positive")
+	}
+	if c.Kafka.OutboxRelayInterval <= 0 || c.Kafka.OutboxRetention <= 0 {
+		return fmt.Errorf("kafka outbox relay interval and retention must be positive")
+	}
+	if c.Kafka.OutboxBatchSize < 1 {
+		return fmt.Errorf("kafka outbox batch size must be at least 1")
+	}
+	if c.Kafka.MaxAttempts < 1 {
+		return fmt.Errorf("kafka max attempts must be at least 1")
+	}
+	if c.Kafka.DLQTopic != "" && (c.Kafka.DLQTopic == c.Kafka.Topic || c.Kafka.DLQTopic == c.Kafka.ThumbnailTopic || c.Kafka.DLQTopic == c.Kafka.ReprocessTopic) {
+		return fmt.Errorf("kafka dead-letter topic must differ from the processing topics")
+	}
+	if c.Image.RetryInterval < 0 || c.Image.RetryMax < 0 {
+		return fmt.Errorf("processing retry interval and max must not be negative")
+	}
+	if c.Image.RetryMaxAge <= 0 {
+		return fmt.Errorf("processing retry max age must be positive")
+	}
+	if c.Image.MaxProcessingAttempts < 0 {
+		return fmt.Errorf("processing max attempts must not be negative")
+	}
+	if c.Image.CPUThrottle < 0 || c.Image.CPUThrottle >= 1 {
+		return fmt.Errorf("processing cpu throttle must be in [0, 1)")
+	}
+	if c.Image.MaxConcurrentDecodes < 0 {
+		return fmt.Errorf("max concurrent decodes must not be negative")
+	}
+	if c.Image.MaxFileSize <= 0 {
+		return fmt.Errorf("IMAGE_MAX_FILE_SIZE must be positive, got %d", c.Image.MaxFileSize)
+	}
+	// Resizing to a zero dimension yields a degenerate image
+	for _, dim := range []struct {
+		name  string
+		value int
+	}{
+		{"IMAGE_THUMBNAIL_WIDTH", c.Image.ThumbnailWidth},
+		{"IMAGE_THUMBNAIL_HEIGHT", c.Image.ThumbnailHeight},
+		{"IMAGE_PROCESSED_WIDTH", c.Image.ProcessedWidth},
+		{"IMAGE_PROCESSED_HEIGHT", c.Image.ProcessedHeight},
+	} {
+		if dim.value <= 0 {
+			return fmt.Errorf("%s must be positive, got %d", dim.name, dim.value)
+		}
+	}
+	if c.Image.MinWidth < 0 || c.Image.MinHeight < 0 {
+		return fmt.Errorf("image minimum dimensions must not be negative")
+	}
+	if c.Image.MaxWidth < 0 || c.Image.MaxHeight < 0 || c.Image.MaxPixels < 0 {
+		return fmt.Errorf("image maximum dimensions must not be negative")
+	}
+	if c.Image.DedupMaxDistance < 0 || c.Image.DedupMaxDistance > 64 {
+		return fmt.Errorf("image dedup max distance must be between 0 and 64")
+	}
+	// Sizes from the environment are checked when parsed, but a config file
+	// sets them directly
+	seen := make(map[string]bool)
+	for _, size := range c.Image.ThumbnailSizes {
+		if size.Label == "" || strings.ContainsAny(size.Label, `/\.`) || seen[size.Label] {
+			return fmt.Errorf("invalid or duplicate thumbnail size label %q", size.Label)
+		}
+		if size.Width <= 0 || size.Height <= 0 {
+			return fmt.Errorf("thumbnail size %q must have positive dimensions", size.Label)
+		}
+		seen[size.Label] = true
+	}
+	if !ValidJPEGQuality(c.Image.JPEGQuality) || !ValidJPEGQuality(c.Image.ThumbnailJPEGQuality) {
+		return fmt.Errorf("image jpeg qualities must be between 1 and 100")
+	}
+	if c.Image.ThumbnailConcurrency < 1 {
+		return fmt.Errorf("image thumbnail concurrency must be at least 1")
+	}
+	switch c.Image.IDScheme {
+	case "uuid", "uuidv7", "ulid", "short":
+	default:
+		return fmt.Errorf("invalid id scheme %q: must be one of uuid, uuidv7, ulid, short", c.Image.IDScheme)
+	}
+	if len(c.Image.AllowedFormats) == 0 {
+		return fmt.Errorf("image allowed formats must not be empty")
+	}
+	for _, format := range c.Image.AllowedFormats {
+		if !slices.Contains(ImageFormats, format) {
+			return fmt.Errorf("invalid allowed format %q: must be one of %s", format, strings.Join(ImageFormats, ", "))
+		}
+	}
+	switch c.Image.FallbackOutputFormat {
+	case "jpeg", "png", "gif":
+	default:
+		return fmt.Errorf("invalid fallback output format %q: must be one of jpeg, png, gif", c.Image.FallbackOutputFormat)
+	}
+	switch c.Image.OutputFormat {
+	case "", "jpeg", "png", "gif":
+	case "webp":
+		return fmt.Errorf("invalid output format %q: webp can't be encoded, must be one of jpeg, png, gif", c.Image.OutputFormat)
+	default:
+		return fmt.Errorf("invalid output format %q: must be one of jpeg, png, gif", c.Image.OutputFormat)
+	}
+	if _, err := ParsePNGCompression(c.Image.PNGCompression); err != nil {
+		return fmt.Errorf("invalid png compression: %w", err)
+	}
+	if c.Scan.Enabled && (c.Scan.Address == "" || c.Scan.Timeout <= 0) {
+		return fmt.Errorf("upload scanning requires a scanner address and a positive timeout")
+	}
+	if len(c.CORS.AllowedOrigins) > 0 && len(c.CORS.AllowedMethods) == 0 {
+		return fmt.Errorf("CORS requires at least one allowed method")
+	}
+	if c.CORS.MaxAge < 0 {
+		return fmt.Errorf("CORS max age must not be negative")
+	}
+	if c.RateLimit.RequestsPerSecond < 0 {
+		return fmt.Errorf("rate limit must not be negative")
+	}
+	if c.RateLimit.RequestsPerSecond > 0 && c.RateLimit.Burst < 1 {
+		return fmt.Errorf("rate limit burst must be at least 1")
+	}
+	if c.Tracing.Endpoint != "" {
+		u, err := url.Parse(c.Tracing.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid tracing endpoint %q: must be an http or https URL", c.Tracing.Endpoint)
+		}
+		if c.Tracing.ServiceName == "" {
+			return fmt.Errorf("tracing requires a service name")
+		}
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return fmt.Errorf("tracing sample ratio must be between 0 and 1")
+	}
+	if c.Auth.RequireAll && len(c.Auth.APIKeys) == 0 {
+		return fmt.Errorf("API_AUTH_ALL requires API_KEYS")
+	}
+	if c.Webhook.URL != "" && c.Webhook.Timeout <= 0 {
+		return fmt.Errorf("webhook timeout must be positive")
+	}
+	switch c.Scan.FailPolicy {
+	case ScanFailClosed, ScanFailOpen:
+	default:
+		return fmt.Errorf("invalid upload scan fail policy %q: must be closed or open", c.Scan.FailPolicy)
+	}
+	switch c.Image.MultipleFilesPolicy {
+	case MultipleFilesReject, MultipleFilesAll:
+	default:
+		return fmt.Errorf("invalid multiple files policy %q: must be reject or all", c.Image.MultipleFilesPolicy)
+	}
+	switch c.Image.AnimatedWebP {
+	case AnimatedWebPReject, AnimatedWebPFirstFrame:
+	default:
+		return fmt.Errorf("invalid animated webp handling %q: must be reject or first-frame", c.Image.AnimatedWebP)
+	}
+	if c.Image.SharpenAmount < 0 || c.Image.SharpenAmount > 5 {
+		return fmt.Errorf("image sharpen amount must be between 0 and 5")
+	}
+	switch c.Image.ResizeAlgorithm {
+	case ResizeNearest, ResizeBilinear, ResizeBicubic, ResizeMitchellNetravali, ResizeLanczos2, ResizeLanczos3:
+	default:
+		return fmt.Errorf("invalid resize algorithm %q: must be one of nearest, bilinear, bicubic, mitchell, lanczos2, lanczos3", c.Image.ResizeAlgorithm)
+	}
+	switch c.Image.WatermarkPosition {
+	case WatermarkTopLeft, WatermarkTopRight, WatermarkBottomLeft, WatermarkBottomRight, WatermarkCenter:
+	default:
+		return fmt.Errorf("invalid watermark position %q: must be one of top-left, top-right, bottom-left, bottom-right, center", c.Image.WatermarkPosition)
+	}
+	if c.Image.WatermarkOpacity < 0 || c.Image.WatermarkOpacity > 1 {
+		return fmt.Errorf("watermark opacity must be between 0 and 1")
+	}
+	if _, err := ParseHexColor(c.Image.FlattenBackground); err != nil {
+		return fmt.Errorf("invalid flatten background: %w", err)
+	}
 	return nil
 }
 
+// ValidJPEGQuality reports whether q is a JPEG quality the encoder accepts
+func ValidJPEGQuality(q int) bool {
+	return q >= 1 && q <= 100
+}
+
+// ParsePNGCompression parses a PNG compression level: default, no,
+// best-speed or best-compression
+func ParsePNGCompression(s string) (png.CompressionLevel, error) {
+	switch s {
+	case "default":
+		return png.DefaultCompression, nil
+	case "no":
+		return png.NoCompression, nil
+	case "best-speed":
+		return png.BestSpeed, nil
+	case "best-compression":
+		return png.BestCompression, nil
+	}
+	return 0, fmt.Errorf("level %q must be one of default, no, best-speed, best-compression", s)
+}
+
+// ParseTrustedProxies parses proxy addresses, each an IP or a CIDR
+func ParseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("proxy %q must be an IP or a CIDR", entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// ParseHexColor parses a #rrggbb (or rrggbb) color
+func ParseHexColor(s string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("color %q must be in #rrggbb format", s)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("color %q must be in #rrggbb format", s)
+	}
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -129,6 +908,15 @@ func getEnvInt64(key string, defaultValue int64) int64 {
 	return defaultValue
 }
 
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+	}
+	return defaultValue
+}
+
 func getEnvBool(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		if boolValue, err := strconv.ParseBool(value); err == nil {
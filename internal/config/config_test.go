@@ -0,0 +1,254 @@
+package config
+
+import (
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseThumbnailSizes(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []ThumbnailSize
+		wantErr bool
+	}{
+		{name: "empty", input: "", want: nil},
+		{name: "blank", input: "  ", want: nil},
+		{name: "single", input: "small:100x80", want: []ThumbnailSize{{Label: "small", Width: 100, Height: 80}}},
+		{
+			name:  "several with spaces",
+			input: "small:100x100, medium:300x200",
+			want:  []ThumbnailSize{{Label: "small", Width: 100, Height: 100}, {Label: "medium", Width: 300, Height: 200}},
+		},
+		{name: "missing label", input: ":100x100", wantErr: true},
+		{name: "missing colon", input: "small100x100", wantErr: true},
+		{name: "label with slash", input: "../small:100x100", wantErr: true},
+		{name: "label with dot", input: "sm.all:100x100", wantErr: true},
+		{name: "duplicate label", input: "small:100x100,small:200x200", wantErr: true},
+		{name: "missing height", input: "small:100", wantErr: true},
+		{name: "non-numeric", input: "small:axb", wantErr: true},
+		{name: "zero width", input: "small:0x100", wantErr: true},
+		{name: "negative height", input: "small:100x-1", wantErr: true},
+		{name: "trailing comma", input: "small:100x100,", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseThumbnailSizes(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseThumbnailSizes(%q) = %v, want an error", tt.input, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseThumbnailSizes(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := `
+server:
+  port: 9090
+  read_timeout: 5s
+kafka:
+  brokers: [kafka-1:9092, kafka-2:9092]
+image:
+  jpeg_quality: 70
+  thumbnail_sizes:
+    - label: small
+      width: 64
+      height: 64
+`
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// The environment overrides the file
+	t.Setenv("IMAGE_JPEG_QUALITY", "60")
+
+	cfg, err := LoadFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Port != 9090 {
+		t.Errorf("Server.Port = %d, want 9090 from the file", cfg.Server.Port)
+	}
+	if cfg.Server.ReadTimeout != 5*time.Second {
+		t.Errorf("Server.ReadTimeout = %v, want 5s from the file", cfg.Server.ReadTimeout)
+	}
+	if !slices.Equal(cfg.Kafka.Brokers, []string{"kafka-1:9092", "kafka-2:9092"}) {
+		t.Errorf("Kafka.Brokers = %v, want the file's", cfg.Kafka.Brokers)
+	}
+	if want := []ThumbnailSize{{Label: "small", Width: 64, Height: 64}}; !reflect.DeepEqual(cfg.Image.ThumbnailSizes, want) {
+		t.Errorf("Image.ThumbnailSizes = %v, want %v", cfg.Image.ThumbnailSizes, want)
+	}
+	if cfg.Image.JPEGQuality != 60 {
+		t.Errorf("Image.JPEGQuality = %d, want 60 from the environment", cfg.Image.JPEGQuality)
+	}
+	// Settings missing from the file keep their defaults
+	if want := defaults().Server.MaxBodySize; cfg.Server.MaxBodySize != want {
+		t.Errorf("Server.MaxBodySize = %d, want the default %d", cfg.Server.MaxBodySize, want)
+	}
+}
+
+func TestLoadFromFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := LoadFromFile(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("missing file loaded without an error")
+	}
+
+	invalid := filepath.Join(dir, "invalid.yaml")
+	if err := os.WriteFile(invalid, []byte("server: [unclosed"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFromFile(invalid); err == nil {
+		t.Error("malformed file loaded without an error")
+	}
+}
+
+func TestLoadResizeAlgorithm(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{value: ResizeNearest},
+		{value: ResizeBilinear},
+		{value: ResizeBicubic},
+		{value: ResizeMitchellNetravali},
+		{value: ResizeLanczos2},
+		{value: ResizeLanczos3},
+		{value: "lanczos", wantErr: true},
+		{value: "Bicubic", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("CONFIG_FILE", "")
+			t.Setenv("IMAGE_RESIZE_ALGORITHM", tt.value)
+			cfg, err := Load()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Load accepted resize algorithm %q", tt.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Image.ResizeAlgorithm != tt.value {
+				t.Errorf("ResizeAlgorithm = %q, want %q", cfg.Image.ResizeAlgorithm, tt.value)
+			}
+		})
+	}
+}
+
+func TestParsePNGCompression(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    png.CompressionLevel
+		wantErr bool
+	}{
+		{value: "default", want: png.DefaultCompression},
+		{value: "no", want: png.NoCompression},
+		{value: "best-speed", want: png.BestSpeed},
+		{value: "best-compression", want: png.BestCompression},
+		{value: "best", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParsePNGCompression(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePNGCompression(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ParsePNGCompression(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateDimensions(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(*ImageConfig)
+		field  string
+	}{
+		{name: "zero thumbnail width", mutate: func(c *ImageConfig) { c.ThumbnailWidth = 0 }, field: "IMAGE_THUMBNAIL_WIDTH"},
+		{name: "negative thumbnail width", mutate: func(c *ImageConfig) { c.ThumbnailWidth = -1 }, field: "IMAGE_THUMBNAIL_WIDTH"},
+		{name: "zero thumbnail height", mutate: func(c *ImageConfig) { c.ThumbnailHeight = 0 }, field: "IMAGE_THUMBNAIL_HEIGHT"},
+		{name: "zero processed width", mutate: func(c *ImageConfig) { c.ProcessedWidth = 0 }, field: "IMAGE_PROCESSED_WIDTH"},
+		{name: "zero processed height", mutate: func(c *ImageConfig) { c.ProcessedHeight = 0 }, field: "IMAGE_PROCESSED_HEIGHT"},
+		{name: "negative processed height", mutate: func(c *ImageConfig) { c.ProcessedHeight = -100 }, field: "IMAGE_PROCESSED_HEIGHT"},
+		{name: "zero max file size", mutate: func(c *ImageConfig) { c.MaxFileSize = 0 }, field: "IMAGE_MAX_FILE_SIZE"},
+		{name: "negative max file size", mutate: func(c *ImageConfig) { c.MaxFileSize = -1 }, field: "IMAGE_MAX_FILE_SIZE"},
+		// The first offending field is reported
+		{name: "processed width and height", mutate: func(c *ImageConfig) { c.ProcessedWidth, c.ProcessedHeight = 0, 0 }, field: "IMAGE_PROCESSED_WIDTH"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CONFIG_FILE", "")
+			cfg, err := Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.mutate(&cfg.Image)
+			err = cfg.Validate()
+			if err == nil {
+				t.Fatal("Validate accepted the config")
+			}
+			if !strings.Contains(err.Error(), tt.field) {
+				t.Errorf("error %q doesn't name %s", err, tt.field)
+			}
+		})
+	}
+}
+
+func TestLoadRejectsZeroProcessedWidth(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("IMAGE_PROCESSED_WIDTH", "0")
+	if _, err := Load(); err == nil || !strings.Contains(err.Error(), "IMAGE_PROCESSED_WIDTH") {
+		t.Errorf("Load error = %v, want one naming IMAGE_PROCESSED_WIDTH", err)
+	}
+}
+
+func TestLoadAnimatedWebP(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{value: AnimatedWebPReject},
+		{value: AnimatedWebPFirstFrame},
+		{value: "first", wantErr: true},
+		{value: "Reject", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("CONFIG_FILE", "")
+			t.Setenv("IMAGE_ANIMATED_WEBP", tt.value)
+			cfg, err := Load()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Load accepted animated webp handling %q", tt.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Image.AnimatedWebP != tt.value {
+				t.Errorf("AnimatedWebP = %q, want %q", cfg.Image.AnimatedWebP, tt.value)
+			}
+		})
+	}
+}
@@ -15,6 +15,16 @@ const (
 	StatusFailed     ProcessingStatus = "failed"
 )
 
+// Valid reports whether s is a known status
+func (s ProcessingStatus) Valid() bool {
+	switch s {
+	case StatusPending, StatusProcessing, StatusCompleted, StatusFailed:
+		return true
+	default:
+		return false
+	}
+}
+
 // ImageFormat represents supported image formats
 type ImageFormat string
 
@@ -22,22 +32,148 @@ const (
 	FormatJPEG ImageFormat = "jpeg"
 	FormatPNG  ImageFormat = "png"
 	FormatGIF  ImageFormat = "gif"
+	FormatWebP ImageFormat = "webp"
+	FormatTIFF ImageFormat = "tiff"
+	FormatBMP  ImageFormat = "bmp"
 )
 
+// Valid reports whether f is a supported format
+func (f ImageFormat) Valid() bool {
+	switch f {
+	case FormatJPEG, FormatPNG, FormatGIF, FormatWebP, FormatTIFF, FormatBMP:
+		return true
+	default:
+		return false
+	}
+}
+
 // Image represents a processed image entity
 type Image struct {
-	ID              string           `json:"id"`
-	OriginalPath    string           `json:"original_path"`
-	ProcessedPath   string           `json:"processed_path"`
-	ThumbnailPath   string           `json:"thumbnail_path"`
-	Status          ProcessingStatus `json:"status"`
-	Format          ImageFormat      `json:"format"`
-	OriginalWidth   int              `json:"original_width"`
-	OriginalHeight  int              `json:"original_height"`
-	ProcessedWidth  int              `json:"processed_width"`
-	ProcessedHeight int              `json:"processed_height"`
-	CreatedAt       time.Time        `json:"created_at"`
-	UpdatedAt       time.Time        `json:"updated_at"`
+	ID                 string            `json:"id"`
+	OriginalPath       string            `json:"original_path"`
+	ProcessedPath      string            `json:"processed_path"`
+	ThumbnailPath      string            `json:"thumbnail_path"`
+	Thumbnails         map[string]string `json:"thumbnails,omitempty"`
+	LQIPPath           string            `json:"lqip_path,omitempty"`
+	Placeholder        string            `json:"placeholder,omitempty"`
+	Status             ProcessingStatus  `json:"status"`
+	Format             ImageFormat       `json:"format"`
+	ProcessedFormat    ImageFormat       `json:"processed_format"`
+	OriginalWidth      int               `json:"original_width"`
+	OriginalHeight     int               `json:"original_height"`
+	ProcessedWidth     int               `json:"processed_width"`
+	ProcessedHeight    int               `json:"processed_height"`
+	OriginalSize       int64             `json:"original_size"`
+	ProcessedSize      int64             `json:"processed_size"`
+	ProcessingKey      string            `json:"-"`
+	IdempotencyKey     string            `json:"-"`
+	ProcessedChecksum  string            `json:"processed_checksum"`
+	ThumbnailChecksum  string            `json:"thumbnail_checksum"`
+	ProcessingAttempts int               `json:"processing_attempts"`
+	RetryCount         int               `json:"retry_count"`
+	FailureReason      string            `json:"failure_reason,omitempty"`
+	Sharpness          *float64          `json:"sharpness,omitempty"`
+	DeletedAt          *time.Time        `json:"deleted_at,omitempty"`
+	PHash              *int64            `json:"-"`
+	Duplicate          bool              `json:"duplicate,omitempty"`
+	Params             ProcessingParams  `json:"processing_params"`
+	Metadata           ImageMetadata     `json:"-"`
+	CreatedAt          time.Time         `json:"created_at"`
+	UpdatedAt          time.Time         `json:"updated_at"`
+}
+
+// AttemptsExhausted reports whether the image may not be processed again.
+// A zero limit means unlimited.
+func (img *Image) AttemptsExhausted(maxAttempts int) bool {
+	return maxAttempts > 0 && img.ProcessingAttempts >= maxAttempts
+}
+
+// ImageFilter narrows image listings; zero fields don't filter
+type ImageFilter struct {
+	Status       ProcessingStatus
+	Format       ImageFormat
+	MinSharpness *float64
+	MaxSharpness *float64
+}
+
+// StatsGroup aggregates the images sharing a status and source format
+type StatsGroup struct {
+	Status         ProcessingStatus `json:"status"`
+	Format         ImageFormat      `json:"format"`
+	Count          int              `json:"count"`
+	OriginalBytes  int64            `json:"original_bytes"`
+	ProcessedBytes int64            `json:"processed_bytes"`
+}
+
+// ImageStats summarizes stored images. Soft-deleted images aren't counted.
+type ImageStats struct {
+	Groups         []StatsGroup `json:"groups"`
+	Count          int          `json:"count"`
+	OriginalBytes  int64        `json:"original_bytes"`
+	ProcessedBytes int64        `json:"processed_bytes"`
+}
+
+// ImageEvent records a status transition of an image
+type ImageEvent struct {
+	ID        int64            `json:"id"`
+	ImageID   string           `json:"image_id"`
+	Status    ProcessingStatus `json:"status"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+// TaskKind selects which derivatives a processing task generates
+type TaskKind string
+
+const (
+	// TaskKindAll generates both the processed image and the thumbnail
+	TaskKindAll       TaskKind = ""
+	TaskKindProcessed TaskKind = "processed"
+	TaskKindThumbnail TaskKind = "thumbnail"
+)
+
+// TaskOrigin tells what queued a processing task, so that reprocessing can be
+// routed away from fresh uploads
+type TaskOrigin string
+
+const (
+	TaskOriginUpload TaskOrigin = ""
+	// TaskOriginReprocess marks tasks run again on a stored original, on
+	// request or by the retry sweeper
+	TaskOriginReprocess TaskOrigin = "reprocess"
+)
+
+// TaskPriority orders tasks waiting in the consumer's queue
+type TaskPriority int
+
+const (
+	PriorityLow    TaskPriority = -1
+	PriorityNormal TaskPriority = 0
+	PriorityHigh   TaskPriority = 1
+)
+
+// ParsePriority parses a priority name, defaulting to normal when empty
+func ParsePriority(s string) (TaskPriority, error) {
+	switch s {
+	case "low":
+		return PriorityLow, nil
+	case "", "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	default:
+		return PriorityNormal, ErrInvalidPriority
+	}
+}
+
+func (p TaskPriority) String() string {
+	switch {
+	case p < PriorityNormal:
+		return "low"
+	case p > PriorityNormal:
+		return "high"
+	default:
+		return "normal"
+	}
 }
 
 // ProcessingTask represents a task for background processing
@@ -47,6 +183,95 @@ type ProcessingTask struct {
 	Format    ImageFormat `json:"format"`
 	Width     int         `json:"width"`
 	Height    int         `json:"height"`
+	Kind      TaskKind    `json:"kind,omitempty"`
+	Origin    TaskOrigin  `json:"origin,omitempty"`
+	// Priority travels in a message header rather than the payload
+	Priority TaskPriority `json:"-"`
+}
+
+// OutboxMessage is a processing task queued in the same transaction as its
+// image, kept until it's been published to Kafka
+type OutboxMessage struct {
+	ID        int64
+	Task      *ProcessingTask
+	CreatedAt time.Time
+}
+
+// ProcessingParams are the per-image processing parameters requested at
+// upload. They're stored with the image so that reprocessing keeps them;
+// zero values mean the configured defaults.
+type ProcessingParams struct {
+	Crop *CropRect `json:"crop,omitempty"`
+	// Quality is the JPEG quality of the processed image
+	Quality int `json:"quality,omitempty"`
+	// Rotation turns the image clockwise by 0, 90, 180 or 270 degrees
+	// after cropping
+	Rotation int `json:"rotation,omitempty"`
+	// Grayscale converts the derivatives to grayscale
+	Grayscale bool `json:"grayscale,omitempty"`
+	// Brightness and Contrast adjust the tone, each in [-100, 100]
+	Brightness int `json:"brightness,omitempty"`
+	Contrast   int `json:"contrast,omitempty"`
+}
+
+// IsZero reports whether no parameter differs from the defaults
+func (p ProcessingParams) IsZero() bool {
+	return p.Crop == nil && p.Quality == 0 && p.Rotation == 0 && !p.Grayscale &&
+		p.Brightness == 0 && p.Contrast == 0
+}
+
+// ValidToneAdjustment reports whether v is a valid brightness or contrast
+func ValidToneAdjustment(v int) bool {
+	return v >= -100 && v <= 100
+}
+
+// ValidRotation reports whether degrees is a supported clockwise rotation
+func ValidRotation(degrees int) bool {
+	switch degrees {
+	case 0, 90, 180, 270:
+		return true
+	default:
+		return false
+	}
+}
+
+// ImageMetadata is the camera metadata read from an upload's EXIF
+type ImageMetadata struct {
+	Make  string `json:"make,omitempty"`
+	Model string `json:"model,omitempty"`
+	// CapturedAt is the camera's local time, without a zone
+	CapturedAt string       `json:"captured_at,omitempty"`
+	GPS        *GPSLocation `json:"gps,omitempty"`
+}
+
+// GPSLocation is where a photo was taken, in decimal degrees
+type GPSLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// CropRect is a region of the upright source image, in pixels
+type CropRect struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// FileVerification is the result of checking one stored file against its checksum
+type FileVerification struct {
+	Path     string `json:"path"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+}
+
+// VerificationResult reports whether an image's stored derivatives are intact
+type VerificationResult struct {
+	ImageID string             `json:"image_id"`
+	OK      bool               `json:"ok"`
+	Files   []FileVerification `json:"files"`
 }
 
 // Validate validates image invariants
@@ -62,8 +287,31 @@ func (i *Image) Validate() error {
 
 // Domain errors
 var (
-	ErrInvalidImageID   = errors.New("invalid image id")
-	ErrInvalidImagePath = errors.New("invalid image path")
-	ErrImageNotFound    = errors.New("image not found")
-	ErrInvalidFormat    = errors.New("invalid image format")
+	ErrInvalidImageID         = errors.New("invalid image id")
+	ErrInvalidImagePath       = errors.New("invalid image path")
+	ErrImageNotFound          = errors.New("image not found")
+	ErrInvalidFormat          = errors.New("invalid image format")
+	ErrFormatNotAllowed       = errors.New("image format is not allowed")
+	ErrEmptyFile              = errors.New("uploaded file is empty")
+	ErrFileTooLarge           = errors.New("file size exceeds maximum allowed size")
+	ErrInvalidPriority        = errors.New("invalid priority: must be one of low, normal, high")
+	ErrImageTooSmall          = errors.New("image is smaller than the minimum dimensions")
+	ErrImageTooLarge          = errors.New("image exceeds the maximum dimensions")
+	ErrInvalidRotation        = errors.New("invalid rotation: degrees must be 90, 180 or 270")
+	ErrImageNotProcessed      = errors.New("image is not processed yet")
+	ErrOriginalMissing        = errors.New("original file no longer exists")
+	ErrInvalidGrayscale       = errors.New("invalid grayscale: must be true or false")
+	ErrInvalidQuality         = errors.New("invalid quality: must be an integer between 1 and 100")
+	ErrInvalidBrightness      = errors.New("invalid brightness: must be an integer between -100 and 100")
+	ErrInvalidContrast        = errors.New("invalid contrast: must be an integer between -100 and 100")
+	ErrInvalidCrop            = errors.New("invalid crop: crop_x, crop_y, crop_w and crop_h must be given together as integers, with a positive size and a non-negative offset")
+	ErrAttemptsExhausted      = errors.New("maximum processing attempts reached")
+	ErrInfected               = errors.New("file is infected")
+	ErrScanUnavailable        = errors.New("malware scanner unavailable")
+	ErrGIFTooLarge            = errors.New("gif exceeds frame or pixel limits")
+	ErrAnimatedWebP           = errors.New("animated webp is not supported")
+	ErrInvalidIdempotencyKey  = errors.New("invalid idempotency key: must be at most 255 characters")
+	ErrIdempotencyKeyConflict = errors.New("idempotency key is already used by another upload")
+	ErrIdempotencyKeyBatch    = errors.New("idempotency key is only supported for single-file uploads")
+	ErrFilesNotDeleted        = errors.New("image deleted, but some of its files could not be removed")
 )
@@ -0,0 +1 @@
+ALTER TABLE images ADD COLUMN IF NOT EXISTS processed_format VARCHAR(10) NOT NULL DEFAULT '';
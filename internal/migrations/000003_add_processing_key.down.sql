@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_images_processing_key;
+ALTER TABLE images DROP COLUMN IF EXISTS processing_key;
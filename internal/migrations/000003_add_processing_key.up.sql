@@ -0,0 +1,3 @@
+ALTER TABLE images ADD COLUMN IF NOT EXISTS processing_key VARCHAR(64) NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_images_processing_key ON images(processing_key);
@@ -0,0 +1,2 @@
+ALTER TABLE images DROP COLUMN IF EXISTS thumbnail_checksum;
+ALTER TABLE images DROP COLUMN IF EXISTS processed_checksum;
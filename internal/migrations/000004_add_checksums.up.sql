@@ -0,0 +1,2 @@
+ALTER TABLE images ADD COLUMN IF NOT EXISTS processed_checksum VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE images ADD COLUMN IF NOT EXISTS thumbnail_checksum VARCHAR(64) NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+ALTER TABLE images ADD COLUMN IF NOT EXISTS thumbnails JSONB NOT NULL DEFAULT '{}'::jsonb;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_image_events_image_id;
+DROP TABLE IF EXISTS image_events;
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS image_events (
+    id BIGSERIAL PRIMARY KEY,
+    image_id VARCHAR(255) NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+    status VARCHAR(50) NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_image_events_image_id ON image_events(image_id, created_at);
@@ -0,0 +1,2 @@
+ALTER TABLE images DROP COLUMN IF EXISTS failure_reason;
+ALTER TABLE images DROP COLUMN IF EXISTS processing_attempts;
@@ -0,0 +1 @@
+ALTER TABLE images ADD COLUMN IF NOT EXISTS lqip_path VARCHAR(500) NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_images_deleted_at;
+ALTER TABLE images DROP COLUMN IF EXISTS deleted_at;
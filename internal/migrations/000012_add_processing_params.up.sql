@@ -0,0 +1 @@
+ALTER TABLE images ADD COLUMN IF NOT EXISTS processing_params JSONB NOT NULL DEFAULT '{}'::jsonb;
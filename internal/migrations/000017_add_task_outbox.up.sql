@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS task_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    image_id VARCHAR(255) NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+    task JSONB NOT NULL,
+    priority SMALLINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL,
+    sent_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_task_outbox_unsent ON task_outbox(created_at) WHERE sent_at IS NULL;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_images_failed;
+ALTER TABLE images DROP COLUMN IF EXISTS retry_count;
@@ -0,0 +1,3 @@
+ALTER TABLE images ADD COLUMN IF NOT EXISTS retry_count INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_images_failed ON images(updated_at) WHERE status = 'failed' AND deleted_at IS NULL;
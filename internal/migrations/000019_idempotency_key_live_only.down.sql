@@ -0,0 +1,4 @@
+-- Keys reused after a soft delete would break the index covering every row
+UPDATE images SET idempotency_key = NULL WHERE deleted_at IS NOT NULL;
+DROP INDEX IF EXISTS idx_images_idempotency_key;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_images_idempotency_key ON images(idempotency_key);
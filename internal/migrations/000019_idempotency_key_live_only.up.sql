@@ -0,0 +1,3 @@
+-- Soft-deleted images release their idempotency key
+DROP INDEX IF EXISTS idx_images_idempotency_key;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_images_idempotency_key ON images(idempotency_key) WHERE deleted_at IS NULL;
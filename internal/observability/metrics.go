@@ -0,0 +1,73 @@
+package observability
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type Metrics struct {
+	registry *prometheus.Registry
+
+	ProcessingInFlight prometheus.Gauge
+	UploadsTotal       prometheus.Counter
+	UploadDuration     prometheus.Histogram
+	ProcessedTotal     *prometheus.CounterVec
+	ProcessingDuration prometheus.Histogram
+	ConsumerLag        *prometheus.GaugeVec
+}
+
+func NewMetrics() *Metrics {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	m := &Metrics{
+		registry: registry,
+		ProcessingInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "imageprocessor_processing_in_flight",
+			Help: "Number of images currently being processed.",
+		}),
+		UploadsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "imageprocessor_uploads_total",
+			Help: "Number of upload requests received.",
+		}),
+		UploadDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "imageprocessor_upload_duration_seconds",
+			Help:    "Time spent handling upload requests.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		ProcessedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "imageprocessor_images_processed_total",
+			Help: "Number of processing runs by resulting status.",
+		}, []string{"status"}),
+		ProcessingDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "imageprocessor_processing_duration_seconds",
+			Help:    "Time spent in ProcessImage.",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		}),
+		ConsumerLag: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "imageprocessor_kafka_consumer_lag",
+			Help: "Messages behind the partition high watermark as of the last fetch.",
+		}, []string{"topic", "partition"}),
+	}
+	registry.MustRegister(
+		m.ProcessingInFlight,
+		m.UploadsTotal,
+		m.UploadDuration,
+		m.ProcessedTotal,
+		m.ProcessingDuration,
+		m.ConsumerLag,
+	)
+
+	return m
+}
+
+// Handler returns the HTTP handler exposing the metrics registry
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
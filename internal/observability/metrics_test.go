@@ -0,0 +1,41 @@
+package observability
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	m := NewMetrics()
+	m.UploadsTotal.Inc()
+	m.UploadsTotal.Inc()
+	m.ProcessedTotal.WithLabelValues("completed").Inc()
+	m.ProcessingInFlight.Set(3)
+	m.UploadDuration.Observe(0.2)
+	m.ProcessingDuration.Observe(1.5)
+	m.ConsumerLag.WithLabelValues("images", "0").Set(7)
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	body, _ := io.ReadAll(rec.Body)
+
+	for _, want := range []string{
+		"imageprocessor_uploads_total 2",
+		`imageprocessor_images_processed_total{status="completed"} 1`,
+		"imageprocessor_processing_in_flight 3",
+		"imageprocessor_upload_duration_seconds_count 1",
+		"imageprocessor_processing_duration_seconds_count 1",
+		`imageprocessor_kafka_consumer_lag{partition="0",topic="images"} 7`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("scrape is missing %q", want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+	_ "github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/oziev02/ImageProcessor/internal/domain"
+	"github.com/oziev02/ImageProcessor/internal/migrations"
+)
+
+// testDB connects to the database at TEST_DATABASE_URL, a postgres:// URL,
+// migrates it and empties its tables. Tests using it are skipped when the
+// variable isn't set.
+func testDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	sourceDriver, err := iofs.New(migrations.Files, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := migrate.NewWithSourceInstance("iofs", sourceDriver, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	ctx := context.Background()
+	db, err := pgxpool.New(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	if _, err := db.Exec(ctx, `TRUNCATE images, image_events, task_outbox`); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// seedImage stores a completed JPEG image with the given ID, created age ago,
+// the way uploading and processing do; edit changes it before it's stored
+func seedImage(t *testing.T, r ImageRepository, id string, age time.Duration, edit func(img *domain.Image)) *domain.Image {
+	t.Helper()
+	created := time.Now().Add(-age).UTC().Truncate(time.Microsecond)
+	img := &domain.Image{
+		ID:             id,
+		OriginalPath:   "original/" + id + ".jpg",
+		ProcessedPath:  "processed/" + id + ".jpg",
+		ThumbnailPath:  "thumbnails/" + id + ".jpg",
+		Status:         domain.StatusCompleted,
+		Format:         domain.FormatJPEG,
+		OriginalWidth:  800,
+		OriginalHeight: 600,
+		CreatedAt:      created,
+		UpdatedAt:      created,
+	}
+	if edit != nil {
+		edit(img)
+	}
+	ctx := context.Background()
+	if err := r.Create(ctx, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Update(ctx, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.UpdateThumbnail(ctx, img); err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
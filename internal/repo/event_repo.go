@@ -0,0 +1,63 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+type EventRepository interface {
+	Create(ctx context.Context, event *domain.ImageEvent) error
+	ListByImageID(ctx context.Context, imageID string) ([]*domain.ImageEvent, error)
+}
+
+type eventRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewEventRepository(db *pgxpool.Pool) EventRepository {
+	return &eventRepo{db: db}
+}
+
+func (r *eventRepo) Create(ctx context.Context, event *domain.ImageEvent) error {
+	query := `
+		INSERT INTO image_events (image_id, status, created_at)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`
+	if err := r.db.QueryRow(ctx, query, event.ImageID, event.Status, event.CreatedAt).Scan(&event.ID); err != nil {
+		return fmt.Errorf("failed to create image event: %w", err)
+	}
+	return nil
+}
+
+// ListByImageID returns an image's events oldest first
+func (r *eventRepo) ListByImageID(ctx context.Context, imageID string) ([]*domain.ImageEvent, error) {
+	query := `
+		SELECT id, image_id, status, created_at
+		FROM image_events
+		WHERE image_id = $1
+		ORDER BY created_at, id
+	`
+	rows, err := r.db.Query(ctx, query, imageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list image events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []*domain.ImageEvent
+	for rows.Next() {
+		var event domain.ImageEvent
+		if err := rows.Scan(&event.ID, &event.ImageID, &event.Status, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan image event: %w", err)
+		}
+		events = append(events, &event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list image events: %w", err)
+	}
+
+	return events, nil
+}
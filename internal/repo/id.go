@@ -0,0 +1,84 @@
+package repo
+
+import (
+	"crypto/rand"
+	"math/big"
+
+	"github.com/google/uuid"
+	"github.com/oklog/ulid/v2"
+)
+
+// ID schemes supported by NewIDGenerator
+const (
+	IDSchemeUUID   = "uuid"
+	IDSchemeUUIDv7 = "uuidv7"
+	IDSchemeULID   = "ulid"
+	IDSchemeShort  = "short"
+)
+
+const (
+	shortIDAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	shortIDLength   = 16 // ~95 bits of randomness
+)
+
+// IDGenerator generates URL-safe image IDs
+type IDGenerator interface {
+	NewID() string
+}
+
+// NewIDGenerator returns the generator for the given scheme. uuidv7 and ulid
+// IDs sort by creation time, which keeps inserts into the primary key index
+// local. Unknown schemes fall back to UUID.
+func NewIDGenerator(scheme string) IDGenerator {
+	switch scheme {
+	case IDSchemeUUIDv7:
+		return uuidV7Generator{}
+	case IDSchemeULID:
+		return ulidGenerator{}
+	case IDSchemeShort:
+		return shortIDGenerator{}
+	default:
+		return uuidGenerator{}
+	}
+}
+
+type uuidGenerator struct{}
+
+func (uuidGenerator) NewID() string {
+	return uuid.New().String()
+}
+
+type uuidV7Generator struct{}
+
+func (uuidV7Generator) NewID() string {
+	id, err := uuid.NewV7()
+	if err != nil {
+		// crypto/rand never fails on supported platforms
+		return uuid.New().String()
+	}
+	return id.String()
+}
+
+// ulid.Make is monotonic within a millisecond, so IDs generated by one
+// process stay ordered
+type ulidGenerator struct{}
+
+func (ulidGenerator) NewID() string {
+	return ulid.Make().String()
+}
+
+type shortIDGenerator struct{}
+
+func (shortIDGenerator) NewID() string {
+	max := big.NewInt(int64(len(shortIDAlphabet)))
+	id := make([]byte, shortIDLength)
+	for i := range id {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			// crypto/rand never fails on supported platforms
+			return uuid.New().String()
+		}
+		id[i] = shortIDAlphabet[n.Int64()]
+	}
+	return string(id)
+}
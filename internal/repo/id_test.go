@@ -0,0 +1,57 @@
+package repo
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestIDsSortByCreation(t *testing.T) {
+	for _, scheme := range []string{IDSchemeUUIDv7, IDSchemeULID} {
+		t.Run(scheme, func(t *testing.T) {
+			gen := NewIDGenerator(scheme)
+			// Many IDs within the same millisecond, and some across several
+			var ids []string
+			for i := range 2000 {
+				ids = append(ids, gen.NewID())
+				if i%500 == 0 {
+					time.Sleep(2 * time.Millisecond)
+				}
+			}
+			for i := 1; i < len(ids); i++ {
+				if ids[i] <= ids[i-1] {
+					t.Fatalf("ID %d %s doesn't sort after ID %d %s", i, ids[i], i-1, ids[i-1])
+				}
+			}
+		})
+	}
+}
+
+func TestNewIDGenerator(t *testing.T) {
+	tests := []struct {
+		scheme string
+		length int
+	}{
+		{IDSchemeUUID, 36},
+		{IDSchemeUUIDv7, 36},
+		{IDSchemeULID, 26},
+		{IDSchemeShort, shortIDLength},
+		{"unknown", 36}, // falls back to UUID
+	}
+	for _, tt := range tests {
+		t.Run(tt.scheme, func(t *testing.T) {
+			gen := NewIDGenerator(tt.scheme)
+			a, b := gen.NewID(), gen.NewID()
+			if len(a) != tt.length {
+				t.Errorf("ID %q is %d characters, want %d", a, len(a), tt.length)
+			}
+			if a == b {
+				t.Errorf("two IDs are both %q", a)
+			}
+			// IDs end up in paths and URLs unescaped
+			if url.PathEscape(a) != a {
+				t.Errorf("ID %q isn't URL-safe", a)
+			}
+		})
+	}
+}
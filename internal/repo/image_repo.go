@@ -2,20 +2,46 @@ package repo
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
-	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/oziev02/ImageProcessor/internal/domain"
 )
 
 type ImageRepository interface {
 	Create(ctx context.Context, img *domain.Image) error
+	CreateWithTasks(ctx context.Context, img *domain.Image, tasks []*domain.ProcessingTask) ([]*domain.OutboxMessage, error)
 	GetByID(ctx context.Context, id string) (*domain.Image, error)
+	GetByIdempotencyKey(ctx context.Context, key string) (*domain.Image, error)
 	Update(ctx context.Context, img *domain.Image) error
+	UpdateWithTasks(ctx context.Context, img *domain.Image, tasks []*domain.ProcessingTask) ([]*domain.OutboxMessage, error)
+	UpdateThumbnail(ctx context.Context, img *domain.Image) error
 	Delete(ctx context.Context, id string) error
-	List(ctx context.Context, limit, offset int) ([]*domain.Image, error)
+	Restore(ctx context.Context, id string) error
+	HardDelete(ctx context.Context, id string) (*domain.Image, error)
+	PurgeDeleted(ctx context.Context, olderThan time.Duration) ([]*domain.Image, error)
+	DeleteByStatus(ctx context.Context, status domain.ProcessingStatus) ([]*domain.Image, error)
+	List(ctx context.Context, filter domain.ImageFilter, limit, offset int) ([]*domain.Image, error)
+	ListEach(ctx context.Context, filter domain.ImageFilter, limit, offset int, fn func(img *domain.Image) error) error
+	Count(ctx context.Context, filter domain.ImageFilter) (int, error)
+	ForEach(ctx context.Context, filter domain.ImageFilter, fn func(img *domain.Image) error) error
+	GetCompletedByProcessingKey(ctx context.Context, key string) (*domain.Image, error)
+	FindSimilar(ctx context.Context, phash int64, maxDistance int) (*domain.Image, error)
+	Stats(ctx context.Context) (*domain.ImageStats, error)
+	RetryFailed(ctx context.Context, filter RetryFilter, tasksFor func(img *domain.Image) []*domain.ProcessingTask) ([]*domain.Image, []*domain.OutboxMessage, error)
+}
+
+// RetryFilter selects the failed images RetryFailed requeues
+type RetryFilter struct {
+	CreatedAfter time.Time
+	MaxRetries   int // retried fewer times than this
+	MaxAttempts  int // processing attempts left, 0 for no limit
+	Limit        int
 }
 
 type imageRepo struct {
@@ -26,55 +52,176 @@ func NewImageRepository(db *pgxpool.Pool) ImageRepository {
 	return &imageRepo{db: db}
 }
 
+const imageColumns = `id, original_path, processed_path, thumbnail_path, status, format,
+	original_width, original_height, processed_width, processed_height, created_at, updated_at,
+	processed_format, processing_key, processed_checksum, thumbnail_checksum, thumbnails,
+	processing_attempts, failure_reason, lqip_path, sharpness, deleted_at, phash, processing_params,
+	original_size, processed_size, placeholder, metadata, retry_count`
+
+func scanImage(row pgx.Row) (*domain.Image, error) {
+	var img domain.Image
+	if err := row.Scan(
+		&img.ID, &img.OriginalPath, &img.ProcessedPath, &img.ThumbnailPath, &img.Status,
+		&img.Format, &img.OriginalWidth, &img.OriginalHeight, &img.ProcessedWidth, &img.ProcessedHeight,
+		&img.CreatedAt, &img.UpdatedAt, &img.ProcessedFormat, &img.ProcessingKey,
+		&img.ProcessedChecksum, &img.ThumbnailChecksum, &img.Thumbnails,
+		&img.ProcessingAttempts, &img.FailureReason, &img.LQIPPath, &img.Sharpness,
+		&img.DeletedAt, &img.PHash, &img.Params,
+		&img.OriginalSize, &img.ProcessedSize, &img.Placeholder, &img.Metadata,
+		&img.RetryCount,
+	); err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
+// idempotencyKeyIndex is the unique index on the idempotency_key of images
+// that aren't deleted
+const idempotencyKeyIndex = "idx_images_idempotency_key"
+
+// nullIfEmpty stores an empty string as NULL, which unique indexes ignore
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// thumbnailsValue keeps a nil map from being stored as JSON null
+func thumbnailsValue(thumbnails map[string]string) map[string]string {
+	if thumbnails == nil {
+		return map[string]string{}
+	}
+	return thumbnails
+}
+
+// execer is implemented by both the pool and a transaction
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
 func (r *imageRepo) Create(ctx context.Context, img *domain.Image) error {
+	return insertImage(ctx, r.db, img)
+}
+
+// CreateWithTasks creates img and queues its processing tasks in the outbox
+// in one transaction, so that the image can't be left pending without them
+func (r *imageRepo) CreateWithTasks(ctx context.Context, img *domain.Image, tasks []*domain.ProcessingTask) ([]*domain.OutboxMessage, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := insertImage(ctx, tx, img); err != nil {
+		return nil, err
+	}
+	messages, err := insertOutbox(ctx, tx, tasks, img.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return messages, nil
+}
+
+func insertImage(ctx context.Context, db execer, img *domain.Image) error {
 	query := `
 		INSERT INTO images (id, original_path, processed_path, thumbnail_path, status, format, 
-			original_width, original_height, processed_width, processed_height, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+			original_width, original_height, processed_width, processed_height, created_at, updated_at,
+			processed_format, processing_key, processed_checksum, thumbnail_checksum, thumbnails, phash,
+			processing_params, original_size, idempotency_key, metadata)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22)
 	`
-	_, err := r.db.Exec(ctx, query,
+	_, err := db.Exec(ctx, query,
 		img.ID, img.OriginalPath, img.ProcessedPath, img.ThumbnailPath, img.Status,
 		img.Format, img.OriginalWidth, img.OriginalHeight, img.ProcessedWidth, img.ProcessedHeight,
-		img.CreatedAt, img.UpdatedAt,
+		img.CreatedAt, img.UpdatedAt, img.ProcessedFormat, img.ProcessingKey,
+		img.ProcessedChecksum, img.ThumbnailChecksum, thumbnailsValue(img.Thumbnails), img.PHash,
+		img.Params, img.OriginalSize, nullIfEmpty(img.IdempotencyKey), img.Metadata,
 	)
 	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == idempotencyKeyIndex {
+			return domain.ErrIdempotencyKeyConflict
+		}
 		return fmt.Errorf("failed to create image: %w", err)
 	}
 	return nil
 }
 
 func (r *imageRepo) GetByID(ctx context.Context, id string) (*domain.Image, error) {
-	query := `
-		SELECT id, original_path, processed_path, thumbnail_path, status, format,
-			original_width, original_height, processed_width, processed_height, created_at, updated_at
-		FROM images
-		WHERE id = $1
-	`
-	var img domain.Image
-	err := r.db.QueryRow(ctx, query, id).Scan(
-		&img.ID, &img.OriginalPath, &img.ProcessedPath, &img.ThumbnailPath, &img.Status,
-		&img.Format, &img.OriginalWidth, &img.OriginalHeight, &img.ProcessedWidth, &img.ProcessedHeight,
-		&img.CreatedAt, &img.UpdatedAt,
-	)
+	query := `SELECT ` + imageColumns + ` FROM images WHERE id = $1 AND deleted_at IS NULL`
+	img, err := scanImage(r.db.QueryRow(ctx, query, id))
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return nil, domain.ErrImageNotFound
 		}
 		return nil, fmt.Errorf("failed to get image: %w", err)
 	}
-	return &img, nil
+	return img, nil
+}
+
+// GetByIdempotencyKey returns the image an upload with the same key created
+func (r *imageRepo) GetByIdempotencyKey(ctx context.Context, key string) (*domain.Image, error) {
+	query := `SELECT ` + imageColumns + ` FROM images WHERE idempotency_key = $1 AND deleted_at IS NULL`
+	img, err := scanImage(r.db.QueryRow(ctx, query, key))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, domain.ErrImageNotFound
+		}
+		return nil, fmt.Errorf("failed to get image by idempotency key: %w", err)
+	}
+	img.IdempotencyKey = key
+	return img, nil
 }
 
+// Update persists processing state. Thumbnail fields, including the
+// placeholder, are written separately by UpdateThumbnail, since thumbnails
+// may be generated by another consumer.
 func (r *imageRepo) Update(ctx context.Context, img *domain.Image) error {
+	return updateImage(ctx, r.db, img)
+}
+
+// UpdateWithTasks updates img and queues its processing tasks in the outbox
+// in one transaction, like CreateWithTasks for an image that already exists
+func (r *imageRepo) UpdateWithTasks(ctx context.Context, img *domain.Image, tasks []*domain.ProcessingTask) ([]*domain.OutboxMessage, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := updateImage(ctx, tx, img); err != nil {
+		return nil, err
+	}
+	messages, err := insertOutbox(ctx, tx, tasks, img.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return messages, nil
+}
+
+func updateImage(ctx context.Context, db execer, img *domain.Image) error {
 	query := `
 		UPDATE images
-		SET processed_path = $2, thumbnail_path = $3, status = $4,
-			processed_width = $5, processed_height = $6, updated_at = $7
+		SET processed_path = $2, status = $3,
+			processed_width = $4, processed_height = $5, updated_at = $6,
+			processed_format = $7, processing_key = $8, processed_checksum = $9,
+			processing_attempts = $10, failure_reason = $11, sharpness = $12,
+			processing_params = $13, processed_size = $14
 		WHERE id = $1
 	`
-	_, err := r.db.Exec(ctx, query,
-		img.ID, img.ProcessedPath, img.ThumbnailPath, img.Status,
+	_, err := db.Exec(ctx, query,
+		img.ID, img.ProcessedPath, img.Status,
 		img.ProcessedWidth, img.ProcessedHeight, img.UpdatedAt,
+		img.ProcessedFormat, img.ProcessingKey, img.ProcessedChecksum,
+		img.ProcessingAttempts, img.FailureReason, img.Sharpness,
+		img.Params, img.ProcessedSize,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to update image: %w", err)
@@ -82,49 +229,354 @@ func (r *imageRepo) Update(ctx context.Context, img *domain.Image) error {
 	return nil
 }
 
-func (r *imageRepo) Delete(ctx context.Context, id string) error {
-	query := `DELETE FROM images WHERE id = $1`
-	_, err := r.db.Exec(ctx, query, id)
+func (r *imageRepo) UpdateThumbnail(ctx context.Context, img *domain.Image) error {
+	query := `
+		UPDATE images
+		SET thumbnail_path = $2, thumbnail_checksum = $3, updated_at = $4, thumbnails = $5,
+			lqip_path = $6, placeholder = $7
+		WHERE id = $1
+	`
+	_, err := r.db.Exec(ctx, query, img.ID, img.ThumbnailPath, img.ThumbnailChecksum, img.UpdatedAt,
+		thumbnailsValue(img.Thumbnails), img.LQIPPath, img.Placeholder)
 	if err != nil {
-		return fmt.Errorf("failed to delete image: %w", err)
+		return fmt.Errorf("failed to update thumbnail: %w", err)
 	}
 	return nil
 }
 
-func (r *imageRepo) List(ctx context.Context, limit, offset int) ([]*domain.Image, error) {
+// GetCompletedByProcessingKey returns the most recently completed image whose
+// derivatives were produced from the same source and parameters
+func (r *imageRepo) GetCompletedByProcessingKey(ctx context.Context, key string) (*domain.Image, error) {
 	query := `
-		SELECT id, original_path, processed_path, thumbnail_path, status, format,
-			original_width, original_height, processed_width, processed_height, created_at, updated_at
+		SELECT ` + imageColumns + `
 		FROM images
-		ORDER BY created_at DESC
-		LIMIT $1 OFFSET $2
+		WHERE processing_key = $1 AND status = $2 AND deleted_at IS NULL
+		ORDER BY updated_at DESC
+		LIMIT 1
+	`
+	img, err := scanImage(r.db.QueryRow(ctx, query, key, domain.StatusCompleted))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, domain.ErrImageNotFound
+		}
+		return nil, fmt.Errorf("failed to get image by processing key: %w", err)
+	}
+	return img, nil
+}
+
+// FindSimilar returns the closest image whose perceptual hash differs from
+// phash in at most maxDistance bits, oldest first among equally close ones.
+// Failed images aren't considered.
+func (r *imageRepo) FindSimilar(ctx context.Context, phash int64, maxDistance int) (*domain.Image, error) {
+	query := `
+		SELECT ` + imageColumns + `
+		FROM images
+		WHERE phash IS NOT NULL AND deleted_at IS NULL AND status <> $3
+			AND bit_count((phash # $1)::bit(64)) <= $2
+		ORDER BY bit_count((phash # $1)::bit(64)), created_at
+		LIMIT 1
 	`
-	rows, err := r.db.Query(ctx, query, limit, offset)
+	img, err := scanImage(r.db.QueryRow(ctx, query, phash, maxDistance, domain.StatusFailed))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, domain.ErrImageNotFound
+		}
+		return nil, fmt.Errorf("failed to find similar image: %w", err)
+	}
+	return img, nil
+}
+
+// Delete soft-deletes the image: it disappears from reads but its row and
+// files are kept until purged, so it can still be restored
+func (r *imageRepo) Delete(ctx context.Context, id string) error {
+	query := `UPDATE images SET deleted_at = $2 WHERE id = $1 AND deleted_at IS NULL`
+	tag, err := r.db.Exec(ctx, query, id, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to delete image: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrImageNotFound
+	}
+	return nil
+}
+
+// Restore undoes a soft delete that hasn't been purged yet
+func (r *imageRepo) Restore(ctx context.Context, id string) error {
+	query := `UPDATE images SET deleted_at = NULL WHERE id = $1 AND deleted_at IS NOT NULL`
+	tag, err := r.db.Exec(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("failed to restore image: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrImageNotFound
+	}
+	return nil
+}
+
+// HardDelete permanently removes the image row, soft-deleted or not, and
+// returns it so that its files can be removed
+func (r *imageRepo) HardDelete(ctx context.Context, id string) (*domain.Image, error) {
+	query := `DELETE FROM images WHERE id = $1 RETURNING ` + imageColumns
+	img, err := scanImage(r.db.QueryRow(ctx, query, id))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, domain.ErrImageNotFound
+		}
+		return nil, fmt.Errorf("failed to delete image: %w", err)
+	}
+	return img, nil
+}
+
+// PurgeDeleted permanently removes images soft-deleted more than olderThan
+// ago and returns them so that their files can be removed
+func (r *imageRepo) PurgeDeleted(ctx context.Context, olderThan time.Duration) ([]*domain.Image, error) {
+	query := `DELETE FROM images WHERE deleted_at < $1 RETURNING ` + imageColumns
+	rows, err := r.db.Query(ctx, query, time.Now().Add(-olderThan))
 	if err != nil {
-		return nil, fmt.Errorf("failed to list images: %w", err)
+		return nil, fmt.Errorf("failed to purge images: %w", err)
 	}
 	defer rows.Close()
 
-	var images []*domain.Image
+	images := []*domain.Image{}
 	for rows.Next() {
-		var img domain.Image
-		if err := rows.Scan(
-			&img.ID, &img.OriginalPath, &img.ProcessedPath, &img.ThumbnailPath, &img.Status,
-			&img.Format, &img.OriginalWidth, &img.OriginalHeight, &img.ProcessedWidth, &img.ProcessedHeight,
-			&img.CreatedAt, &img.UpdatedAt,
-		); err != nil {
+		img, err := scanImage(rows)
+		if err != nil {
 			return nil, fmt.Errorf("failed to scan image: %w", err)
 		}
-		images = append(images, &img)
+		images = append(images, img)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to purge images: %w", err)
+	}
+
+	return images, nil
+}
+
+// DeleteByStatus permanently removes every image with the given status,
+// soft-deleted or not, in a single statement, and returns them so that their
+// files can be removed
+func (r *imageRepo) DeleteByStatus(ctx context.Context, status domain.ProcessingStatus) ([]*domain.Image, error) {
+	query := `DELETE FROM images WHERE status = $1 RETURNING ` + imageColumns
+	rows, err := r.db.Query(ctx, query, status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete images: %w", err)
+	}
+	defer rows.Close()
+
+	images := []*domain.Image{}
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan image: %w", err)
+		}
+		images = append(images, img)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to delete images: %w", err)
+	}
+
+	return images, nil
+}
+
+// RetryFailed resets the failed images matching filter to pending, counting
+// the retry, and queues tasksFor each of them in the outbox, in one
+// transaction. Rows being retried by another instance are skipped.
+func (r *imageRepo) RetryFailed(ctx context.Context, filter RetryFilter, tasksFor func(img *domain.Image) []*domain.ProcessingTask) ([]*domain.Image, []*domain.OutboxMessage, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback(ctx)
 
+	now := time.Now()
+	query := `
+		UPDATE images
+		SET status = $1, retry_count = retry_count + 1, failure_reason = '', updated_at = $2
+		WHERE id IN (
+			SELECT id FROM images
+			WHERE status = $3 AND deleted_at IS NULL AND created_at > $4 AND retry_count < $5
+				AND ($6 = 0 OR processing_attempts < $6)
+			ORDER BY updated_at
+			LIMIT $7
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + imageColumns
+	rows, err := tx.Query(ctx, query, domain.StatusPending, now, domain.StatusFailed,
+		filter.CreatedAfter, filter.MaxRetries, filter.MaxAttempts, filter.Limit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to retry failed images: %w", err)
+	}
+	var images []*domain.Image
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			rows.Close()
+			return nil, nil, fmt.Errorf("failed to scan image: %w", err)
+		}
+		images = append(images, img)
+	}
+	rows.Close()
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("failed to iterate images: %w", err)
+		return nil, nil, fmt.Errorf("failed to retry failed images: %w", err)
 	}
 
+	var messages []*domain.OutboxMessage
+	for _, img := range images {
+		queued, err := insertOutbox(ctx, tx, tasksFor(img), now)
+		if err != nil {
+			return nil, nil, err
+		}
+		messages = append(messages, queued...)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return images, messages, nil
+}
+
+// filterClause builds the WHERE clause for filter, returning it with its
+// positional arguments. Values are always passed as arguments, never inlined.
+// Soft-deleted images are always excluded.
+func filterClause(filter domain.ImageFilter) (string, []any) {
+	conditions := []string{"deleted_at IS NULL"}
+	var args []any
+	add := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.Status != "" {
+		add("status = $%d", filter.Status)
+	}
+	if filter.Format != "" {
+		add("format = $%d", filter.Format)
+	}
+	if filter.MinSharpness != nil {
+		add("sharpness >= $%d", *filter.MinSharpness)
+	}
+	if filter.MaxSharpness != nil {
+		add("sharpness <= $%d", *filter.MaxSharpness)
+	}
+
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+func (r *imageRepo) List(ctx context.Context, filter domain.ImageFilter, limit, offset int) ([]*domain.Image, error) {
+	images := []*domain.Image{}
+	err := r.ListEach(ctx, filter, limit, offset, func(img *domain.Image) error {
+		images = append(images, img)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 	return images, nil
 }
 
-func GenerateID() string {
-	return uuid.New().String()
+// ListEach streams a page of images from a cursor, calling fn for each row
+// instead of collecting them. Iteration stops at the first error returned by fn.
+func (r *imageRepo) ListEach(ctx context.Context, filter domain.ImageFilter, limit, offset int, fn func(img *domain.Image) error) error {
+	where, args := filterClause(filter)
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM images%s
+		ORDER BY created_at DESC
+		LIMIT $%d OFFSET $%d
+	`, imageColumns, where, len(args)+1, len(args)+2)
+	rows, err := r.db.Query(ctx, query, append(args, limit, offset)...)
+	if err != nil {
+		return fmt.Errorf("failed to list images: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return fmt.Errorf("failed to scan image: %w", err)
+		}
+		if err := fn(img); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterate images: %w", err)
+	}
+
+	return nil
+}
+
+// Count returns the number of images List pages through
+func (r *imageRepo) Count(ctx context.Context, filter domain.ImageFilter) (int, error) {
+	where, args := filterClause(filter)
+	var count int
+	if err := r.db.QueryRow(ctx, `SELECT COUNT(*) FROM images`+where, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count images: %w", err)
+	}
+	return count, nil
+}
+
+// ForEach streams images matching filter from a cursor, newest first, calling
+// fn for each row. Iteration stops at the first error returned by fn.
+func (r *imageRepo) ForEach(ctx context.Context, filter domain.ImageFilter, fn func(img *domain.Image) error) error {
+	where, args := filterClause(filter)
+	query := `SELECT ` + imageColumns + ` FROM images` + where + ` ORDER BY created_at DESC`
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query images: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			return fmt.Errorf("failed to scan image: %w", err)
+		}
+		if err := fn(img); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterate images: %w", err)
+	}
+
+	return nil
+}
+
+// Stats counts images and sums their file sizes per status and format
+func (r *imageRepo) Stats(ctx context.Context) (*domain.ImageStats, error) {
+	query := `
+		SELECT status, format, COUNT(*),
+			COALESCE(SUM(original_size), 0)::bigint, COALESCE(SUM(processed_size), 0)::bigint
+		FROM images
+		WHERE deleted_at IS NULL
+		GROUP BY status, format
+		ORDER BY status, format
+	`
+	rows, err := r.db.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query image stats: %w", err)
+	}
+	defer rows.Close()
+
+	stats := &domain.ImageStats{Groups: []domain.StatsGroup{}}
+	for rows.Next() {
+		var g domain.StatsGroup
+		if err := rows.Scan(&g.Status, &g.Format, &g.Count, &g.OriginalBytes, &g.ProcessedBytes); err != nil {
+			return nil, fmt.Errorf("failed to scan image stats: %w", err)
+		}
+		stats.Groups = append(stats.Groups, g)
+		stats.Count += g.Count
+		stats.OriginalBytes += g.OriginalBytes
+		stats.ProcessedBytes += g.ProcessedBytes
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate image stats: %w", err)
+	}
+
+	return stats, nil
 }
@@ -0,0 +1,451 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+func TestFilterClause(t *testing.T) {
+	low, high := 0.25, 0.75
+	tests := []struct {
+		name      string
+		filter    domain.ImageFilter
+		wantWhere string
+		wantArgs  []any
+	}{
+		{
+			name:      "no filter",
+			wantWhere: " WHERE deleted_at IS NULL",
+		},
+		{
+			name:      "status",
+			filter:    domain.ImageFilter{Status: domain.StatusFailed},
+			wantWhere: " WHERE deleted_at IS NULL AND status = $1",
+			wantArgs:  []any{domain.StatusFailed},
+		},
+		{
+			name:      "combined",
+			filter:    domain.ImageFilter{Status: domain.StatusCompleted, Format: domain.FormatPNG, MinSharpness: &low, MaxSharpness: &high},
+			wantWhere: " WHERE deleted_at IS NULL AND status = $1 AND format = $2 AND sharpness >= $3 AND sharpness <= $4",
+			wantArgs:  []any{domain.StatusCompleted, domain.FormatPNG, low, high},
+		},
+		{
+			name:      "format and sharpness",
+			filter:    domain.ImageFilter{Format: domain.FormatGIF, MaxSharpness: &high},
+			wantWhere: " WHERE deleted_at IS NULL AND format = $1 AND sharpness <= $2",
+			wantArgs:  []any{domain.FormatGIF, high},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			where, args := filterClause(tt.filter)
+			if where != tt.wantWhere {
+				t.Errorf("where = %q, want %q", where, tt.wantWhere)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestListFilters(t *testing.T) {
+	db := testDB(t)
+	r := NewImageRepository(db)
+	ctx := context.Background()
+	sharp, blurry := 0.9, 0.1
+
+	seedImage(t, r, "oldest", 3*time.Hour, func(img *domain.Image) { img.Sharpness = &sharp })
+	seedImage(t, r, "middle", 2*time.Hour, func(img *domain.Image) {
+		img.Format = domain.FormatPNG
+		img.Sharpness = &sharp
+	})
+	seedImage(t, r, "newest", time.Hour, func(img *domain.Image) {
+		img.Status = domain.StatusFailed
+		img.Sharpness = &blurry
+	})
+
+	tests := []struct {
+		name   string
+		filter domain.ImageFilter
+		want   []string
+	}{
+		{name: "no filter keeps newest first", want: []string{"newest", "middle", "oldest"}},
+		{name: "status", filter: domain.ImageFilter{Status: domain.StatusCompleted}, want: []string{"middle", "oldest"}},
+		{name: "status and format", filter: domain.ImageFilter{Status: domain.StatusCompleted, Format: domain.FormatJPEG}, want: []string{"oldest"}},
+		{name: "sharpness", filter: domain.ImageFilter{MinSharpness: &sharp}, want: []string{"middle", "oldest"}},
+		{name: "no match", filter: domain.ImageFilter{Status: domain.StatusFailed, Format: domain.FormatPNG}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			images, err := r.List(ctx, tt.filter, 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := []string{}
+			for _, img := range images {
+				ids = append(ids, img.ID)
+			}
+			if !slices.Equal(ids, tt.want) {
+				t.Errorf("List = %v, want %v", ids, tt.want)
+			}
+			count, err := r.Count(ctx, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != len(tt.want) {
+				t.Errorf("Count = %d, want %d", count, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	db := testDB(t)
+	r := NewImageRepository(db)
+	ctx := context.Background()
+	seedImage(t, r, "a", time.Hour, nil)
+	seedImage(t, r, "b", 2*time.Hour, nil)
+
+	if err := r.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	// A soft-deleted image disappears from every read
+	if _, err := r.GetByID(ctx, "a"); !errors.Is(err, domain.ErrImageNotFound) {
+		t.Errorf("GetByID after Delete = %v, want ErrImageNotFound", err)
+	}
+	images, err := r.List(ctx, domain.ImageFilter{}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].ID != "b" {
+		t.Errorf("List after Delete returned %d images, want only b", len(images))
+	}
+	if count, _ := r.Count(ctx, domain.ImageFilter{}); count != 1 {
+		t.Errorf("Count after Delete = %d, want 1", count)
+	}
+	if err := r.Delete(ctx, "a"); !errors.Is(err, domain.ErrImageNotFound) {
+		t.Errorf("second Delete = %v, want ErrImageNotFound", err)
+	}
+
+	// Restoring brings it back unchanged
+	if err := r.Restore(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := r.GetByID(ctx, "a")
+	if err != nil {
+		t.Fatalf("GetByID after Restore: %v", err)
+	}
+	if restored.ProcessedPath != "processed/a.jpg" || restored.DeletedAt != nil {
+		t.Errorf("restored image = %+v", restored)
+	}
+	if err := r.Restore(ctx, "a"); !errors.Is(err, domain.ErrImageNotFound) {
+		t.Errorf("Restore of a live image = %v, want ErrImageNotFound", err)
+	}
+}
+
+func TestHardDelete(t *testing.T) {
+	db := testDB(t)
+	r := NewImageRepository(db)
+	ctx := context.Background()
+	seedImage(t, r, "live", time.Hour, nil)
+	seedImage(t, r, "deleted", time.Hour, nil)
+	if err := r.Delete(ctx, "deleted"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both live and soft-deleted images are removed for good, returning the
+	// paths of their files
+	for _, id := range []string{"live", "deleted"} {
+		img, err := r.HardDelete(ctx, id)
+		if err != nil {
+			t.Fatalf("HardDelete(%s): %v", id, err)
+		}
+		if img.OriginalPath != "original/"+id+".jpg" {
+			t.Errorf("HardDelete(%s) returned original path %q", id, img.OriginalPath)
+		}
+		if err := r.Restore(ctx, id); !errors.Is(err, domain.ErrImageNotFound) {
+			t.Errorf("Restore after HardDelete(%s) = %v, want ErrImageNotFound", id, err)
+		}
+		if _, err := r.HardDelete(ctx, id); !errors.Is(err, domain.ErrImageNotFound) {
+			t.Errorf("second HardDelete(%s) = %v, want ErrImageNotFound", id, err)
+		}
+	}
+}
+
+func TestPurgeDeleted(t *testing.T) {
+	db := testDB(t)
+	r := NewImageRepository(db)
+	ctx := context.Background()
+	seedImage(t, r, "live", time.Hour, nil)
+	seedImage(t, r, "deleted", time.Hour, nil)
+	if err := r.Delete(ctx, "deleted"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleted too recently to be purged
+	purged, err := r.PurgeDeleted(ctx, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 0 {
+		t.Fatalf("purged %d images, want none", len(purged))
+	}
+
+	purged, err = r.PurgeDeleted(ctx, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 1 || purged[0].ID != "deleted" {
+		t.Fatalf("purged %v, want only the deleted image", purged)
+	}
+	if _, err := r.GetByID(ctx, "live"); err != nil {
+		t.Errorf("live image gone after purge: %v", err)
+	}
+}
+
+func TestUpdateWithTasks(t *testing.T) {
+	db := testDB(t)
+	r := NewImageRepository(db)
+	ctx := context.Background()
+	img := seedImage(t, r, "a", time.Hour, func(img *domain.Image) {
+		img.Status = domain.StatusFailed
+		img.FailureReason = "storage unavailable"
+	})
+
+	img.Status = domain.StatusPending
+	img.FailureReason = ""
+	img.UpdatedAt = time.Now()
+	task := &domain.ProcessingTask{ImageID: "a", ImagePath: img.OriginalPath, Format: img.Format, Origin: domain.TaskOriginReprocess}
+	messages, err := r.UpdateWithTasks(ctx, img, []*domain.ProcessingTask{task})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].ID == 0 {
+		t.Fatalf("UpdateWithTasks queued %v, want one message", messages)
+	}
+
+	stored, err := r.GetByID(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != domain.StatusPending || stored.FailureReason != "" {
+		t.Errorf("stored status %s, reason %q, want pending", stored.Status, stored.FailureReason)
+	}
+
+	// The task waits in the outbox for the relay
+	var relayed []*domain.ProcessingTask
+	n, err := NewOutboxRepository(db).RelayUnsent(ctx, time.Now().Add(time.Minute), 10, func(msg *domain.OutboxMessage) error {
+		relayed = append(relayed, msg.Task)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || relayed[0].ImagePath != img.OriginalPath || relayed[0].Origin != domain.TaskOriginReprocess {
+		t.Errorf("relayed %d tasks %+v, want the reprocess task for %s", n, relayed, img.OriginalPath)
+	}
+}
+
+func TestSizesRoundTrip(t *testing.T) {
+	db := testDB(t)
+	r := NewImageRepository(db)
+	ctx := context.Background()
+
+	// Uploading stores the original size, processing the processed one
+	created := time.Now().UTC().Truncate(time.Microsecond)
+	img := &domain.Image{ID: "a", OriginalPath: "original/a.jpg", Status: domain.StatusPending, Format: domain.FormatJPEG,
+		OriginalWidth: 800, OriginalHeight: 600, OriginalSize: 123456, CreatedAt: created, UpdatedAt: created}
+	if err := r.Create(ctx, img); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := r.GetByID(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.OriginalSize != 123456 || stored.ProcessedSize != 0 {
+		t.Errorf("after Create: sizes %d/%d, want 123456/0", stored.OriginalSize, stored.ProcessedSize)
+	}
+
+	stored.Status = domain.StatusCompleted
+	stored.ProcessedPath = "processed/a.jpg"
+	stored.ProcessedSize = 65432
+	if err := r.Update(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+	images, err := r.List(ctx, domain.ImageFilter{}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].OriginalSize != 123456 || images[0].ProcessedSize != 65432 {
+		t.Fatalf("after Update: List = %+v, want sizes 123456/65432", images)
+	}
+}
+
+func TestCreateIdempotencyKeyConflict(t *testing.T) {
+	db := testDB(t)
+	r := NewImageRepository(db)
+	ctx := context.Background()
+
+	newImage := func(id string) *domain.Image {
+		now := time.Now().UTC().Truncate(time.Microsecond)
+		return &domain.Image{ID: id, OriginalPath: "original/" + id + ".jpg", Status: domain.StatusPending,
+			Format: domain.FormatJPEG, IdempotencyKey: "key-1", CreatedAt: now, UpdatedAt: now}
+	}
+	task := func(id string) []*domain.ProcessingTask {
+		return []*domain.ProcessingTask{{ImageID: id, ImagePath: "original/" + id + ".jpg", Format: domain.FormatJPEG}}
+	}
+	if _, err := r.CreateWithTasks(ctx, newImage("a"), task("a")); err != nil {
+		t.Fatal(err)
+	}
+	// The second upload with the key is rolled back, tasks included
+	if _, err := r.CreateWithTasks(ctx, newImage("b"), task("b")); !errors.Is(err, domain.ErrIdempotencyKeyConflict) {
+		t.Fatalf("second CreateWithTasks = %v, want ErrIdempotencyKeyConflict", err)
+	}
+
+	if count, _ := r.Count(ctx, domain.ImageFilter{}); count != 1 {
+		t.Errorf("%d images, want one", count)
+	}
+	existing, err := r.GetByIdempotencyKey(ctx, "key-1")
+	if err != nil || existing.ID != "a" {
+		t.Errorf("GetByIdempotencyKey = %v, %v, want a", existing, err)
+	}
+	var queued int
+	if err := db.QueryRow(ctx, `SELECT count(*) FROM task_outbox`).Scan(&queued); err != nil {
+		t.Fatal(err)
+	}
+	if queued != 1 {
+		t.Errorf("%d tasks queued, want one", queued)
+	}
+
+	// Deleting the image releases its key
+	if err := r.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.CreateWithTasks(ctx, newImage("c"), task("c")); err != nil {
+		t.Fatalf("CreateWithTasks after deleting a = %v, want the key reusable", err)
+	}
+	if existing, err := r.GetByIdempotencyKey(ctx, "key-1"); err != nil || existing.ID != "c" {
+		t.Errorf("GetByIdempotencyKey after reuse = %v, %v, want c", existing, err)
+	}
+}
+
+func TestDeleteByStatus(t *testing.T) {
+	db := testDB(t)
+	r := NewImageRepository(db)
+	ctx := context.Background()
+	failed := func(img *domain.Image) { img.Status = domain.StatusFailed }
+	seedImage(t, r, "failed-1", time.Hour, failed)
+	seedImage(t, r, "failed-2", 2*time.Hour, failed)
+	seedImage(t, r, "failed-deleted", time.Hour, failed)
+	seedImage(t, r, "completed", time.Hour, nil)
+	seedImage(t, r, "pending", time.Hour, func(img *domain.Image) { img.Status = domain.StatusPending })
+	if err := r.Delete(ctx, "failed-deleted"); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := r.DeleteByStatus(ctx, domain.StatusFailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, img := range deleted {
+		ids = append(ids, img.ID)
+	}
+	slices.Sort(ids)
+	if want := []string{"failed-1", "failed-2", "failed-deleted"}; !slices.Equal(ids, want) {
+		t.Errorf("deleted %v, want %v", ids, want)
+	}
+
+	// Only the failed images are gone, soft-deleted ones included
+	for _, id := range []string{"completed", "pending"} {
+		if _, err := r.GetByID(ctx, id); err != nil {
+			t.Errorf("GetByID(%s) after DeleteByStatus: %v", id, err)
+		}
+	}
+	if err := r.Restore(ctx, "failed-deleted"); !errors.Is(err, domain.ErrImageNotFound) {
+		t.Errorf("Restore of a deleted failed image = %v, want ErrImageNotFound", err)
+	}
+	if again, err := r.DeleteByStatus(ctx, domain.StatusFailed); err != nil || len(again) != 0 {
+		t.Errorf("second DeleteByStatus = %d images, %v, want none", len(again), err)
+	}
+}
+
+func TestRetryFailed(t *testing.T) {
+	db := testDB(t)
+	r := NewImageRepository(db)
+	ctx := context.Background()
+	failed := func(attempts int) func(img *domain.Image) {
+		return func(img *domain.Image) {
+			img.Status = domain.StatusFailed
+			img.FailureReason = "storage unavailable"
+			img.ProcessingAttempts = attempts
+		}
+	}
+	seedImage(t, r, "retryable", time.Hour, failed(1))
+	seedImage(t, r, "too-old", 48*time.Hour, failed(1))
+	seedImage(t, r, "out-of-attempts", time.Hour, failed(3))
+	seedImage(t, r, "deleted", time.Hour, failed(1))
+	seedImage(t, r, "completed", time.Hour, nil)
+	if err := r.Delete(ctx, "deleted"); err != nil {
+		t.Fatal(err)
+	}
+
+	filter := RetryFilter{CreatedAfter: time.Now().Add(-24 * time.Hour), MaxRetries: 2, MaxAttempts: 3, Limit: 10}
+	tasksFor := func(img *domain.Image) []*domain.ProcessingTask {
+		return []*domain.ProcessingTask{{ImageID: img.ID, ImagePath: img.OriginalPath, Origin: domain.TaskOriginReprocess}}
+	}
+	retry := func() ([]*domain.Image, []*domain.OutboxMessage) {
+		t.Helper()
+		images, messages, err := r.RetryFailed(ctx, filter, tasksFor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return images, messages
+	}
+
+	// Only the recent, live failure with attempts left is selected
+	images, messages := retry()
+	if len(images) != 1 || images[0].ID != "retryable" {
+		t.Fatalf("retried %d images, want only retryable", len(images))
+	}
+	if images[0].Status != domain.StatusPending || images[0].RetryCount != 1 || images[0].FailureReason != "" {
+		t.Errorf("retried image: status %s, retry count %d, reason %q", images[0].Status, images[0].RetryCount, images[0].FailureReason)
+	}
+	if len(messages) != 1 || messages[0].Task.ImageID != "retryable" {
+		t.Errorf("queued %v, want the task of retryable", messages)
+	}
+	// Pending now, so not retried again until it fails
+	if images, _ := retry(); len(images) != 0 {
+		t.Errorf("retried %d pending images", len(images))
+	}
+
+	// Each retry counts, up to MaxRetries
+	for want := 2; want <= 3; want++ {
+		img, _ := r.GetByID(ctx, "retryable")
+		img.Status = domain.StatusFailed
+		if err := r.Update(ctx, img); err != nil {
+			t.Fatal(err)
+		}
+		images, _ = retry()
+		if want > filter.MaxRetries {
+			if len(images) != 0 {
+				t.Errorf("retried past MaxRetries %d", filter.MaxRetries)
+			}
+			break
+		}
+		if len(images) != 1 || images[0].RetryCount != want {
+			t.Fatalf("retry %d: %d images", want, len(images))
+		}
+	}
+	stored, _ := r.GetByID(ctx, "retryable")
+	if stored.Status != domain.StatusFailed || stored.RetryCount != 2 {
+		t.Errorf("after the cap: status %s, retry count %d, want failed and 2", stored.Status, stored.RetryCount)
+	}
+}
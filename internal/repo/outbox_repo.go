@@ -0,0 +1,120 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+// OutboxRepository tracks the processing tasks queued with their images by
+// ImageRepository.CreateWithTasks or UpdateWithTasks until they're published
+type OutboxRepository interface {
+	MarkSent(ctx context.Context, ids ...int64) error
+	RelayUnsent(ctx context.Context, createdBefore time.Time, limit int, publish func(msg *domain.OutboxMessage) error) (int, error)
+	PruneSent(ctx context.Context, olderThan time.Duration) (int64, error)
+}
+
+type outboxRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewOutboxRepository(db *pgxpool.Pool) OutboxRepository {
+	return &outboxRepo{db: db}
+}
+
+// insertOutbox queues tasks within tx, the transaction creating or updating
+// their image
+func insertOutbox(ctx context.Context, tx pgx.Tx, tasks []*domain.ProcessingTask, now time.Time) ([]*domain.OutboxMessage, error) {
+	query := `
+		INSERT INTO task_outbox (image_id, task, priority, created_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`
+	messages := make([]*domain.OutboxMessage, 0, len(tasks))
+	for _, task := range tasks {
+		msg := &domain.OutboxMessage{Task: task, CreatedAt: now}
+		if err := tx.QueryRow(ctx, query, task.ImageID, task, task.Priority, now).Scan(&msg.ID); err != nil {
+			return nil, fmt.Errorf("failed to queue task: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// MarkSent records that the tasks have been published
+func (r *outboxRepo) MarkSent(ctx context.Context, ids ...int64) error {
+	query := `UPDATE task_outbox SET sent_at = $1 WHERE id = ANY($2)`
+	if _, err := r.db.Exec(ctx, query, time.Now(), ids); err != nil {
+		return fmt.Errorf("failed to mark tasks sent: %w", err)
+	}
+	return nil
+}
+
+// RelayUnsent calls publish for up to limit unsent tasks created before
+// createdBefore, oldest first, and marks them sent. It stops at the first
+// publish error, returning it with the number sent so far. Rows are locked
+// while being published, and those locked already are skipped, so that
+// several instances can relay at once without sending a task twice.
+func (r *outboxRepo) RelayUnsent(ctx context.Context, createdBefore time.Time, limit int, publish func(msg *domain.OutboxMessage) error) (int, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		SELECT id, task, priority, created_at
+		FROM task_outbox
+		WHERE sent_at IS NULL AND created_at < $1
+		ORDER BY created_at, id
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	`
+	rows, err := tx.Query(ctx, query, createdBefore, limit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list unsent tasks: %w", err)
+	}
+	var messages []*domain.OutboxMessage
+	for rows.Next() {
+		msg := &domain.OutboxMessage{Task: &domain.ProcessingTask{}}
+		if err := rows.Scan(&msg.ID, msg.Task, &msg.Task.Priority, &msg.CreatedAt); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan unsent task: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to list unsent tasks: %w", err)
+	}
+
+	sent := 0
+	var publishErr error
+	for _, msg := range messages {
+		if publishErr = publish(msg); publishErr != nil {
+			break
+		}
+		if _, err := tx.Exec(ctx, `UPDATE task_outbox SET sent_at = $1 WHERE id = $2`, time.Now(), msg.ID); err != nil {
+			return 0, fmt.Errorf("failed to mark task sent: %w", err)
+		}
+		sent++
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return sent, publishErr
+}
+
+// PruneSent deletes tasks published more than olderThan ago
+func (r *outboxRepo) PruneSent(ctx context.Context, olderThan time.Duration) (int64, error) {
+	query := `DELETE FROM task_outbox WHERE sent_at < $1`
+	tag, err := r.db.Exec(ctx, query, time.Now().Add(-olderThan))
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune sent tasks: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,62 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+func TestRelayUnsent(t *testing.T) {
+	db := testDB(t)
+	images, outbox := NewImageRepository(db), NewOutboxRepository(db)
+	ctx := context.Background()
+	for _, id := range []string{"a", "b", "c"} {
+		now := time.Now().UTC().Truncate(time.Microsecond)
+		img := &domain.Image{ID: id, OriginalPath: "original/" + id + ".jpg", Status: domain.StatusPending,
+			Format: domain.FormatJPEG, CreatedAt: now, UpdatedAt: now}
+		task := &domain.ProcessingTask{ImageID: id, ImagePath: img.OriginalPath, Format: img.Format}
+		if _, err := images.CreateWithTasks(ctx, img, []*domain.ProcessingTask{task}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Tasks younger than createdBefore are left to their upload
+	if sent, err := outbox.RelayUnsent(ctx, time.Now().Add(-time.Hour), 10, func(*domain.OutboxMessage) error { return nil }); err != nil || sent != 0 {
+		t.Fatalf("RelayUnsent of older tasks = %d, %v, want none", sent, err)
+	}
+
+	// A publish failure stops the relay, keeping what was sent before it
+	errKafka := errors.New("kafka unavailable")
+	var published []string
+	sent, err := outbox.RelayUnsent(ctx, time.Now().Add(time.Minute), 10, func(msg *domain.OutboxMessage) error {
+		if msg.Task.ImageID == "b" {
+			return errKafka
+		}
+		published = append(published, msg.Task.ImageID)
+		return nil
+	})
+	if !errors.Is(err, errKafka) || sent != 1 {
+		t.Fatalf("RelayUnsent = %d, %v, want 1 and the publish error", sent, err)
+	}
+
+	// The next relay picks up where it stopped
+	published = nil
+	sent, err = outbox.RelayUnsent(ctx, time.Now().Add(time.Minute), 10, func(msg *domain.OutboxMessage) error {
+		published = append(published, msg.Task.ImageID)
+		return nil
+	})
+	if err != nil || sent != 2 || len(published) != 2 || published[0] != "b" || published[1] != "c" {
+		t.Fatalf("second RelayUnsent = %d %v, %v, want b and c", sent, published, err)
+	}
+
+	// Sent tasks aren't relayed again
+	if sent, _ := outbox.RelayUnsent(ctx, time.Now().Add(time.Minute), 10, func(*domain.OutboxMessage) error { return nil }); sent != 0 {
+		t.Errorf("third RelayUnsent sent %d tasks, want none", sent)
+	}
+	if pruned, err := outbox.PruneSent(ctx, 0); err != nil || pruned != 3 {
+		t.Errorf("PruneSent = %d, %v, want 3", pruned, err)
+	}
+}
@@ -0,0 +1,157 @@
+package repo
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"strings"
+	"sync"
+)
+
+// cachedStorage keeps the most recently read files in memory, up to capacity
+// bytes, in front of another storage. Files larger than an eighth of the
+// capacity are streamed without being cached, so that one-off reads of large
+// originals don't flush the images being served. Writes and deletes through
+// the cache invalidate the paths they touch.
+type cachedStorage struct {
+	inner    StorageRepository
+	capacity int64
+	maxEntry int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+	// epoch advances on every invalidation, so that a read racing a write
+	// doesn't cache what it read before the write
+	epoch uint64
+}
+
+type cacheEntry struct {
+	path string
+	data []byte
+}
+
+// NewCachedStorage returns inner behind an LRU cache of capacity bytes, or
+// inner itself when capacity is zero
+func NewCachedStorage(inner StorageRepository, capacity int64) StorageRepository {
+	if capacity <= 0 {
+		return inner
+	}
+	return &cachedStorage{
+		inner:    inner,
+		capacity: capacity,
+		maxEntry: max(capacity/8, 1),
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *cachedStorage) Save(ctx context.Context, path string, data io.Reader) error {
+	c.evict(path)
+	err := c.inner.Save(ctx, path, data)
+	c.evict(path)
+	return err
+}
+
+func (c *cachedStorage) Read(ctx context.Context, path string) (io.ReadCloser, error) {
+	c.mu.Lock()
+	if elem, ok := c.entries[path]; ok {
+		c.order.MoveToFront(elem)
+		data := elem.Value.(*cacheEntry).data
+		c.mu.Unlock()
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	epoch := c.epoch
+	c.mu.Unlock()
+
+	rc, err := c.inner.Read(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(rc, c.maxEntry+1))
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	if int64(len(data)) > c.maxEntry {
+		// Too large to cache; hand back what was read followed by the rest
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), rc), rc}, nil
+	}
+	rc.Close()
+
+	c.add(path, data, epoch)
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (c *cachedStorage) Delete(ctx context.Context, path string) error {
+	err := c.inner.Delete(ctx, path)
+	c.evict(path)
+	return err
+}
+
+func (c *cachedStorage) DeleteAll(ctx context.Context, path string) error {
+	err := c.inner.DeleteAll(ctx, path)
+
+	dir := strings.TrimSuffix(path, "/") + "/"
+	c.mu.Lock()
+	for p, elem := range c.entries {
+		if p == path || strings.HasPrefix(p, dir) {
+			c.remove(elem)
+		}
+	}
+	c.epoch++
+	c.mu.Unlock()
+	return err
+}
+
+// Exists asks the storage even for cached files, since verification relies
+// on it to find files that went missing behind the cache's back
+func (c *cachedStorage) Exists(ctx context.Context, path string) (bool, error) {
+	return c.inner.Exists(ctx, path)
+}
+
+func (c *cachedStorage) Size(ctx context.Context, path string) (int64, error) {
+	return c.inner.Size(ctx, path)
+}
+
+// add caches data for path unless the cache was invalidated since epoch,
+// evicting the least recently used files to make room
+func (c *cachedStorage) add(path string, data []byte, epoch uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.epoch != epoch {
+		return
+	}
+	if elem, ok := c.entries[path]; ok {
+		c.remove(elem)
+	}
+	c.entries[path] = c.order.PushFront(&cacheEntry{path: path, data: data})
+	c.size += int64(len(data))
+	for c.size > c.capacity {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *cachedStorage) evict(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[path]; ok {
+		c.remove(elem)
+	}
+	c.epoch++
+}
+
+// remove drops elem from the cache; c.mu must be held
+func (c *cachedStorage) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	c.order.Remove(elem)
+	delete(c.entries, entry.path)
+	c.size -= int64(len(entry.data))
+}
@@ -0,0 +1,189 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// countingStorage is an in-memory storage counting reads that reach it
+type countingStorage struct {
+	StorageRepository
+	files map[string][]byte
+	reads map[string]int
+}
+
+func newCountingStorage(files map[string]string) *countingStorage {
+	s := &countingStorage{files: make(map[string][]byte), reads: make(map[string]int)}
+	for path, data := range files {
+		s.files[path] = []byte(data)
+	}
+	return s
+}
+
+func (s *countingStorage) Save(ctx context.Context, path string, data io.Reader) error {
+	b, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	s.files[path] = b
+	return nil
+}
+
+func (s *countingStorage) Read(ctx context.Context, path string) (io.ReadCloser, error) {
+	s.reads[path]++
+	data, ok := s.files[path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *countingStorage) Delete(ctx context.Context, path string) error {
+	delete(s.files, path)
+	return nil
+}
+
+func (s *countingStorage) DeleteAll(ctx context.Context, path string) error {
+	for p := range s.files {
+		if p == path || strings.HasPrefix(p, path+"/") {
+			delete(s.files, p)
+		}
+	}
+	return nil
+}
+
+func readString(t *testing.T, s StorageRepository, path string) string {
+	t.Helper()
+	rc, err := s.Read(context.Background(), path)
+	if err != nil {
+		t.Fatalf("Read(%s): %v", path, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCachedStorageRead(t *testing.T) {
+	inner := newCountingStorage(map[string]string{"processed/a.jpg": "image a"})
+	cache := NewCachedStorage(inner, 1024)
+
+	for range 3 {
+		if got := readString(t, cache, "processed/a.jpg"); got != "image a" {
+			t.Fatalf("Read = %q, want %q", got, "image a")
+		}
+	}
+	if inner.reads["processed/a.jpg"] != 1 {
+		t.Errorf("storage read %d times, want the later reads served from cache", inner.reads["processed/a.jpg"])
+	}
+
+	// Missing files aren't cached
+	for range 2 {
+		if _, err := cache.Read(context.Background(), "processed/missing.jpg"); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("Read of a missing file = %v, want os.ErrNotExist", err)
+		}
+	}
+	if inner.reads["processed/missing.jpg"] != 2 {
+		t.Errorf("missing file read %d times, want 2", inner.reads["processed/missing.jpg"])
+	}
+}
+
+func TestCachedStorageInvalidation(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name       string
+		invalidate func(StorageRepository) error
+		want       string // read back afterwards, empty when deleted
+	}{
+		{
+			name:       "delete",
+			invalidate: func(s StorageRepository) error { return s.Delete(ctx, "a/b.jpg") },
+		},
+		{
+			name:       "delete all",
+			invalidate: func(s StorageRepository) error { return s.DeleteAll(ctx, "a") },
+		},
+		{
+			name:       "save",
+			invalidate: func(s StorageRepository) error { return s.Save(ctx, "a/b.jpg", strings.NewReader("new")) },
+			want:       "new",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := newCountingStorage(map[string]string{"a/b.jpg": "old", "ab.jpg": "other"})
+			cache := NewCachedStorage(inner, 1024)
+			readString(t, cache, "a/b.jpg")
+			readString(t, cache, "ab.jpg")
+
+			if err := tt.invalidate(cache); err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				if _, err := cache.Read(ctx, "a/b.jpg"); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("Read after %s = %v, want os.ErrNotExist", tt.name, err)
+				}
+			} else if got := readString(t, cache, "a/b.jpg"); got != tt.want {
+				t.Errorf("Read after %s = %q, want %q", tt.name, got, tt.want)
+			}
+			if inner.reads["a/b.jpg"] != 2 {
+				t.Errorf("storage read %d times, want the cached copy evicted", inner.reads["a/b.jpg"])
+			}
+
+			// A sibling sharing the prefix stays cached
+			readString(t, cache, "ab.jpg")
+			if inner.reads["ab.jpg"] != 1 {
+				t.Errorf("ab.jpg read %d times, want it still cached", inner.reads["ab.jpg"])
+			}
+		})
+	}
+}
+
+func TestCachedStorageCapacity(t *testing.T) {
+	inner := newCountingStorage(map[string]string{
+		"a":     strings.Repeat("a", 40),
+		"b":     strings.Repeat("b", 40),
+		"c":     strings.Repeat("c", 40),
+		"large": strings.Repeat("l", 100),
+	})
+	// Raise the capacity/8 entry limit so that two files fit
+	cache := NewCachedStorage(inner, 100).(*cachedStorage)
+	cache.maxEntry = 50
+
+	readString(t, cache, "a")
+	readString(t, cache, "b")
+	readString(t, cache, "a") // b is now the least recently used
+	readString(t, cache, "c") // evicts b
+	readString(t, cache, "a")
+	readString(t, cache, "b")
+	if inner.reads["a"] != 1 || inner.reads["b"] != 2 {
+		t.Errorf("reads a=%d b=%d, want a kept and b evicted", inner.reads["a"], inner.reads["b"])
+	}
+	if cache.size > cache.capacity {
+		t.Errorf("cache holds %d bytes, over its capacity %d", cache.size, cache.capacity)
+	}
+
+	// Files over the entry limit are streamed whole but not cached
+	for range 2 {
+		if got := readString(t, cache, "large"); got != strings.Repeat("l", 100) {
+			t.Fatalf("Read of a large file = %d bytes, want 100", len(got))
+		}
+	}
+	if inner.reads["large"] != 2 {
+		t.Errorf("large file read %d times, want it never cached", inner.reads["large"])
+	}
+}
+
+func TestNewCachedStorageDisabled(t *testing.T) {
+	inner := newCountingStorage(nil)
+	if got := NewCachedStorage(inner, 0); got != StorageRepository(inner) {
+		t.Errorf("NewCachedStorage with no capacity = %T, want the inner storage", got)
+	}
+}
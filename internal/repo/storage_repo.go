@@ -12,7 +12,12 @@ type StorageRepository interface {
 	Save(ctx context.Context, path string, data io.Reader) error
 	Read(ctx context.Context, path string) (io.ReadCloser, error)
 	Delete(ctx context.Context, path string) error
+	// DeleteAll removes a directory and everything under it
+	DeleteAll(ctx context.Context, path string) error
 	Exists(ctx context.Context, path string) (bool, error)
+	// Size returns the file size in bytes, or -1 when the backend can't
+	// report it cheaply
+	Size(ctx context.Context, path string) (int64, error)
 }
 
 type storageRepo struct {
@@ -66,6 +71,14 @@ func (r *storageRepo) Delete(ctx context.Context, path string) error {
 	return nil
 }
 
+func (r *storageRepo) DeleteAll(ctx context.Context, path string) error {
+	fullPath := filepath.Join(r.basePath, path)
+	if err := os.RemoveAll(fullPath); err != nil {
+		return fmt.Errorf("failed to delete directory: %w", err)
+	}
+	return nil
+}
+
 func (r *storageRepo) Exists(ctx context.Context, path string) (bool, error) {
 	fullPath := filepath.Join(r.basePath, path)
 	_, err := os.Stat(fullPath)
@@ -77,3 +90,15 @@ func (r *storageRepo) Exists(ctx context.Context, path string) (bool, error) {
 	}
 	return true, nil
 }
+
+func (r *storageRepo) Size(ctx context.Context, path string) (int64, error) {
+	fullPath := filepath.Join(r.basePath, path)
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, fmt.Errorf("file not found: %w", err)
+		}
+		return 0, fmt.Errorf("failed to stat file: %w", err)
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+// animatedGIF is a GIF with several frames. Each frame is composited onto
+// the full canvas as it's displayed, disposal included, so that frames can
+// be cropped, rotated and resized independently like still images. It acts
+// as its first frame wherever a still image is expected.
+type animatedGIF struct {
+	image.Image // first frame
+	frames      []image.Image
+	delays      []int // in 100ths of a second
+	palettes    []color.Palette
+	loopCount   int
+}
+
+// decodeGIF decodes every frame of a GIF, returning an *animatedGIF when
+// there are several and the only frame otherwise
+func decodeGIF(r io.Reader) (image.Image, error) {
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) == 1 {
+		return g.Image[0], nil
+	}
+
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	for _, frame := range g.Image {
+		bounds = bounds.Union(frame.Bounds())
+	}
+	canvas := image.NewRGBA(bounds)
+	anim := &animatedGIF{
+		frames:    make([]image.Image, len(g.Image)),
+		delays:    g.Delay,
+		palettes:  make([]color.Palette, len(g.Image)),
+		loopCount: g.LoopCount,
+	}
+	for i, frame := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		anim.frames[i] = cloneRGBA(canvas)
+		anim.palettes[i] = frame.Palette
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	anim.Image = anim.frames[0]
+	return anim, nil
+}
+
+// eachFrame applies fn to img, or to every frame of an animated GIF
+func eachFrame(img image.Image, fn func(image.Image) image.Image) image.Image {
+	anim, ok := img.(*animatedGIF)
+	if !ok {
+		return fn(img)
+	}
+	frames := make([]image.Image, len(anim.frames))
+	for i, frame := range anim.frames {
+		frames[i] = fn(frame)
+	}
+	return &animatedGIF{
+		Image:     frames[0],
+		frames:    frames,
+		delays:    anim.delays,
+		palettes:  anim.palettes,
+		loopCount: anim.loopCount,
+	}
+}
+
+// stillFrame returns img, or the first frame of an animated GIF
+func stillFrame(img image.Image) image.Image {
+	if anim, ok := img.(*animatedGIF); ok {
+		return anim.frames[0]
+	}
+	return img
+}
+
+// encodeAnimatedGIF writes every frame of anim in its original palette.
+// Frames cover the whole canvas, so each replaces the previous one.
+func encodeAnimatedGIF(w io.Writer, anim *animatedGIF) error {
+	g := &gif.GIF{
+		Image:     make([]*image.Paletted, len(anim.frames)),
+		Delay:     make([]int, len(anim.frames)),
+		Disposal:  make([]byte, len(anim.frames)),
+		LoopCount: anim.loopCount,
+	}
+	for i, frame := range anim.frames {
+		b := frame.Bounds()
+		paletted := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), anim.palettes[i])
+		draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), frame, b.Min)
+		g.Image[i] = paletted
+		if i < len(anim.delays) {
+			g.Delay[i] = anim.delays[i]
+		}
+		g.Disposal[i] = gif.DisposalBackground
+	}
+	if err := gif.EncodeAll(w, g); err != nil {
+		return fmt.Errorf("failed to encode animated GIF: %w", err)
+	}
+	return nil
+}
+
+func cloneRGBA(src *image.RGBA) *image.RGBA {
+	dst := image.NewRGBA(src.Bounds())
+	copy(dst.Pix, src.Pix)
+	return dst
+}
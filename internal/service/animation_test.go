@@ -0,0 +1,144 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	"slices"
+	"testing"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+var gifPalette = color.Palette{
+	color.RGBA{A: 0},
+	color.RGBA{R: 255, A: 255},
+	color.RGBA{G: 255, A: 255},
+	color.RGBA{B: 255, A: 255},
+}
+
+// filledFrame is a frame covering r in the palette color at index
+func filledFrame(r image.Rectangle, index uint8) *image.Paletted {
+	frame := image.NewPaletted(r, gifPalette)
+	for i := range frame.Pix {
+		frame.Pix[i] = index
+	}
+	return frame
+}
+
+func encodeGIF(t *testing.T, g *gif.GIF) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcessAnimatedGIF(t *testing.T) {
+	bounds := image.Rect(0, 0, 900, 600)
+	tests := []struct {
+		name   string
+		frames int
+	}{
+		{name: "animated", frames: 3},
+		{name: "single frame", frames: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &gif.GIF{LoopCount: 2}
+			for i := range tt.frames {
+				src.Image = append(src.Image, filledFrame(bounds, uint8(i+1)))
+				src.Delay = append(src.Delay, 10*(i+1))
+			}
+
+			cfg := testConfig(t)
+			images, storage := newFakeImages(), newMemStorage()
+			task := seedOriginal(t, images, storage, "anim", encodeGIF(t, src), domain.FormatGIF)
+			if err := newTestProcessor(cfg, images, storage).ProcessImage(context.Background(), task); err != nil {
+				t.Fatal(err)
+			}
+			img, _ := images.GetByID(context.Background(), "anim")
+
+			for _, derivative := range []struct {
+				path  string
+				width int
+			}{
+				{img.ProcessedPath, cfg.Image.ProcessedWidth},
+				{img.ThumbnailPath, cfg.Image.ThumbnailWidth},
+			} {
+				got, err := gif.DecodeAll(bytes.NewReader(storage.files[derivative.path]))
+				if err != nil {
+					t.Fatalf("%s: %v", derivative.path, err)
+				}
+				if len(got.Image) != tt.frames {
+					t.Fatalf("%s has %d frames, want %d", derivative.path, len(got.Image), tt.frames)
+				}
+				if tt.frames > 1 && (!slices.Equal(got.Delay, src.Delay) || got.LoopCount != src.LoopCount) {
+					t.Errorf("%s: delays %v, loop count %d, want %v, %d", derivative.path, got.Delay, got.LoopCount, src.Delay, src.LoopCount)
+				}
+				// Every frame is resized, keeping its own content
+				for i, frame := range got.Image {
+					if frame.Bounds().Dx() != derivative.width {
+						t.Errorf("%s frame %d is %d wide, want %d", derivative.path, i, frame.Bounds().Dx(), derivative.width)
+					}
+					c := frame.At(frame.Bounds().Dx()/2, frame.Bounds().Dy()/2)
+					if c != gifPalette[i+1] {
+						t.Errorf("%s frame %d center = %v, want %v", derivative.path, i, c, gifPalette[i+1])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeGIFDisposal(t *testing.T) {
+	// A red canvas, a green square in the corner disposed of as configured,
+	// then a blue pixel in the opposite corner
+	bounds := image.Rect(0, 0, 4, 4)
+	tests := []struct {
+		name     string
+		disposal byte
+		want     color.Color // in the corner on the last frame
+	}{
+		{name: "none", disposal: gif.DisposalNone, want: gifPalette[2]},
+		{name: "background", disposal: gif.DisposalBackground, want: gifPalette[0]},
+		{name: "previous", disposal: gif.DisposalPrevious, want: gifPalette[1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := encodeGIF(t, &gif.GIF{
+				Image: []*image.Paletted{
+					filledFrame(bounds, 1),
+					filledFrame(image.Rect(0, 0, 2, 2), 2),
+					filledFrame(image.Rect(3, 3, 4, 4), 3),
+				},
+				Delay:    []int{0, 0, 0},
+				Disposal: []byte{gif.DisposalNone, tt.disposal, gif.DisposalNone},
+				Config:   image.Config{Width: 4, Height: 4},
+			})
+			img, err := decodeGIF(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			anim, ok := img.(*animatedGIF)
+			if !ok || len(anim.frames) != 3 {
+				t.Fatalf("decodeGIF = %T, want an animatedGIF of 3 frames", img)
+			}
+
+			last := anim.frames[2]
+			if got := color.RGBAModel.Convert(last.At(0, 0)); got != color.RGBAModel.Convert(tt.want) {
+				t.Errorf("corner = %v, want %v", got, tt.want)
+			}
+			if got := color.RGBAModel.Convert(last.At(3, 3)); got != gifPalette[3] {
+				t.Errorf("last frame's own pixel = %v, want %v", got, gifPalette[3])
+			}
+			// Frames are whole canvases, so the first one stands in as a still
+			if stillFrame(img).Bounds() != bounds || color.RGBAModel.Convert(stillFrame(img).At(0, 0)) != gifPalette[1] {
+				t.Errorf("still frame = %v at %v, want the red canvas", stillFrame(img).At(0, 0), stillFrame(img).Bounds())
+			}
+		})
+	}
+}
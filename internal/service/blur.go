@@ -0,0 +1,94 @@
+package service
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// sharpenSigma is the blur radius of the unsharp mask; a small one suits
+// the fine detail lost when downscaling
+const sharpenSigma = 1.0
+
+// gaussianBlur blurs img with a Gaussian of the given standard deviation in
+// pixels, as two passes of a 1D kernel. Edges are extended by clamping.
+func gaussianBlur(img image.Image, sigma float64) *image.NRGBA {
+	bounds := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	if sigma <= 0 {
+		return src
+	}
+
+	kernel := gaussianKernel(sigma)
+	tmp := image.NewNRGBA(src.Bounds())
+	convolve(tmp, src, kernel, 4, src.Stride)
+	dst := image.NewNRGBA(src.Bounds())
+	convolve(dst, tmp, kernel, src.Stride, 4)
+	return dst
+}
+
+// gaussianKernel returns normalized weights covering three sigmas each side
+func gaussianKernel(sigma float64) []float64 {
+	radius := int(math.Ceil(3 * sigma))
+	kernel := make([]float64, 2*radius+1)
+	var sum float64
+	for i := range kernel {
+		x := float64(i - radius)
+		kernel[i] = math.Exp(-x * x / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+	return kernel
+}
+
+// convolve applies kernel to src along one axis into dst. step is the byte
+// distance between neighbours along that axis and lineStep between lines.
+func convolve(dst, src *image.NRGBA, kernel []float64, step, lineStep int) {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	length, lines := w, h
+	if step != 4 {
+		length, lines = h, w
+	}
+	radius := len(kernel) / 2
+
+	for line := 0; line < lines; line++ {
+		base := line * lineStep
+		for i := 0; i < length; i++ {
+			var acc [4]float64
+			for k, weight := range kernel {
+				j := min(max(i+k-radius, 0), length-1)
+				p := src.Pix[base+j*step:]
+				for c := range acc {
+					acc[c] += float64(p[c]) * weight
+				}
+			}
+			p := dst.Pix[base+i*step:]
+			for c := range acc {
+				p[c] = uint8(min(max(acc[c]+0.5, 0), 255))
+			}
+		}
+	}
+}
+
+// sharpen applies an unsharp mask: each channel moves away from its blurred
+// value by amount times the difference, which strengthens edges. Alpha is kept.
+func sharpen(img image.Image, amount, sigma float64) image.Image {
+	if amount <= 0 {
+		return img
+	}
+	blurred := gaussianBlur(img, sigma)
+	bounds := img.Bounds()
+	dst := image.NewNRGBA(blurred.Bounds())
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			v := float64(dst.Pix[i+c])
+			out := v + amount*(v-float64(blurred.Pix[i+c]))
+			dst.Pix[i+c] = uint8(min(max(out+0.5, 0), 255))
+		}
+	}
+	return dst
+}
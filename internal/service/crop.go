@@ -0,0 +1,31 @@
+package service
+
+import (
+	"image"
+	"image/draw"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+// cropImage returns the crop region of img, clamped to its bounds. With no
+// crop, or a region entirely outside the image, img is returned as is.
+func cropImage(img image.Image, crop *domain.CropRect) image.Image {
+	if crop == nil {
+		return img
+	}
+
+	bounds := img.Bounds()
+	rect := image.Rect(crop.X, crop.Y, crop.X+crop.W, crop.Y+crop.H).Add(bounds.Min).Intersect(bounds)
+	if rect.Empty() {
+		return img
+	}
+
+	if sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, rect.Min, draw.Src)
+	return dst
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"image"
+	"testing"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+func TestCropImage(t *testing.T) {
+	src := testImage(100, 80)
+
+	tests := []struct {
+		name     string
+		crop     *domain.CropRect
+		wantRect image.Rectangle // in source coordinates
+	}{
+		{name: "no crop", crop: nil, wantRect: image.Rect(0, 0, 100, 80)},
+		{name: "inside", crop: &domain.CropRect{X: 10, Y: 20, W: 30, H: 40}, wantRect: image.Rect(10, 20, 40, 60)},
+		{name: "whole image", crop: &domain.CropRect{X: 0, Y: 0, W: 100, H: 80}, wantRect: image.Rect(0, 0, 100, 80)},
+		{name: "clamped right and bottom", crop: &domain.CropRect{X: 90, Y: 70, W: 50, H: 50}, wantRect: image.Rect(90, 70, 100, 80)},
+		{name: "larger than the image", crop: &domain.CropRect{X: 0, Y: 0, W: 500, H: 500}, wantRect: image.Rect(0, 0, 100, 80)},
+		{name: "entirely outside", crop: &domain.CropRect{X: 200, Y: 200, W: 10, H: 10}, wantRect: image.Rect(0, 0, 100, 80)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cropImage(src, tt.crop)
+			if size := got.Bounds().Size(); size != tt.wantRect.Size() {
+				t.Fatalf("size = %v, want %v", size, tt.wantRect.Size())
+			}
+			// The cropped image starts at the region's top-left pixel
+			b := got.Bounds()
+			if !sameColor(got.At(b.Min.X, b.Min.Y), src.At(tt.wantRect.Min.X, tt.wantRect.Min.Y)) {
+				t.Errorf("top-left pixel isn't the source pixel at %v", tt.wantRect.Min)
+			}
+			if !sameColor(got.At(b.Max.X-1, b.Max.Y-1), src.At(tt.wantRect.Max.X-1, tt.wantRect.Max.Y-1)) {
+				t.Errorf("bottom-right pixel isn't the source pixel at %v", tt.wantRect.Max.Sub(image.Pt(1, 1)))
+			}
+		})
+	}
+}
+
+func TestCropImageOffsetBounds(t *testing.T) {
+	// The crop region is relative to the image, whatever its bounds' origin
+	src := testImage(100, 80).SubImage(image.Rect(20, 10, 100, 80))
+	got := cropImage(src, &domain.CropRect{X: 5, Y: 5, W: 10, H: 10})
+	if got.Bounds() != image.Rect(25, 15, 35, 25) {
+		t.Errorf("bounds = %v, want %v", got.Bounds(), image.Rect(25, 15, 35, 25))
+	}
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+// jpegEOI is the end-of-image marker truncated JPEGs are missing
+var jpegEOI = []byte{0xFF, 0xD9}
+
+// decodeLenient retries an image that failed strict decoding. It recovers
+// truncated JPEGs by padding the missing entropy-coded data, which leaves the
+// lost part of the image grey, and images whose content doesn't match the
+// expected format by sniffing it.
+func decodeLenient(data []byte, format domain.ImageFormat) (image.Image, string, error) {
+	if format == domain.FormatJPEG && !bytes.HasSuffix(data, jpegEOI) {
+		if img, err := decodeTruncatedJPEG(data); err == nil {
+			return img, "truncated jpeg padded", nil
+		}
+	}
+
+	img, name, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("lenient decode failed: %w", err)
+	}
+	return img, "decoded as " + name, nil
+}
+
+// decodeTruncatedJPEG pads data with zeros, which decode as valid if
+// meaningless coefficients, followed by an end-of-image marker. Zero bits can
+// take several bytes per block to decode, so the padding is a generous byte
+// per pixel of the dimensions in the header.
+func decodeTruncatedJPEG(data []byte) (image.Image, error) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	padding := cfg.Width*cfg.Height + 1024
+	padded := make([]byte, len(data), len(data)+padding+len(jpegEOI))
+	copy(padded, data)
+	padded = append(padded, make([]byte, padding)...)
+	padded = append(padded, jpegEOI...)
+
+	return jpeg.Decode(bytes.NewReader(padded))
+}
@@ -0,0 +1,39 @@
+package service
+
+import (
+	"context"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// DecodeLimiter bounds how many images are decoded at once. A decoded image
+// holds its full pixel buffer in memory, so a burst of large uploads and
+// processing tasks decoding together could otherwise exhaust it. One limiter
+// is shared by every service of the process.
+type DecodeLimiter struct {
+	sem *semaphore.Weighted
+}
+
+// NewDecodeLimiter returns a limiter allowing n concurrent decodes, or nil,
+// which doesn't limit, when n is zero
+func NewDecodeLimiter(n int) *DecodeLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return &DecodeLimiter{sem: semaphore.NewWeighted(int64(n))}
+}
+
+// acquire waits for a decode slot until ctx is done. Every successful
+// acquire must be followed by a release.
+func (l *DecodeLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	return l.sem.Acquire(ctx, 1)
+}
+
+func (l *DecodeLimiter) release() {
+	if l != nil {
+		l.sem.Release(1)
+	}
+}
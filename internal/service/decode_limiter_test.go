@@ -0,0 +1,93 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDecodeLimiter(t *testing.T) {
+	ctx := context.Background()
+	l := NewDecodeLimiter(2)
+	for range 2 {
+		if err := l.acquire(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A third decode waits for a slot
+	acquired := make(chan error, 1)
+	go func() { acquired <- l.acquire(ctx) }()
+	select {
+	case <-acquired:
+		t.Fatal("third decode started with both slots taken")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// and starts as soon as one frees
+	l.release()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("third decode still waiting after a slot freed")
+	}
+
+	// A waiting decode gives up with its context
+	waitCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(waitCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("acquire with every slot taken = %v, want DeadlineExceeded", err)
+	}
+	l.release()
+	l.release()
+}
+
+func TestDecodeLimiterDisabled(t *testing.T) {
+	l := NewDecodeLimiter(0)
+	if l != nil {
+		t.Fatal("NewDecodeLimiter(0) limits decodes")
+	}
+	// A nil limiter lets any number through
+	for range 100 {
+		if err := l.acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.release()
+}
+
+func TestUploadWaitsForDecodeSlot(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestImageService(testConfig(t))
+	ts.decodes = NewDecodeLimiter(1)
+	data := encodePNG(t, testImage(100, 100))
+
+	// Processing elsewhere holds the only slot
+	if err := ts.decodes.acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	uploaded := make(chan error, 1)
+	go func() {
+		_, err := ts.upload(ctx, "a.png", data, UploadOptions{})
+		uploaded <- err
+	}()
+	select {
+	case err := <-uploaded:
+		t.Fatalf("upload decoded while the slot was taken: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ts.decodes.release()
+	select {
+	case err := <-uploaded:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload still waiting after the slot freed")
+	}
+}
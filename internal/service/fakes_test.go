@@ -0,0 +1,450 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime/multipart"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oziev02/ImageProcessor/internal/config"
+	"github.com/oziev02/ImageProcessor/internal/domain"
+	"github.com/oziev02/ImageProcessor/internal/observability"
+	"github.com/oziev02/ImageProcessor/internal/repo"
+	kafkatransport "github.com/oziev02/ImageProcessor/internal/transport/kafka"
+)
+
+// memStorage is an in-memory StorageRepository that counts reads per path
+type memStorage struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	reads map[string]int
+	// deleteErrs fails deleting these paths, leaving the files in place
+	deleteErrs map[string]error
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{files: make(map[string][]byte), reads: make(map[string]int)}
+}
+
+func (m *memStorage) Save(ctx context.Context, path string, data io.Reader) error {
+	b, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[path] = b
+	return nil
+}
+
+func (m *memStorage) Read(ctx context.Context, path string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reads[path]++
+	b, ok := m.files[path]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (m *memStorage) Delete(ctx context.Context, path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.deleteErrs[path]; err != nil {
+		return err
+	}
+	delete(m.files, path)
+	return nil
+}
+
+func (m *memStorage) DeleteAll(ctx context.Context, path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for p := range m.files {
+		if p == path || strings.HasPrefix(p, path+"/") {
+			delete(m.files, p)
+		}
+	}
+	return nil
+}
+
+func (m *memStorage) Exists(ctx context.Context, path string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.files[path]
+	return ok, nil
+}
+
+func (m *memStorage) Size(ctx context.Context, path string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.files[path]
+	if !ok {
+		return 0, fs.ErrNotExist
+	}
+	return int64(len(b)), nil
+}
+
+// paths returns the stored paths, sorted
+func (m *memStorage) paths() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	paths := make([]string, 0, len(m.files))
+	for path := range m.files {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+func (m *memStorage) readCount(path string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reads[path]
+}
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// fakeImages is an in-memory ImageRepository covering what uploads use
+type fakeImages struct {
+	repo.ImageRepository
+	mu        sync.Mutex
+	images    map[string]*domain.Image
+	tasks     []*domain.ProcessingTask
+	createErr error
+	updateErr error
+}
+
+func newFakeImages() *fakeImages {
+	return &fakeImages{images: make(map[string]*domain.Image)}
+}
+
+func (f *fakeImages) CreateWithTasks(ctx context.Context, img *domain.Image, tasks []*domain.ProcessingTask) ([]*domain.OutboxMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.createErr != nil {
+		return nil, f.createErr
+	}
+	if img.IdempotencyKey != "" {
+		for _, existing := range f.images {
+			if existing.IdempotencyKey == img.IdempotencyKey {
+				return nil, domain.ErrIdempotencyKeyConflict
+			}
+		}
+	}
+	clone := *img
+	f.images[img.ID] = &clone
+	return f.queue(tasks), nil
+}
+
+func (f *fakeImages) UpdateWithTasks(ctx context.Context, img *domain.Image, tasks []*domain.ProcessingTask) ([]*domain.OutboxMessage, error) {
+	if err := f.Update(ctx, img); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queue(tasks), nil
+}
+
+// queue records tasks as queued in the outbox, with f.mu held
+func (f *fakeImages) queue(tasks []*domain.ProcessingTask) []*domain.OutboxMessage {
+	messages := make([]*domain.OutboxMessage, 0, len(tasks))
+	for _, task := range tasks {
+		f.tasks = append(f.tasks, task)
+		messages = append(messages, &domain.OutboxMessage{ID: int64(len(f.tasks)), Task: task})
+	}
+	return messages
+}
+
+func (f *fakeImages) GetByID(ctx context.Context, id string) (*domain.Image, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	img, ok := f.images[id]
+	if !ok {
+		return nil, domain.ErrImageNotFound
+	}
+	clone := *img
+	return &clone, nil
+}
+
+func (f *fakeImages) GetByIdempotencyKey(ctx context.Context, key string) (*domain.Image, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, img := range f.images {
+		if img.IdempotencyKey == key {
+			clone := *img
+			return &clone, nil
+		}
+	}
+	return nil, domain.ErrImageNotFound
+}
+
+func (f *fakeImages) HardDelete(ctx context.Context, id string) (*domain.Image, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	img, ok := f.images[id]
+	if !ok {
+		return nil, domain.ErrImageNotFound
+	}
+	delete(f.images, id)
+	return img, nil
+}
+
+func (f *fakeImages) DeleteByStatus(ctx context.Context, status domain.ProcessingStatus) ([]*domain.Image, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	deleted := []*domain.Image{}
+	for id, img := range f.images {
+		if img.Status == status {
+			deleted = append(deleted, img)
+			delete(f.images, id)
+		}
+	}
+	return deleted, nil
+}
+
+// RetryFailed applies filter like the SQL, taking images in ID order
+func (f *fakeImages) RetryFailed(ctx context.Context, filter repo.RetryFilter, tasksFor func(img *domain.Image) []*domain.ProcessingTask) ([]*domain.Image, []*domain.OutboxMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := make([]string, 0, len(f.images))
+	for id := range f.images {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	var images []*domain.Image
+	var messages []*domain.OutboxMessage
+	for _, id := range ids {
+		img := f.images[id]
+		if len(images) == filter.Limit {
+			break
+		}
+		if img.Status != domain.StatusFailed || img.DeletedAt != nil || !img.CreatedAt.After(filter.CreatedAfter) ||
+			img.RetryCount >= filter.MaxRetries || (filter.MaxAttempts > 0 && img.ProcessingAttempts >= filter.MaxAttempts) {
+			continue
+		}
+		img.Status, img.FailureReason = domain.StatusPending, ""
+		img.RetryCount++
+		img.UpdatedAt = time.Now()
+		clone := *img
+		images = append(images, &clone)
+		messages = append(messages, f.queue(tasksFor(&clone))...)
+	}
+	return images, messages, nil
+}
+
+func (f *fakeImages) Update(ctx context.Context, img *domain.Image) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.updateErr != nil {
+		return f.updateErr
+	}
+	stored, ok := f.images[img.ID]
+	if !ok {
+		return domain.ErrImageNotFound
+	}
+	// Thumbnail fields are only written by UpdateThumbnail
+	clone := *img
+	clone.ThumbnailPath, clone.ThumbnailChecksum = stored.ThumbnailPath, stored.ThumbnailChecksum
+	clone.Thumbnails, clone.LQIPPath, clone.Placeholder = stored.Thumbnails, stored.LQIPPath, stored.Placeholder
+	f.images[img.ID] = &clone
+	return nil
+}
+
+func (f *fakeImages) UpdateThumbnail(ctx context.Context, img *domain.Image) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stored, ok := f.images[img.ID]
+	if !ok {
+		return domain.ErrImageNotFound
+	}
+	stored.ThumbnailPath, stored.ThumbnailChecksum = img.ThumbnailPath, img.ThumbnailChecksum
+	stored.Thumbnails, stored.LQIPPath, stored.Placeholder = img.Thumbnails, img.LQIPPath, img.Placeholder
+	return nil
+}
+
+func (f *fakeImages) GetCompletedByProcessingKey(ctx context.Context, key string) (*domain.Image, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, img := range f.images {
+		if img.ProcessingKey == key && img.Status == domain.StatusCompleted {
+			clone := *img
+			return &clone, nil
+		}
+	}
+	return nil, domain.ErrImageNotFound
+}
+
+func (f *fakeImages) FindSimilar(ctx context.Context, phash int64, maxDistance int) (*domain.Image, error) {
+	return nil, domain.ErrImageNotFound
+}
+
+func (f *fakeImages) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.images)
+}
+
+// fakeEvents records image events, failing with err when set
+type fakeEvents struct {
+	repo.EventRepository
+	mu     sync.Mutex
+	events []*domain.ImageEvent
+	err    error
+}
+
+func (f *fakeEvents) Create(ctx context.Context, event *domain.ImageEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.events = append(f.events, event)
+	return nil
+}
+
+// fakeOutbox records the messages marked sent
+type fakeOutbox struct {
+	repo.OutboxRepository
+	mu   sync.Mutex
+	sent []int64
+}
+
+func (f *fakeOutbox) MarkSent(ctx context.Context, ids ...int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, ids...)
+	return nil
+}
+
+// fakeProducer records the tasks sent, failing with err when set
+type fakeProducer struct {
+	kafkatransport.Producer
+	mu    sync.Mutex
+	tasks []*domain.ProcessingTask
+	err   error
+}
+
+func (f *fakeProducer) SendTask(ctx context.Context, task *domain.ProcessingTask) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.tasks = append(f.tasks, task)
+	return nil
+}
+
+func (f *fakeProducer) sent() []*domain.ProcessingTask {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*domain.ProcessingTask(nil), f.tasks...)
+}
+
+// testImageService is an imageService over in-memory fakes
+type testImageService struct {
+	*imageService
+	images   *fakeImages
+	events   *fakeEvents
+	outbox   *fakeOutbox
+	storage  *memStorage
+	producer *fakeProducer
+}
+
+func newTestImageService(cfg *config.Config) *testImageService {
+	ts := &testImageService{
+		images:   newFakeImages(),
+		events:   &fakeEvents{},
+		outbox:   &fakeOutbox{},
+		storage:  newMemStorage(),
+		producer: &fakeProducer{},
+	}
+	ts.imageService = NewImageService(ts.images, ts.events, ts.outbox, ts.storage, ts.producer, nil, nil, cfg, discardLogger()).(*imageService)
+	return ts
+}
+
+// newTestProcessor returns a processorService over images and storage
+func newTestProcessor(cfg *config.Config, images *fakeImages, storage repo.StorageRepository) *processorService {
+	return NewProcessorService(images, &fakeEvents{}, storage, nil, nil, cfg, observability.NewMetrics(), discardLogger()).(*processorService)
+}
+
+// seedOriginal stores data as the original of a pending image with the given
+// ID and returns the task processing it
+func seedOriginal(t *testing.T, images *fakeImages, storage repo.StorageRepository, id string, data []byte, format domain.ImageFormat) *domain.ProcessingTask {
+	t.Helper()
+	path := "original/" + id + getExtension(format)
+	if err := storage.Save(context.Background(), path, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	images.mu.Lock()
+	images.images[id] = &domain.Image{ID: id, OriginalPath: path, Status: domain.StatusPending, Format: format}
+	images.mu.Unlock()
+	return &domain.ProcessingTask{ImageID: id, ImagePath: path, Format: format, Kind: domain.TaskKindAll}
+}
+
+// testConfig returns the default configuration
+func testConfig(t *testing.T) *config.Config {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// uploadFile is a multipart.File over data
+type uploadFile struct {
+	*bytes.Reader
+}
+
+func (uploadFile) Close() error { return nil }
+
+// upload uploads data as a file named filename
+func (ts *testImageService) upload(ctx context.Context, filename string, data []byte, opts UploadOptions) (*domain.Image, error) {
+	var file multipart.File = uploadFile{bytes.NewReader(data)}
+	return ts.Upload(ctx, file, &multipart.FileHeader{Filename: filename, Size: int64(len(data))}, opts)
+}
+
+// testImage returns a w x h image with a horizontal gradient
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			img.Set(x, y, color.RGBA{R: uint8(x * 255 / max(w-1, 1)), G: uint8(y * 255 / max(h-1, 1)), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T, img image.Image, quality int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
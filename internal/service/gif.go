@@ -0,0 +1,110 @@
+package service
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/oziev02/ImageProcessor/internal/config"
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+// checkGIFLimits walks the GIF block structure without decoding any pixel
+// data and rejects files whose frame count or total decoded pixel count
+// (canvas size times frames) exceed the configured limits.
+func checkGIFLimits(r io.Reader, cfg config.ImageConfig) error {
+	width, height, frames, err := scanGIF(r)
+	if err != nil {
+		return fmt.Errorf("failed to read gif structure: %w", err)
+	}
+
+	if cfg.GIFMaxFrames > 0 && frames > cfg.GIFMaxFrames {
+		return fmt.Errorf("%w: %d frames, limit is %d", domain.ErrGIFTooLarge, frames, cfg.GIFMaxFrames)
+	}
+	pixels := int64(width) * int64(height) * int64(frames)
+	if cfg.GIFMaxPixels > 0 && pixels > cfg.GIFMaxPixels {
+		return fmt.Errorf("%w: %d pixels across all frames, limit is %d", domain.ErrGIFTooLarge, pixels, cfg.GIFMaxPixels)
+	}
+	return nil
+}
+
+// scanGIF returns the logical screen size and the number of image frames
+func scanGIF(r io.Reader) (width, height, frames int, err error) {
+	br := bufio.NewReader(r)
+
+	// Header and logical screen descriptor
+	var screen [13]byte
+	if _, err := io.ReadFull(br, screen[:]); err != nil {
+		return 0, 0, 0, err
+	}
+	if string(screen[:3]) != "GIF" {
+		return 0, 0, 0, domain.ErrInvalidFormat
+	}
+	width = int(binary.LittleEndian.Uint16(screen[6:8]))
+	height = int(binary.LittleEndian.Uint16(screen[8:10]))
+	if err := skipColorTable(br, screen[10]); err != nil {
+		return 0, 0, 0, err
+	}
+
+	for {
+		introducer, err := br.ReadByte()
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+		switch introducer {
+		case 0x21: // Extension: label followed by sub-blocks
+			if _, err := br.ReadByte(); err != nil {
+				return 0, 0, 0, err
+			}
+			if err := skipSubBlocks(br); err != nil {
+				return 0, 0, 0, err
+			}
+		case 0x2C: // Image descriptor
+			var desc [9]byte
+			if _, err := io.ReadFull(br, desc[:]); err != nil {
+				return 0, 0, 0, err
+			}
+			if err := skipColorTable(br, desc[8]); err != nil {
+				return 0, 0, 0, err
+			}
+			// LZW minimum code size, then the image data sub-blocks
+			if _, err := br.ReadByte(); err != nil {
+				return 0, 0, 0, err
+			}
+			if err := skipSubBlocks(br); err != nil {
+				return 0, 0, 0, err
+			}
+			frames++
+		case 0x3B: // Trailer
+			return width, height, frames, nil
+		default:
+			return 0, 0, 0, fmt.Errorf("unexpected gif block 0x%02x", introducer)
+		}
+	}
+}
+
+func skipColorTable(br *bufio.Reader, flags byte) error {
+	if flags&0x80 == 0 {
+		return nil
+	}
+	size := 3 * (1 << ((flags & 0x07) + 1))
+	_, err := br.Discard(size)
+	return err
+}
+
+func skipSubBlocks(br *bufio.Reader) error {
+	for {
+		size, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		if _, err := br.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+}
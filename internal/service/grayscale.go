@@ -0,0 +1,16 @@
+package service
+
+import (
+	"image"
+	"image/draw"
+)
+
+// grayscale converts img to 8-bit luminance. Transparent areas are flattened
+// onto the background first, as they'd otherwise turn black.
+func (s *processorService) grayscale(img image.Image) *image.Gray {
+	img = s.flatten(img)
+	bounds := img.Bounds()
+	gray := image.NewGray(bounds)
+	draw.Draw(gray, bounds, img, bounds.Min, draw.Src)
+	return gray
+}
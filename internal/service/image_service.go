@@ -1,84 +1,283 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"image"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
+	"log/slog"
 	"mime/multipart"
+	"net/http"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/oziev02/ImageProcessor/internal/config"
 	"github.com/oziev02/ImageProcessor/internal/domain"
 	"github.com/oziev02/ImageProcessor/internal/repo"
+	"github.com/oziev02/ImageProcessor/internal/transport/clamav"
 	kafkatransport "github.com/oziev02/ImageProcessor/internal/transport/kafka"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
 )
 
 type ImageService interface {
-	Upload(ctx context.Context, file multipart.File, header *multipart.FileHeader) (*domain.Image, error)
+	Upload(ctx context.Context, file multipart.File, header *multipart.FileHeader, opts UploadOptions) (*domain.Image, error)
 	GetByID(ctx context.Context, id string) (*domain.Image, error)
 	Delete(ctx context.Context, id string) error
-	List(ctx context.Context, limit, offset int) ([]*domain.Image, error)
+	Restore(ctx context.Context, id string) error
+	Reprocess(ctx context.Context, id string, priority domain.TaskPriority) (*domain.Image, error)
+	HardDelete(ctx context.Context, id string) error
+	PurgeDeleted(ctx context.Context, olderThan time.Duration) (int, error)
+	DeleteByStatus(ctx context.Context, status domain.ProcessingStatus) (int, error)
+	ListEach(ctx context.Context, filter domain.ImageFilter, limit, offset int, fn func(img *domain.Image) error) error
+	Count(ctx context.Context, filter domain.ImageFilter) (int, error)
+	ForEach(ctx context.Context, filter domain.ImageFilter, fn func(img *domain.Image) error) error
+	Verify(ctx context.Context, id string) (*domain.VerificationResult, error)
+	History(ctx context.Context, id string) ([]*domain.ImageEvent, error)
+	Stats(ctx context.Context) (*domain.ImageStats, error)
+	RetryFailed(ctx context.Context, limit int) (int, error)
+}
+
+// UploadOptions are per-upload processing parameters
+type UploadOptions struct {
+	Priority domain.TaskPriority
+	// Params are stored with the image and applied on every processing run
+	Params domain.ProcessingParams
+	// IdempotencyKey, when set, makes a repeated upload return the image
+	// the first one created
+	IdempotencyKey string
 }
 
 type imageService struct {
 	imageRepo   repo.ImageRepository
+	eventRepo   repo.EventRepository
+	outboxRepo  repo.OutboxRepository
 	storageRepo repo.StorageRepository
 	producer    kafkatransport.Producer
+	scanner     clamav.Scanner
+	ids         repo.IDGenerator
+	decodes     *DecodeLimiter // nil when unlimited
 	cfg         *config.Config
+	logger      *slog.Logger
 }
 
 func NewImageService(
 	imageRepo repo.ImageRepository,
+	eventRepo repo.EventRepository,
+	outboxRepo repo.OutboxRepository,
 	storageRepo repo.StorageRepository,
 	producer kafkatransport.Producer,
+	scanner clamav.Scanner,
+	decodes *DecodeLimiter,
 	cfg *config.Config,
+	logger *slog.Logger,
 ) ImageService {
 	return &imageService{
 		imageRepo:   imageRepo,
+		eventRepo:   eventRepo,
+		outboxRepo:  outboxRepo,
 		storageRepo: storageRepo,
 		producer:    producer,
+		scanner:     scanner,
+		ids:         repo.NewIDGenerator(cfg.Image.IDScheme),
+		decodes:     decodes,
 		cfg:         cfg,
+		logger:      logger,
+	}
+}
+
+func (s *imageService) Upload(ctx context.Context, file multipart.File, header *multipart.FileHeader, opts UploadOptions) (*domain.Image, error) {
+	ctx, span := tracer.Start(ctx, "ImageService.Upload", trace.WithAttributes(
+		attribute.String("upload.filename", header.Filename),
+		attribute.Int64("upload.size", header.Size),
+	))
+	img, err := s.upload(ctx, file, header, opts)
+	if img != nil {
+		span.SetAttributes(attribute.String("image.id", img.ID))
 	}
+	endSpan(span, err)
+	return img, err
 }
 
-func (s *imageService) Upload(ctx context.Context, file multipart.File, header *multipart.FileHeader) (*domain.Image, error) {
+func (s *imageService) upload(ctx context.Context, file multipart.File, header *multipart.FileHeader, opts UploadOptions) (*domain.Image, error) {
+	// A retried upload gets the image its first attempt created
+	if opts.IdempotencyKey != "" {
+		existing, err := s.imageRepo.GetByIdempotencyKey(ctx, opts.IdempotencyKey)
+		if err == nil {
+			return existing, nil
+		}
+		if !errors.Is(err, domain.ErrImageNotFound) {
+			return nil, fmt.Errorf("failed to look up idempotency key: %w", err)
+		}
+	}
+
+	// Reject empty uploads before saving or decoding anything
+	if header.Size == 0 {
+		return nil, domain.ErrEmptyFile
+	}
+	if _, err := file.Read(make([]byte, 1)); err == io.EOF {
+		return nil, domain.ErrEmptyFile
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind file: %w", err)
+	}
+
 	// Validate file size
 	if header.Size > s.cfg.Image.MaxFileSize {
-		return nil, fmt.Errorf("file size exceeds maximum allowed size")
+		return nil, domain.ErrFileTooLarge
 	}
 
 	// Generate ID
-	id := repo.GenerateID()
+	id := s.ids.NewID()
 
-	// Determine format
+	// Determine format from the content, falling back to the extension
 	ext := strings.ToLower(filepath.Ext(header.Filename))
-	format, err := parseFormat(ext)
+	extFormat, extErr := parseFormat(ext)
+	format, err := detectFormat(file)
 	if err != nil {
-		return nil, fmt.Errorf("unsupported format: %w", err)
+		return nil, err
+	}
+	if format == "" {
+		if extErr != nil {
+			return nil, fmt.Errorf("unsupported format: %w", extErr)
+		}
+		format = extFormat
+	}
+	if extErr != nil || extFormat != format {
+		// Store the original under an extension matching its real format
+		ext = getExtension(format)
+	}
+	if !slices.Contains(s.cfg.Image.AllowedFormats, string(format)) {
+		return nil, fmt.Errorf("%w: %s", domain.ErrFormatNotAllowed, format)
 	}
 
-	// Save original file
-	originalPath := filepath.Join("original", id+ext)
-	if err := s.storageRepo.Save(ctx, originalPath, file); err != nil {
-		return nil, fmt.Errorf("failed to save original file: %w", err)
+	// Check animated GIF limits before anything decodes the frames
+	if format == domain.FormatGIF {
+		if err := checkGIFLimits(file, s.cfg.Image); err != nil {
+			return nil, err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to rewind file: %w", err)
+		}
 	}
 
-	// Read image dimensions
-	file.Seek(0, 0)
-	img, _, err := decodeImageForDimensions(file, format)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode image: %w", err)
+	// Animated WebP only gets its first frame decoded, unless it's rejected
+	if format == domain.FormatWebP && s.cfg.Image.AnimatedWebP == config.AnimatedWebPReject {
+		if animated, _ := isAnimatedWebP(file); animated {
+			return nil, domain.ErrAnimatedWebP
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to rewind file: %w", err)
+		}
+	}
+
+	// Check the dimensions from the header before anything decodes the pixels
+	if err := checkDimensionLimits(file, format, s.cfg.Image); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind file: %w", err)
+	}
+
+	// Nothing is stored before the scanner has cleared it
+	if err := s.scan(ctx, file); err != nil {
+		return nil, err
+	}
+
+	// From here on anything but a completed upload removes what it left
+	// behind: the original file, and the record once it's created, which
+	// would otherwise stay pending forever without its task
+	originalPath := storagePath(s.cfg.Storage, fileOriginal, id, ext)
+	completed, created := false, false
+	defer func() {
+		if completed {
+			return
+		}
+		cleanupCtx := context.WithoutCancel(ctx)
+		if created {
+			if _, err := s.imageRepo.HardDelete(cleanupCtx, id); err != nil {
+				s.logger.Warn("failed to remove record of failed upload", "image_id", id, "error", err)
+			}
+		}
+		if err := s.storageRepo.Delete(cleanupCtx, originalPath); err != nil {
+			s.logger.Warn("failed to remove original of failed upload", "path", originalPath, "error", err)
+		}
+	}()
+
+	// Save original file, decoding it from the same bytes so that the upload
+	// is read once. header.Size is whatever the client claimed, so the size
+	// actually written is enforced as well.
+	limited := &sizeLimitReader{r: file, remaining: s.cfg.Image.MaxFileSize}
+	if err := s.decodes.acquire(ctx); err != nil {
+		return nil, fmt.Errorf("failed to wait for a decode slot: %w", err)
+	}
+	saved := s.saveDecoded(ctx, originalPath, limited, format)
+	img, decodeErr := saved.img, saved.decodeErr
+	if saved.saveErr == nil && decodeErr != nil && s.cfg.Image.LenientDecode {
+		img, decodeErr = s.decodeLenient(file, format, decodeErr)
+	}
+	s.decodes.release()
+	if saved.saveErr != nil {
+		if errors.Is(saved.saveErr, domain.ErrFileTooLarge) {
+			return nil, domain.ErrFileTooLarge
+		}
+		return nil, fmt.Errorf("failed to save original file: %w", saved.saveErr)
+	}
+	originalSize := s.cfg.Image.MaxFileSize - limited.remaining
+
+	if decodeErr != nil {
+		// Undecodable content is the client's problem, not ours
+		return nil, fmt.Errorf("failed to decode image: %w: %w", domain.ErrInvalidFormat, decodeErr)
 	}
 	bounds := img.Bounds()
 	width := bounds.Dx()
 	height := bounds.Dy()
 
+	// Only JPEG and TIFF carry EXIF
+	var metadata domain.ImageMetadata
+	if format == domain.FormatJPEG || format == domain.FormatTIFF {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to rewind file: %w", err)
+		}
+		metadata = extractMetadata(file, s.cfg.Image.KeepGPS)
+	}
+
+	// Reject images below the minimum dimensions, zero meaning no minimum
+	if width < s.cfg.Image.MinWidth || height < s.cfg.Image.MinHeight {
+		return nil, fmt.Errorf("%w: %dx%d, minimum is %dx%d", domain.ErrImageTooSmall,
+			width, height, s.cfg.Image.MinWidth, s.cfg.Image.MinHeight)
+	}
+
+	// Return the existing image for re-uploads of the same photo. An upload
+	// with its own parameters asks for different derivatives, so it's never
+	// a duplicate.
+	var phash *int64
+	if s.cfg.Image.DedupEnabled && opts.Params.IsZero() {
+		hash := int64(differenceHash(img))
+		phash = &hash
+		existing, err := s.imageRepo.FindSimilar(ctx, hash, s.cfg.Image.DedupMaxDistance)
+		if err != nil && !errors.Is(err, domain.ErrImageNotFound) {
+			return nil, fmt.Errorf("failed to look up duplicates: %w", err)
+		}
+		if existing != nil {
+			// The deferred cleanup drops the original saved for this upload
+			existing.Duplicate = true
+			return existing, nil
+		}
+	}
+
 	// Create image record
 	now := time.Now()
 	image := &domain.Image{
@@ -92,6 +291,11 @@ func (s *imageService) Upload(ctx context.Context, file multipart.File, header *
 		OriginalHeight:  height,
 		ProcessedWidth:  0,
 		ProcessedHeight: 0,
+		OriginalSize:    originalSize,
+		PHash:           phash,
+		Params:          opts.Params,
+		IdempotencyKey:  opts.IdempotencyKey,
+		Metadata:        metadata,
 		CreatedAt:       now,
 		UpdatedAt:       now,
 	}
@@ -100,53 +304,368 @@ func (s *imageService) Upload(ctx context.Context, file multipart.File, header *
 		return nil, fmt.Errorf("invalid image: %w", err)
 	}
 
-	// Save to database
-	if err := s.imageRepo.Create(ctx, image); err != nil {
+	// Save to database, queueing the tasks in the same transaction so that
+	// they outlive Kafka being unavailable or a crash before they're sent
+	messages, err := s.imageRepo.CreateWithTasks(ctx, image, s.buildTasks(image, opts.Priority, domain.TaskOriginUpload))
+	if err != nil {
+		if errors.Is(err, domain.ErrIdempotencyKeyConflict) {
+			// A concurrent upload with the same key got there first
+			if existing, lookupErr := s.imageRepo.GetByIdempotencyKey(ctx, opts.IdempotencyKey); lookupErr == nil {
+				return existing, nil
+			}
+			return nil, err
+		}
 		return nil, fmt.Errorf("failed to create image record: %w", err)
 	}
+	created = true
+	completed = true
+	// History is for auditing only, so a failed write doesn't undo the upload
+	event := &domain.ImageEvent{ImageID: id, Status: image.Status, CreatedAt: now}
+	if err := s.eventRepo.Create(ctx, event); err != nil {
+		s.logger.Warn("failed to record image event", "image_id", id, "status", image.Status, "error", err)
+	}
+
+	s.publishQueued(ctx, messages)
+	return image, nil
+}
 
-	// Send to Kafka for processing
+// publishQueued sends the tasks an upload or reprocess queued right away. Those that
+// fail stay in the outbox for the relay to send later.
+func (s *imageService) publishQueued(ctx context.Context, messages []*domain.OutboxMessage) {
+	var sent []int64
+	for _, msg := range messages {
+		if err := s.producer.SendTask(ctx, msg.Task); err != nil {
+			s.logger.Warn("failed to send processing task, leaving it to the outbox relay",
+				"image_id", msg.Task.ImageID, "error", err)
+			continue
+		}
+		sent = append(sent, msg.ID)
+	}
+	if len(sent) == 0 {
+		return
+	}
+	if err := s.outboxRepo.MarkSent(context.WithoutCancel(ctx), sent...); err != nil {
+		// The relay sends them again, which processing tolerates
+		s.logger.Warn("failed to mark processing tasks sent", "error", err)
+	}
+}
+
+// buildTasks returns the processing tasks of img, fanning out a separate
+// thumbnail task when thumbnails have their own topic. The origin lets the
+// producer pick the topic.
+func (s *imageService) buildTasks(img *domain.Image, priority domain.TaskPriority, origin domain.TaskOrigin) []*domain.ProcessingTask {
 	task := &domain.ProcessingTask{
-		ImageID:   id,
-		ImagePath: originalPath,
-		Format:    format,
-		Width:     width,
-		Height:    height,
+		ImageID:   img.ID,
+		ImagePath: img.OriginalPath,
+		Format:    img.Format,
+		Width:     img.OriginalWidth,
+		Height:    img.OriginalHeight,
+		Origin:    origin,
+		Priority:  priority,
 	}
-	if err := s.producer.SendTask(ctx, task); err != nil {
-		return nil, fmt.Errorf("failed to send processing task: %w", err)
+	tasks := []*domain.ProcessingTask{task}
+	if s.cfg.Kafka.ThumbnailTopic != "" {
+		thumbnailTask := *task
+		thumbnailTask.Kind = domain.TaskKindThumbnail
+		task.Kind = domain.TaskKindProcessed
+		tasks = append(tasks, &thumbnailTask)
 	}
+	return tasks
+}
 
-	return image, nil
+// Reprocess runs processing again on a stored original with the current
+// configuration and the image's own parameters. It's an explicit request,
+// so the attempts count starts over.
+func (s *imageService) Reprocess(ctx context.Context, id string, priority domain.TaskPriority) (*domain.Image, error) {
+	img, err := s.imageRepo.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	exists, err := s.storageRepo.Exists(ctx, img.OriginalPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check original file: %w", err)
+	}
+	if !exists {
+		return nil, domain.ErrOriginalMissing
+	}
+
+	img.Status = domain.StatusPending
+	img.ProcessingAttempts = 0
+	img.FailureReason = ""
+	img.UpdatedAt = time.Now()
+	// Queue the tasks with the reset so that they outlive Kafka being
+	// unavailable, as uploads do
+	messages, err := s.imageRepo.UpdateWithTasks(ctx, img, s.buildTasks(img, priority, domain.TaskOriginReprocess))
+	if err != nil {
+		return nil, fmt.Errorf("failed to reset image status: %w", err)
+	}
+	event := &domain.ImageEvent{ImageID: id, Status: img.Status, CreatedAt: img.UpdatedAt}
+	if err := s.eventRepo.Create(ctx, event); err != nil {
+		s.logger.Warn("failed to record image event", "image_id", id, "status", img.Status, "error", err)
+	}
+
+	s.publishQueued(ctx, messages)
+	return img, nil
+}
+
+// RetryFailed requeues up to limit failed images that may still succeed,
+// e.g. after a transient storage error: those created within
+// PROCESSING_RETRY_MAX_AGE, retried fewer than PROCESSING_RETRY_MAX times
+// and with processing attempts left. Retries go at low priority.
+func (s *imageService) RetryFailed(ctx context.Context, limit int) (int, error) {
+	filter := repo.RetryFilter{
+		CreatedAfter: time.Now().Add(-s.cfg.Image.RetryMaxAge),
+		MaxRetries:   s.cfg.Image.RetryMax,
+		MaxAttempts:  s.cfg.Image.MaxProcessingAttempts,
+		Limit:        limit,
+	}
+	images, messages, err := s.imageRepo.RetryFailed(ctx, filter, func(img *domain.Image) []*domain.ProcessingTask {
+		return s.buildTasks(img, domain.PriorityLow, domain.TaskOriginReprocess)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, img := range images {
+		event := &domain.ImageEvent{ImageID: img.ID, Status: img.Status, CreatedAt: img.UpdatedAt}
+		if err := s.eventRepo.Create(ctx, event); err != nil {
+			s.logger.Warn("failed to record image event", "image_id", img.ID, "status", img.Status, "error", err)
+		}
+	}
+	s.publishQueued(ctx, messages)
+	return len(images), nil
+}
+
+// scan checks the upload for malware when a scanner is configured. An
+// unreachable scanner rejects the upload unless the policy is fail-open.
+func (s *imageService) scan(ctx context.Context, file io.ReadSeeker) error {
+	if s.scanner == nil {
+		return nil
+	}
+
+	err := s.scanner.Scan(ctx, file)
+	if _, seekErr := file.Seek(0, io.SeekStart); seekErr != nil {
+		return fmt.Errorf("failed to rewind file: %w", seekErr)
+	}
+	if err == nil || errors.Is(err, domain.ErrInfected) {
+		return err
+	}
+	if s.cfg.Scan.FailPolicy == config.ScanFailOpen {
+		s.logger.Warn("malware scan failed, accepting upload unscanned", "error", err)
+		return nil
+	}
+	return fmt.Errorf("%w: %v", domain.ErrScanUnavailable, err)
 }
 
 func (s *imageService) GetByID(ctx context.Context, id string) (*domain.Image, error) {
 	return s.imageRepo.GetByID(ctx, id)
 }
 
+// Delete soft-deletes the image. Its files stay in storage until it's purged
+// or hard-deleted, so that it can be restored.
 func (s *imageService) Delete(ctx context.Context, id string) error {
-	img, err := s.imageRepo.GetByID(ctx, id)
+	return s.imageRepo.Delete(ctx, id)
+}
+
+func (s *imageService) Restore(ctx context.Context, id string) error {
+	return s.imageRepo.Restore(ctx, id)
+}
+
+// HardDelete permanently removes the image and its files. The record is
+// deleted first, so a file that couldn't be removed is reported wrapped in
+// domain.ErrFilesNotDeleted and a repeated delete returns ErrImageNotFound.
+func (s *imageService) HardDelete(ctx context.Context, id string) error {
+	img, err := s.imageRepo.HardDelete(ctx, id)
 	if err != nil {
 		return err
 	}
+	if err := s.removeFiles(ctx, img); err != nil {
+		return fmt.Errorf("%w: %w", domain.ErrFilesNotDeleted, err)
+	}
+	return nil
+}
 
-	// Delete files
-	if img.OriginalPath != "" {
-		_ = s.storageRepo.Delete(ctx, img.OriginalPath)
+// PurgeDeleted permanently removes images soft-deleted more than olderThan
+// ago along with their files, returning how many were purged
+func (s *imageService) PurgeDeleted(ctx context.Context, olderThan time.Duration) (int, error) {
+	images, err := s.imageRepo.PurgeDeleted(ctx, olderThan)
+	if err != nil {
+		return 0, err
 	}
-	if img.ProcessedPath != "" {
-		_ = s.storageRepo.Delete(ctx, img.ProcessedPath)
+	for _, img := range images {
+		if err := s.removeFiles(ctx, img); err != nil {
+			s.logger.Warn("failed to remove files of deleted image", "image_id", img.ID, "error", err)
+		}
 	}
-	if img.ThumbnailPath != "" {
-		_ = s.storageRepo.Delete(ctx, img.ThumbnailPath)
+	return len(images), nil
+}
+
+// DeleteByStatus permanently removes every image with the given status
+// along with its files, returning how many were deleted
+func (s *imageService) DeleteByStatus(ctx context.Context, status domain.ProcessingStatus) (int, error) {
+	images, err := s.imageRepo.DeleteByStatus(ctx, status)
+	if err != nil {
+		return 0, err
 	}
+	for _, img := range images {
+		if err := s.removeFiles(ctx, img); err != nil {
+			s.logger.Warn("failed to remove files of deleted image", "image_id", img.ID, "error", err)
+		}
+	}
+	return len(images), nil
+}
 
-	// Delete from database
-	return s.imageRepo.Delete(ctx, id)
+// removeFiles deletes every stored file of img, ignoring missing ones. It
+// keeps going past failures and returns them all joined.
+func (s *imageService) removeFiles(ctx context.Context, img *domain.Image) error {
+	var errs []error
+	paths := []string{img.OriginalPath, img.ProcessedPath, img.ThumbnailPath, img.LQIPPath}
+	for _, path := range img.Thumbnails {
+		paths = append(paths, path)
+	}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if err := s.storageRepo.Delete(ctx, path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+	}
+	// In the grouped layout the image's directory is the one holding its
+	// original, wherever the layout and sharding at upload time put it
+	if dir := filepath.Dir(img.OriginalPath); filepath.Base(dir) == img.ID {
+		if err := s.storageRepo.DeleteAll(ctx, dir); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", dir, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ListEach streams a page of images matching filter to fn without holding
+// the whole page in memory
+func (s *imageService) ListEach(ctx context.Context, filter domain.ImageFilter, limit, offset int, fn func(img *domain.Image) error) error {
+	return s.imageRepo.ListEach(ctx, filter, limit, offset, fn)
+}
+
+func (s *imageService) Count(ctx context.Context, filter domain.ImageFilter) (int, error) {
+	return s.imageRepo.Count(ctx, filter)
+}
+
+func (s *imageService) ForEach(ctx context.Context, filter domain.ImageFilter, fn func(img *domain.Image) error) error {
+	return s.imageRepo.ForEach(ctx, filter, fn)
+}
+
+func (s *imageService) Stats(ctx context.Context) (*domain.ImageStats, error) {
+	return s.imageRepo.Stats(ctx)
+}
+
+// History returns the image's status transitions, oldest first
+func (s *imageService) History(ctx context.Context, id string) ([]*domain.ImageEvent, error) {
+	if _, err := s.imageRepo.GetByID(ctx, id); err != nil {
+		return nil, err
+	}
+
+	events, err := s.eventRepo.ListByImageID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if events == nil {
+		events = []*domain.ImageEvent{}
+	}
+	return events, nil
 }
 
-func (s *imageService) List(ctx context.Context, limit, offset int) ([]*domain.Image, error) {
-	return s.imageRepo.List(ctx, limit, offset)
+// Verify re-reads the stored derivatives and compares them with the
+// checksums recorded when they were written
+func (s *imageService) Verify(ctx context.Context, id string) (*domain.VerificationResult, error) {
+	img, err := s.imageRepo.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &domain.VerificationResult{ImageID: img.ID, OK: true, Files: []domain.FileVerification{}}
+	files := []struct{ path, checksum string }{
+		{img.ProcessedPath, img.ProcessedChecksum},
+		{img.ThumbnailPath, img.ThumbnailChecksum},
+	}
+	for _, f := range files {
+		// Not processed yet, or processed before checksums were recorded
+		if f.path == "" || f.checksum == "" {
+			continue
+		}
+
+		check := domain.FileVerification{Path: f.path, Expected: f.checksum}
+		actual, err := s.checksum(ctx, f.path)
+		if err != nil {
+			check.Error = err.Error()
+		} else {
+			check.Actual = actual
+			check.OK = actual == f.checksum
+		}
+		if !check.OK {
+			result.OK = false
+		}
+		result.Files = append(result.Files, check)
+	}
+
+	return result, nil
+}
+
+func (s *imageService) checksum(ctx context.Context, path string) (string, error) {
+	reader, err := s.storageRepo.Read(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// sniffLen is how many leading bytes detectFormat inspects
+const sniffLen = 512
+
+// TIFF byte order marks followed by the magic number 42
+var (
+	tiffLittleEndian = []byte("II*\x00")
+	tiffBigEndian    = []byte("MM\x00*")
+)
+
+// detectFormat sniffs the image format from the leading bytes of r and
+// rewinds it. An empty format with a nil error means the content wasn't
+// recognised and the caller should fall back to the file extension.
+func detectFormat(r io.ReadSeeker) (domain.ImageFormat, error) {
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("failed to read file header: %w", err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to rewind file: %w", err)
+	}
+
+	// DetectContentType doesn't know TIFF
+	if bytes.HasPrefix(buf[:n], tiffLittleEndian) || bytes.HasPrefix(buf[:n], tiffBigEndian) {
+		return domain.FormatTIFF, nil
+	}
+
+	switch http.DetectContentType(buf[:n]) {
+	case "image/jpeg":
+		return domain.FormatJPEG, nil
+	case "image/png":
+		return domain.FormatPNG, nil
+	case "image/gif":
+		return domain.FormatGIF, nil
+	case "image/webp":
+		return domain.FormatWebP, nil
+	case "image/bmp":
+		return domain.FormatBMP, nil
+	default:
+		return "", nil
+	}
 }
 
 func parseFormat(ext string) (domain.ImageFormat, error) {
@@ -157,11 +676,122 @@ func parseFormat(ext string) (domain.ImageFormat, error) {
 		return domain.FormatPNG, nil
 	case ".gif":
 		return domain.FormatGIF, nil
+	case ".webp":
+		return domain.FormatWebP, nil
+	case ".tif", ".tiff":
+		return domain.FormatTIFF, nil
+	case ".bmp":
+		return domain.FormatBMP, nil
 	default:
 		return "", domain.ErrInvalidFormat
 	}
 }
 
+// savedUpload is the outcome of saveDecoded. Decoding and saving fail
+// separately: a save error means nothing usable was stored, while a decode
+// error with a successful save leaves the original for a lenient retry.
+type savedUpload struct {
+	img       image.Image
+	decodeErr error
+	saveErr   error
+}
+
+// saveDecoded saves r to path while decoding it. The decoder reads the bytes
+// being saved through a pipe, and whatever it leaves unread is drained so
+// that saving never waits on it.
+func (s *imageService) saveDecoded(ctx context.Context, path string, r io.Reader, format domain.ImageFormat) savedUpload {
+	pr, pw := io.Pipe()
+	done := make(chan savedUpload, 1)
+	go func() {
+		img, _, err := decodeImageForDimensions(pr, format)
+		io.Copy(io.Discard, pr)
+		done <- savedUpload{img: img, decodeErr: err}
+	}()
+
+	saveErr := s.storageRepo.Save(ctx, path, io.TeeReader(r, pw))
+	// Ends the decoder's input, failing it if saving stopped midway
+	pw.CloseWithError(saveErr)
+	result := <-done
+	result.saveErr = saveErr
+	return result
+}
+
+// decodeLenient rereads file for a lenient decode after strictErr, returning
+// strictErr if that fails too
+func (s *imageService) decodeLenient(file multipart.File, format domain.ImageFormat, strictErr error) (image.Image, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, strictErr
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, strictErr
+	}
+
+	img, strategy, err := decodeLenient(data, format)
+	if err != nil {
+		return nil, strictErr
+	}
+	s.logger.Warn("strict decode failed, used lenient decode", "strategy", strategy, "error", strictErr)
+	return img, nil
+}
+
+// sizeLimitReader reads from r until more than remaining bytes arrive, then
+// fails with domain.ErrFileTooLarge
+type sizeLimitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	// Allow one byte past the limit to tell an exact fit from an overflow
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return 0, domain.ErrFileTooLarge
+	}
+	return n, err
+}
+
+// checkDimensionLimits rejects images whose header declares dimensions over
+// the configured maximums, zero meaning no limit. An unreadable header is
+// left for decoding to report.
+func checkDimensionLimits(r io.Reader, format domain.ImageFormat, cfg config.ImageConfig) error {
+	var imgCfg image.Config
+	var err error
+	switch format {
+	case domain.FormatJPEG:
+		imgCfg, err = jpeg.DecodeConfig(r)
+	case domain.FormatPNG:
+		imgCfg, err = png.DecodeConfig(r)
+	case domain.FormatGIF:
+		imgCfg, err = gif.DecodeConfig(r)
+	case domain.FormatWebP:
+		imgCfg, err = webp.DecodeConfig(r)
+	case domain.FormatTIFF:
+		imgCfg, err = tiff.DecodeConfig(r)
+	case domain.FormatBMP:
+		imgCfg, err = bmp.DecodeConfig(r)
+	default:
+		return domain.ErrInvalidFormat
+	}
+	if err != nil {
+		return nil
+	}
+
+	width, height := imgCfg.Width, imgCfg.Height
+	if (cfg.MaxWidth > 0 && width > cfg.MaxWidth) || (cfg.MaxHeight > 0 && height > cfg.MaxHeight) {
+		return fmt.Errorf("%w: %dx%d, maximum is %dx%d", domain.ErrImageTooLarge,
+			width, height, cfg.MaxWidth, cfg.MaxHeight)
+	}
+	if pixels := int64(width) * int64(height); cfg.MaxPixels > 0 && pixels > cfg.MaxPixels {
+		return fmt.Errorf("%w: %d pixels, maximum is %d", domain.ErrImageTooLarge, pixels, cfg.MaxPixels)
+	}
+	return nil
+}
+
 func decodeImageForDimensions(r io.Reader, format domain.ImageFormat) (image.Image, string, error) {
 	switch format {
 	case domain.FormatJPEG:
@@ -173,6 +803,15 @@ func decodeImageForDimensions(r io.Reader, format domain.ImageFormat) (image.Ima
 	case domain.FormatGIF:
 		img, err := gif.Decode(r)
 		return img, "gif", err
+	case domain.FormatWebP:
+		img, err := decodeWebP(r)
+		return img, "webp", err
+	case domain.FormatTIFF:
+		img, err := tiff.Decode(r)
+		return img, "tiff", err
+	case domain.FormatBMP:
+		img, err := bmp.Decode(r)
+		return img, "bmp", err
 	default:
 		return nil, "", domain.ErrInvalidFormat
 	}
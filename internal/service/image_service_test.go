@@ -0,0 +1,511 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image/gif"
+	"io"
+	"mime/multipart"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/oziev02/ImageProcessor/internal/config"
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+func TestDetectFormat(t *testing.T) {
+	var gifData bytes.Buffer
+	if err := gif.Encode(&gifData, testImage(4, 4), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want domain.ImageFormat
+	}{
+		{name: "jpeg", data: encodeJPEG(t, testImage(4, 4), 90), want: domain.FormatJPEG},
+		{name: "png", data: encodePNG(t, testImage(4, 4)), want: domain.FormatPNG},
+		{name: "gif", data: gifData.Bytes(), want: domain.FormatGIF},
+		{name: "tiff little endian", data: []byte("II*\x00\x08\x00\x00\x00"), want: domain.FormatTIFF},
+		{name: "tiff big endian", data: []byte("MM\x00*\x00\x00\x00\x08"), want: domain.FormatTIFF},
+		{name: "webp", data: []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), want: domain.FormatWebP},
+		{name: "bmp", data: []byte("BM\x00\x00\x00\x00\x00\x00\x00\x00"), want: domain.FormatBMP},
+		{name: "unrecognised", data: []byte("plain text"), want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bytes.NewReader(tt.data)
+			got, err := detectFormat(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("detectFormat = %q, want %q", got, tt.want)
+			}
+			if pos, _ := r.Seek(0, io.SeekCurrent); pos != 0 {
+				t.Errorf("reader left at %d, want it rewound", pos)
+			}
+		})
+	}
+}
+
+func TestUploadMislabeledFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		data     []byte
+		want     domain.ImageFormat
+		wantExt  string
+	}{
+		{name: "png named jpg", filename: "photo.jpg", data: encodePNG(t, testImage(8, 8)), want: domain.FormatPNG, wantExt: ".png"},
+		{name: "jpeg named png", filename: "photo.png", data: encodeJPEG(t, testImage(8, 8), 90), want: domain.FormatJPEG, wantExt: ".jpg"},
+		{name: "png without extension", filename: "photo", data: encodePNG(t, testImage(8, 8)), want: domain.FormatPNG, wantExt: ".png"},
+		{name: "correctly labelled", filename: "photo.jpeg", data: encodeJPEG(t, testImage(8, 8), 90), want: domain.FormatJPEG, wantExt: ".jpeg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestImageService(testConfig(t))
+			img, err := ts.upload(context.Background(), tt.filename, tt.data, UploadOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Format != tt.want {
+				t.Errorf("Format = %q, want %q", img.Format, tt.want)
+			}
+			if ext := filepath.Ext(img.OriginalPath); ext != tt.wantExt {
+				t.Errorf("original stored as %q, want extension %q", img.OriginalPath, tt.wantExt)
+			}
+			if ok, _ := ts.storage.Exists(context.Background(), img.OriginalPath); !ok {
+				t.Errorf("original %q not stored", img.OriginalPath)
+			}
+		})
+	}
+}
+
+// pngHeader returns the signature and IHDR chunk of a w x h RGBA PNG, with
+// none of the pixel data a real file of that size would hold
+func pngHeader(w, h uint32) []byte {
+	var ihdr bytes.Buffer
+	ihdr.WriteString("IHDR")
+	binary.Write(&ihdr, binary.BigEndian, w)
+	binary.Write(&ihdr, binary.BigEndian, h)
+	ihdr.Write([]byte{8, 6, 0, 0, 0}) // 8-bit RGBA, no interlacing
+
+	var out bytes.Buffer
+	out.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&out, binary.BigEndian, uint32(ihdr.Len()-4))
+	out.Write(ihdr.Bytes())
+	binary.Write(&out, binary.BigEndian, crc32.ChecksumIEEE(ihdr.Bytes()))
+	return out.Bytes()
+}
+
+func TestCheckDimensionLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		w, h    uint32
+		limits  config.ImageConfig
+		wantErr bool
+	}{
+		{name: "within limits", w: 1000, h: 800, limits: config.ImageConfig{MaxWidth: 4000, MaxHeight: 4000, MaxPixels: 1 << 24}},
+		{name: "too wide", w: 5000, h: 10, limits: config.ImageConfig{MaxWidth: 4000, MaxHeight: 4000}, wantErr: true},
+		{name: "too tall", w: 10, h: 5000, limits: config.ImageConfig{MaxWidth: 4000, MaxHeight: 4000}, wantErr: true},
+		{name: "too many pixels", w: 3000, h: 3000, limits: config.ImageConfig{MaxPixels: 1 << 20}, wantErr: true},
+		{name: "pixel count overflowing int32", w: 1 << 20, h: 1 << 20, limits: config.ImageConfig{MaxPixels: 1 << 30}, wantErr: true},
+		{name: "no limits", w: 1 << 20, h: 1 << 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkDimensionLimits(bytes.NewReader(pngHeader(tt.w, tt.h)), domain.FormatPNG, tt.limits)
+			if got := errors.Is(err, domain.ErrImageTooLarge); got != tt.wantErr {
+				t.Errorf("checkDimensionLimits = %v, want ErrImageTooLarge = %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUploadRejectsOversizedHeader(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Image.MaxWidth, cfg.Image.MaxHeight = 10000, 10000
+	ts := newTestImageService(cfg)
+
+	// A few bytes claiming a 100000x100000 image are rejected before
+	// anything decodes, or allocates, the pixels
+	_, err := ts.upload(context.Background(), "bomb.png", pngHeader(100000, 100000), UploadOptions{})
+	if !errors.Is(err, domain.ErrImageTooLarge) {
+		t.Fatalf("Upload = %v, want ErrImageTooLarge", err)
+	}
+	if paths := ts.storage.paths(); len(paths) != 0 {
+		t.Errorf("storage holds %v, want nothing", paths)
+	}
+	if ts.images.count() != 0 {
+		t.Errorf("%d images created, want none", ts.images.count())
+	}
+}
+
+func TestSizeLimitReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		limit   int64
+		wantErr bool
+	}{
+		{name: "under the limit", size: 100, limit: 1000},
+		{name: "exact fit", size: 1000, limit: 1000},
+		{name: "one byte over", size: 1001, limit: 1000, wantErr: true},
+		{name: "far over", size: 1 << 20, limit: 1000, wantErr: true},
+		{name: "empty", size: 0, limit: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &sizeLimitReader{r: bytes.NewReader(make([]byte, tt.size)), remaining: tt.limit}
+			n, err := io.Copy(io.Discard, l)
+			if tt.wantErr {
+				if !errors.Is(err, domain.ErrFileTooLarge) {
+					t.Fatalf("read %d bytes, error %v, want ErrFileTooLarge", n, err)
+				}
+				if n > tt.limit {
+					t.Errorf("passed on %d bytes, more than the limit of %d", n, tt.limit)
+				}
+				return
+			}
+			if err != nil || n != int64(tt.size) {
+				t.Fatalf("read %d bytes, error %v, want %d bytes", n, err, tt.size)
+			}
+			if want := tt.limit - int64(tt.size); l.remaining != want {
+				t.Errorf("remaining = %d, want %d", l.remaining, want)
+			}
+		})
+	}
+}
+
+func TestUploadUnderstatedSize(t *testing.T) {
+	cfg := testConfig(t)
+	data := encodePNG(t, testImage(200, 200))
+	cfg.Image.MaxFileSize = int64(len(data)) - 1
+	ts := newTestImageService(cfg)
+
+	// The client claims a tiny file, the bytes written are what count
+	file := uploadFile{bytes.NewReader(data)}
+	_, err := ts.Upload(context.Background(), file, &multipart.FileHeader{Filename: "big.png", Size: 10}, UploadOptions{})
+	if !errors.Is(err, domain.ErrFileTooLarge) {
+		t.Fatalf("Upload = %v, want ErrFileTooLarge", err)
+	}
+	if paths := ts.storage.paths(); len(paths) != 0 {
+		t.Errorf("storage holds %v, want nothing", paths)
+	}
+	if ts.images.count() != 0 {
+		t.Errorf("%d images created, want none", ts.images.count())
+	}
+}
+
+func TestUploadCleanup(t *testing.T) {
+	valid := encodePNG(t, testImage(200, 200))
+	tests := []struct {
+		name      string
+		data      []byte
+		createErr error
+		wantErr   error
+	}{
+		// The header passes the checks, the pixels after it are cut off
+		{name: "decode failure", data: valid[:len(valid)/2], wantErr: domain.ErrInvalidFormat},
+		{name: "record failure", data: valid, createErr: errors.New("connection reset")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestImageService(testConfig(t))
+			ts.images.createErr = tt.createErr
+
+			_, err := ts.upload(context.Background(), "a.png", tt.data, UploadOptions{})
+			if err == nil {
+				t.Fatal("Upload succeeded")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Upload = %v, want %v", err, tt.wantErr)
+			}
+			if paths := ts.storage.paths(); len(paths) != 0 {
+				t.Errorf("storage holds %v after the failed upload", paths)
+			}
+			if ts.images.count() != 0 {
+				t.Errorf("%d images left after the failed upload", ts.images.count())
+			}
+			if sent := ts.producer.sent(); len(sent) != 0 {
+				t.Errorf("%d tasks sent for the failed upload", len(sent))
+			}
+		})
+	}
+}
+
+func TestUploadProducerFailure(t *testing.T) {
+	ts := newTestImageService(testConfig(t))
+	ts.producer.err = errors.New("kafka unavailable")
+
+	// The tasks are queued with the record, so the upload stands and waits
+	// for the outbox relay rather than being rolled back
+	img, err := ts.upload(context.Background(), "a.png", encodePNG(t, testImage(200, 200)), UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.images.GetByID(context.Background(), img.ID); err != nil {
+		t.Fatalf("image record: %v", err)
+	}
+	if paths := ts.storage.paths(); !slices.Equal(paths, []string{img.OriginalPath}) {
+		t.Errorf("storage holds %v, want only the original %s", paths, img.OriginalPath)
+	}
+	ts.images.mu.Lock()
+	queued := len(ts.images.tasks)
+	ts.images.mu.Unlock()
+	if queued == 0 {
+		t.Error("no tasks queued in the outbox")
+	}
+	if len(ts.outbox.sent) != 0 {
+		t.Errorf("outbox messages %v marked sent although sending failed", ts.outbox.sent)
+	}
+}
+
+func TestReprocess(t *testing.T) {
+	tests := []struct {
+		name           string
+		thumbnailTopic string
+		producerErr    error
+		wantKinds      []domain.TaskKind
+	}{
+		{name: "single task", wantKinds: []domain.TaskKind{domain.TaskKindAll}},
+		{name: "thumbnail topic", thumbnailTopic: "thumbnails", wantKinds: []domain.TaskKind{domain.TaskKindProcessed, domain.TaskKindThumbnail}},
+		{name: "kafka unavailable", producerErr: errors.New("kafka unavailable"), wantKinds: []domain.TaskKind{domain.TaskKindAll}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			cfg := testConfig(t)
+			cfg.Kafka.ThumbnailTopic = tt.thumbnailTopic
+			ts := newTestImageService(cfg)
+			ts.producer.err = tt.producerErr
+			seedOriginal(t, ts.images, ts.storage, "a", encodePNG(t, testImage(40, 30)), domain.FormatPNG)
+			ts.images.images["a"].Status = domain.StatusFailed
+			ts.images.images["a"].ProcessingAttempts = 3
+			ts.images.images["a"].FailureReason = "storage unavailable"
+
+			img, err := ts.Reprocess(ctx, "a", domain.PriorityLow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, _ := ts.images.GetByID(ctx, "a")
+			for _, got := range []*domain.Image{img, stored} {
+				if got.Status != domain.StatusPending || got.ProcessingAttempts != 0 || got.FailureReason != "" {
+					t.Errorf("status %s, %d attempts, reason %q, want a reset pending image",
+						got.Status, got.ProcessingAttempts, got.FailureReason)
+				}
+			}
+
+			// Every task is queued in the outbox, whether or not it's sent
+			ts.images.mu.Lock()
+			queued := slices.Clone(ts.images.tasks)
+			ts.images.mu.Unlock()
+			var kinds []domain.TaskKind
+			for _, task := range queued {
+				kinds = append(kinds, task.Kind)
+				if task.ImageID != "a" || task.ImagePath != "original/a.png" || task.Format != domain.FormatPNG {
+					t.Errorf("task for %s at %s as %s, want a at original/a.png as png", task.ImageID, task.ImagePath, task.Format)
+				}
+				if task.Origin != domain.TaskOriginReprocess || task.Priority != domain.PriorityLow {
+					t.Errorf("task origin %q, priority %d, want reprocess at low priority", task.Origin, task.Priority)
+				}
+			}
+			if !slices.Equal(kinds, tt.wantKinds) {
+				t.Errorf("queued task kinds %v, want %v", kinds, tt.wantKinds)
+			}
+
+			wantSent := len(tt.wantKinds)
+			if tt.producerErr != nil {
+				wantSent = 0
+			}
+			if sent := ts.producer.sent(); len(sent) != wantSent {
+				t.Errorf("%d tasks sent, want %d", len(sent), wantSent)
+			}
+			if len(ts.outbox.sent) != wantSent {
+				t.Errorf("%d outbox messages marked sent, want %d", len(ts.outbox.sent), wantSent)
+			}
+		})
+	}
+}
+
+func TestReprocessOriginalMissing(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestImageService(testConfig(t))
+	seedOriginal(t, ts.images, ts.storage, "a", encodePNG(t, testImage(40, 30)), domain.FormatPNG)
+	if err := ts.storage.Delete(ctx, "original/a.png"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ts.Reprocess(ctx, "a", domain.PriorityNormal); !errors.Is(err, domain.ErrOriginalMissing) {
+		t.Fatalf("Reprocess = %v, want ErrOriginalMissing", err)
+	}
+	if len(ts.images.tasks) != 0 || len(ts.producer.sent()) != 0 {
+		t.Error("tasks queued for an image without its original")
+	}
+	if _, err := ts.Reprocess(ctx, "missing", domain.PriorityNormal); !errors.Is(err, domain.ErrImageNotFound) {
+		t.Errorf("Reprocess of an unknown image = %v, want ErrImageNotFound", err)
+	}
+}
+
+func TestUploadIdempotencyKey(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestImageService(testConfig(t))
+	data := encodePNG(t, testImage(200, 200))
+	opts := UploadOptions{IdempotencyKey: "key-1"}
+
+	first, err := ts.upload(ctx, "a.png", data, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A retry of the same request gets the same image
+	again, err := ts.upload(ctx, "a.png", data, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != first.ID {
+		t.Errorf("retry created %s, want the first upload's %s", again.ID, first.ID)
+	}
+	// Another key is another upload
+	other, err := ts.upload(ctx, "a.png", data, UploadOptions{IdempotencyKey: "key-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.ID == first.ID {
+		t.Error("a different key returned the first upload")
+	}
+
+	if ts.images.count() != 2 {
+		t.Errorf("%d images, want one per key", ts.images.count())
+	}
+	if len(ts.images.tasks) != 2 {
+		t.Errorf("%d tasks queued, want one per key", len(ts.images.tasks))
+	}
+	if paths := ts.storage.paths(); len(paths) != 2 {
+		t.Errorf("storage holds %v, want one original per key", paths)
+	}
+}
+
+func TestUploadIdempotencyKeyConcurrent(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestImageService(testConfig(t))
+	data := encodePNG(t, testImage(200, 200))
+
+	// Uploads racing past the lookup conflict on creation and get the winner
+	const uploads = 8
+	ids := make([]string, uploads)
+	errs := make([]error, uploads)
+	var wg sync.WaitGroup
+	for i := range uploads {
+		wg.Go(func() {
+			img, err := ts.upload(ctx, "a.png", data, UploadOptions{IdempotencyKey: "key-1"})
+			if err == nil {
+				ids[i] = img.ID
+			}
+			errs[i] = err
+		})
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("upload %d: %v", i, err)
+		}
+		if ids[i] != ids[0] {
+			t.Errorf("upload %d got %s, upload 0 %s", i, ids[i], ids[0])
+		}
+	}
+	if ts.images.count() != 1 {
+		t.Errorf("%d images, want one", ts.images.count())
+	}
+	if paths := ts.storage.paths(); len(paths) != 1 {
+		t.Errorf("storage holds %v, want only the winner's original", paths)
+	}
+}
+
+func TestDeleteByStatus(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestImageService(testConfig(t))
+	for id, status := range map[string]domain.ProcessingStatus{
+		"failed-1": domain.StatusFailed, "failed-2": domain.StatusFailed, "done": domain.StatusCompleted,
+	} {
+		seedOriginal(t, ts.images, ts.storage, id, []byte(id), domain.FormatPNG)
+		ts.images.images[id].Status = status
+	}
+
+	n, err := ts.DeleteByStatus(ctx, domain.StatusFailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("deleted %d images, want 2", n)
+	}
+	if _, err := ts.GetByID(ctx, "done"); err != nil {
+		t.Errorf("completed image: %v", err)
+	}
+	if paths := ts.storage.paths(); !slices.Equal(paths, []string{"original/done.png"}) {
+		t.Errorf("storage holds %v, want only the completed image's original", paths)
+	}
+}
+
+func TestHardDelete(t *testing.T) {
+	ctx := context.Background()
+	errStorage := errors.New("storage unavailable")
+	files := map[string]string{
+		"original/a.png":   "original",
+		"processed/a.png":  "processed",
+		"thumbnails/a.png": "thumbnail",
+	}
+	tests := []struct {
+		name       string
+		deleteErrs map[string]error
+		wantErr    error
+		wantLeft   []string
+	}{
+		{name: "all files removed"},
+		{
+			name:       "file left behind",
+			deleteErrs: map[string]error{"processed/a.png": errStorage},
+			wantErr:    domain.ErrFilesNotDeleted,
+			wantLeft:   []string{"processed/a.png"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestImageService(testConfig(t))
+			for path, data := range files {
+				ts.storage.files[path] = []byte(data)
+			}
+			ts.images.images["a"] = &domain.Image{
+				ID: "a", OriginalPath: "original/a.png", ProcessedPath: "processed/a.png", ThumbnailPath: "thumbnails/a.png",
+			}
+			ts.storage.deleteErrs = tt.deleteErrs
+
+			err := ts.HardDelete(ctx, "a")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("HardDelete error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil && !errors.Is(err, errStorage) {
+				t.Errorf("error %v doesn't wrap the storage error", err)
+			}
+			// The record goes regardless, and the other files with it
+			if _, err := ts.GetByID(ctx, "a"); !errors.Is(err, domain.ErrImageNotFound) {
+				t.Errorf("GetByID after delete = %v, want ErrImageNotFound", err)
+			}
+			if paths := ts.storage.paths(); !slices.Equal(paths, tt.wantLeft) {
+				t.Errorf("storage holds %v, want %v", paths, tt.wantLeft)
+			}
+
+			// Deleting again finds nothing, even with files left over
+			if err := ts.HardDelete(ctx, "a"); !errors.Is(err, domain.ErrImageNotFound) {
+				t.Errorf("second HardDelete = %v, want ErrImageNotFound", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"path/filepath"
+
+	"github.com/oziev02/ImageProcessor/internal/config"
+)
+
+// Kinds of stored files, also the directory names of the split layout
+const (
+	fileOriginal  = "original"
+	fileProcessed = "processed"
+	fileThumbnail = "thumbnail"
+	fileLQIP      = "lqip"
+)
+
+// groupedNames are the file names of each kind in the grouped layout
+var groupedNames = map[string]string{
+	fileOriginal:  "original",
+	fileProcessed: "processed",
+	fileThumbnail: "thumb",
+	fileLQIP:      "lqip",
+}
+
+// storagePath builds the storage path of one of an image's files. The split
+// layout is {kind}/{id}{ext}, the grouped one {id}/{name}{ext}.
+func storagePath(cfg config.StorageConfig, kind, imageID, ext string) string {
+	shard := shardPrefix(cfg, imageID)
+	if cfg.Layout == config.StorageLayoutGrouped {
+		return filepath.Join(shard, imageID, groupedNames[kind]+ext)
+	}
+	return filepath.Join(kind, shard, imageID+ext)
+}
+
+// thumbnailVariantPath builds the path of a labelled thumbnail variant:
+// thumbnail/{label}/{id}{ext} split, {id}/thumb_{label}{ext} grouped
+func thumbnailVariantPath(cfg config.StorageConfig, label, imageID, ext string) string {
+	shard := shardPrefix(cfg, imageID)
+	if cfg.Layout == config.StorageLayoutGrouped {
+		return filepath.Join(shard, imageID, groupedNames[fileThumbnail]+"_"+label+ext)
+	}
+	return filepath.Join(fileThumbnail, label, shard, imageID+ext)
+}
+
+// shardPrefix returns the two directory levels placed before the image's
+// files when sharding is enabled, taken from the first four characters of
+// its ID: ab/cd for abcd1234-... IDs too short to shard get no prefix.
+func shardPrefix(cfg config.StorageConfig, imageID string) string {
+	if !cfg.PathSharding || len(imageID) < 4 {
+		return ""
+	}
+	return filepath.Join(imageID[:2], imageID[2:4])
+}
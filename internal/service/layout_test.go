@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/oziev02/ImageProcessor/internal/config"
+)
+
+func TestStoragePath(t *testing.T) {
+	const id = "abcd1234-ef"
+	tests := []struct {
+		name    string
+		cfg     config.StorageConfig
+		kind    string
+		imageID string
+		want    string
+	}{
+		{name: "split", cfg: config.StorageConfig{Layout: config.StorageLayoutSplit}, kind: fileOriginal, imageID: id, want: "original/abcd1234-ef.png"},
+		{name: "grouped", cfg: config.StorageConfig{Layout: config.StorageLayoutGrouped}, kind: fileThumbnail, imageID: id, want: "abcd1234-ef/thumb.png"},
+		{name: "split sharded", cfg: config.StorageConfig{Layout: config.StorageLayoutSplit, PathSharding: true}, kind: fileProcessed, imageID: id, want: "processed/ab/cd/abcd1234-ef.png"},
+		{name: "grouped sharded", cfg: config.StorageConfig{Layout: config.StorageLayoutGrouped, PathSharding: true}, kind: fileLQIP, imageID: id, want: "ab/cd/abcd1234-ef/lqip.png"},
+		{name: "too short to shard", cfg: config.StorageConfig{Layout: config.StorageLayoutSplit, PathSharding: true}, kind: fileOriginal, imageID: "abc", want: "original/abc.png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := storagePath(tt.cfg, tt.kind, tt.imageID, ".png")
+			if got != filepath.FromSlash(tt.want) {
+				t.Errorf("storagePath = %q, want %q", got, tt.want)
+			}
+			// The path is derived from the ID alone, so it's found again later
+			if again := storagePath(tt.cfg, tt.kind, tt.imageID, ".png"); again != got {
+				t.Errorf("second storagePath = %q, first %q", again, got)
+			}
+		})
+	}
+
+	cfg := config.StorageConfig{Layout: config.StorageLayoutSplit, PathSharding: true}
+	if got, want := thumbnailVariantPath(cfg, "small", id, ".jpg"), filepath.FromSlash("thumbnail/small/ab/cd/abcd1234-ef.jpg"); got != want {
+		t.Errorf("thumbnailVariantPath = %q, want %q", got, want)
+	}
+}
+
+func TestShardedLayout(t *testing.T) {
+	for _, layout := range []string{config.StorageLayoutSplit, config.StorageLayoutGrouped} {
+		t.Run(layout, func(t *testing.T) {
+			ctx := context.Background()
+			cfg := testConfig(t)
+			cfg.Storage.Layout = layout
+			cfg.Storage.PathSharding = true
+			ts := newTestImageService(cfg)
+
+			img, err := ts.upload(ctx, "a.png", encodePNG(t, testImage(400, 300)), UploadOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			processor := newTestProcessor(cfg, ts.images, ts.storage)
+			if err := processor.ProcessImage(ctx, ts.images.tasks[0]); err != nil {
+				t.Fatal(err)
+			}
+			img, err = ts.GetByID(ctx, img.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Every file is written under the image's shard and read back from it
+			sharded := filepath.Join(img.ID[:2], img.ID[2:4], img.ID)
+			paths := ts.storage.paths()
+			if len(paths) < 3 {
+				t.Fatalf("stored %v, want the original, processed file and thumbnail", paths)
+			}
+			for _, path := range paths {
+				if !strings.Contains(path, sharded) {
+					t.Errorf("%s is outside the shard %s", path, sharded)
+				}
+			}
+			for _, path := range []string{img.OriginalPath, img.ProcessedPath, img.ThumbnailPath} {
+				rc, err := ts.storage.Read(ctx, path)
+				if err != nil {
+					t.Errorf("reading %s: %v", path, err)
+					continue
+				}
+				rc.Close()
+			}
+
+			// Deleting finds them all at the same paths
+			if err := ts.HardDelete(ctx, img.ID); err != nil {
+				t.Fatal(err)
+			}
+			if paths := ts.storage.paths(); len(paths) != 0 {
+				t.Errorf("storage holds %v after HardDelete", paths)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+const (
+	// lqipWidth is the width of the low-quality placeholder; clients scale
+	// it up blurred, so a few hundred bytes are enough
+	lqipWidth   = 20
+	lqipQuality = 30
+
+	// The inline placeholder is blurred before encoding so that it looks the
+	// same however the client scales it
+	placeholderWidth = 16
+	placeholderSigma = 1.5
+)
+
+// placeholderPrefix makes the stored placeholder usable as an img src as is
+const placeholderPrefix = "data:image/jpeg;base64,"
+
+// generateLQIP stores a tiny, heavily compressed JPEG of src to show while
+// the full image loads. It's always JPEG whatever the output format.
+func (s *processorService) generateLQIP(ctx context.Context, imageID string, src image.Image) (string, error) {
+	var buf bytes.Buffer
+	err := s.throttle.run(ctx, func() error {
+		img := src
+		if src.Bounds().Dx() > lqipWidth {
+			img = resize.Resize(lqipWidth, 0, src, resize.Bilinear)
+		}
+		if err := jpeg.Encode(&buf, s.flatten(img), &jpeg.Options{Quality: lqipQuality}); err != nil {
+			return fmt.Errorf("failed to encode placeholder: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	path := storagePath(s.cfg.Storage, fileLQIP, imageID, ".jpg")
+	if err := s.storageRepo.Save(ctx, path, &buf); err != nil {
+		return "", fmt.Errorf("failed to save placeholder: %w", err)
+	}
+	return path, nil
+}
+
+// generatePlaceholder returns a tiny, blurred JPEG of src as a data URI to
+// be stored on the record and inlined by clients
+func (s *processorService) generatePlaceholder(ctx context.Context, src image.Image) (string, error) {
+	var img image.Image
+	err := s.throttle.run(ctx, func() error {
+		img = s.flatten(src)
+		if img.Bounds().Dx() > placeholderWidth {
+			img = resize.Resize(placeholderWidth, 0, img, resize.Bilinear)
+		}
+		img = gaussianBlur(img, placeholderSigma)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return encodePlaceholder(img)
+}
+
+func encodePlaceholder(img image.Image) (string, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: lqipQuality}); err != nil {
+		return "", fmt.Errorf("failed to encode placeholder: %w", err)
+	}
+	return placeholderPrefix + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// rotatePlaceholder rotates a placeholder made by generatePlaceholder
+func rotatePlaceholder(placeholder string, degrees int) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(placeholder, placeholderPrefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode placeholder: %w", err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode placeholder: %w", err)
+	}
+	return encodePlaceholder(rotateImage(img, degrees))
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+func TestPlaceholder(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		ctx := context.Background()
+		cfg := testConfig(t)
+		cfg.Image.GeneratePlaceholder = enabled
+		images, storage := newFakeImages(), newMemStorage()
+		task := seedOriginal(t, images, storage, "a", encodePNG(t, testImage(800, 600)), domain.FormatPNG)
+		if err := newTestProcessor(cfg, images, storage).ProcessImage(ctx, task); err != nil {
+			t.Fatal(err)
+		}
+		img, _ := images.GetByID(ctx, "a")
+
+		// The LQIP file comes with every thumbnail
+		rc, err := storage.Read(ctx, img.LQIPPath)
+		if err != nil {
+			t.Fatalf("LQIP %q: %v", img.LQIPPath, err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		if lqip, err := jpeg.DecodeConfig(bytes.NewReader(data)); err != nil || lqip.Width != lqipWidth || lqip.Height != 15 {
+			t.Errorf("LQIP is %dx%d (%v), want %dx15", lqip.Width, lqip.Height, err, lqipWidth)
+		}
+		if len(data) > 2048 {
+			t.Errorf("LQIP is %d bytes, want a tiny file", len(data))
+		}
+
+		if !enabled {
+			if img.Placeholder != "" {
+				t.Errorf("placeholder generated while disabled: %q", img.Placeholder)
+			}
+			continue
+		}
+		// The inline placeholder is a data URI small enough to embed
+		if !strings.HasPrefix(img.Placeholder, placeholderPrefix) {
+			t.Fatalf("placeholder %.40q is not a JPEG data URI", img.Placeholder)
+		}
+		if len(img.Placeholder) > 2048 {
+			t.Errorf("placeholder is %d bytes, want a tiny preview", len(img.Placeholder))
+		}
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(img.Placeholder, placeholderPrefix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if preview, err := jpeg.DecodeConfig(bytes.NewReader(raw)); err != nil || preview.Width != placeholderWidth {
+			t.Errorf("placeholder is %d wide (%v), want %d", preview.Width, err, placeholderWidth)
+		}
+	}
+}
+
+func TestGaussianBlur(t *testing.T) {
+	// A hard black to white edge down the middle
+	src := image.NewNRGBA(image.Rect(0, 0, 16, 4))
+	for y := range 4 {
+		for x := range 16 {
+			v := uint8(0)
+			if x >= 8 {
+				v = 255
+			}
+			src.SetNRGBA(x, y, color.NRGBA{v, v, v, 255})
+		}
+	}
+
+	blurred := gaussianBlur(src, 1.5)
+	left, right := blurred.NRGBAAt(7, 2).R, blurred.NRGBAAt(8, 2).R
+	if left == 0 || right == 255 || left >= right {
+		t.Errorf("edge pixels %d and %d, want a gradient across the edge", left, right)
+	}
+	// Far from the edge nothing changes
+	if far := blurred.NRGBAAt(0, 2); far.R != 0 || far.A != 255 {
+		t.Errorf("pixel far from the edge = %v, want black", far)
+	}
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"io"
+	"strings"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// exifTimeLayout formats the capture time as the camera recorded it, in its
+// local time, since EXIF rarely says which zone that was
+const exifTimeLayout = "2006-01-02T15:04:05"
+
+// extractMetadata reads camera metadata from the EXIF in r, leaving fields
+// empty when there's no EXIF or a tag is missing. GPS coordinates reveal
+// where a photo was taken, so they're only kept with keepGPS.
+func extractMetadata(r io.Reader, keepGPS bool) domain.ImageMetadata {
+	var meta domain.ImageMetadata
+	x, err := exif.Decode(r)
+	if err != nil {
+		return meta
+	}
+
+	meta.Make = exifString(x, exif.Make)
+	meta.Model = exifString(x, exif.Model)
+	if t, err := x.DateTime(); err == nil {
+		meta.CapturedAt = t.Format(exifTimeLayout)
+	}
+	if keepGPS {
+		if lat, long, err := x.LatLong(); err == nil {
+			meta.GPS = &domain.GPSLocation{Latitude: lat, Longitude: long}
+		}
+	}
+	return meta
+}
+
+// exifString returns a string tag trimmed of the padding cameras add
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	value, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(value, "\x00"))
+}
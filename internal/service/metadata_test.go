@@ -0,0 +1,170 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+// exifEntry is a tag of an IFD with its value as stored
+type exifEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+}
+
+func exifASCII(tag uint16, s string) exifEntry {
+	return exifEntry{tag: tag, typ: 2, count: uint32(len(s) + 1), value: append([]byte(s), 0)}
+}
+
+// exifDegrees is a GPS coordinate as three RATIONALs, minutes and seconds
+// to the hundredth
+func exifDegrees(tag uint16, deg float64) exifEntry {
+	d := math.Floor(deg)
+	m := math.Floor((deg - d) * 60)
+	s := ((deg-d)*60 - m) * 60
+	var v bytes.Buffer
+	for _, r := range [][2]uint32{{uint32(d), 1}, {uint32(m), 1}, {uint32(math.Round(s * 100)), 100}} {
+		binary.Write(&v, binary.LittleEndian, r)
+	}
+	return exifEntry{tag: tag, typ: 5, count: 3, value: v.Bytes()}
+}
+
+// writeIFD appends an IFD of entries, sorted by tag, to tiff, with values
+// too long to be inline right after it
+func writeIFD(tiff *bytes.Buffer, entries []exifEntry) {
+	dataOffset := uint32(tiff.Len() + 2 + 12*len(entries) + 4)
+	var data bytes.Buffer
+	binary.Write(tiff, binary.LittleEndian, uint16(len(entries)))
+	for _, e := range entries {
+		binary.Write(tiff, binary.LittleEndian, e.tag)
+		binary.Write(tiff, binary.LittleEndian, e.typ)
+		binary.Write(tiff, binary.LittleEndian, e.count)
+		if len(e.value) <= 4 {
+			tiff.Write(append(e.value, make([]byte, 4-len(e.value))...))
+			continue
+		}
+		binary.Write(tiff, binary.LittleEndian, dataOffset+uint32(data.Len()))
+		data.Write(e.value)
+		if data.Len()%2 == 1 {
+			data.WriteByte(0)
+		}
+	}
+	binary.Write(tiff, binary.LittleEndian, uint32(0)) // no next IFD
+	tiff.Write(data.Bytes())
+}
+
+// withCameraExif inserts an EXIF segment with camera, capture time and GPS
+// tags after the start-of-image marker of a JPEG
+func withCameraExif(jpegData []byte, lat, long float64) []byte {
+	gps := []exifEntry{
+		exifASCII(0x0001, "N"),
+		exifDegrees(0x0002, lat),
+		exifASCII(0x0003, "E"),
+		exifDegrees(0x0004, long),
+	}
+	ifd0 := []exifEntry{
+		exifASCII(0x010f, "Canon\x00\x00"), // padded the way cameras do
+		exifASCII(0x0110, "  Canon EOS R5 "),
+		exifASCII(0x0132, "2024:05:17 14:03:59"),
+		{tag: 0x8825, typ: 4, count: 1}, // GPS IFD pointer, set below
+	}
+
+	var tiff bytes.Buffer
+	tiff.WriteString("II*\x00")
+	binary.Write(&tiff, binary.LittleEndian, uint32(8))
+	// IFD0 is written twice, the second time knowing where the GPS IFD goes
+	for range 2 {
+		tiff.Truncate(8)
+		writeIFD(&tiff, ifd0)
+		ifd0[3].value = binary.LittleEndian.AppendUint32(nil, uint32(tiff.Len()))
+	}
+	writeIFD(&tiff, gps)
+
+	payload := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	var out bytes.Buffer
+	out.Write(jpegData[:2])
+	out.Write([]byte{0xff, 0xe1})
+	binary.Write(&out, binary.BigEndian, uint16(len(payload)+2))
+	out.Write(payload)
+	out.Write(jpegData[2:])
+	return out.Bytes()
+}
+
+func TestExtractMetadata(t *testing.T) {
+	plain := encodeJPEG(t, testImage(8, 8), 90)
+	photo := withCameraExif(plain, 55.75, 37.62)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		keepGPS bool
+		want    domain.ImageMetadata
+	}{
+		{
+			name: "camera sample",
+			data: photo,
+			want: domain.ImageMetadata{Make: "Canon", Model: "Canon EOS R5", CapturedAt: "2024-05-17T14:03:59"},
+		},
+		{
+			name:    "camera sample keeping GPS",
+			data:    photo,
+			keepGPS: true,
+			want: domain.ImageMetadata{Make: "Canon", Model: "Canon EOS R5", CapturedAt: "2024-05-17T14:03:59",
+				GPS: &domain.GPSLocation{Latitude: 55.75, Longitude: 37.62}},
+		},
+		{name: "no EXIF", data: plain, keepGPS: true},
+		{name: "orientation only", data: withOrientation(plain, 6), keepGPS: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := extractMetadata(bytes.NewReader(tt.data), tt.keepGPS)
+			if got.Make != tt.want.Make || got.Model != tt.want.Model || got.CapturedAt != tt.want.CapturedAt {
+				t.Errorf("metadata = %+v, want %+v", got, tt.want)
+			}
+			switch {
+			case tt.want.GPS == nil && got.GPS != nil:
+				t.Errorf("GPS = %+v, want none", *got.GPS)
+			case tt.want.GPS != nil && got.GPS == nil:
+				t.Error("GPS missing")
+			case tt.want.GPS != nil:
+				if math.Abs(got.GPS.Latitude-tt.want.GPS.Latitude) > 1e-4 || math.Abs(got.GPS.Longitude-tt.want.GPS.Longitude) > 1e-4 {
+					t.Errorf("GPS = %+v, want %+v", *got.GPS, *tt.want.GPS)
+				}
+			}
+		})
+	}
+}
+
+func TestMetadataWithoutExifIsEmptyObject(t *testing.T) {
+	meta := extractMetadata(bytes.NewReader(encodeJPEG(t, testImage(8, 8), 90)), true)
+	data, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "{}" {
+		t.Errorf("metadata without EXIF = %s, want {}", data)
+	}
+}
+
+func TestUploadStoresMetadata(t *testing.T) {
+	ts := newTestImageService(testConfig(t))
+	photo := withCameraExif(encodeJPEG(t, testImage(200, 200), 90), 55.75, 37.62)
+
+	img, err := ts.upload(context.Background(), "photo.jpg", photo, UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := ts.images.GetByID(context.Background(), img.ID)
+	if stored.Metadata.Model != "Canon EOS R5" || stored.Metadata.CapturedAt != "2024-05-17T14:03:59" {
+		t.Errorf("stored metadata = %+v", stored.Metadata)
+	}
+	if stored.Metadata.GPS != nil {
+		t.Error("GPS stored without IMAGE_KEEP_GPS")
+	}
+}
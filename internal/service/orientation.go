@@ -0,0 +1,74 @@
+package service
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// exifOrientation returns the EXIF orientation of a JPEG, 1 (upright) when
+// the tag is missing or unreadable
+func exifOrientation(data []byte) int {
+	x, err := exif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 1
+	}
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+	orientation, err := tag.Int(0)
+	if err != nil || orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return orientation
+}
+
+// applyOrientation rotates and flips img as the EXIF orientation requires
+// for it to display upright
+func applyOrientation(img image.Image, orientation int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// Maps a destination pixel to the source pixel it's copied from
+	var from func(x, y int) (int, int)
+	dw, dh := w, h
+	switch orientation {
+	case 2: // mirrored horizontally
+		from = func(x, y int) (int, int) { return w - 1 - x, y }
+	case 3: // rotated 180
+		from = func(x, y int) (int, int) { return w - 1 - x, h - 1 - y }
+	case 4: // mirrored vertically
+		from = func(x, y int) (int, int) { return x, h - 1 - y }
+	case 5: // mirrored horizontally, then rotated 270 CW
+		from = func(x, y int) (int, int) { return y, x }
+		dw, dh = h, w
+	case 6: // rotated 90 CW
+		from = func(x, y int) (int, int) { return y, h - 1 - x }
+		dw, dh = h, w
+	case 7: // mirrored horizontally, then rotated 90 CW
+		from = func(x, y int) (int, int) { return w - 1 - y, h - 1 - x }
+		dw, dh = h, w
+	case 8: // rotated 270 CW
+		from = func(x, y int) (int, int) { return w - 1 - y, x }
+		dw, dh = h, w
+	default:
+		return img
+	}
+
+	// Copy through RGBA pixel buffers rather than At/Set, which are slow
+	// for photo-sized images
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := from(x, y)
+			si := src.PixOffset(sx, sy)
+			copy(dst.Pix[dst.PixOffset(x, y):][:4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// withOrientation inserts an EXIF segment with the given orientation after
+// the start-of-image marker of a JPEG
+func withOrientation(jpegData []byte, orientation uint16) []byte {
+	var tiff bytes.Buffer
+	tiff.WriteString("II*\x00")
+	binary.Write(&tiff, binary.LittleEndian, uint32(8)) // offset of IFD0
+	binary.Write(&tiff, binary.LittleEndian, uint16(1)) // one entry
+	binary.Write(&tiff, binary.LittleEndian, uint16(0x0112))
+	binary.Write(&tiff, binary.LittleEndian, uint16(3)) // SHORT
+	binary.Write(&tiff, binary.LittleEndian, uint32(1))
+	binary.Write(&tiff, binary.LittleEndian, orientation)
+	binary.Write(&tiff, binary.LittleEndian, uint16(0))
+	binary.Write(&tiff, binary.LittleEndian, uint32(0)) // no next IFD
+
+	payload := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	var out bytes.Buffer
+	out.Write(jpegData[:2])
+	out.Write([]byte{0xff, 0xe1})
+	binary.Write(&out, binary.BigEndian, uint16(len(payload)+2))
+	out.Write(payload)
+	out.Write(jpegData[2:])
+	return out.Bytes()
+}
+
+func TestExifOrientation(t *testing.T) {
+	plain := encodeJPEG(t, testImage(8, 8), 90)
+	if got := exifOrientation(plain); got != 1 {
+		t.Errorf("without EXIF: orientation = %d, want 1", got)
+	}
+	for orientation := uint16(1); orientation <= 8; orientation++ {
+		if got := exifOrientation(withOrientation(plain, orientation)); got != int(orientation) {
+			t.Errorf("orientation = %d, want %d", got, orientation)
+		}
+	}
+	// Out-of-range values are treated as upright
+	if got := exifOrientation(withOrientation(plain, 9)); got != 1 {
+		t.Errorf("invalid orientation 9 read as %d, want 1", got)
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// A 3x2 image as stored, marked at the first two pixels of its first row
+	red := color.RGBA{R: 255, A: 255}
+	green := color.RGBA{G: 255, A: 255}
+	stored := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	stored.Set(0, 0, red)
+	stored.Set(1, 0, green)
+
+	// Where the marks must be once displayed upright, following the EXIF
+	// definition of where the stored first row and column go
+	tests := []struct {
+		orientation int
+		size        image.Point
+		red, green  image.Point
+	}{
+		{orientation: 1, size: image.Pt(3, 2), red: image.Pt(0, 0), green: image.Pt(1, 0)},
+		{orientation: 2, size: image.Pt(3, 2), red: image.Pt(2, 0), green: image.Pt(1, 0)},
+		{orientation: 3, size: image.Pt(3, 2), red: image.Pt(2, 1), green: image.Pt(1, 1)},
+		{orientation: 4, size: image.Pt(3, 2), red: image.Pt(0, 1), green: image.Pt(1, 1)},
+		{orientation: 5, size: image.Pt(2, 3), red: image.Pt(0, 0), green: image.Pt(0, 1)},
+		{orientation: 6, size: image.Pt(2, 3), red: image.Pt(1, 0), green: image.Pt(1, 1)},
+		{orientation: 7, size: image.Pt(2, 3), red: image.Pt(1, 2), green: image.Pt(1, 1)},
+		{orientation: 8, size: image.Pt(2, 3), red: image.Pt(0, 2), green: image.Pt(0, 1)},
+	}
+	for _, tt := range tests {
+		got := applyOrientation(stored, tt.orientation)
+		if size := got.Bounds().Size(); size != tt.size {
+			t.Errorf("orientation %d: size = %v, want %v", tt.orientation, size, tt.size)
+			continue
+		}
+		if c := got.At(tt.red.X, tt.red.Y); !sameColor(c, red) {
+			t.Errorf("orientation %d: pixel %v = %v, want red", tt.orientation, tt.red, c)
+		}
+		if c := got.At(tt.green.X, tt.green.Y); !sameColor(c, green) {
+			t.Errorf("orientation %d: pixel %v = %v, want green", tt.orientation, tt.green, c)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/oziev02/ImageProcessor/internal/config"
+	"github.com/oziev02/ImageProcessor/internal/domain"
+	"github.com/oziev02/ImageProcessor/internal/repo"
+	kafkatransport "github.com/oziev02/ImageProcessor/internal/transport/kafka"
+)
+
+// OutboxRelay publishes the processing tasks left in the outbox, because
+// Kafka was unavailable during their upload or the process stopped before
+// sending them
+type OutboxRelay interface {
+	Run(ctx context.Context)
+}
+
+type outboxRelay struct {
+	outboxRepo repo.OutboxRepository
+	producer   kafkatransport.Producer
+	cfg        *config.Config
+	logger     *slog.Logger
+}
+
+func NewOutboxRelay(
+	outboxRepo repo.OutboxRepository,
+	producer kafkatransport.Producer,
+	cfg *config.Config,
+	logger *slog.Logger,
+) OutboxRelay {
+	return &outboxRelay{
+		outboxRepo: outboxRepo,
+		producer:   producer,
+		cfg:        cfg,
+		logger:     logger,
+	}
+}
+
+// Run relays the outbox every KAFKA_OUTBOX_RELAY_INTERVAL until ctx is done
+func (r *outboxRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.Kafka.OutboxRelayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.relay(ctx)
+		}
+	}
+}
+
+// relay publishes unsent tasks batch by batch until none is left or
+// publishing fails, then drops tasks sent before the retention period
+func (r *outboxRelay) relay(ctx context.Context) {
+	// Younger tasks may still be being sent by their upload
+	createdBefore := time.Now().Add(-r.cfg.Kafka.OutboxRelayInterval)
+	publish := func(msg *domain.OutboxMessage) error {
+		return r.producer.SendTask(ctx, msg.Task)
+	}
+	for {
+		sent, err := r.outboxRepo.RelayUnsent(ctx, createdBefore, r.cfg.Kafka.OutboxBatchSize, publish)
+		if sent > 0 {
+			r.logger.Info("relayed processing tasks from the outbox", "count", sent)
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				r.logger.Warn("failed to relay processing tasks", "error", err)
+			}
+			return
+		}
+		if sent < r.cfg.Kafka.OutboxBatchSize {
+			break
+		}
+	}
+
+	pruned, err := r.outboxRepo.PruneSent(ctx, r.cfg.Kafka.OutboxRetention)
+	if err != nil {
+		if ctx.Err() == nil {
+			r.logger.Warn("failed to prune the outbox", "error", err)
+		}
+		return
+	}
+	if pruned > 0 {
+		r.logger.Info("pruned sent tasks from the outbox", "count", pruned)
+	}
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+	"github.com/oziev02/ImageProcessor/internal/repo"
+)
+
+// memOutbox is an in-memory OutboxRepository
+type memOutbox struct {
+	repo.OutboxRepository
+	mu       sync.Mutex
+	messages []*domain.OutboxMessage
+	sentAt   map[int64]time.Time
+	pruned   int
+}
+
+func (m *memOutbox) queue(task *domain.ProcessingTask, createdAt time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, &domain.OutboxMessage{ID: int64(len(m.messages) + 1), Task: task, CreatedAt: createdAt})
+}
+
+func (m *memOutbox) RelayUnsent(ctx context.Context, createdBefore time.Time, limit int, publish func(msg *domain.OutboxMessage) error) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sent := 0
+	for _, msg := range m.messages {
+		if sent == limit {
+			break
+		}
+		if _, ok := m.sentAt[msg.ID]; ok || !msg.CreatedAt.Before(createdBefore) {
+			continue
+		}
+		if err := publish(msg); err != nil {
+			return sent, err
+		}
+		m.sentAt[msg.ID] = time.Now()
+		sent++
+	}
+	return sent, nil
+}
+
+func (m *memOutbox) PruneSent(ctx context.Context, olderThan time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruned++
+	return 0, nil
+}
+
+func (m *memOutbox) unsent() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.messages) - len(m.sentAt)
+}
+
+func TestOutboxRelay(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConfig(t)
+	cfg.Kafka.OutboxRelayInterval = time.Minute
+	cfg.Kafka.OutboxBatchSize = 2
+
+	outbox := &memOutbox{sentAt: make(map[int64]time.Time)}
+	old := time.Now().Add(-time.Hour)
+	for i := range 5 {
+		outbox.queue(&domain.ProcessingTask{ImageID: fmt.Sprintf("img-%d", i)}, old)
+	}
+	// Too recent, its upload may still be sending it
+	outbox.queue(&domain.ProcessingTask{ImageID: "recent"}, time.Now())
+
+	producer := &fakeProducer{err: errors.New("kafka unavailable")}
+	relay := NewOutboxRelay(outbox, producer, cfg, discardLogger()).(*outboxRelay)
+
+	// While Kafka is down the tasks stay queued, and nothing is pruned
+	relay.relay(ctx)
+	if n := outbox.unsent(); n != 6 {
+		t.Fatalf("%d tasks unsent after a failed relay, want 6", n)
+	}
+	if outbox.pruned != 0 {
+		t.Error("pruned after a failed relay")
+	}
+
+	// Once it's back, every old task is sent, batch after batch, in order
+	producer.err = nil
+	relay.relay(ctx)
+	var sent []string
+	for _, task := range producer.sent() {
+		sent = append(sent, task.ImageID)
+	}
+	if want := []string{"img-0", "img-1", "img-2", "img-3", "img-4"}; !slices.Equal(sent, want) {
+		t.Errorf("sent %v, want %v", sent, want)
+	}
+	if n := outbox.unsent(); n != 1 {
+		t.Errorf("%d tasks unsent, want only the recent one", n)
+	}
+	if outbox.pruned != 1 {
+		t.Errorf("pruned %d times, want once after relaying", outbox.pruned)
+	}
+
+	// Sent tasks aren't sent again
+	relay.relay(ctx)
+	if n := len(producer.sent()); n != 5 {
+		t.Errorf("%d tasks sent after another relay, want still 5", n)
+	}
+}
@@ -0,0 +1,30 @@
+package service
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/nfnt/resize"
+)
+
+// differenceHash computes a 64-bit perceptual hash of img: each bit tells
+// whether a pixel of a 9x8 grayscale version is brighter than its right
+// neighbour. Re-encoding or rescaling an image barely changes the hash, so
+// near-identical images are within a small Hamming distance of each other.
+func differenceHash(img image.Image) uint64 {
+	small := resize.Resize(9, 8, img, resize.Bilinear)
+	bounds := small.Bounds()
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := color.GrayModel.Convert(small.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray).Y
+			right := color.GrayModel.Convert(small.At(bounds.Min.X+x+1, bounds.Min.Y+y)).(color.Gray).Y
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"math/bits"
+	"testing"
+)
+
+// wavesImage is a smooth pattern of light and dark patches whose layout
+// depends on the frequencies fx and fy
+func wavesImage(w, h int, fx, fy float64) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			v := 128 + 60*math.Sin(float64(x)*fx) + 60*math.Cos(float64(y)*fy)
+			img.Set(x, y, color.RGBA{R: uint8(v), G: uint8(v * 0.8), B: uint8(255 - v), A: 255})
+		}
+	}
+	return img
+}
+
+func jpegRoundTrip(t *testing.T, img image.Image, quality int) image.Image {
+	t.Helper()
+	decoded, err := jpeg.Decode(bytes.NewReader(encodeJPEG(t, img, quality)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestDifferenceHash(t *testing.T) {
+	maxDistance := testConfig(t).Image.DedupMaxDistance
+	src := wavesImage(320, 240, 0.031, 0.027)
+
+	high := differenceHash(jpegRoundTrip(t, src, 95))
+	low := differenceHash(jpegRoundTrip(t, src, 40))
+	if d := bits.OnesCount64(high ^ low); d > maxDistance {
+		t.Errorf("qualities 95 and 40 hash %d bits apart, want at most %d", d, maxDistance)
+	}
+
+	other := differenceHash(jpegRoundTrip(t, wavesImage(320, 240, 0.053, 0.011), 95))
+	if d := bits.OnesCount64(high ^ other); d <= maxDistance {
+		t.Errorf("different images hash %d bits apart, want more than %d", d, maxDistance)
+	}
+}
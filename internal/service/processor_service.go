@@ -1,164 +1,977 @@
 package service
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
+	"image/draw"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
-	"os"
-	"path/filepath"
+	"log/slog"
 	"time"
 
 	"github.com/nfnt/resize"
 	"github.com/oziev02/ImageProcessor/internal/config"
 	"github.com/oziev02/ImageProcessor/internal/domain"
+	"github.com/oziev02/ImageProcessor/internal/observability"
 	"github.com/oziev02/ImageProcessor/internal/repo"
+	"github.com/oziev02/ImageProcessor/internal/transport/webhook"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"golang.org/x/sync/errgroup"
 )
 
 type ProcessorService interface {
 	ProcessImage(ctx context.Context, task *domain.ProcessingTask) error
+	MarkFailed(ctx context.Context, task *domain.ProcessingTask, cause error) error
+	Rotate(ctx context.Context, id string, degrees int) (*domain.Image, error)
 }
 
 type processorService struct {
 	imageRepo   repo.ImageRepository
+	eventRepo   repo.EventRepository
 	storageRepo repo.StorageRepository
+	notifier    webhook.Notifier // nil when disabled
 	cfg         *config.Config
+	metrics     *observability.Metrics
+	logger      *slog.Logger
+	throttle    *throttle
+	decodes     *DecodeLimiter // nil when unlimited
+	// interpolation is the configured resize algorithm
+	interpolation resize.InterpolationFunction
 }
 
 func NewProcessorService(
 	imageRepo repo.ImageRepository,
+	eventRepo repo.EventRepository,
 	storageRepo repo.StorageRepository,
+	notifier webhook.Notifier,
+	decodes *DecodeLimiter,
 	cfg *config.Config,
+	metrics *observability.Metrics,
+	logger *slog.Logger,
 ) ProcessorService {
 	return &processorService{
-		imageRepo:   imageRepo,
-		storageRepo: storageRepo,
-		cfg:         cfg,
+		imageRepo:     imageRepo,
+		eventRepo:     eventRepo,
+		storageRepo:   storageRepo,
+		notifier:      notifier,
+		cfg:           cfg,
+		metrics:       metrics,
+		logger:        logger,
+		throttle:      newThrottle(cfg.Image.CPUThrottle),
+		decodes:       decodes,
+		interpolation: interpolationFunc(cfg.Image.ResizeAlgorithm),
 	}
 }
 
 func (s *processorService) ProcessImage(ctx context.Context, task *domain.ProcessingTask) error {
+	s.metrics.ProcessingInFlight.Inc()
+	defer s.metrics.ProcessingInFlight.Dec()
+
+	// A child of the upload's span when the task carried its trace context
+	ctx, span := tracer.Start(ctx, "ProcessorService.ProcessImage", trace.WithAttributes(
+		attribute.String("image.id", task.ImageID),
+		attribute.String("task.kind", string(task.Kind)),
+	))
+	start := time.Now()
+	err := s.processImage(ctx, task)
+	s.metrics.ProcessingDuration.Observe(time.Since(start).Seconds())
+	endSpan(span, err)
+
+	status := domain.StatusCompleted
+	if err != nil {
+		status = domain.StatusFailed
+	}
+	s.metrics.ProcessedTotal.WithLabelValues(string(status)).Inc()
+
+	return err
+}
+
+func (s *processorService) processImage(ctx context.Context, task *domain.ProcessingTask) error {
+	// A task picked up during shutdown is left for redelivery
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if task.Kind == domain.TaskKindThumbnail {
+		return s.processThumbnail(ctx, task)
+	}
+
 	// Get image record
 	img, err := s.imageRepo.GetByID(ctx, task.ImageID)
+	if errors.Is(err, domain.ErrImageNotFound) {
+		// Deleted while queued; retrying won't bring it back
+		s.logger.Info("skipping task for deleted image", "image_id", task.ImageID)
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("failed to get image: %w", err)
 	}
 
+	// Permanently bad images would otherwise be retried forever
+	if img.AttemptsExhausted(s.cfg.Image.MaxProcessingAttempts) {
+		if img.Status != domain.StatusFailed {
+			s.markFailed(ctx, img, domain.ErrAttemptsExhausted)
+		}
+		s.logger.Warn("refusing to process image", "image_id", img.ID,
+			"attempts", img.ProcessingAttempts, "error", domain.ErrAttemptsExhausted)
+		return nil
+	}
+
 	// Update status to processing
 	img.Status = domain.StatusProcessing
+	img.ProcessingAttempts++
+	img.FailureReason = ""
 	img.UpdatedAt = time.Now()
 	if err := s.imageRepo.Update(ctx, img); err != nil {
 		return fmt.Errorf("failed to update status: %w", err)
 	}
+	s.recordEvent(ctx, img)
 
 	// Read original image
-	originalReader, err := s.storageRepo.Read(ctx, task.ImagePath)
+	data, err := s.readOriginal(ctx, task.ImagePath)
 	if err != nil {
-		img.Status = domain.StatusFailed
-		img.UpdatedAt = time.Now()
-		_ = s.imageRepo.Update(ctx, img)
-		return fmt.Errorf("failed to read original image: %w", err)
+		s.markFailed(ctx, img, err)
+		return err
+	}
+
+	// Derivatives of the same source with the same parameters are identical,
+	// so reuse them instead of reprocessing when they already exist. Only
+	// tasks generating every derivative take part.
+	outputFormat := s.outputFormat(task.Format)
+	wm := s.loadWatermark()
+	var processingKey string
+	if task.Kind == domain.TaskKindAll {
+		processingKey = s.processingKey(data, outputFormat, wm, img.Params)
+		reused, err := s.reuseDerivatives(ctx, img, processingKey, outputFormat)
+		if err != nil {
+			err = fmt.Errorf("failed to reuse derivatives: %w", err)
+			s.markFailed(ctx, img, err)
+			return err
+		}
+		if reused {
+			s.warmCache(ctx, img)
+			return nil
+		}
 	}
-	defer originalReader.Close()
 
 	// Decode image
-	originalImg, _, err := decodeImage(originalReader, task.Format)
+	originalImg, err := s.decodeOriginal(ctx, data, task.Format)
 	if err != nil {
-		img.Status = domain.StatusFailed
-		img.UpdatedAt = time.Now()
-		_ = s.imageRepo.Update(ctx, img)
-		return fmt.Errorf("failed to decode image: %w", err)
-	}
-
-	// Process resized image
-	processedImg := resize.Resize(
-		uint(s.cfg.Image.ProcessedWidth),
-		uint(s.cfg.Image.ProcessedHeight),
-		originalImg,
-		resize.Lanczos3,
-	)
-
-	// Process thumbnail
-	thumbnailImg := resize.Resize(
-		uint(s.cfg.Image.ThumbnailWidth),
-		uint(s.cfg.Image.ThumbnailHeight),
-		originalImg,
-		resize.Lanczos3,
-	)
-
-	// Save processed image
-	processedPath := filepath.Join("processed", task.ImageID+getExtension(task.Format))
-	if err := s.saveImage(ctx, processedPath, processedImg, task.Format); err != nil {
-		img.Status = domain.StatusFailed
-		img.UpdatedAt = time.Now()
-		_ = s.imageRepo.Update(ctx, img)
-		return fmt.Errorf("failed to save processed image: %w", err)
+		// Shutdown interrupted waiting for a decode slot; the task is
+		// redelivered
+		if ctx.Err() != nil {
+			return err
+		}
+		s.markFailed(ctx, img, err)
+		return err
+	}
+	originalImg = s.applyParams(originalImg, img.Params)
+	if err := ctx.Err(); err != nil {
+		s.markFailed(ctx, img, err)
+		return err
 	}
 
-	// Save thumbnail
-	thumbnailPath := filepath.Join("thumbnail", task.ImageID+getExtension(task.Format))
-	if err := s.saveImage(ctx, thumbnailPath, thumbnailImg, task.Format); err != nil {
-		img.Status = domain.StatusFailed
-		img.UpdatedAt = time.Now()
-		_ = s.imageRepo.Update(ctx, img)
-		return fmt.Errorf("failed to save thumbnail: %w", err)
+	if s.cfg.Image.SharpnessEnabled {
+		score := sharpness(stillFrame(originalImg))
+		img.Sharpness = &score
 	}
 
-	// Add watermark if enabled
-	if s.cfg.Image.WatermarkEnabled && s.cfg.Image.WatermarkPath != "" {
-		// For simplicity, we'll skip watermark for now
-		// In production, you'd overlay the watermark here
+	// Generate processed image, and thumbnail unless a separate task does it
+	processed := s.processedDerivative(wm, img.Params)
+	derivatives := []*derivative{processed}
+	var thumbnail *derivative
+	var variants []*derivative
+	if task.Kind == domain.TaskKindAll {
+		thumbnail = s.thumbnailDerivative(wm)
+		variants = s.thumbnailVariants(wm)
+		derivatives = append(derivatives, thumbnail)
+		derivatives = append(derivatives, variants...)
+	}
+	if err := s.generateDerivatives(ctx, task.ImageID, originalImg, outputFormat, derivatives); err != nil {
+		s.markFailed(ctx, img, err)
+		return err
+	}
+	var lqipPath, placeholder string
+	if thumbnail != nil {
+		if lqipPath, err = s.generateLQIP(ctx, task.ImageID, stillFrame(originalImg)); err != nil {
+			s.removeDerivatives(ctx, derivatives)
+			s.markFailed(ctx, img, err)
+			return err
+		}
+		if s.cfg.Image.GeneratePlaceholder {
+			if placeholder, err = s.generatePlaceholder(ctx, stillFrame(originalImg)); err != nil {
+				s.removeDerivatives(ctx, derivatives)
+				s.removeFile(ctx, lqipPath)
+				s.markFailed(ctx, img, err)
+				return err
+			}
+		}
+	}
+	// Past this point the files are recorded, so drop them if interrupted
+	if err := ctx.Err(); err != nil {
+		s.removeDerivatives(ctx, derivatives)
+		s.removeFile(ctx, lqipPath)
+		s.markFailed(ctx, img, err)
+		return err
 	}
 
 	// Update image record
-	img.ProcessedPath = processedPath
-	img.ThumbnailPath = thumbnailPath
+	img.UpdatedAt = time.Now()
+	if thumbnail != nil {
+		img.ThumbnailPath = thumbnail.path
+		img.ThumbnailChecksum = thumbnail.checksum
+		img.Thumbnails = variantPaths(variants)
+		img.LQIPPath = lqipPath
+		img.Placeholder = placeholder
+		if err := s.imageRepo.UpdateThumbnail(ctx, img); err != nil {
+			return fmt.Errorf("failed to update image record: %w", err)
+		}
+	}
+
+	img.ProcessedPath = processed.path
+	img.ProcessedFormat = outputFormat
+	img.ProcessingKey = processingKey
+	img.ProcessedChecksum = processed.checksum
+	img.ProcessedSize = processed.size
 	img.Status = domain.StatusCompleted
-	bounds := processedImg.Bounds()
+	bounds := processed.img.Bounds()
 	img.ProcessedWidth = bounds.Dx()
 	img.ProcessedHeight = bounds.Dy()
-	img.UpdatedAt = time.Now()
 
 	if err := s.imageRepo.Update(ctx, img); err != nil {
 		return fmt.Errorf("failed to update image record: %w", err)
 	}
+	s.recordEvent(ctx, img)
+	s.warmCache(ctx, img)
+
+	return nil
+}
+
+// warmCache reads img's processed image, thumbnail and placeholder through
+// the storage cache when warming is enabled, so that they're cached before
+// the first client asks for them. A file that can't be read only misses that
+// head start, so failures are logged.
+func (s *processorService) warmCache(ctx context.Context, img *domain.Image) {
+	if !s.cfg.Storage.CacheWarm {
+		return
+	}
+	for _, path := range []string{img.ProcessedPath, img.ThumbnailPath, img.LQIPPath} {
+		if path == "" {
+			continue
+		}
+		// The cache fills itself on Read; files too large for it are
+		// streamed, and closing without reading them costs nothing
+		reader, err := s.storageRepo.Read(ctx, path)
+		if err != nil {
+			s.logger.Warn("failed to warm storage cache", "path", path, "error", err)
+			continue
+		}
+		reader.Close()
+	}
+}
+
+// processThumbnail handles thumbnail-only tasks from the thumbnail topic.
+// The image status is driven by the processed-image task, so failures here
+// are returned without marking the image failed.
+func (s *processorService) processThumbnail(ctx context.Context, task *domain.ProcessingTask) error {
+	img, err := s.imageRepo.GetByID(ctx, task.ImageID)
+	if errors.Is(err, domain.ErrImageNotFound) {
+		s.logger.Info("skipping task for deleted image", "image_id", task.ImageID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get image: %w", err)
+	}
+
+	data, err := s.readOriginal(ctx, task.ImagePath)
+	if err != nil {
+		return err
+	}
+
+	originalImg, err := s.decodeOriginal(ctx, data, task.Format)
+	if err != nil {
+		return err
+	}
+	originalImg = s.applyParams(originalImg, img.Params)
+
+	wm := s.loadWatermark()
+	thumbnail := s.thumbnailDerivative(wm)
+	variants := s.thumbnailVariants(wm)
+	derivatives := append([]*derivative{thumbnail}, variants...)
+	if err := s.generateDerivatives(ctx, task.ImageID, originalImg, s.outputFormat(task.Format), derivatives); err != nil {
+		return err
+	}
+	lqipPath, err := s.generateLQIP(ctx, task.ImageID, stillFrame(originalImg))
+	if err != nil {
+		s.removeDerivatives(ctx, derivatives)
+		return err
+	}
+	var placeholder string
+	if s.cfg.Image.GeneratePlaceholder {
+		if placeholder, err = s.generatePlaceholder(ctx, stillFrame(originalImg)); err != nil {
+			s.removeDerivatives(ctx, derivatives)
+			s.removeFile(ctx, lqipPath)
+			return err
+		}
+	}
+
+	img.ThumbnailPath = thumbnail.path
+	img.ThumbnailChecksum = thumbnail.checksum
+	img.Thumbnails = variantPaths(variants)
+	img.LQIPPath = lqipPath
+	img.Placeholder = placeholder
+	img.UpdatedAt = time.Now()
+	if err := s.imageRepo.UpdateThumbnail(ctx, img); err != nil {
+		return fmt.Errorf("failed to update image record: %w", err)
+	}
+
+	return nil
+}
+
+// MarkFailed marks the task's image failed once retries are exhausted.
+// Thumbnail tasks don't drive the image status, so they're left alone.
+func (s *processorService) MarkFailed(ctx context.Context, task *domain.ProcessingTask, cause error) error {
+	if task.Kind == domain.TaskKindThumbnail {
+		return nil
+	}
+
+	img, err := s.imageRepo.GetByID(ctx, task.ImageID)
+	if err != nil {
+		return fmt.Errorf("failed to get image: %w", err)
+	}
+	if img.Status == domain.StatusFailed {
+		return nil
+	}
+
+	img.Status = domain.StatusFailed
+	img.FailureReason = cause.Error()
+	img.UpdatedAt = time.Now()
+	if err := s.imageRepo.Update(ctx, img); err != nil {
+		return fmt.Errorf("failed to update status: %w", err)
+	}
+	s.recordEvent(ctx, img)
+	return nil
+}
+
+// markFailed records a failed processing attempt. An attempt interrupted by
+// a cancelled context didn't fail, so the image is requeued instead.
+func (s *processorService) markFailed(ctx context.Context, img *domain.Image, cause error) {
+	if ctx.Err() != nil {
+		s.requeue(ctx, img)
+		return
+	}
+	img.Status = domain.StatusFailed
+	img.FailureReason = cause.Error()
+	img.UpdatedAt = time.Now()
+	if err := s.imageRepo.Update(ctx, img); err == nil {
+		s.recordEvent(ctx, img)
+	}
+}
+
+// requeue puts an interrupted image back to pending so that the redelivered
+// task processes it again, without counting the interrupted attempt. It
+// runs detached from cancellation since it's called when ctx is cancelled.
+func (s *processorService) requeue(ctx context.Context, img *domain.Image) {
+	ctx = context.WithoutCancel(ctx)
+	img.Status = domain.StatusPending
+	img.ProcessingAttempts = max(img.ProcessingAttempts-1, 0)
+	img.UpdatedAt = time.Now()
+	if err := s.imageRepo.Update(ctx, img); err != nil {
+		s.logger.Warn("failed to requeue interrupted image", "image_id", img.ID, "error", err)
+		return
+	}
+	s.recordEvent(ctx, img)
+}
+
+// removeFile deletes a single saved file, ignoring an empty path
+func (s *processorService) removeFile(ctx context.Context, path string) {
+	if path == "" {
+		return
+	}
+	if err := s.storageRepo.Delete(context.WithoutCancel(ctx), path); err != nil {
+		s.logger.Warn("failed to remove partial derivative", "path", path, "error", err)
+	}
+}
+
+// recordEvent appends img's current status to its history. History is for
+// auditing only, so a failed write is logged rather than failing processing.
+func (s *processorService) recordEvent(ctx context.Context, img *domain.Image) {
+	event := &domain.ImageEvent{ImageID: img.ID, Status: img.Status, CreatedAt: img.UpdatedAt}
+	if err := s.eventRepo.Create(ctx, event); err != nil {
+		s.logger.Warn("failed to record image event", "image_id", img.ID, "status", img.Status, "error", err)
+	}
+	if img.Status == domain.StatusCompleted || img.Status == domain.StatusFailed {
+		s.notify(ctx, img)
+	}
+}
+
+// notify posts img's final status to the webhook. Like history, it mustn't
+// fail processing, so errors are only logged.
+func (s *processorService) notify(ctx context.Context, img *domain.Image) {
+	if s.notifier == nil {
+		return
+	}
+	if err := s.notifier.Notify(ctx, img); err != nil {
+		s.logger.Warn("failed to send webhook", "image_id", img.ID, "status", img.Status, "error", err)
+	}
+}
+
+func (s *processorService) readOriginal(ctx context.Context, path string) ([]byte, error) {
+	reader, err := s.storageRepo.Read(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read original image: %w", err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read original image: %w", err)
+	}
+	return data, nil
+}
+
+func (s *processorService) decodeOriginal(ctx context.Context, data []byte, format domain.ImageFormat) (image.Image, error) {
+	if format == domain.FormatGIF {
+		if err := checkGIFLimits(bytes.NewReader(data), s.cfg.Image); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.decodes.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer s.decodes.release()
+
+	// Animated GIFs keep every frame so that derivatives stay animated
+	var img image.Image
+	var err error
+	if format == domain.FormatGIF {
+		img, err = decodeGIF(bytes.NewReader(data))
+	} else {
+		img, _, err = decodeImage(bytes.NewReader(data), format)
+	}
+	if err != nil && s.cfg.Image.LenientDecode {
+		lenientImg, strategy, lenientErr := decodeLenient(data, format)
+		if lenientErr == nil {
+			s.logger.Warn("strict decode failed, used lenient decode", "strategy", strategy, "error", err)
+			return lenientImg, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
 
+	// Phone photos are often stored sideways with an EXIF flag telling
+	// viewers to rotate them, which the stdlib decoder ignores. Derivatives
+	// are corrected; the original is kept untouched.
+	if format == domain.FormatJPEG {
+		img = applyOrientation(img, exifOrientation(data))
+	}
+	return img, nil
+}
+
+// applyParams applies the image's own parameters to the decoded source
+func (s *processorService) applyParams(src image.Image, params domain.ProcessingParams) image.Image {
+	if _, ok := src.(*animatedGIF); ok {
+		return eachFrame(src, func(frame image.Image) image.Image {
+			return s.applyParams(frame, params)
+		})
+	}
+	img := rotateImage(cropImage(src, params.Crop), params.Rotation)
+	img = adjustTone(img, params.Brightness, params.Contrast)
+	if s.cfg.Image.Grayscale || params.Grayscale {
+		img = s.grayscale(img)
+	}
+	return img
+}
+
+// processedDerivative uses the image's own quality when it was given one
+func (s *processorService) processedDerivative(wm *watermark, params domain.ProcessingParams) *derivative {
+	quality := s.cfg.Image.JPEGQuality
+	if params.Quality != 0 {
+		quality = params.Quality
+	}
+	return &derivative{
+		dir:       fileProcessed,
+		width:     s.cfg.Image.ProcessedWidth,
+		height:    s.cfg.Image.ProcessedHeight,
+		quality:   quality,
+		watermark: wm,
+	}
+}
+
+// thumbnailDerivative only carries the watermark when configured to
+func (s *processorService) thumbnailDerivative(wm *watermark) *derivative {
+	d := &derivative{
+		dir:     fileThumbnail,
+		width:   s.cfg.Image.ThumbnailWidth,
+		height:  s.cfg.Image.ThumbnailHeight,
+		quality: s.cfg.Image.ThumbnailJPEGQuality,
+	}
+	if s.cfg.Image.WatermarkThumbnail {
+		d.watermark = wm
+	}
+	return d
+}
+
+// thumbnailVariants returns a derivative for each configured thumbnail size
+func (s *processorService) thumbnailVariants(wm *watermark) []*derivative {
+	variants := make([]*derivative, 0, len(s.cfg.Image.ThumbnailSizes))
+	for _, size := range s.cfg.Image.ThumbnailSizes {
+		d := &derivative{
+			dir:     fileThumbnail,
+			label:   size.Label,
+			width:   size.Width,
+			height:  size.Height,
+			quality: s.cfg.Image.ThumbnailJPEGQuality,
+		}
+		if s.cfg.Image.WatermarkThumbnail {
+			d.watermark = wm
+		}
+		variants = append(variants, d)
+	}
+	return variants
+}
+
+// variantPaths maps the labels of generated variants to their paths
+func variantPaths(variants []*derivative) map[string]string {
+	paths := make(map[string]string, len(variants))
+	for _, d := range variants {
+		paths[d.label] = d.path
+	}
+	return paths
+}
+
+// derivative describes a resized copy of the original to generate and store
+type derivative struct {
+	dir       string
+	label     string // thumbnail variant label, empty for the default ones
+	width     int
+	height    int
+	quality   int        // JPEG quality
+	watermark *watermark // nil for none
+
+	// Set once generated
+	img      image.Image
+	path     string
+	checksum string
+	size     int64
+	saved    bool
+}
+
+// generateDerivatives resizes and saves derivatives concurrently, bounded by
+// the configured concurrency. The first error cancels the remaining work.
+func (s *processorService) generateDerivatives(ctx context.Context, imageID string, src image.Image, format domain.ImageFormat, derivatives []*derivative) error {
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(s.cfg.Image.ThumbnailConcurrency, 1))
+
+	for _, d := range derivatives {
+		g.Go(func() error {
+			if err := gctx.Err(); err != nil {
+				return err
+			}
+			err := s.throttle.run(gctx, func() error {
+				d.img = eachFrame(src, func(frame image.Image) image.Image {
+					frame = s.resize(frame, d.width, d.height)
+					if s.cfg.Image.SharpenAmount > 0 {
+						frame = sharpen(frame, s.cfg.Image.SharpenAmount, sharpenSigma)
+					}
+					if d.watermark != nil {
+						frame = d.watermark.apply(frame, s.cfg.Image)
+					}
+					return frame
+				})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			d.path = s.pathFor(d, imageID, format)
+			return s.throttle.run(gctx, func() error {
+				saved, err := s.saveImage(gctx, d.path, d.img, format, d.quality)
+				if err != nil {
+					return fmt.Errorf("failed to save %s image: %w", d.dir, err)
+				}
+				d.checksum, d.size = saved.checksum, saved.size
+				d.saved = true
+				return nil
+			})
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		// A failed task must not leave some of its derivatives behind
+		s.removeDerivatives(ctx, derivatives)
+		return err
+	}
 	return nil
 }
 
-func (s *processorService) saveImage(ctx context.Context, path string, img image.Image, format domain.ImageFormat) error {
-	// Create a temporary file
-	tmpFile, err := os.CreateTemp("", "img-*")
+// removeDerivatives deletes the derivatives that were already saved. It uses
+// a context detached from cancellation so that cleanup still runs when the
+// failure was a cancelled context.
+func (s *processorService) removeDerivatives(ctx context.Context, derivatives []*derivative) {
+	ctx = context.WithoutCancel(ctx)
+	for _, d := range derivatives {
+		if !d.saved {
+			continue
+		}
+		if err := s.storageRepo.Delete(ctx, d.path); err != nil {
+			s.logger.Warn("failed to remove partial derivative", "path", d.path, "error", err)
+		}
+		d.saved = false
+	}
+}
+
+// resize scales src to width x height. With aspect preservation the image is
+// fitted inside that box instead, and never upscaled.
+func (s *processorService) resize(src image.Image, width, height int) image.Image {
+	if !s.cfg.Image.PreserveAspect {
+		return resize.Resize(uint(width), uint(height), src, s.interpolation)
+	}
+
+	w, h, ok := fitDimensions(src.Bounds().Dx(), src.Bounds().Dy(), width, height)
+	if !ok {
+		return src
+	}
+	return resize.Resize(w, h, src, s.interpolation)
+}
+
+// interpolationFunc maps a configured resize algorithm to its interpolation
+// function. The name is validated at config load.
+func interpolationFunc(algorithm string) resize.InterpolationFunction {
+	switch algorithm {
+	case config.ResizeNearest:
+		return resize.NearestNeighbor
+	case config.ResizeBilinear:
+		return resize.Bilinear
+	case config.ResizeBicubic:
+		return resize.Bicubic
+	case config.ResizeMitchellNetravali:
+		return resize.MitchellNetravali
+	case config.ResizeLanczos2:
+		return resize.Lanczos2
+	default:
+		return resize.Lanczos3
+	}
+}
+
+// fitDimensions returns resize.Resize dimensions that fit a srcW x srcH image
+// inside maxW x maxH keeping its aspect ratio; the dimension passed as 0 is
+// scaled proportionally. ok is false when the image already fits.
+func fitDimensions(srcW, srcH, maxW, maxH int) (w, h uint, ok bool) {
+	if srcW <= maxW && srcH <= maxH {
+		return 0, 0, false
+	}
+
+	// Constrain by whichever side needs the larger reduction
+	if float64(maxW)/float64(srcW) <= float64(maxH)/float64(srcH) {
+		return uint(maxW), 0, true
+	}
+	return 0, uint(maxH), true
+}
+
+func (s *processorService) derivativePath(kind, imageID string, format domain.ImageFormat) string {
+	return storagePath(s.cfg.Storage, kind, imageID, getExtension(format))
+}
+
+// pathFor returns where to store d, labelled variants having their own paths
+func (s *processorService) pathFor(d *derivative, imageID string, format domain.ImageFormat) string {
+	if d.label != "" {
+		return thumbnailVariantPath(s.cfg.Storage, d.label, imageID, getExtension(format))
+	}
+	return s.derivativePath(d.dir, imageID, format)
+}
+
+// processingKey derives a deterministic key from the source bytes and every
+// parameter that affects the generated derivatives
+func (s *processorService) processingKey(source []byte, format domain.ImageFormat, wm *watermark, imageParams domain.ProcessingParams) string {
+	sourceHash := sha256.Sum256(source)
+	params := fmt.Sprintf("%x|%s|processed=%dx%d@%d|thumbnail=%dx%d@%d|aspect=%t|background=%s|orientation=exif|grayscale=%t|resize=%s|sharpen=%g|placeholder=%t",
+		sourceHash, format,
+		s.cfg.Image.ProcessedWidth, s.cfg.Image.ProcessedHeight, s.cfg.Image.JPEGQuality,
+		s.cfg.Image.ThumbnailWidth, s.cfg.Image.ThumbnailHeight, s.cfg.Image.ThumbnailJPEGQuality,
+		s.cfg.Image.PreserveAspect, s.cfg.Image.FlattenBackground, s.cfg.Image.Grayscale,
+		s.cfg.Image.ResizeAlgorithm, s.cfg.Image.SharpenAmount, s.cfg.Image.GeneratePlaceholder,
+	)
+	// The compression level only changes PNG output
+	if format == domain.FormatPNG {
+		params += "|png=" + s.cfg.Image.PNGCompression
+	}
+	for _, size := range s.cfg.Image.ThumbnailSizes {
+		params += fmt.Sprintf("|%s=%dx%d", size.Label, size.Width, size.Height)
+	}
+	if !imageParams.IsZero() {
+		// Marshalling a struct is deterministic
+		encoded, _ := json.Marshal(imageParams)
+		params += "|params=" + string(encoded)
+	}
+	if wm != nil {
+		params += fmt.Sprintf("|watermark=%s,%s,%.2f,%t", wm.hash,
+			s.cfg.Image.WatermarkPosition, s.cfg.Image.WatermarkOpacity, s.cfg.Image.WatermarkThumbnail)
+	}
+	key := sha256.Sum256([]byte(params))
+	return hex.EncodeToString(key[:])
+}
+
+// reuseDerivatives completes img from existing derivatives with the same
+// processing key, either its own from a previous run or another image's,
+// which are copied under img's paths. It reports whether reuse happened.
+func (s *processorService) reuseDerivatives(ctx context.Context, img *domain.Image, key string, format domain.ImageFormat) (bool, error) {
+	source := img
+	if img.ProcessingKey != key || img.ProcessedPath == "" {
+		existing, err := s.imageRepo.GetCompletedByProcessingKey(ctx, key)
+		if err != nil {
+			if errors.Is(err, domain.ErrImageNotFound) {
+				return false, nil
+			}
+			return false, err
+		}
+		source = existing
+	}
+
+	// Derivatives may have been removed from storage since
+	paths := []string{source.ProcessedPath, source.ThumbnailPath}
+	for _, size := range s.cfg.Image.ThumbnailSizes {
+		path, ok := source.Thumbnails[size.Label]
+		if !ok {
+			return false, nil
+		}
+		paths = append(paths, path)
+	}
+	for _, path := range paths {
+		exists, err := s.storageRepo.Exists(ctx, path)
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			return false, nil
+		}
+	}
+
+	// An image reusing its own derivatives keeps their paths, which may
+	// predate a storage layout change
+	processedPath, thumbnailPath := source.ProcessedPath, source.ThumbnailPath
+	thumbnails := source.Thumbnails
+	lqipPath := source.LQIPPath
+	if source.ID != img.ID {
+		// Images processed before placeholders existed have none to copy
+		if source.LQIPPath != "" {
+			lqipPath = storagePath(s.cfg.Storage, fileLQIP, img.ID, ".jpg")
+			if err := s.copyFile(ctx, source.LQIPPath, lqipPath); err != nil {
+				return false, err
+			}
+		}
+		processedPath = s.derivativePath(fileProcessed, img.ID, format)
+		thumbnailPath = s.derivativePath(fileThumbnail, img.ID, format)
+		thumbnails = make(map[string]string, len(s.cfg.Image.ThumbnailSizes))
+		for _, size := range s.cfg.Image.ThumbnailSizes {
+			path := thumbnailVariantPath(s.cfg.Storage, size.Label, img.ID, getExtension(format))
+			if err := s.copyFile(ctx, source.Thumbnails[size.Label], path); err != nil {
+				return false, err
+			}
+			thumbnails[size.Label] = path
+		}
+		if err := s.copyFile(ctx, source.ProcessedPath, processedPath); err != nil {
+			return false, err
+		}
+		if err := s.copyFile(ctx, source.ThumbnailPath, thumbnailPath); err != nil {
+			return false, err
+		}
+	}
+
+	img.UpdatedAt = time.Now()
+	img.ThumbnailPath = thumbnailPath
+	img.ThumbnailChecksum = source.ThumbnailChecksum
+	img.Thumbnails = thumbnails
+	img.LQIPPath = lqipPath
+	img.Placeholder = source.Placeholder
+	if err := s.imageRepo.UpdateThumbnail(ctx, img); err != nil {
+		return false, fmt.Errorf("failed to update image record: %w", err)
+	}
+
+	img.ProcessedPath = processedPath
+	img.ProcessedFormat = format
+	img.ProcessedWidth = source.ProcessedWidth
+	img.ProcessedHeight = source.ProcessedHeight
+	img.ProcessingKey = key
+	img.ProcessedChecksum = source.ProcessedChecksum
+	img.ProcessedSize = source.ProcessedSize
+	// The score depends on the source only, so it carries over too
+	if source.Sharpness != nil {
+		img.Sharpness = source.Sharpness
+	}
+	img.Status = domain.StatusCompleted
+	if err := s.imageRepo.Update(ctx, img); err != nil {
+		return false, fmt.Errorf("failed to update image record: %w", err)
+	}
+	s.recordEvent(ctx, img)
+
+	return true, nil
+}
+
+func (s *processorService) copyFile(ctx context.Context, from, to string) error {
+	reader, err := s.storageRepo.Read(ctx, from)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return s.storageRepo.Save(ctx, to, reader)
+}
+
+// savedFile describes an encoded image written to storage
+type savedFile struct {
+	checksum string
+	size     int64
+}
+
+// saveImage encodes img in format into storage at path and returns the
+// SHA-256 and size of the stored bytes. quality only applies to JPEG.
+func (s *processorService) saveImage(ctx context.Context, path string, img image.Image, format domain.ImageFormat, quality int) (savedFile, error) {
+	encode, err := s.encoder(img, format, quality)
+	if err != nil {
+		return savedFile{}, err
+	}
+
+	// Encode straight into storage through a pipe, so that the encoded image
+	// is neither held in memory nor written to a temp file first. Writes
+	// are buffered to reach storage in large chunks.
+	pr, pw := io.Pipe()
+	encodeErr := make(chan error, 1)
+	go func() {
+		bw := bufio.NewWriterSize(pw, 64<<10)
+		err := encode(bw)
+		if err == nil {
+			err = bw.Flush()
+		}
+		pw.CloseWithError(err)
+		encodeErr <- err
+	}()
+
+	// Hash and measure the bytes as they're written
+	hasher := sha256.New()
+	var size byteCounter
+	saveErr := s.storageRepo.Save(ctx, path, io.TeeReader(pr, io.MultiWriter(hasher, &size)))
+	// Unblocks the encoder if storage stopped reading early
+	pr.Close()
+	err = <-encodeErr
+	if saveErr != nil {
+		return savedFile{}, saveErr
+	}
 	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
+		return savedFile{}, err
+	}
+	return savedFile{checksum: hex.EncodeToString(hasher.Sum(nil)), size: int64(size)}, nil
+}
+
+// encoder returns a function writing img in format, or an error when the
+// format can't be encoded
+func (s *processorService) encoder(img image.Image, format domain.ImageFormat, quality int) (func(io.Writer) error, error) {
+	// Only GIF derivatives stay animated
+	if anim, ok := img.(*animatedGIF); ok {
+		if format == domain.FormatGIF {
+			return func(w io.Writer) error { return encodeAnimatedGIF(w, anim) }, nil
+		}
+		img = stillFrame(img)
 	}
-	defer os.Remove(tmpFile.Name())
-	defer tmpFile.Close()
 
-	// Encode image
 	switch format {
 	case domain.FormatJPEG:
-		if err := jpeg.Encode(tmpFile, img, &jpeg.Options{Quality: 90}); err != nil {
-			return fmt.Errorf("failed to encode JPEG: %w", err)
-		}
+		// JPEG has no alpha channel, so transparent areas would turn black
+		img = s.flatten(img)
+		return func(w io.Writer) error {
+			if err := jpeg.Encode(w, img, &jpeg.Options{Quality: quality}); err != nil {
+				return fmt.Errorf("failed to encode JPEG: %w", err)
+			}
+			return nil
+		}, nil
 	case domain.FormatPNG:
-		if err := png.Encode(tmpFile, img); err != nil {
-			return fmt.Errorf("failed to encode PNG: %w", err)
-		}
+		level, _ := config.ParsePNGCompression(s.cfg.Image.PNGCompression)
+		enc := png.Encoder{CompressionLevel: level}
+		return func(w io.Writer) error {
+			if err := enc.Encode(w, img); err != nil {
+				return fmt.Errorf("failed to encode PNG: %w", err)
+			}
+			return nil
+		}, nil
 	case domain.FormatGIF:
-		if err := gif.Encode(tmpFile, img, &gif.Options{}); err != nil {
-			return fmt.Errorf("failed to encode GIF: %w", err)
-		}
+		return func(w io.Writer) error {
+			if err := gif.Encode(w, img, &gif.Options{}); err != nil {
+				return fmt.Errorf("failed to encode GIF: %w", err)
+			}
+			return nil
+		}, nil
+	case domain.FormatWebP:
+		// There is no pure-Go WebP encoder, so outputFormat never selects
+		// WebP; such sources are re-encoded in the fallback format instead
+		return nil, fmt.Errorf("webp encoding is not supported")
 	default:
-		return domain.ErrInvalidFormat
+		return nil, domain.ErrInvalidFormat
 	}
+}
+
+// byteCounter counts the bytes written to it
+type byteCounter int64
 
-	// Read temp file and save to storage
-	tmpFile.Seek(0, 0)
-	return s.storageRepo.Save(ctx, path, tmpFile)
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// flatten composites images with transparency onto the configured background
+func (s *processorService) flatten(img image.Image) image.Image {
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return img
+	}
+
+	// Validated at config load
+	bg, _ := config.ParseHexColor(s.cfg.Image.FlattenBackground)
+
+	bounds := img.Bounds()
+	flat := image.NewRGBA(bounds)
+	draw.Draw(flat, bounds, &image.Uniform{C: bg}, image.Point{}, draw.Src)
+	draw.Draw(flat, bounds, img, bounds.Min, draw.Over)
+	return flat
+}
+
+// outputFormat returns the format derivatives are encoded in: the configured
+// output format if any, else the source format when we have an encoder for
+// it, PNG for the lossless TIFF and BMP, otherwise the configured fallback.
+func (s *processorService) outputFormat(format domain.ImageFormat) domain.ImageFormat {
+	if s.cfg.Image.OutputFormat != "" {
+		return domain.ImageFormat(s.cfg.Image.OutputFormat)
+	}
+	if canEncode(format) {
+		return format
+	}
+	if format == domain.FormatTIFF || format == domain.FormatBMP {
+		return domain.FormatPNG
+	}
+	return domain.ImageFormat(s.cfg.Image.FallbackOutputFormat)
+}
+
+// canEncode reports whether saveImage can encode the given format.
+// WebP is decode-only; TIFF and BMP aren't displayed by browsers, so their
+// derivatives are never encoded in them.
+func canEncode(format domain.ImageFormat) bool {
+	switch format {
+	case domain.FormatJPEG, domain.FormatPNG, domain.FormatGIF:
+		return true
+	default:
+		return false
+	}
 }
 
 func decodeImage(r io.Reader, format domain.ImageFormat) (image.Image, string, error) {
@@ -172,6 +985,15 @@ func decodeImage(r io.Reader, format domain.ImageFormat) (image.Image, string, e
 	case domain.FormatGIF:
 		img, err := gif.Decode(r)
 		return img, "gif", err
+	case domain.FormatWebP:
+		img, err := decodeWebP(r)
+		return img, "webp", err
+	case domain.FormatTIFF:
+		img, err := tiff.Decode(r)
+		return img, "tiff", err
+	case domain.FormatBMP:
+		img, err := bmp.Decode(r)
+		return img, "bmp", err
 	default:
 		return nil, "", domain.ErrInvalidFormat
 	}
@@ -185,6 +1007,12 @@ func getExtension(format domain.ImageFormat) string {
 		return ".png"
 	case domain.FormatGIF:
 		return ".gif"
+	case domain.FormatWebP:
+		return ".webp"
+	case domain.FormatTIFF:
+		return ".tiff"
+	case domain.FormatBMP:
+		return ".bmp"
 	default:
 		return ".jpg"
 	}
@@ -0,0 +1,459 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nfnt/resize"
+	"github.com/oziev02/ImageProcessor/internal/config"
+	"github.com/oziev02/ImageProcessor/internal/domain"
+	"github.com/oziev02/ImageProcessor/internal/repo"
+)
+
+func TestWarmCache(t *testing.T) {
+	ctx := context.Background()
+	paths := []string{"processed/a.jpg", "thumbnails/a.jpg", "lqip/a.jpg"}
+	img := &domain.Image{ProcessedPath: paths[0], ThumbnailPath: paths[1], LQIPPath: paths[2]}
+
+	for _, warm := range []bool{false, true} {
+		inner := newMemStorage()
+		for _, path := range paths {
+			if err := inner.Save(ctx, path, strings.NewReader("data")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cfg := &config.Config{}
+		cfg.Storage.CacheWarm = warm
+		s := &processorService{storageRepo: repo.NewCachedStorage(inner, 1<<20), cfg: cfg, logger: discardLogger()}
+
+		s.warmCache(ctx, img)
+		for _, path := range paths {
+			want := 0
+			if warm {
+				want = 1
+			}
+			if got := inner.readCount(path); got != want {
+				t.Errorf("warm=%v: %s read %d times while warming, want %d", warm, path, got, want)
+			}
+			// Once warmed, a client's first read doesn't reach storage
+			reader, err := s.storageRepo.Read(ctx, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader.Close()
+			if got := inner.readCount(path); got != 1 {
+				t.Errorf("warm=%v: %s read %d times from storage, want 1", warm, path, got)
+			}
+		}
+	}
+}
+
+func TestOutputFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		fallback string
+		source   domain.ImageFormat
+		want     domain.ImageFormat
+	}{
+		{name: "jpeg kept", fallback: "png", source: domain.FormatJPEG, want: domain.FormatJPEG},
+		{name: "png kept", fallback: "jpeg", source: domain.FormatPNG, want: domain.FormatPNG},
+		{name: "gif kept", fallback: "jpeg", source: domain.FormatGIF, want: domain.FormatGIF},
+		{name: "webp to fallback", fallback: "jpeg", source: domain.FormatWebP, want: domain.FormatJPEG},
+		{name: "webp to png fallback", fallback: "png", source: domain.FormatWebP, want: domain.FormatPNG},
+		{name: "tiff to png", fallback: "jpeg", source: domain.FormatTIFF, want: domain.FormatPNG},
+		{name: "bmp to png", fallback: "jpeg", source: domain.FormatBMP, want: domain.FormatPNG},
+		{name: "configured output wins", output: "jpeg", fallback: "png", source: domain.FormatPNG, want: domain.FormatJPEG},
+		{name: "configured output for webp", output: "gif", fallback: "png", source: domain.FormatWebP, want: domain.FormatGIF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Image.OutputFormat = tt.output
+			cfg.Image.FallbackOutputFormat = tt.fallback
+			s := &processorService{cfg: cfg}
+			got := s.outputFormat(tt.source)
+			if got != tt.want {
+				t.Errorf("outputFormat(%s) = %s, want %s", tt.source, got, tt.want)
+			}
+			if !canEncode(got) {
+				t.Errorf("outputFormat(%s) = %s, which can't be encoded", tt.source, got)
+			}
+		})
+	}
+}
+
+func TestCanEncode(t *testing.T) {
+	tests := []struct {
+		format domain.ImageFormat
+		want   bool
+	}{
+		{domain.FormatJPEG, true},
+		{domain.FormatPNG, true},
+		{domain.FormatGIF, true},
+		{domain.FormatWebP, false},
+		{domain.FormatTIFF, false},
+		{domain.FormatBMP, false},
+	}
+	for _, tt := range tests {
+		if got := canEncode(tt.format); got != tt.want {
+			t.Errorf("canEncode(%s) = %v, want %v", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestResizePreservesAspect(t *testing.T) {
+	tests := []struct {
+		name         string
+		srcW, srcH   int
+		maxW, maxH   int
+		wantW, wantH int
+	}{
+		{name: "16:9 into a square", srcW: 1600, srcH: 900, maxW: 800, maxH: 800, wantW: 800, wantH: 450},
+		{name: "16:9 limited by height", srcW: 1600, srcH: 900, maxW: 1200, maxH: 450, wantW: 800, wantH: 450},
+		{name: "9:16 into a square", srcW: 900, srcH: 1600, maxW: 800, maxH: 800, wantW: 450, wantH: 800},
+		{name: "already fits", srcW: 1600, srcH: 900, maxW: 1920, maxH: 1080, wantW: 1600, wantH: 900},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Image.PreserveAspect = true
+			s := &processorService{cfg: cfg, interpolation: interpolationFunc(config.ResizeNearest)}
+
+			got := s.resize(image.NewRGBA(image.Rect(0, 0, tt.srcW, tt.srcH)), tt.maxW, tt.maxH).Bounds()
+			if got.Dx() != tt.wantW || got.Dy() != tt.wantH {
+				t.Errorf("resized to %dx%d, want %dx%d", got.Dx(), got.Dy(), tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+func TestJPEGQuality(t *testing.T) {
+	ctx := context.Background()
+	storage := newMemStorage()
+	cfg := &config.Config{}
+	cfg.Image.JPEGQuality = 90
+	s := &processorService{storageRepo: storage, cfg: cfg}
+	img := testImage(256, 256)
+
+	sizes := make(map[int]int64)
+	for _, quality := range []int{30, 60, 90} {
+		saved, err := s.saveImage(ctx, "processed/a.jpg", img, domain.FormatJPEG, quality)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[quality] = saved.size
+	}
+	if !(sizes[30] < sizes[60] && sizes[60] < sizes[90]) {
+		t.Errorf("sizes by quality = %v, want fewer bytes at lower quality", sizes)
+	}
+
+	// An image's own quality overrides the configured one
+	if d := s.processedDerivative(nil, domain.ProcessingParams{}); d.quality != 90 {
+		t.Errorf("default quality = %d, want 90", d.quality)
+	}
+	if d := s.processedDerivative(nil, domain.ProcessingParams{Quality: 40}); d.quality != 40 {
+		t.Errorf("requested quality = %d, want 40", d.quality)
+	}
+}
+
+// cancellingStorage cancels processing as soon as the first derivative is
+// saved, simulating a shutdown in the middle of a task
+type cancellingStorage struct {
+	*memStorage
+	cancel context.CancelFunc
+}
+
+func (s *cancellingStorage) Save(ctx context.Context, path string, data io.Reader) error {
+	err := s.memStorage.Save(ctx, path, data)
+	s.cancel()
+	return err
+}
+
+func TestProcessImageCancelled(t *testing.T) {
+	original := encodeJPEG(t, testImage(640, 480), 90)
+
+	t.Run("before starting", func(t *testing.T) {
+		storage, images := newMemStorage(), newFakeImages()
+		task := seedOriginal(t, images, storage, "a", original, domain.FormatJPEG)
+		s := newTestProcessor(testConfig(t), images, storage)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := s.ProcessImage(ctx, task); !errors.Is(err, context.Canceled) {
+			t.Fatalf("ProcessImage = %v, want context.Canceled", err)
+		}
+		if paths := storage.paths(); !slices.Equal(paths, []string{task.ImagePath}) {
+			t.Errorf("storage holds %v, want only the original", paths)
+		}
+		img, _ := images.GetByID(context.Background(), "a")
+		if img.Status != domain.StatusPending || img.ProcessingAttempts != 0 {
+			t.Errorf("image is %s after %d attempts, want it untouched", img.Status, img.ProcessingAttempts)
+		}
+	})
+
+	t.Run("while saving derivatives", func(t *testing.T) {
+		inner, images := newMemStorage(), newFakeImages()
+		task := seedOriginal(t, images, inner, "a", original, domain.FormatJPEG)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := newTestProcessor(testConfig(t), images, &cancellingStorage{memStorage: inner, cancel: cancel})
+
+		if err := s.ProcessImage(ctx, task); err == nil {
+			t.Fatal("ProcessImage succeeded, want the cancellation")
+		}
+		if paths := inner.paths(); !slices.Equal(paths, []string{task.ImagePath}) {
+			t.Errorf("storage holds %v, want only the original", paths)
+		}
+		// An interrupted attempt is requeued rather than failed
+		img, _ := images.GetByID(context.Background(), "a")
+		if img.Status != domain.StatusPending || img.ProcessedPath != "" {
+			t.Errorf("image is %s with processed path %q, want it pending", img.Status, img.ProcessedPath)
+		}
+	})
+}
+
+func TestInterpolationFunc(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		want      resize.InterpolationFunction
+	}{
+		{config.ResizeNearest, resize.NearestNeighbor},
+		{config.ResizeBilinear, resize.Bilinear},
+		{config.ResizeBicubic, resize.Bicubic},
+		{config.ResizeMitchellNetravali, resize.MitchellNetravali},
+		{config.ResizeLanczos2, resize.Lanczos2},
+		{config.ResizeLanczos3, resize.Lanczos3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			if got := interpolationFunc(tt.algorithm); got != tt.want {
+				t.Errorf("interpolationFunc(%q) = %v, want %v", tt.algorithm, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPNGCompression(t *testing.T) {
+	ctx := context.Background()
+	img := testImage(256, 256)
+
+	sizes := make(map[string]int)
+	for _, level := range []string{"no", "best-speed", "default", "best-compression"} {
+		storage := newMemStorage()
+		cfg := &config.Config{}
+		cfg.Image.PNGCompression = level
+		s := &processorService{storageRepo: storage, cfg: cfg}
+		if _, err := s.saveImage(ctx, "processed/a.png", img, domain.FormatPNG, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		// The stored file is what an encoder at that level produces
+		parsed, _ := config.ParsePNGCompression(level)
+		var want bytes.Buffer
+		if err := (&png.Encoder{CompressionLevel: parsed}).Encode(&want, img); err != nil {
+			t.Fatal(err)
+		}
+		got := storage.files["processed/a.png"]
+		if !bytes.Equal(got, want.Bytes()) {
+			t.Errorf("%s: stored %d bytes, an encoder at that level gives %d", level, len(got), want.Len())
+		}
+		sizes[level] = len(got)
+	}
+	if !(sizes["best-compression"] <= sizes["best-speed"] && sizes["best-speed"] < sizes["no"]) {
+		t.Errorf("sizes by level = %v, want smaller files at higher compression", sizes)
+	}
+}
+
+func TestProcessingKeyPNGCompression(t *testing.T) {
+	key := func(format domain.ImageFormat, level string) string {
+		cfg := testConfig(t)
+		cfg.Image.PNGCompression = level
+		s := newTestProcessor(cfg, newFakeImages(), newMemStorage())
+		return s.processingKey([]byte("source"), format, nil, domain.ProcessingParams{})
+	}
+	// A new level must not reuse PNG derivatives encoded at the old one,
+	// while other formats are unaffected by it
+	if key(domain.FormatPNG, "default") == key(domain.FormatPNG, "best-compression") {
+		t.Error("PNG output keys don't depend on the compression level")
+	}
+	if key(domain.FormatJPEG, "default") != key(domain.FormatJPEG, "best-compression") {
+		t.Error("JPEG output keys depend on the PNG compression level")
+	}
+}
+
+func TestPNGUploadOutputFormat(t *testing.T) {
+	tests := []struct {
+		name, output string
+		want         domain.ImageFormat
+		wantExt      string
+	}{
+		{name: "source format kept", want: domain.FormatPNG, wantExt: ".png"},
+		{name: "jpeg configured", output: "jpeg", want: domain.FormatJPEG, wantExt: ".jpg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			cfg := testConfig(t)
+			cfg.Image.OutputFormat = tt.output
+			ts := newTestImageService(cfg)
+			uploaded, err := ts.upload(ctx, "a.png", encodePNG(t, testImage(400, 300)), UploadOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := newTestProcessor(cfg, ts.images, ts.storage).ProcessImage(ctx, ts.images.tasks[0]); err != nil {
+				t.Fatal(err)
+			}
+			img, _ := ts.GetByID(ctx, uploaded.ID)
+
+			if img.Format != domain.FormatPNG || img.ProcessedFormat != tt.want {
+				t.Errorf("format %s processed as %s, want png processed as %s", img.Format, img.ProcessedFormat, tt.want)
+			}
+			// The files are encoded as, and named after, the output format
+			for _, path := range []string{img.ProcessedPath, img.ThumbnailPath} {
+				if !strings.HasSuffix(path, tt.wantExt) {
+					t.Errorf("%s doesn't end in %s", path, tt.wantExt)
+				}
+				_, format, err := image.DecodeConfig(bytes.NewReader(ts.storage.files[path]))
+				if err != nil || format != string(tt.want) {
+					t.Errorf("%s decodes as %q (%v), want %s", path, format, err, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// failingStorage reads up to n bytes of each save before failing with err
+type failingStorage struct {
+	*memStorage
+	n   int64
+	err error
+}
+
+func (f *failingStorage) Save(ctx context.Context, path string, data io.Reader) error {
+	if _, err := io.Copy(io.Discard, io.LimitReader(data, f.n)); err != nil {
+		return err
+	}
+	return f.err
+}
+
+// meanDiff is the mean absolute difference between the channels of a and b
+func meanDiff(a, b image.Image) float64 {
+	var total, n float64
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			ar, ag, ab, aa := a.At(x, y).RGBA()
+			br, bg, bb, ba := b.At(x, y).RGBA()
+			for _, d := range [][2]uint32{{ar, br}, {ag, bg}, {ab, bb}, {aa, ba}} {
+				total += math.Abs(float64(d[0]>>8) - float64(d[1]>>8))
+				n++
+			}
+		}
+	}
+	return total / n
+}
+
+func TestSaveImage(t *testing.T) {
+	src := testImage(300, 200)
+	tests := []struct {
+		format  domain.ImageFormat
+		decode  func(io.Reader) (image.Image, error)
+		maxDiff float64
+	}{
+		{format: domain.FormatPNG, decode: png.Decode, maxDiff: 0},
+		{format: domain.FormatJPEG, decode: jpeg.Decode, maxDiff: 3},
+		{format: domain.FormatGIF, decode: gif.Decode, maxDiff: 16},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			storage := newMemStorage()
+			s := newTestProcessor(testConfig(t), newFakeImages(), storage)
+			saved, err := s.saveImage(context.Background(), "processed/a", src, tt.format, 90)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data := storage.files["processed/a"]
+			sum := sha256.Sum256(data)
+			if saved.checksum != hex.EncodeToString(sum[:]) || saved.size != int64(len(data)) {
+				t.Errorf("saved checksum %s, size %d, don't match the %d stored bytes", saved.checksum, saved.size, len(data))
+			}
+			got, err := tt.decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Bounds() != src.Bounds() {
+				t.Fatalf("decoded bounds %v, want %v", got.Bounds(), src.Bounds())
+			}
+			if diff := meanDiff(src, got); diff > tt.maxDiff {
+				t.Errorf("decoded image differs by %.2f on average, want at most %.2f", diff, tt.maxDiff)
+			}
+		})
+	}
+}
+
+func TestSaveImageErrors(t *testing.T) {
+	errStorage := errors.New("storage unavailable")
+	// Noise doesn't compress, so the encoder outruns the pipe's buffer and
+	// blocks until storage reads or gives up
+	noise := image.NewRGBA(image.Rect(0, 0, 512, 512))
+	rand.NewChaCha8([32]byte{}).Read(noise.Pix)
+
+	tests := []struct {
+		name    string
+		storage repo.StorageRepository
+		img     image.Image
+		format  domain.ImageFormat
+		wantErr error
+	}{
+		{name: "storage fails at once", storage: &failingStorage{memStorage: newMemStorage(), err: errStorage},
+			img: noise, format: domain.FormatPNG, wantErr: errStorage},
+		{name: "storage fails midway", storage: &failingStorage{memStorage: newMemStorage(), n: 100 << 10, err: errStorage},
+			img: noise, format: domain.FormatPNG, wantErr: errStorage},
+		{name: "encoder fails", storage: newMemStorage(),
+			img: image.NewRGBA(image.Rectangle{}), format: domain.FormatPNG},
+		{name: "unencodable format", storage: newMemStorage(),
+			img: noise, format: domain.FormatWebP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestProcessor(testConfig(t), newFakeImages(), tt.storage)
+			done := make(chan error, 1)
+			go func() {
+				_, err := s.saveImage(context.Background(), "processed/a", tt.img, tt.format, 90)
+				done <- err
+			}()
+
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("saveImage didn't return; the encoder is stuck on the pipe")
+			}
+			if err == nil {
+				t.Fatal("saveImage succeeded")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			if mem, ok := tt.storage.(*memStorage); ok && len(mem.paths()) != 0 {
+				t.Errorf("stored %v after a failed save", mem.paths())
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/oziev02/ImageProcessor/internal/config"
+)
+
+// retryBatchSize is how many failed images a sweep requeues per transaction
+const retryBatchSize = 100
+
+// RetrySweeper periodically requeues failed images with
+// ImageService.RetryFailed
+type RetrySweeper interface {
+	Run(ctx context.Context)
+}
+
+type retrySweeper struct {
+	imageSvc ImageService
+	cfg      *config.Config
+	logger   *slog.Logger
+}
+
+func NewRetrySweeper(imageSvc ImageService, cfg *config.Config, logger *slog.Logger) RetrySweeper {
+	return &retrySweeper{
+		imageSvc: imageSvc,
+		cfg:      cfg,
+		logger:   logger,
+	}
+}
+
+// Run sweeps every PROCESSING_RETRY_INTERVAL until ctx is done
+func (s *retrySweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.Image.RetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sweep(ctx)
+		}
+	}
+}
+
+// sweep requeues batch by batch until no retryable image is left
+func (s *retrySweeper) sweep(ctx context.Context) {
+	for {
+		retried, err := s.imageSvc.RetryFailed(ctx, retryBatchSize)
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger.Warn("failed to retry failed images", "error", err)
+			}
+			return
+		}
+		if retried > 0 {
+			s.logger.Info("requeued failed images", "count", retried)
+		}
+		if retried < retryBatchSize {
+			return
+		}
+	}
+}
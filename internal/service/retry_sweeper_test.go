@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+func TestRetryFailed(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConfig(t)
+	cfg.Image.RetryMax = 2
+	cfg.Image.RetryMaxAge = 24 * time.Hour
+	cfg.Image.MaxProcessingAttempts = 3
+	ts := newTestImageService(cfg)
+
+	seed := func(id string, age time.Duration, attempts int) {
+		seedOriginal(t, ts.images, ts.storage, id, []byte(id), domain.FormatPNG)
+		img := ts.images.images[id]
+		img.Status, img.ProcessingAttempts = domain.StatusFailed, attempts
+		img.CreatedAt = time.Now().Add(-age)
+	}
+	seed("retryable", time.Hour, 1)
+	seed("too-old", 48*time.Hour, 1)
+	seed("out-of-attempts", time.Hour, 3)
+
+	// Each sweep counts a retry, until PROCESSING_RETRY_MAX
+	for retry := 1; retry <= 3; retry++ {
+		n, err := ts.RetryFailed(ctx, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, _ := ts.images.GetByID(ctx, "retryable")
+		if retry > cfg.Image.RetryMax {
+			if n != 0 || img.Status != domain.StatusFailed {
+				t.Errorf("retry %d past the cap: %d retried, status %s", retry, n, img.Status)
+			}
+			break
+		}
+		if n != 1 || img.Status != domain.StatusPending || img.RetryCount != retry {
+			t.Fatalf("retry %d: %d retried, status %s, retry count %d", retry, n, img.Status, img.RetryCount)
+		}
+		ts.images.mu.Lock()
+		ts.images.images["retryable"].Status = domain.StatusFailed
+		ts.images.mu.Unlock()
+	}
+
+	// Retries go at low priority, to the reprocess topic, and are recorded
+	sent := ts.producer.sent()
+	if len(sent) != cfg.Image.RetryMax {
+		t.Fatalf("%d tasks sent, want one per retry", len(sent))
+	}
+	for _, task := range sent {
+		if task.ImageID != "retryable" || task.Priority != domain.PriorityLow || task.Origin != domain.TaskOriginReprocess {
+			t.Errorf("task %+v, want a low priority reprocess task of retryable", task)
+		}
+	}
+	if len(ts.outbox.sent) != cfg.Image.RetryMax {
+		t.Errorf("%d outbox messages marked sent, want %d", len(ts.outbox.sent), cfg.Image.RetryMax)
+	}
+	if len(ts.events.events) != cfg.Image.RetryMax {
+		t.Errorf("%d events recorded, want %d", len(ts.events.events), cfg.Image.RetryMax)
+	}
+}
+
+// countingRetries returns the next of results from each RetryFailed
+type countingRetries struct {
+	ImageService
+	results []int
+	err     error
+	calls   int
+}
+
+func (c *countingRetries) RetryFailed(ctx context.Context, limit int) (int, error) {
+	c.calls++
+	if c.calls > len(c.results) {
+		return 0, c.err
+	}
+	return c.results[c.calls-1], nil
+}
+
+func TestRetrySweep(t *testing.T) {
+	tests := []struct {
+		name      string
+		results   []int
+		err       error
+		wantCalls int
+	}{
+		{name: "nothing to retry", results: []int{0}, wantCalls: 1},
+		{name: "partial batch", results: []int{7}, wantCalls: 1},
+		{name: "full batches", results: []int{retryBatchSize, retryBatchSize, 3}, wantCalls: 3},
+		{name: "error", results: []int{retryBatchSize}, err: errors.New("db down"), wantCalls: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &countingRetries{results: tt.results, err: tt.err}
+			NewRetrySweeper(svc, testConfig(t), discardLogger()).(*retrySweeper).sweep(context.Background())
+			if svc.calls != tt.wantCalls {
+				t.Errorf("RetryFailed called %d times, want %d", svc.calls, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"time"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+// rotateImage turns img clockwise by degrees, a multiple of 90
+func rotateImage(img image.Image, degrees int) image.Image {
+	// The EXIF orientations for the same rotations
+	switch degrees {
+	case 90:
+		return applyOrientation(img, 6)
+	case 180:
+		return applyOrientation(img, 3)
+	case 270:
+		return applyOrientation(img, 8)
+	default:
+		return img
+	}
+}
+
+// Rotate turns the stored derivatives of a processed image clockwise in
+// place and adds the rotation to its parameters, so that reprocessing the
+// original reproduces it. The files are rewritten one at a time, so when one
+// of them or the record fails to update, those already rotated are written
+// back as they were.
+func (s *processorService) Rotate(ctx context.Context, id string, degrees int) (*domain.Image, error) {
+	if !domain.ValidRotation(degrees) || degrees == 0 {
+		return nil, domain.ErrInvalidRotation
+	}
+
+	img, err := s.imageRepo.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if img.Status != domain.StatusCompleted || img.ProcessedPath == "" {
+		return nil, domain.ErrImageNotProcessed
+	}
+	format := img.ProcessedFormat
+	if format == "" {
+		// Records processed before processed_format was tracked
+		format = img.Format
+	}
+
+	// What the files and record held before, to put back on failure
+	before := *img
+	var previous []storedFile
+	thumbnailUpdated, completed := false, false
+	defer func() {
+		if completed {
+			return
+		}
+		s.restoreFiles(ctx, previous)
+		if thumbnailUpdated {
+			if err := s.imageRepo.UpdateThumbnail(context.WithoutCancel(ctx), &before); err != nil {
+				s.logger.Warn("failed to restore image record", "image_id", img.ID, "error", err)
+			}
+		}
+	}()
+	rotate := func(path string, format domain.ImageFormat, quality int) (savedFile, image.Rectangle, error) {
+		data, err := s.readFile(ctx, path)
+		if err != nil {
+			return savedFile{}, image.Rectangle{}, err
+		}
+		previous = append(previous, storedFile{path: path, data: data})
+		return s.rotateFile(ctx, path, data, format, quality, degrees)
+	}
+
+	processedQuality := s.cfg.Image.JPEGQuality
+	if img.Params.Quality != 0 {
+		processedQuality = img.Params.Quality
+	}
+	saved, bounds, err := rotate(img.ProcessedPath, format, processedQuality)
+	if err != nil {
+		return nil, err
+	}
+	img.ProcessedChecksum = saved.checksum
+	img.ProcessedSize = saved.size
+	img.ProcessedWidth, img.ProcessedHeight = bounds.Dx(), bounds.Dy()
+
+	if img.ThumbnailPath != "" {
+		saved, _, err := rotate(img.ThumbnailPath, format, s.cfg.Image.ThumbnailJPEGQuality)
+		if err != nil {
+			return nil, err
+		}
+		img.ThumbnailChecksum = saved.checksum
+	}
+	for _, path := range img.Thumbnails {
+		if _, _, err := rotate(path, format, s.cfg.Image.ThumbnailJPEGQuality); err != nil {
+			return nil, err
+		}
+	}
+	if img.LQIPPath != "" {
+		if _, _, err := rotate(img.LQIPPath, domain.FormatJPEG, lqipQuality); err != nil {
+			return nil, err
+		}
+	}
+
+	if img.Placeholder != "" {
+		if img.Placeholder, err = rotatePlaceholder(img.Placeholder, degrees); err != nil {
+			return nil, err
+		}
+	}
+
+	img.Params.Rotation = (img.Params.Rotation + degrees) % 360
+	// The derivatives no longer match the key, so they mustn't be reused
+	// for another upload of the same source
+	img.ProcessingKey = ""
+	img.UpdatedAt = time.Now()
+	if err := s.imageRepo.UpdateThumbnail(ctx, img); err != nil {
+		return nil, fmt.Errorf("failed to update image record: %w", err)
+	}
+	thumbnailUpdated = true
+	if err := s.imageRepo.Update(ctx, img); err != nil {
+		return nil, fmt.Errorf("failed to update image record: %w", err)
+	}
+	completed = true
+	return img, nil
+}
+
+// storedFile is the content of a file before it was overwritten
+type storedFile struct {
+	path string
+	data []byte
+}
+
+// restoreFiles writes files back as they were. It uses a context detached
+// from cancellation so that a cancelled rotation is still undone.
+func (s *processorService) restoreFiles(ctx context.Context, files []storedFile) {
+	ctx = context.WithoutCancel(ctx)
+	for _, f := range files {
+		if err := s.storageRepo.Save(ctx, f.path, bytes.NewReader(f.data)); err != nil {
+			s.logger.Warn("failed to restore rotated file", "path", f.path, "error", err)
+		}
+	}
+}
+
+func (s *processorService) readFile(ctx context.Context, path string) ([]byte, error) {
+	reader, err := s.storageRepo.Read(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return data, nil
+}
+
+// rotateFile overwrites the stored image at path, whose content is data,
+// with its rotated version, returning what was saved and the new bounds
+func (s *processorService) rotateFile(ctx context.Context, path string, data []byte, format domain.ImageFormat, quality, degrees int) (savedFile, image.Rectangle, error) {
+	if err := s.decodes.acquire(ctx); err != nil {
+		return savedFile{}, image.Rectangle{}, err
+	}
+	var src image.Image
+	var err error
+	if format == domain.FormatGIF {
+		src, err = decodeGIF(bytes.NewReader(data))
+	} else {
+		src, _, err = decodeImage(bytes.NewReader(data), format)
+	}
+	s.decodes.release()
+	if err != nil {
+		return savedFile{}, image.Rectangle{}, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+
+	var rotated image.Image
+	err = s.throttle.run(ctx, func() error {
+		rotated = eachFrame(src, func(frame image.Image) image.Image {
+			return rotateImage(frame, degrees)
+		})
+		return nil
+	})
+	if err != nil {
+		return savedFile{}, image.Rectangle{}, err
+	}
+	saved, err := s.saveImage(ctx, path, rotated, format, quality)
+	if err != nil {
+		return savedFile{}, image.Rectangle{}, fmt.Errorf("failed to save %s: %w", path, err)
+	}
+	return saved, rotated.Bounds(), nil
+}
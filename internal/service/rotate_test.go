@@ -0,0 +1,143 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+// seedProcessed stores a completed image whose processed image is w x h and
+// thumbnail half that, returning the image
+func seedProcessed(t *testing.T, images *fakeImages, storage *memStorage, w, h int) *domain.Image {
+	t.Helper()
+	ctx := context.Background()
+	img := &domain.Image{
+		ID:              "a",
+		Status:          domain.StatusCompleted,
+		Format:          domain.FormatJPEG,
+		ProcessedFormat: domain.FormatJPEG,
+		ProcessedPath:   "processed/a.jpg",
+		ThumbnailPath:   "thumbnails/a.jpg",
+		ProcessedWidth:  w,
+		ProcessedHeight: h,
+	}
+	storage.Save(ctx, img.ProcessedPath, bytes.NewReader(encodeJPEG(t, testImage(w, h), 90)))
+	storage.Save(ctx, img.ThumbnailPath, bytes.NewReader(encodeJPEG(t, testImage(w/2, h/2), 90)))
+	images.images[img.ID] = img
+	return img
+}
+
+func storedSize(t *testing.T, storage *memStorage, path string) image.Point {
+	t.Helper()
+	reader, err := storage.Read(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	cfg, err := jpeg.DecodeConfig(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return image.Pt(cfg.Width, cfg.Height)
+}
+
+func TestRotate(t *testing.T) {
+	tests := []struct {
+		degrees      int
+		wantW, wantH int
+	}{
+		{degrees: 90, wantW: 60, wantH: 100},
+		{degrees: 180, wantW: 100, wantH: 60},
+		{degrees: 270, wantW: 60, wantH: 100},
+	}
+	for _, tt := range tests {
+		storage, images := newMemStorage(), newFakeImages()
+		seedProcessed(t, images, storage, 100, 60)
+		s := newTestProcessor(testConfig(t), images, storage)
+
+		img, err := s.Rotate(context.Background(), "a", tt.degrees)
+		if err != nil {
+			t.Fatalf("%d: %v", tt.degrees, err)
+		}
+		if img.ProcessedWidth != tt.wantW || img.ProcessedHeight != tt.wantH {
+			t.Errorf("%d: record is %dx%d, want %dx%d", tt.degrees, img.ProcessedWidth, img.ProcessedHeight, tt.wantW, tt.wantH)
+		}
+		if got := storedSize(t, storage, img.ProcessedPath); got != image.Pt(tt.wantW, tt.wantH) {
+			t.Errorf("%d: processed file is %v, want %dx%d", tt.degrees, got, tt.wantW, tt.wantH)
+		}
+		if got := storedSize(t, storage, img.ThumbnailPath); got != image.Pt(tt.wantW/2, tt.wantH/2) {
+			t.Errorf("%d: thumbnail is %v, want %dx%d", tt.degrees, got, tt.wantW/2, tt.wantH/2)
+		}
+		stored, _ := images.GetByID(context.Background(), "a")
+		if stored.Params.Rotation != tt.degrees {
+			t.Errorf("%d: stored rotation = %d", tt.degrees, stored.Params.Rotation)
+		}
+	}
+}
+
+// failingSave fails saving the paths containing fail
+type failingSave struct {
+	*memStorage
+	fail string
+}
+
+func (s *failingSave) Save(ctx context.Context, path string, data io.Reader) error {
+	if strings.Contains(path, s.fail) {
+		io.Copy(io.Discard, data)
+		return errors.New("disk full")
+	}
+	return s.memStorage.Save(ctx, path, data)
+}
+
+func TestRotateRestoresOnFailure(t *testing.T) {
+	storage, images := newMemStorage(), newFakeImages()
+	seedProcessed(t, images, storage, 100, 60)
+	processed := append([]byte(nil), storage.files["processed/a.jpg"]...)
+
+	// The processed image is rotated before saving the thumbnail fails
+	s := newTestProcessor(testConfig(t), images, &failingSave{memStorage: storage, fail: "thumbnails/"})
+	if _, err := s.Rotate(context.Background(), "a", 90); err == nil {
+		t.Fatal("Rotate succeeded, want the save error")
+	}
+
+	if !bytes.Equal(storage.files["processed/a.jpg"], processed) {
+		t.Error("processed image left rotated after the failure")
+	}
+	stored, _ := images.GetByID(context.Background(), "a")
+	if stored.Params.Rotation != 0 || stored.ProcessedWidth != 100 {
+		t.Errorf("record changed to rotation %d, width %d", stored.Params.Rotation, stored.ProcessedWidth)
+	}
+}
+
+func TestRotateRestoresOnRecordFailure(t *testing.T) {
+	storage, images := newMemStorage(), newFakeImages()
+	seedProcessed(t, images, storage, 100, 60)
+	before := map[string][]byte{}
+	for path, data := range storage.files {
+		before[path] = append([]byte(nil), data...)
+	}
+	images.updateErr = errors.New("connection lost")
+
+	s := newTestProcessor(testConfig(t), images, storage)
+	if _, err := s.Rotate(context.Background(), "a", 90); err == nil {
+		t.Fatal("Rotate succeeded, want the update error")
+	}
+
+	for path, data := range before {
+		if !bytes.Equal(storage.files[path], data) {
+			t.Errorf("%s left rotated after the failure", path)
+		}
+	}
+	// The thumbnail fields were written before the update failed
+	stored, _ := images.GetByID(context.Background(), "a")
+	if stored.ThumbnailChecksum != "" {
+		t.Errorf("thumbnail checksum left at %q, want it restored", stored.ThumbnailChecksum)
+	}
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/nfnt/resize"
+)
+
+// sharpnessWidth bounds the width the sharpness score is computed at, so
+// that scoring a large image stays cheap
+const sharpnessWidth = 512
+
+// sharpness scores how in focus src is as the variance of the Laplacian of
+// its downscaled grayscale version. Blurry images have few edges and score
+// low; the score is only comparable between images of similar content.
+func sharpness(src image.Image) float64 {
+	img := src
+	if src.Bounds().Dx() > sharpnessWidth {
+		img = resize.Resize(sharpnessWidth, 0, src, resize.Bilinear)
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w < 3 || h < 3 {
+		return 0
+	}
+
+	gray := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.GrayModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray)
+			gray[y*w+x] = float64(c.Y)
+		}
+	}
+
+	// 4-neighbour Laplacian over the interior pixels
+	var sum, sumSq float64
+	n := float64((w - 2) * (h - 2))
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			i := y*w + x
+			l := gray[i-w] + gray[i+w] + gray[i-1] + gray[i+1] - 4*gray[i]
+			sum += l
+			sumSq += l * l
+		}
+	}
+	mean := sum / n
+	return sumSq/n - mean*mean
+}
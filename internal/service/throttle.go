@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+	"runtime"
+	"time"
+)
+
+// throttle lowers the CPU impact of heavy image operations on shared hosts.
+// GOMAXPROCS is process-wide, so instead operations are bounded by a
+// semaphore sized to the allowed share of CPUs and followed by a pause
+// proportional to their duration.
+type throttle struct {
+	sem   chan struct{}
+	pause float64 // pause per second of work
+}
+
+// newThrottle returns a throttle yielding the given fraction of CPU time,
+// in [0, 1), or nil when level is zero
+func newThrottle(level float64) *throttle {
+	if level <= 0 {
+		return nil
+	}
+	slots := int(float64(runtime.GOMAXPROCS(0)) * (1 - level))
+	return &throttle{
+		sem:   make(chan struct{}, max(slots, 1)),
+		pause: level / (1 - level),
+	}
+}
+
+// run calls fn within the throttle's limits. A nil throttle runs fn directly.
+func (t *throttle) run(ctx context.Context, fn func() error) error {
+	if t == nil {
+		return fn()
+	}
+
+	select {
+	case t.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	start := time.Now()
+	err := fn()
+	<-t.sem
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(time.Duration(float64(time.Since(start)) * t.pause))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"image"
+	"image/draw"
+)
+
+// adjustTone applies a linear brightness and contrast correction to the RGB
+// channels of img, each adjustment in [-100, 100]. Brightness shifts the
+// channels by up to the full range; contrast scales them around mid-grey,
+// from flat grey at -100 to twice the spread at 100. Alpha is kept.
+func adjustTone(img image.Image, brightness, contrast int) image.Image {
+	if brightness == 0 && contrast == 0 {
+		return img
+	}
+
+	// Every channel value maps the same way, so compute the mapping once
+	var table [256]uint8
+	shift := float64(brightness) * 255 / 100
+	scale := float64(100+contrast) / 100
+	for v := range table {
+		out := (float64(v)-128)*scale + 128 + shift
+		table[v] = uint8(min(max(out+0.5, 0), 255))
+	}
+
+	// Work on non-premultiplied pixels so that transparency doesn't skew
+	// the channels
+	bounds := img.Bounds()
+	dst := image.NewNRGBA(bounds)
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		dst.Pix[i] = table[dst.Pix[i]]
+		dst.Pix[i+1] = table[dst.Pix[i+1]]
+		dst.Pix[i+2] = table[dst.Pix[i+2]]
+	}
+	return dst
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestAdjustTone(t *testing.T) {
+	tests := []struct {
+		name                 string
+		brightness, contrast int
+		in, want             color.NRGBA
+	}{
+		{name: "unchanged", in: color.NRGBA{100, 150, 200, 255}, want: color.NRGBA{100, 150, 200, 255}},
+		{name: "brightened", brightness: 20, in: color.NRGBA{100, 150, 200, 255}, want: color.NRGBA{151, 201, 251, 255}},
+		{name: "darkened", brightness: -20, in: color.NRGBA{100, 150, 200, 255}, want: color.NRGBA{49, 99, 149, 255}},
+		{name: "brightened past white", brightness: 100, in: color.NRGBA{100, 150, 200, 255}, want: color.NRGBA{255, 255, 255, 255}},
+		{name: "no contrast", contrast: -100, in: color.NRGBA{10, 150, 250, 255}, want: color.NRGBA{128, 128, 128, 255}},
+		{name: "double contrast", contrast: 100, in: color.NRGBA{100, 150, 200, 255}, want: color.NRGBA{72, 172, 255, 255}},
+		{name: "alpha kept", brightness: 20, in: color.NRGBA{100, 150, 200, 128}, want: color.NRGBA{151, 201, 251, 128}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+			for y := range 2 {
+				for x := range 2 {
+					src.SetNRGBA(x, y, tt.in)
+				}
+			}
+			got := color.NRGBAModel.Convert(adjustTone(src, tt.brightness, tt.contrast).At(1, 1)).(color.NRGBA)
+			if got != tt.want {
+				t.Errorf("pixel = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+
+	"github.com/nfnt/resize"
+	"github.com/oziev02/ImageProcessor/internal/config"
+)
+
+// watermarkMargin is the gap in pixels between the watermark and the edges
+const watermarkMargin = 10
+
+type watermark struct {
+	img  image.Image
+	hash string // SHA-256 of the watermark file, part of the processing key
+}
+
+// loadWatermark reads the configured watermark PNG. A missing or unreadable
+// file is logged and processing continues without a watermark.
+func (s *processorService) loadWatermark() *watermark {
+	if !s.cfg.Image.WatermarkEnabled || s.cfg.Image.WatermarkPath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.cfg.Image.WatermarkPath)
+	if err != nil {
+		s.logger.Warn("failed to read watermark, continuing without it",
+			"path", s.cfg.Image.WatermarkPath, "error", err)
+		return nil
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		s.logger.Warn("failed to decode watermark, continuing without it",
+			"path", s.cfg.Image.WatermarkPath, "error", err)
+		return nil
+	}
+
+	sum := sha256.Sum256(data)
+	return &watermark{img: img, hash: hex.EncodeToString(sum[:])}
+}
+
+// apply composites the watermark onto a copy of dst at the configured
+// position and opacity. A watermark larger than dst is scaled down to fit.
+func (w *watermark) apply(dst image.Image, cfg config.ImageConfig) image.Image {
+	bounds := dst.Bounds()
+	out := image.NewRGBA(bounds)
+	draw.Draw(out, bounds, dst, bounds.Min, draw.Src)
+
+	mark := w.img
+	maxW := uint(max(bounds.Dx()-2*watermarkMargin, 1))
+	maxH := uint(max(bounds.Dy()-2*watermarkMargin, 1))
+	if uint(mark.Bounds().Dx()) > maxW || uint(mark.Bounds().Dy()) > maxH {
+		mark = resize.Thumbnail(maxW, maxH, mark, resize.Lanczos3)
+	}
+
+	size := mark.Bounds().Size()
+	at := watermarkOrigin(bounds, size, cfg.WatermarkPosition)
+	mask := image.NewUniform(color.Alpha{A: uint8(cfg.WatermarkOpacity * 0xff)})
+	draw.DrawMask(out, image.Rectangle{Min: at, Max: at.Add(size)}, mark, mark.Bounds().Min, mask, image.Point{}, draw.Over)
+
+	return out
+}
+
+func watermarkOrigin(bounds image.Rectangle, size image.Point, position string) image.Point {
+	left := bounds.Min.X + watermarkMargin
+	top := bounds.Min.Y + watermarkMargin
+	right := bounds.Max.X - watermarkMargin - size.X
+	bottom := bounds.Max.Y - watermarkMargin - size.Y
+
+	switch position {
+	case config.WatermarkTopLeft:
+		return image.Pt(left, top)
+	case config.WatermarkTopRight:
+		return image.Pt(right, top)
+	case config.WatermarkBottomLeft:
+		return image.Pt(left, bottom)
+	case config.WatermarkCenter:
+		return image.Pt(
+			bounds.Min.X+(bounds.Dx()-size.X)/2,
+			bounds.Min.Y+(bounds.Dy()-size.Y)/2,
+		)
+	default: // bottom-right
+		return image.Pt(right, bottom)
+	}
+}
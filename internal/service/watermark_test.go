@@ -0,0 +1,76 @@
+package service
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/oziev02/ImageProcessor/internal/config"
+)
+
+func TestWatermarkApply(t *testing.T) {
+	// A white 20x20 mark over a black 200x100 image
+	markPath := filepath.Join(t.TempDir(), "watermark.png")
+	mark := image.NewRGBA(image.Rect(0, 0, 20, 20))
+	draw.Draw(mark, mark.Bounds(), image.White, image.Point{}, draw.Src)
+	f, err := os.Create(markPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, mark); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	src := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(src, src.Bounds(), image.Black, image.Point{}, draw.Src)
+
+	// Points inside the mark and in the opposite corner for each position
+	tests := []struct {
+		position string
+		marked   image.Point
+		clean    image.Point
+	}{
+		{position: config.WatermarkTopLeft, marked: image.Pt(15, 15), clean: image.Pt(185, 85)},
+		{position: config.WatermarkTopRight, marked: image.Pt(185, 15), clean: image.Pt(15, 85)},
+		{position: config.WatermarkBottomLeft, marked: image.Pt(15, 85), clean: image.Pt(185, 15)},
+		{position: config.WatermarkBottomRight, marked: image.Pt(185, 85), clean: image.Pt(15, 15)},
+		{position: config.WatermarkCenter, marked: image.Pt(100, 50), clean: image.Pt(15, 15)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.position, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Image.WatermarkEnabled = true
+			cfg.Image.WatermarkPath = markPath
+			cfg.Image.WatermarkPosition = tt.position
+			cfg.Image.WatermarkOpacity = 0.5
+			s := &processorService{cfg: cfg, logger: discardLogger()}
+
+			wm := s.loadWatermark()
+			if wm == nil {
+				t.Fatal("watermark not loaded")
+			}
+			out := wm.apply(src, cfg.Image)
+
+			if got := out.At(tt.marked.X, tt.marked.Y); sameColor(got, src.At(tt.marked.X, tt.marked.Y)) {
+				t.Errorf("pixel %v under the watermark is unchanged: %v", tt.marked, got)
+			}
+			if got := out.At(tt.clean.X, tt.clean.Y); !sameColor(got, src.At(tt.clean.X, tt.clean.Y)) {
+				t.Errorf("pixel %v away from the watermark changed to %v", tt.clean, got)
+			}
+			if !sameColor(src.At(tt.marked.X, tt.marked.Y), color.Black) {
+				t.Error("apply modified its input")
+			}
+		})
+	}
+}
+
+func sameColor(a, b color.Color) bool {
+	r1, g1, b1, a1 := a.RGBA()
+	r2, g2, b2, a2 := b.RGBA()
+	return r1 == r2 && g1 == g2 && b1 == b2 && a1 == a2
+}
@@ -0,0 +1,208 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+
+	"golang.org/x/image/webp"
+)
+
+// x/image/webp decodes still images only: an animated file, whose frames
+// are in ANMF chunks, fails as an invalid format. Animation is detected
+// from the RIFF chunks so that uploads can reject it, and the first frame
+// is decoded by rewrapping it as a still image.
+
+const (
+	webpAnimationFlag = 1 << 1 // in the VP8X header
+	webpAlphaFlag     = 1 << 4
+)
+
+var errInvalidWebP = errors.New("invalid webp structure")
+
+// isAnimatedWebP walks the chunks of a WebP file up to its image data and
+// reports whether it's animated
+func isAnimatedWebP(r io.Reader) (bool, error) {
+	br := bufio.NewReader(r)
+	var header [12]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return false, err
+	}
+	if string(header[:4]) != "RIFF" || string(header[8:]) != "WEBP" {
+		return false, errInvalidWebP
+	}
+
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(br, chunk[:]); err != nil {
+			return false, err
+		}
+		size := int(binary.LittleEndian.Uint32(chunk[4:]))
+		skip := size + size&1
+		switch string(chunk[:4]) {
+		case "VP8X":
+			flags, err := br.ReadByte()
+			if err != nil {
+				return false, err
+			}
+			if flags&webpAnimationFlag != 0 {
+				return true, nil
+			}
+			skip--
+		case "ANIM", "ANMF":
+			return true, nil
+		case "VP8 ", "VP8L":
+			return false, nil
+		}
+		if _, err := br.Discard(skip); err != nil {
+			return false, err
+		}
+	}
+}
+
+// decodeWebP decodes a WebP image, or the first frame of an animated one
+func decodeWebP(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if animated, _ := isAnimatedWebP(bytes.NewReader(data)); !animated {
+		return webp.Decode(bytes.NewReader(data))
+	}
+	return decodeFirstWebPFrame(data)
+}
+
+// webpChunk is a RIFF chunk, raw holding its header, payload and padding
+type webpChunk struct {
+	id      string
+	payload []byte
+	raw     []byte
+}
+
+// webpChunks splits data, the body of a RIFF container or of an ANMF chunk,
+// into chunks
+func webpChunks(data []byte) ([]webpChunk, error) {
+	var chunks []webpChunk
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errInvalidWebP
+		}
+		size := uint64(binary.LittleEndian.Uint32(data[4:8]))
+		end := 8 + size + size&1
+		if end > uint64(len(data)) {
+			// The last chunk's padding may be missing
+			if 8+size > uint64(len(data)) {
+				return nil, errInvalidWebP
+			}
+			end = uint64(len(data))
+		}
+		chunks = append(chunks, webpChunk{id: string(data[:4]), payload: data[8 : 8+size], raw: data[:end]})
+		data = data[end:]
+	}
+	return chunks, nil
+}
+
+// decodeFirstWebPFrame decodes the first frame of an animated WebP, drawn
+// at its offset on a transparent canvas
+func decodeFirstWebPFrame(data []byte) (image.Image, error) {
+	if len(data) < 12 {
+		return nil, errInvalidWebP
+	}
+	chunks, err := webpChunks(data[12:])
+	if err != nil {
+		return nil, err
+	}
+
+	var canvas image.Rectangle
+	for _, chunk := range chunks {
+		switch chunk.id {
+		case "VP8X":
+			if len(chunk.payload) < 10 {
+				return nil, errInvalidWebP
+			}
+			canvas = image.Rect(0, 0, int(uint24(chunk.payload[4:]))+1, int(uint24(chunk.payload[7:]))+1)
+		case "ANMF":
+			// Offsets are stored halved, sizes minus one
+			if len(chunk.payload) < 16 {
+				return nil, errInvalidWebP
+			}
+			p := chunk.payload
+			x, y := 2*int(uint24(p[0:])), 2*int(uint24(p[3:]))
+			w, h := int(uint24(p[6:]))+1, int(uint24(p[9:]))+1
+
+			frame, err := decodeWebPFrame(p[16:], w, h)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode first frame: %w", err)
+			}
+			bounds := image.Rect(x, y, x+w, y+h)
+			if bounds == canvas && frame.Bounds() == canvas {
+				return frame, nil
+			}
+			dst := image.NewNRGBA(canvas)
+			draw.Draw(dst, bounds, frame, frame.Bounds().Min, draw.Src)
+			return dst, nil
+		}
+	}
+	return nil, errInvalidWebP
+}
+
+// decodeWebPFrame decodes the image data of an ANMF chunk, an optional ALPH
+// chunk followed by a VP8 or VP8L one, as a still WebP of w by h pixels
+func decodeWebPFrame(data []byte, w, h int) (image.Image, error) {
+	chunks, err := webpChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var alpha []byte
+	for _, chunk := range chunks {
+		switch chunk.id {
+		case "ALPH":
+			alpha = chunk.raw
+		case "VP8L":
+			return webp.Decode(bytes.NewReader(riffWebP(chunk.raw)))
+		case "VP8 ":
+			if alpha == nil {
+				return webp.Decode(bytes.NewReader(riffWebP(chunk.raw)))
+			}
+			// Lossy frames with alpha need a VP8X header announcing it
+			vp8x := make([]byte, 18)
+			copy(vp8x, "VP8X")
+			binary.LittleEndian.PutUint32(vp8x[4:], 10)
+			vp8x[8] = webpAlphaFlag
+			putUint24(vp8x[12:], uint32(w-1))
+			putUint24(vp8x[15:], uint32(h-1))
+			return webp.Decode(bytes.NewReader(riffWebP(vp8x, alpha, chunk.raw)))
+		}
+	}
+	return nil, errInvalidWebP
+}
+
+// riffWebP wraps chunks in a WebP RIFF container
+func riffWebP(chunks ...[]byte) []byte {
+	var body bytes.Buffer
+	for _, chunk := range chunks {
+		body.Write(chunk)
+		if len(chunk)%2 == 1 {
+			body.WriteByte(0)
+		}
+	}
+	out := make([]byte, 12, 12+body.Len())
+	copy(out, "RIFF")
+	binary.LittleEndian.PutUint32(out[4:], uint32(4+body.Len()))
+	copy(out[8:], "WEBP")
+	return append(out, body.Bytes()...)
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
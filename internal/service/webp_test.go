@@ -0,0 +1,222 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"github.com/oziev02/ImageProcessor/internal/config"
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+// bitWriter packs bits least significant first, as VP8L reads them
+type bitWriter struct {
+	buf   []byte
+	nbits uint
+}
+
+func (b *bitWriter) write(v uint32, n uint) {
+	for i := range n {
+		if b.nbits%8 == 0 {
+			b.buf = append(b.buf, 0)
+		}
+		b.buf[len(b.buf)-1] |= byte(v>>i&1) << (b.nbits % 8)
+		b.nbits++
+	}
+}
+
+// solidVP8L is a lossless bitstream of a w by h image in c. Every prefix
+// code holds a single symbol, so the pixels take no bits at all.
+func solidVP8L(w, h int, c color.NRGBA) []byte {
+	b := &bitWriter{}
+	b.write(0x2f, 8)
+	b.write(uint32(w-1), 14)
+	b.write(uint32(h-1), 14)
+	b.write(1, 1) // alpha is used
+	b.write(0, 3) // version
+	b.write(0, 1) // no transform
+	b.write(0, 1) // no color cache
+	b.write(0, 1) // no meta prefix codes
+	// Green, red, blue, alpha and distance codes, each a simple code of one
+	// 8-bit symbol
+	for _, symbol := range []uint8{c.G, c.R, c.B, c.A, 0} {
+		b.write(1, 1)
+		b.write(0, 1)
+		b.write(1, 1)
+		b.write(uint32(symbol), 8)
+	}
+	return b.buf
+}
+
+func webpChunkBytes(id string, payload []byte) []byte {
+	chunk := make([]byte, 8, 8+len(payload)+1)
+	copy(chunk, id)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(payload)))
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func uint24Bytes(v int) []byte {
+	return []byte{byte(v), byte(v >> 8), byte(v >> 16)}
+}
+
+type webpFrame struct {
+	rect  image.Rectangle
+	color color.NRGBA
+}
+
+// animatedWebP is an animated WebP of a w by h canvas with the given frames
+func animatedWebP(w, h int, frames ...webpFrame) []byte {
+	vp8x := append([]byte{webpAnimationFlag | webpAlphaFlag, 0, 0, 0}, uint24Bytes(w-1)...)
+	vp8x = append(vp8x, uint24Bytes(h-1)...)
+	chunks := [][]byte{
+		webpChunkBytes("VP8X", vp8x),
+		webpChunkBytes("ANIM", []byte{0, 0, 0, 0, 0, 0}), // background, loop count
+	}
+	for _, frame := range frames {
+		r := frame.rect
+		var anmf []byte
+		for _, v := range []int{r.Min.X / 2, r.Min.Y / 2, r.Dx() - 1, r.Dy() - 1, 100} {
+			anmf = append(anmf, uint24Bytes(v)...)
+		}
+		anmf = append(anmf, 0) // flags
+		anmf = append(anmf, webpChunkBytes("VP8L", solidVP8L(r.Dx(), r.Dy(), frame.color))...)
+		chunks = append(chunks, webpChunkBytes("ANMF", anmf))
+	}
+	return riffWebP(chunks...)
+}
+
+var (
+	webpRed  = color.NRGBA{R: 255, A: 255}
+	webpBlue = color.NRGBA{B: 255, A: 255}
+)
+
+func TestIsAnimatedWebP(t *testing.T) {
+	still := riffWebP(webpChunkBytes("VP8L", solidVP8L(4, 4, webpRed)))
+	animated := animatedWebP(4, 4, webpFrame{image.Rect(0, 0, 4, 4), webpRed})
+	tests := []struct {
+		name    string
+		data    []byte
+		want    bool
+		wantErr bool
+	}{
+		{name: "still", data: still},
+		{name: "animated", data: animated, want: true},
+		{name: "not webp", data: []byte("RIFF\x04\x00\x00\x00WAVE"), wantErr: true},
+		{name: "truncated", data: animated[:14], wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := isAnimatedWebP(bytes.NewReader(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("isAnimatedWebP error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("isAnimatedWebP = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeWebP(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		// Colors at the canvas corner and center
+		corner, center color.NRGBA
+	}{
+		{
+			name:   "still",
+			data:   riffWebP(webpChunkBytes("VP8L", solidVP8L(8, 8, webpRed))),
+			corner: webpRed, center: webpRed,
+		},
+		{
+			name: "animated",
+			data: animatedWebP(8, 8,
+				webpFrame{image.Rect(0, 0, 8, 8), webpRed},
+				webpFrame{image.Rect(0, 0, 8, 8), webpBlue}),
+			corner: webpRed, center: webpRed,
+		},
+		{
+			name: "first frame inside the canvas",
+			data: animatedWebP(8, 8,
+				webpFrame{image.Rect(2, 2, 6, 6), webpRed},
+				webpFrame{image.Rect(0, 0, 8, 8), webpBlue}),
+			corner: color.NRGBA{}, center: webpRed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := decodeWebP(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Bounds() != image.Rect(0, 0, 8, 8) {
+				t.Fatalf("bounds = %v, want the 8x8 canvas", img.Bounds())
+			}
+			if got := color.NRGBAModel.Convert(img.At(0, 0)); got != tt.corner {
+				t.Errorf("corner = %v, want %v", got, tt.corner)
+			}
+			if got := color.NRGBAModel.Convert(img.At(4, 4)); got != tt.center {
+				t.Errorf("center = %v, want %v", got, tt.center)
+			}
+		})
+	}
+}
+
+func TestUploadAnimatedWebP(t *testing.T) {
+	data := animatedWebP(320, 240,
+		webpFrame{image.Rect(0, 0, 320, 240), webpRed},
+		webpFrame{image.Rect(0, 0, 320, 240), webpBlue})
+	tests := []struct {
+		handling string
+		wantErr  error
+	}{
+		{handling: config.AnimatedWebPReject, wantErr: domain.ErrAnimatedWebP},
+		{handling: config.AnimatedWebPFirstFrame},
+	}
+	for _, tt := range tests {
+		t.Run(tt.handling, func(t *testing.T) {
+			ctx := context.Background()
+			cfg := testConfig(t)
+			cfg.Image.AnimatedWebP = tt.handling
+			ts := newTestImageService(cfg)
+
+			img, err := ts.upload(ctx, "a.webp", data, UploadOptions{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("upload error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if paths := ts.storage.paths(); len(paths) != 0 {
+					t.Errorf("rejected upload stored %v", paths)
+				}
+				return
+			}
+			if img.Format != domain.FormatWebP || img.OriginalWidth != 320 || img.OriginalHeight != 240 {
+				t.Errorf("uploaded %s %dx%d, want webp 320x240", img.Format, img.OriginalWidth, img.OriginalHeight)
+			}
+
+			// Processing derives the fallback format from the first frame
+			if err := newTestProcessor(cfg, ts.images, ts.storage).ProcessImage(ctx, ts.images.tasks[0]); err != nil {
+				t.Fatal(err)
+			}
+			processed, _ := ts.GetByID(ctx, img.ID)
+			derivative, err := jpeg.Decode(bytes.NewReader(ts.storage.files[processed.ProcessedPath]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, g, b, _ := derivative.At(10, 10).RGBA()
+			if r>>8 < 200 || g>>8 > 50 || b>>8 > 50 {
+				t.Errorf("derivative pixel = %d,%d,%d, want the red first frame", r>>8, g>>8, b>>8)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package clamav
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+// chunkSize is the size of the INSTREAM chunks sent to clamd
+const chunkSize = 64 * 1024
+
+// Scanner checks uploaded content for malware
+type Scanner interface {
+	// Scan returns an error wrapping domain.ErrInfected when r contains
+	// malware; any other error means the content couldn't be scanned
+	Scan(ctx context.Context, r io.Reader) error
+}
+
+type scanner struct {
+	address string
+	timeout time.Duration
+}
+
+// NewScanner creates a scanner streaming content to the clamd daemon at
+// address over TCP
+func NewScanner(address string, timeout time.Duration) Scanner {
+	return &scanner{address: address, timeout: timeout}
+}
+
+// Scan streams r with the clamd INSTREAM command: length-prefixed chunks
+// terminated by a zero-length one, answered by a single reply line
+func (s *scanner) Scan(ctx context.Context, r io.Reader) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return fmt.Errorf("failed to connect to scanner: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriterSize(conn, chunkSize+4)
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return fmt.Errorf("failed to send scan command: %w", err)
+	}
+	buf := make([]byte, chunkSize)
+	var size [4]byte
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			w.Write(size[:])
+			if _, err := w.Write(buf[:n]); err != nil {
+				return fmt.Errorf("failed to stream content to scanner: %w", err)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read content to scan: %w", err)
+		}
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	w.Write(size[:])
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to stream content to scanner: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read scanner reply: %w", err)
+	}
+	return parseReply(reply)
+}
+
+// parseReply interprets replies like "stream: OK" and
+// "stream: Eicar-Test-Signature FOUND"
+func parseReply(reply string) error {
+	reply = strings.TrimRight(reply, "\x00\n")
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return nil
+	case strings.HasSuffix(result, " FOUND"):
+		return fmt.Errorf("%w: %s", domain.ErrInfected, strings.TrimSuffix(result, " FOUND"))
+	default:
+		return fmt.Errorf("scanner error: %s", reply)
+	}
+}
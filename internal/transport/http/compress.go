@@ -0,0 +1,189 @@
+package http
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// compressibleTypes are the response media types worth compressing. Images
+// are compressed already, so their bytes are always served as is.
+var compressibleTypes = []string{
+	"application/json",
+	"application/javascript",
+	"text/csv",
+	"text/css",
+	"text/html",
+	"text/javascript",
+	"text/plain",
+}
+
+// compress gzips, or failing that deflates, text and JSON responses for
+// clients accepting it. Responses shorter than minSize bytes aren't worth
+// the overhead and are sent uncompressed.
+func compress(minSize int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+			if encoding == "" || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize}
+			defer cw.Close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// acceptedEncoding picks gzip or deflate from an Accept-Encoding header,
+// empty when the client accepts neither
+func acceptedEncoding(header string) string {
+	var accepted []string
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		accepted = append(accepted, strings.ToLower(strings.TrimSpace(coding)))
+	}
+	for _, encoding := range []string{"gzip", "deflate"} {
+		if slices.Contains(accepted, encoding) {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// compressWriter buffers the start of a response until it's known to be
+// compressible and at least minSize bytes long, then switches to encoding it
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status      int
+	wroteHeader bool
+	passthrough bool
+	buf         []byte
+	enc         encoder // set once compressing
+}
+
+// encoder is implemented by both *gzip.Writer and *flate.Writer
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+	if !cw.compressible() {
+		cw.passthrough = true
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	// Whether it's compressed depends on the request's encodings
+	cw.Header().Add("Vary", "Accept-Encoding")
+}
+
+// compressible reports whether the response, as described by its status and
+// headers so far, may be compressed
+func (cw *compressWriter) compressible() bool {
+	if cw.status < http.StatusOK || cw.status == http.StatusNoContent || cw.status == http.StatusNotModified {
+		return false
+	}
+	h := cw.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && slices.Contains(compressibleTypes, mediaType)
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case cw.passthrough:
+		return cw.ResponseWriter.Write(p)
+	case cw.enc != nil:
+		return cw.enc.Write(p)
+	}
+
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= cw.minSize {
+		if err := cw.startEncoding(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// startEncoding sends the headers of a compressed response and encodes what
+// was buffered so far
+func (cw *compressWriter) startEncoding() error {
+	h := cw.Header()
+	h.Set("Content-Encoding", cw.encoding)
+	h.Del("Content-Length")
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	if cw.encoding == "gzip" {
+		cw.enc = gzip.NewWriter(cw.ResponseWriter)
+	} else {
+		cw.enc, _ = flate.NewWriter(cw.ResponseWriter, flate.DefaultCompression)
+	}
+	buf := cw.buf
+	cw.buf = nil
+	_, err := cw.enc.Write(buf)
+	return err
+}
+
+// Flush sends what was written so far. A response being flushed is streamed,
+// so it's compressed even if still short.
+func (cw *compressWriter) Flush() {
+	if cw.wroteHeader && !cw.passthrough && cw.enc == nil {
+		if err := cw.startEncoding(); err != nil {
+			return
+		}
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the response: it ends the compressed stream, or sends a
+// response that stayed below minSize uncompressed
+func (cw *compressWriter) Close() error {
+	switch {
+	case cw.enc != nil:
+		return cw.enc.Close()
+	case cw.wroteHeader && !cw.passthrough:
+		cw.ResponseWriter.WriteHeader(cw.status)
+		_, err := cw.ResponseWriter.Write(cw.buf)
+		return err
+	}
+	return nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
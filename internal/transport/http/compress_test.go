@@ -0,0 +1,76 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+func TestCompress(t *testing.T) {
+	images := make(map[string]*domain.Image)
+	for i := range 50 {
+		id := fmt.Sprintf("img-%02d", i)
+		images[id] = &domain.Image{ID: id, Status: domain.StatusCompleted, Format: domain.FormatJPEG, ProcessedPath: "processed/" + id + ".jpg"}
+	}
+	// Image bytes look compressible to gzip but must be served as they are
+	jpegBytes := append([]byte("\xff\xd8\xff\xe0"), bytes.Repeat([]byte("a"), 4096)...)
+	storage := &memStorage{files: map[string][]byte{"processed/img-00.jpg": jpegBytes}}
+	router := compress(1024)(newTestRouter(&fakeImageService{images: images}, storage, testConfig(t)))
+
+	tests := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		wantEncoding   string
+		wantBody       []byte
+	}{
+		{name: "list", path: "/api/images?limit=50", acceptEncoding: "gzip, deflate", wantEncoding: "gzip"},
+		{name: "list deflate only", path: "/api/images?limit=50", acceptEncoding: "deflate", wantEncoding: "deflate"},
+		{name: "list without gzip support", path: "/api/images?limit=50"},
+		{name: "list refusing gzip", path: "/api/images?limit=50", acceptEncoding: "gzip;q=0"},
+		{name: "short response", path: "/api/image/img-01", acceptEncoding: "gzip"},
+		{name: "image", path: "/image/img-00", acceptEncoding: "gzip", wantBody: jpegBytes},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+
+			body := rec.Body.Bytes()
+			if tt.wantEncoding == "gzip" {
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+				if rec.Header().Get("Vary") != "Accept-Encoding" {
+					t.Errorf("Vary = %q, want Accept-Encoding", rec.Header().Get("Vary"))
+				}
+			}
+			if tt.wantBody != nil && !bytes.Equal(body, tt.wantBody) {
+				t.Error("image bytes changed")
+			}
+			if tt.wantEncoding == "gzip" && !bytes.Contains(body, []byte(`"img-49"`)) {
+				t.Errorf("decompressed list %.100s is missing images", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+// errorResponse is the body of every error response:
+// {"error": {"code", "message", "request_id"}}
+type errorResponse struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	// Code is a stable, machine-readable identifier of the error
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// codeInternal is the code of errors that aren't the client's fault
+const codeInternal = "internal_error"
+
+// domainErrors maps domain errors to their response status and code
+var domainErrors = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{domain.ErrImageNotFound, http.StatusNotFound, "image_not_found"},
+	{domain.ErrInvalidImageID, http.StatusBadRequest, "invalid_image_id"},
+	{domain.ErrInvalidFormat, http.StatusBadRequest, "invalid_format"},
+	{domain.ErrFormatNotAllowed, http.StatusUnsupportedMediaType, "format_not_allowed"},
+	{domain.ErrEmptyFile, http.StatusBadRequest, "empty_file"},
+	{domain.ErrFileTooLarge, http.StatusRequestEntityTooLarge, "file_too_large"},
+	{domain.ErrImageTooLarge, http.StatusRequestEntityTooLarge, "image_too_large"},
+	{domain.ErrGIFTooLarge, http.StatusRequestEntityTooLarge, "gif_too_large"},
+	{domain.ErrAnimatedWebP, http.StatusUnsupportedMediaType, "animated_webp_unsupported"},
+	{domain.ErrImageTooSmall, http.StatusBadRequest, "image_too_small"},
+	{domain.ErrInfected, http.StatusUnprocessableEntity, "file_infected"},
+	{domain.ErrScanUnavailable, http.StatusServiceUnavailable, "scan_unavailable"},
+	{domain.ErrInvalidPriority, http.StatusBadRequest, "invalid_priority"},
+	{domain.ErrInvalidCrop, http.StatusBadRequest, "invalid_crop"},
+	{domain.ErrInvalidQuality, http.StatusBadRequest, "invalid_quality"},
+	{domain.ErrInvalidGrayscale, http.StatusBadRequest, "invalid_grayscale"},
+	{domain.ErrInvalidBrightness, http.StatusBadRequest, "invalid_brightness"},
+	{domain.ErrInvalidContrast, http.StatusBadRequest, "invalid_contrast"},
+	{domain.ErrInvalidRotation, http.StatusBadRequest, "invalid_rotation"},
+	{domain.ErrImageNotProcessed, http.StatusConflict, "image_not_processed"},
+	{domain.ErrOriginalMissing, http.StatusConflict, "original_missing"},
+	{domain.ErrInvalidIdempotencyKey, http.StatusBadRequest, "invalid_idempotency_key"},
+	{domain.ErrIdempotencyKeyBatch, http.StatusBadRequest, "invalid_idempotency_key"},
+	{domain.ErrIdempotencyKeyConflict, http.StatusConflict, "idempotency_key_conflict"},
+}
+
+// writeJSONError writes an error response with the given code
+func writeJSONError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	// Like http.Error, drop headers describing a body that's no longer sent
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: errorDetail{
+		Code:      code,
+		Message:   message,
+		RequestID: requestIDFrom(r.Context()),
+	}})
+}
+
+// writeError responds with the status and code of a domain error. Any other
+// error is internal, reported as what failed followed by the error.
+func writeError(w http.ResponseWriter, r *http.Request, err error, what string) {
+	if status, code, ok := classifyError(err); ok {
+		writeJSONError(w, r, status, code, err.Error())
+		return
+	}
+	writeJSONError(w, r, http.StatusInternalServerError, codeInternal, fmt.Sprintf("%s: %v", what, err))
+}
+
+// classifyError returns the status and code of a domain error
+func classifyError(err error) (status int, code string, ok bool) {
+	for _, e := range domainErrors {
+		if errors.Is(err, e.err) {
+			return e.status, e.code, true
+		}
+	}
+	return 0, "", false
+}
+
+// httpError writes an error that has no dedicated code, coded after its
+// status, e.g. "bad_request"
+func httpError(w http.ResponseWriter, r *http.Request, msg string, status int) {
+	code := strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+	writeJSONError(w, r, status, code, msg)
+}
@@ -0,0 +1,99 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+func TestErrorResponses(t *testing.T) {
+	svc := &fakeImageService{uploadErrs: map[string]error{
+		"notes.txt":  fmt.Errorf("unsupported format: %w", domain.ErrInvalidFormat),
+		"broken.jpg": errors.New("disk full"),
+		"anim.webp":  domain.ErrAnimatedWebP,
+	}}
+	router := requestID(newTestRouter(svc, &memStorage{}, testConfig(t)))
+
+	upload := func(filename string) *http.Request {
+		body, contentType := uploadForm(t, []string{filename}, nil)
+		req := httptest.NewRequest(http.MethodPost, "/upload", body)
+		req.Header.Set("Content-Type", contentType)
+		return req
+	}
+	tests := []struct {
+		name       string
+		req        *http.Request
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "image not found", req: httptest.NewRequest(http.MethodGet, "/api/image/missing", nil), wantStatus: http.StatusNotFound, wantCode: "image_not_found"},
+		{name: "bad format upload", req: upload("notes.txt"), wantStatus: http.StatusBadRequest, wantCode: "invalid_format"},
+		{name: "animated webp upload", req: upload("anim.webp"), wantStatus: http.StatusUnsupportedMediaType, wantCode: "animated_webp_unsupported"},
+		{name: "internal error", req: upload("broken.jpg"), wantStatus: http.StatusInternalServerError, wantCode: codeInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Header.Set(requestIDHeader, "req-1")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, tt.req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+
+			// Exactly {"error": {"code", "message", "request_id"}}
+			body, _ := io.ReadAll(rec.Body)
+			var shape map[string]map[string]any
+			if err := json.Unmarshal(body, &shape); err != nil {
+				t.Fatalf("body %s: %v", body, err)
+			}
+			detail, ok := shape["error"]
+			if len(shape) != 1 || !ok {
+				t.Fatalf("body %s, want a single error object", body)
+			}
+			if len(detail) != 3 {
+				t.Errorf("error object %v, want code, message and request_id only", detail)
+			}
+			if detail["code"] != tt.wantCode {
+				t.Errorf("code = %v, want %s", detail["code"], tt.wantCode)
+			}
+			if message, _ := detail["message"].(string); message == "" {
+				t.Error("empty message")
+			}
+			if detail["request_id"] != "req-1" {
+				t.Errorf("request_id = %v, want req-1", detail["request_id"])
+			}
+		})
+	}
+}
+
+func TestHTTPErrorCode(t *testing.T) {
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{http.StatusBadRequest, "bad_request"},
+		{http.StatusMethodNotAllowed, "method_not_allowed"},
+		{http.StatusRequestEntityTooLarge, "request_entity_too_large"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		httpError(rec, httptest.NewRequest(http.MethodGet, "/", nil), "nope", tt.status)
+		var resp errorResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != tt.status || resp.Error.Code != tt.want || resp.Error.Message != "nope" {
+			t.Errorf("httpError(%d) = %d %+v, want code %s", tt.status, rec.Code, resp.Error, tt.want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+// progressingImages returns image "a" with the next of statuses on each
+// GetByID, staying at the last one; an empty status means it's been deleted
+type progressingImages struct {
+	fakeImageService
+	mu       sync.Mutex
+	statuses []domain.ProcessingStatus
+}
+
+func (p *progressingImages) GetByID(ctx context.Context, id string) (*domain.Image, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if id != "a" {
+		return nil, domain.ErrImageNotFound
+	}
+	status := p.statuses[0]
+	if len(p.statuses) > 1 {
+		p.statuses = p.statuses[1:]
+	}
+	if status == "" {
+		return nil, domain.ErrImageNotFound
+	}
+	return &domain.Image{ID: id, Status: status, UpdatedAt: time.Now()}, nil
+}
+
+type sseEvent struct {
+	name string
+	data string
+}
+
+// readEvents reads server-sent events until the server ends the stream
+func readEvents(t *testing.T, url string) []sseEvent {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	var events []sseEvent
+	var event sseEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			event.name = name
+		} else if data, ok := strings.CutPrefix(line, "data: "); ok {
+			event.data = data
+		} else if line == "" && event.name != "" {
+			events = append(events, event)
+			event = sseEvent{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestGetImageEvents(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []domain.ProcessingStatus
+		wantStatuses []domain.ProcessingStatus
+		wantProgress []int
+		wantError    bool
+	}{
+		{
+			name: "until completed",
+			statuses: []domain.ProcessingStatus{domain.StatusPending, domain.StatusPending, domain.StatusProcessing,
+				domain.StatusProcessing, domain.StatusCompleted},
+			wantStatuses: []domain.ProcessingStatus{domain.StatusPending, domain.StatusProcessing, domain.StatusCompleted},
+			wantProgress: []int{0, 50, 100},
+		},
+		{
+			name:         "until failed",
+			statuses:     []domain.ProcessingStatus{domain.StatusProcessing, domain.StatusFailed},
+			wantStatuses: []domain.ProcessingStatus{domain.StatusProcessing, domain.StatusFailed},
+			wantProgress: []int{50, progressFailed},
+		},
+		{
+			name:         "already completed",
+			statuses:     []domain.ProcessingStatus{domain.StatusCompleted},
+			wantStatuses: []domain.ProcessingStatus{domain.StatusCompleted},
+			wantProgress: []int{100},
+		},
+		{
+			name:         "deleted while processing",
+			statuses:     []domain.ProcessingStatus{domain.StatusProcessing, ""},
+			wantStatuses: []domain.ProcessingStatus{domain.StatusProcessing},
+			wantProgress: []int{50},
+			wantError:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.Server.EventsPollInterval = 5 * time.Millisecond
+			svc := &progressingImages{statuses: tt.statuses}
+			srv := httptest.NewServer(newTestRouter(svc, &memStorage{}, cfg))
+			defer srv.Close()
+
+			// Only changes are sent, and the stream ends with processing
+			events := readEvents(t, srv.URL+"/api/image/a/events")
+			var statuses []domain.ProcessingStatus
+			var progress []int
+			for _, event := range events {
+				if event.name != "status" {
+					continue
+				}
+				var status imageStatus
+				if err := json.Unmarshal([]byte(event.data), &status); err != nil {
+					t.Fatalf("event data %q: %v", event.data, err)
+				}
+				statuses = append(statuses, status.Status)
+				progress = append(progress, status.Progress)
+			}
+			if !slices.Equal(statuses, tt.wantStatuses) || !slices.Equal(progress, tt.wantProgress) {
+				t.Errorf("statuses %v with progress %v, want %v with %v", statuses, progress, tt.wantStatuses, tt.wantProgress)
+			}
+			gotError := len(events) > 0 && events[len(events)-1].name == "error"
+			if gotError != tt.wantError {
+				t.Errorf("events %v, want an error event at the end %v", events, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestGetImageEventsNotFound(t *testing.T) {
+	router := newTestRouter(&progressingImages{statuses: []domain.ProcessingStatus{domain.StatusPending}}, &memStorage{}, testConfig(t))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/image/missing/events", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want a JSON error rather than a stream", ct)
+	}
+}
@@ -0,0 +1,181 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/oziev02/ImageProcessor/internal/config"
+	"github.com/oziev02/ImageProcessor/internal/domain"
+	"github.com/oziev02/ImageProcessor/internal/observability"
+	"github.com/oziev02/ImageProcessor/internal/service"
+)
+
+// fakeImageService serves images from a map; the methods a test needs
+// beyond GetByID are overridden by embedding it
+type fakeImageService struct {
+	service.ImageService
+	mu     sync.Mutex
+	images map[string]*domain.Image
+	// uploadErrs fails the upload of the files with these names
+	uploadErrs map[string]error
+	uploaded   []string // contents of the files uploaded
+	// hardDeleteErrs fails the hard delete of these IDs after removing them
+	hardDeleteErrs map[string]error
+}
+
+// Upload stores an image with the file's name as its ID
+func (f *fakeImageService) Upload(ctx context.Context, file multipart.File, header *multipart.FileHeader, opts service.UploadOptions) (*domain.Image, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.uploadErrs[header.Filename]; err != nil {
+		return nil, err
+	}
+	img := &domain.Image{ID: header.Filename, Status: domain.StatusPending, Format: domain.FormatJPEG, Params: opts.Params}
+	if f.images == nil {
+		f.images = make(map[string]*domain.Image)
+	}
+	f.images[img.ID] = img
+	f.uploaded = append(f.uploaded, string(data))
+	return img, nil
+}
+
+func (f *fakeImageService) GetByID(ctx context.Context, id string) (*domain.Image, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	img, ok := f.images[id]
+	if !ok {
+		return nil, domain.ErrImageNotFound
+	}
+	clone := *img
+	return &clone, nil
+}
+
+func (f *fakeImageService) HardDelete(ctx context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.images[id]; !ok {
+		return domain.ErrImageNotFound
+	}
+	delete(f.images, id)
+	return f.hardDeleteErrs[id]
+}
+
+func (f *fakeImageService) matching(filter domain.ImageFilter) []*domain.Image {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var images []*domain.Image
+	for _, img := range f.images {
+		if (filter.Status == "" || img.Status == filter.Status) && (filter.Format == "" || img.Format == filter.Format) {
+			images = append(images, img)
+		}
+	}
+	slices.SortFunc(images, func(a, b *domain.Image) int { return strings.Compare(a.ID, b.ID) })
+	return images
+}
+
+func (f *fakeImageService) Count(ctx context.Context, filter domain.ImageFilter) (int, error) {
+	return len(f.matching(filter)), nil
+}
+
+func (f *fakeImageService) ListEach(ctx context.Context, filter domain.ImageFilter, limit, offset int, fn func(img *domain.Image) error) error {
+	images := f.matching(filter)
+	images = images[min(offset, len(images)):]
+	for _, img := range images[:min(limit, len(images))] {
+		if err := fn(img); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memStorage is an in-memory StorageReader
+type memStorage struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func (m *memStorage) Read(ctx context.Context, path string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.files[path]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (m *memStorage) Size(ctx context.Context, path string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.files[path]
+	if !ok {
+		return 0, fs.ErrNotExist
+	}
+	return int64(len(b)), nil
+}
+
+func (m *memStorage) Exists(ctx context.Context, path string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.files[path]
+	return ok, nil
+}
+
+// uploadForm is a multipart upload of the named files under the image
+// field, each holding "content of <name>", with the given form fields
+func uploadForm(t *testing.T, files []string, fields map[string]string) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, name := range files {
+		part, err := mw.CreateFormFile("image", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(part, "content of "+name)
+	}
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &body, mw.FormDataContentType()
+}
+
+// testConfig returns the default configuration
+func testConfig(t *testing.T) *config.Config {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// newTestRouter returns the handler's routes without the server middleware
+func newTestRouter(svc service.ImageService, storage StorageReader, cfg *config.Config) http.Handler {
+	h := NewHandler(svc, nil, storage, nil, observability.NewMetrics(), cfg, discardLogger())
+	r := chi.NewRouter()
+	h.RegisterRoutes(r)
+	return r
+}
@@ -3,31 +3,76 @@ package http
 import (
 	"context"
 	"embed"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"log/slog"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/oziev02/ImageProcessor/internal/config"
 	"github.com/oziev02/ImageProcessor/internal/domain"
+	"github.com/oziev02/ImageProcessor/internal/observability"
 	"github.com/oziev02/ImageProcessor/internal/service"
 )
 
 type Handler struct {
 	imageService service.ImageService
+	rotator      Rotator
 	storageRepo  StorageReader
+	dependencies map[string]Pinger
+	metrics      *observability.Metrics
+	cfg          *config.Config
+	logger       *slog.Logger
+	// streams is cancelled by stopStreams when the server shuts down, ending
+	// the event streams that would otherwise keep it waiting
+	streams     context.Context
+	stopStreams context.CancelFunc
+}
+
+// Rotator rotates the derivatives of processed images
+type Rotator interface {
+	Rotate(ctx context.Context, id string, degrees int) (*domain.Image, error)
 }
 
 type StorageReader interface {
 	Read(ctx context.Context, path string) (io.ReadCloser, error)
+	Size(ctx context.Context, path string) (int64, error)
+	Exists(ctx context.Context, path string) (bool, error)
 }
 
-func NewHandler(imageService service.ImageService, storageRepo StorageReader) *Handler {
+// NewHandler creates the HTTP handler. dependencies are checked by the
+// readiness probe, keyed by the name reported for them.
+func NewHandler(
+	imageService service.ImageService,
+	rotator Rotator,
+	storageRepo StorageReader,
+	dependencies map[string]Pinger,
+	metrics *observability.Metrics,
+	cfg *config.Config,
+	logger *slog.Logger,
+) *Handler {
+	streams, stopStreams := context.WithCancel(context.Background())
 	return &Handler{
 		imageService: imageService,
+		rotator:      rotator,
 		storageRepo:  storageRepo,
+		dependencies: dependencies,
+		metrics:      metrics,
+		cfg:          cfg,
+		logger:       logger,
+		streams:      streams,
+		stopStreams:  stopStreams,
 	}
 }
 
@@ -44,99 +89,658 @@ func (h *Handler) RegisterRoutes(r chi.Router) {
 	// Serve index.html
 	r.Get("/", h.Index)
 
+	// Prometheus metrics
+	r.Handle("/metrics", h.metrics.Handler())
+
+	// Kubernetes probes
+	r.Get("/healthz", h.Healthz)
+	r.Get("/readyz", h.Readyz)
+
+	// Mutating routes always require an API key when keys are configured,
+	// reads only with API_AUTH_ALL
+	auth := apiKeyAuth(h.cfg.Auth.APIKeys)
+	readAuth := apiKeyAuth(nil)
+	if h.cfg.Auth.RequireAll {
+		readAuth = auth
+	}
+
+	// Upload routes accept large bodies and share a per-client rate limit
+	limit := rateLimit(h.cfg.RateLimit, len(h.cfg.Auth.APIKeys) > 0)
+	r.With(auth, limit, maxBodySize(h.cfg.Server.MaxUploadBodySize)).Post("/upload", h.Upload)
+	r.With(auth, limit, maxBodySize(h.cfg.Server.MaxUploadBodySize)).Post("/upload/batch", h.BatchUpload)
+
 	// API routes
-	r.Post("/upload", h.Upload)
-	r.Get("/image/{id}", h.GetImage)
-	r.Get("/api/image/{id}", h.GetImageInfo)
-	r.Get("/api/images", h.ListImages)
-	r.Delete("/image/{id}", h.DeleteImage)
+	r.Group(func(r chi.Router) {
+		r.Use(maxBodySize(h.cfg.Server.MaxBodySize))
+
+		r.Group(func(r chi.Router) {
+			r.Use(readAuth)
+
+			r.Get("/image/{id}", h.GetImage)
+			r.Get("/image/{id}/lqip", h.GetImageLQIP)
+			r.Get("/image/{id}/original", h.GetOriginalImage)
+			r.Get("/image/{id}/thumbnail", h.GetThumbnail)
+			r.Get("/api/image/{id}", h.GetImageInfo)
+			r.Get("/api/image/{id}/status", h.GetImageStatus)
+			r.Get("/api/image/{id}/events", h.GetImageEvents)
+			r.Get("/api/image/{id}/history", h.GetImageHistory)
+			r.Get("/api/image/{id}/metadata", h.GetImageMetadata)
+			r.Get("/api/images", h.ListImages)
+			r.Get("/api/images/export.csv", h.ExportImagesCSV)
+			r.Get("/api/stats", h.GetStats)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(auth)
+
+			r.Post("/api/image/{id}/verify", h.VerifyImage)
+			r.Delete("/image/{id}", h.DeleteImage)
+			r.Post("/api/image/{id}/restore", h.RestoreImage)
+			r.Post("/api/image/{id}/rotate", h.RotateImage)
+			r.Post("/api/image/{id}/reprocess", h.ReprocessImage)
+			r.Delete("/api/images", h.DeleteImagesByStatus)
+
+			// Admin routes
+			r.Delete("/api/admin/image/{id}", h.HardDeleteImage)
+			r.Post("/api/admin/purge", h.PurgeDeleted)
+		})
+	})
 }
 
 func (h *Handler) Upload(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseMultipartForm(10 << 20); err != nil { // 10MB
-		http.Error(w, "failed to parse multipart form", http.StatusBadRequest)
+	h.metrics.UploadsTotal.Inc()
+	start := time.Now()
+	defer func() { h.metrics.UploadDuration.Observe(time.Since(start).Seconds()) }()
+
+	headers, opts, ok := h.parseUploadForm(w, r)
+	if !ok {
+		return
+	}
+	opts.IdempotencyKey = r.Header.Get("Idempotency-Key")
+	if len(opts.IdempotencyKey) > maxIdempotencyKeyLen {
+		writeError(w, r, domain.ErrInvalidIdempotencyKey, "invalid idempotency key")
 		return
 	}
 
-	file, header, err := r.FormFile("image")
-	if err != nil {
-		http.Error(w, "failed to get file from form", http.StatusBadRequest)
+	// More than one file under the image field is rejected unless configured
+	// to process each of them like a batch
+	if len(headers) > 1 {
+		if opts.IdempotencyKey != "" {
+			writeError(w, r, domain.ErrIdempotencyKeyBatch, "invalid idempotency key")
+			return
+		}
+		if h.cfg.Image.MultipleFilesPolicy != config.MultipleFilesAll {
+			httpError(w, r, "only one file is expected in the image field", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.uploadFiles(r.Context(), headers, opts))
 		return
 	}
-	defer file.Close()
 
-	img, err := h.imageService.Upload(r.Context(), file, header)
+	img, err := h.uploadFile(r.Context(), headers[0], opts)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to upload image: %v", err), http.StatusInternalServerError)
+		writeError(w, r, err, "failed to upload image")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(img)
+	json.NewEncoder(w).Encode(h.present(img))
+}
+
+// maxIdempotencyKeyLen matches the images.idempotency_key column
+const maxIdempotencyKeyLen = 255
+
+// BatchUpload uploads every file of the image field independently and
+// reports the outcome of each, so that files failing validation are skipped
+// rather than failing the whole request
+func (h *Handler) BatchUpload(w http.ResponseWriter, r *http.Request) {
+	h.metrics.UploadsTotal.Inc()
+	start := time.Now()
+	defer func() { h.metrics.UploadDuration.Observe(time.Since(start).Seconds()) }()
+
+	headers, opts, ok := h.parseUploadForm(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.uploadFiles(r.Context(), headers, opts))
+}
+
+// parseUploadForm reads the files and options of an upload form. On failure
+// the error response is written and ok is false.
+func (h *Handler) parseUploadForm(w http.ResponseWriter, r *http.Request) (headers []*multipart.FileHeader, opts service.UploadOptions, ok bool) {
+	if err := r.ParseMultipartForm(10 << 20); err != nil { // 10MB
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			httpError(w, r, "request body too large", http.StatusRequestEntityTooLarge)
+			return nil, opts, false
+		}
+		httpError(w, r, "failed to parse multipart form", http.StatusBadRequest)
+		return nil, opts, false
+	}
+
+	headers = r.MultipartForm.File["image"]
+	if len(headers) == 0 {
+		httpError(w, r, "failed to get file from form", http.StatusBadRequest)
+		return nil, opts, false
+	}
+
+	priority, err := domain.ParsePriority(r.FormValue("priority"))
+	if err != nil {
+		writeError(w, r, err, "invalid priority")
+		return nil, opts, false
+	}
+	crop, err := parseCrop(r)
+	if err != nil {
+		writeError(w, r, err, "invalid crop")
+		return nil, opts, false
+	}
+	quality, err := parseQuality(r)
+	if err != nil {
+		writeError(w, r, err, "invalid quality")
+		return nil, opts, false
+	}
+	grayscale := false
+	if value := r.FormValue("grayscale"); value != "" {
+		if grayscale, err = strconv.ParseBool(value); err != nil {
+			writeError(w, r, domain.ErrInvalidGrayscale, "invalid grayscale")
+			return nil, opts, false
+		}
+	}
+	brightness, err := parseToneAdjustment(r, "brightness", domain.ErrInvalidBrightness)
+	if err != nil {
+		writeError(w, r, err, "invalid brightness")
+		return nil, opts, false
+	}
+	contrast, err := parseToneAdjustment(r, "contrast", domain.ErrInvalidContrast)
+	if err != nil {
+		writeError(w, r, err, "invalid contrast")
+		return nil, opts, false
+	}
+	opts = service.UploadOptions{
+		Priority: priority,
+		Params: domain.ProcessingParams{
+			Crop:       crop,
+			Quality:    quality,
+			Grayscale:  grayscale,
+			Brightness: brightness,
+			Contrast:   contrast,
+		},
+	}
+	return headers, opts, true
+}
+
+// parseQuality reads the optional JPEG quality of an upload, zero when absent
+func parseQuality(r *http.Request) (int, error) {
+	value := r.FormValue("quality")
+	if value == "" {
+		return 0, nil
+	}
+	quality, err := strconv.Atoi(value)
+	if err != nil || !config.ValidJPEGQuality(quality) {
+		return 0, domain.ErrInvalidQuality
+	}
+	return quality, nil
+}
+
+// parseToneAdjustment reads an optional brightness or contrast field of an
+// upload, zero when absent
+func parseToneAdjustment(r *http.Request, field string, errInvalid error) (int, error) {
+	value := r.FormValue(field)
+	if value == "" {
+		return 0, nil
+	}
+	v, err := strconv.Atoi(value)
+	if err != nil || !domain.ValidToneAdjustment(v) {
+		return 0, errInvalid
+	}
+	return v, nil
+}
+
+// parseCrop reads the optional crop region of an upload. The fields must be
+// given all together; a region exceeding the image is clamped when applied.
+func parseCrop(r *http.Request) (*domain.CropRect, error) {
+	fields := []string{"crop_x", "crop_y", "crop_w", "crop_h"}
+	values := make([]int, len(fields))
+	given := 0
+	for i, field := range fields {
+		value := r.FormValue(field)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, domain.ErrInvalidCrop
+		}
+		values[i] = n
+		given++
+	}
+	if given == 0 {
+		return nil, nil
+	}
+
+	crop := &domain.CropRect{X: values[0], Y: values[1], W: values[2], H: values[3]}
+	if given != len(fields) || crop.X < 0 || crop.Y < 0 || crop.W <= 0 || crop.H <= 0 {
+		return nil, domain.ErrInvalidCrop
+	}
+	return crop, nil
+}
+
+// uploadResult is the per-file outcome of a multi-file upload
+type uploadResult struct {
+	Filename string        `json:"filename"`
+	Image    *domain.Image `json:"image,omitempty"`
+	Code     string        `json:"code,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// uploadFiles uploads each file independently so that one failure doesn't
+// abort the others
+func (h *Handler) uploadFiles(ctx context.Context, headers []*multipart.FileHeader, opts service.UploadOptions) []uploadResult {
+	results := make([]uploadResult, 0, len(headers))
+	for _, header := range headers {
+		result := uploadResult{Filename: header.Filename}
+		img, err := h.uploadFile(ctx, header, opts)
+		if err != nil {
+			result.Code = codeInternal
+			if _, code, ok := classifyError(err); ok {
+				result.Code = code
+			}
+			result.Error = err.Error()
+		} else {
+			result.Image = h.present(img)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func (h *Handler) uploadFile(ctx context.Context, header *multipart.FileHeader, opts service.UploadOptions) (*domain.Image, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open uploaded file: %w", err)
+	}
+	defer file.Close()
+
+	return h.imageService.Upload(ctx, file, header, opts)
 }
 
 func (h *Handler) GetImage(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	if id == "" {
-		http.Error(w, "image id is required", http.StatusBadRequest)
+		httpError(w, r, "image id is required", http.StatusBadRequest)
 		return
 	}
 
 	img, err := h.imageService.GetByID(r.Context(), id)
 	if err != nil {
-		if err == domain.ErrImageNotFound {
-			http.Error(w, "image not found", http.StatusNotFound)
-			return
-		}
-		http.Error(w, fmt.Sprintf("failed to get image: %v", err), http.StatusInternalServerError)
+		writeError(w, r, err, "failed to get image")
 		return
 	}
 
 	// Determine which image to serve
-	imagePath := img.ProcessedPath
-	if imagePath == "" {
-		imagePath = img.OriginalPath
+	imagePath, format := img.ProcessedPath, img.ProcessedFormat
+	processed := imagePath != ""
+	if !processed {
+		imagePath, format = img.OriginalPath, img.Format
+	}
+	if format == "" {
+		// Records processed before processed_format was tracked
+		format = img.Format
+	}
+
+	// A processed image never changes, so it's served with a strong ETag and
+	// may be cached. The original stands in only until processing completes,
+	// so clients must revalidate it.
+	etag := fmt.Sprintf(`"%s-%d"`, img.ID, img.UpdatedAt.UnixNano())
+	cacheControl := "no-cache"
+	if processed {
+		if img.ProcessedChecksum != "" {
+			etag = `"` + img.ProcessedChecksum + `"`
+		}
+		cacheControl = fmt.Sprintf("public, max-age=%d", int(h.cfg.Server.CacheMaxAge.Seconds()))
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	h.serveFile(w, r, imagePath, contentType(format), "image")
+}
+
+// GetOriginalImage serves the uploaded file as is, as an attachment named
+// after the image ID
+func (h *Handler) GetOriginalImage(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		httpError(w, r, "image id is required", http.StatusBadRequest)
+		return
 	}
 
-	reader, err := h.storageRepo.Read(r.Context(), imagePath)
+	img, err := h.imageService.GetByID(r.Context(), id)
 	if err != nil {
-		http.Error(w, "failed to read image file", http.StatusInternalServerError)
+		writeError(w, r, err, "failed to get image")
 		return
 	}
-	defer reader.Close()
 
-	// Set content type
-	contentType := "image/jpeg"
-	switch img.Format {
-	case domain.FormatPNG:
-		contentType = "image/png"
-	case domain.FormatGIF:
-		contentType = "image/gif"
+	exists, err := h.storageRepo.Exists(r.Context(), img.OriginalPath)
+	if err != nil {
+		httpError(w, r, "failed to check original file", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		httpError(w, r, domain.ErrOriginalMissing.Error(), http.StatusNotFound)
+		return
+	}
+
+	// The original never changes
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(h.cfg.Server.CacheMaxAge.Seconds())))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s%s"`, img.ID, filepath.Ext(img.OriginalPath)))
+	h.serveFile(w, r, img.OriginalPath, contentType(img.Format), "original")
+}
+
+// GetThumbnail serves the image's thumbnail, or with ?size= one of the
+// labelled variants from IMAGE_THUMBNAIL_SIZES
+func (h *Handler) GetThumbnail(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		httpError(w, r, "image id is required", http.StatusBadRequest)
+		return
+	}
+
+	img, err := h.imageService.GetByID(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err, "failed to get image")
+		return
 	}
 
+	path := img.ThumbnailPath
+	etag := img.ThumbnailChecksum
+	if label := r.URL.Query().Get("size"); label != "" {
+		if !slices.ContainsFunc(h.cfg.Image.ThumbnailSizes, func(s config.ThumbnailSize) bool { return s.Label == label }) {
+			httpError(w, r, fmt.Sprintf("unknown thumbnail size %q", label), http.StatusBadRequest)
+			return
+		}
+		path = img.Thumbnails[label]
+		if etag != "" {
+			// Variants are generated and rotated along with the thumbnail
+			etag += "-" + label
+		}
+	}
+	if path == "" {
+		httpError(w, r, "thumbnail not available", http.StatusNotFound)
+		return
+	}
+	if etag == "" {
+		etag = fmt.Sprintf("%s-%d", img.ID, img.UpdatedAt.UnixNano())
+	}
+	etag = `"` + etag + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(h.cfg.Server.CacheMaxAge.Seconds())))
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// The thumbnail may be stored before processed_format is, so its type
+	// is taken from the file itself
+	ct := mime.TypeByExtension(filepath.Ext(path))
+	if ct == "" {
+		ct = contentType(img.Format)
+	}
+	h.serveFile(w, r, path, ct, "thumbnail")
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// serveFile streams a stored file, announcing its length when the storage
+// backend can report it so that clients can show download progress
+func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, path, contentType, what string) {
+	reader, err := h.storageRepo.Read(r.Context(), path)
+	if err != nil {
+		httpError(w, r, fmt.Sprintf("failed to read %s file", what), http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+
 	w.Header().Set("Content-Type", contentType)
+	if size, err := h.storageRepo.Size(r.Context(), path); err == nil && size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
 	io.Copy(w, reader)
 }
 
+// GetImageLQIP serves the low-quality placeholder generated with the thumbnail
+func (h *Handler) GetImageLQIP(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		httpError(w, r, "image id is required", http.StatusBadRequest)
+		return
+	}
+
+	img, err := h.imageService.GetByID(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err, "failed to get image")
+		return
+	}
+	if img.LQIPPath == "" {
+		httpError(w, r, "placeholder not available", http.StatusNotFound)
+		return
+	}
+
+	h.serveFile(w, r, img.LQIPPath, "image/jpeg", "placeholder")
+}
+
 func (h *Handler) GetImageInfo(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	if id == "" {
-		http.Error(w, "image id is required", http.StatusBadRequest)
+		httpError(w, r, "image id is required", http.StatusBadRequest)
+		return
+	}
+
+	img, err := h.imageService.GetByID(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err, "failed to get image")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.present(img))
+}
+
+// GetImageMetadata returns the camera metadata read from the image's EXIF,
+// an empty object when it had none
+func (h *Handler) GetImageMetadata(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		httpError(w, r, "image id is required", http.StatusBadRequest)
+		return
+	}
+
+	img, err := h.imageService.GetByID(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err, "failed to get image")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(img.Metadata)
+}
+
+// imageStatus is the lightweight response of the status polling endpoint
+type imageStatus struct {
+	Status    domain.ProcessingStatus `json:"status"`
+	Progress  int                     `json:"progress"`
+	UpdatedAt time.Time               `json:"updated_at"`
+}
+
+// progressFailed marks a failed image; it's outside 0-100 so clients can't
+// mistake it for a stage of processing
+const progressFailed = -1
+
+func progress(status domain.ProcessingStatus) int {
+	switch status {
+	case domain.StatusProcessing:
+		return 50
+	case domain.StatusCompleted:
+		return 100
+	case domain.StatusFailed:
+		return progressFailed
+	default:
+		return 0
+	}
+}
+
+func (h *Handler) GetImageStatus(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		httpError(w, r, "image id is required", http.StatusBadRequest)
+		return
+	}
+
+	img, err := h.imageService.GetByID(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err, "failed to get image")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(imageStatus{
+		Status:    img.Status,
+		Progress:  progress(img.Status),
+		UpdatedAt: img.UpdatedAt,
+	})
+}
+
+// GetImageEvents streams the image's status as Server-Sent Events: the
+// current one, then each change until processing completes or fails. The
+// image may be processed by another instance, so changes are found by
+// polling the record.
+func (h *Handler) GetImageEvents(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		httpError(w, r, "image id is required", http.StatusBadRequest)
 		return
 	}
 
 	img, err := h.imageService.GetByID(r.Context(), id)
 	if err != nil {
-		if err == domain.ErrImageNotFound {
-			http.Error(w, "image not found", http.StatusNotFound)
+		writeError(w, r, err, "failed to get image")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, r, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	// The stream outlives the server's write timeout; the request timeout
+	// still ends it, and EventSource clients reconnect
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(h.cfg.Server.EventsPollInterval)
+	defer ticker.Stop()
+
+	var last domain.ProcessingStatus
+	for {
+		if img.Status != last {
+			last = img.Status
+			data, _ := json.Marshal(imageStatus{
+				Status:    img.Status,
+				Progress:  progress(img.Status),
+				UpdatedAt: img.UpdatedAt,
+			})
+			fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+		if img.Status == domain.StatusCompleted || img.Status == domain.StatusFailed {
 			return
 		}
-		http.Error(w, fmt.Sprintf("failed to get image: %v", err), http.StatusInternalServerError)
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-h.streams.Done():
+			// Shutting down; the client reconnects to another instance
+			return
+		case <-ticker.C:
+		}
+
+		if img, err = h.imageService.GetByID(r.Context(), id); err != nil {
+			if r.Context().Err() == nil {
+				data, _ := json.Marshal(map[string]string{"error": err.Error()})
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+				flusher.Flush()
+			}
+			return
+		}
+	}
+}
+
+func (h *Handler) GetImageHistory(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		httpError(w, r, "image id is required", http.StatusBadRequest)
+		return
+	}
+
+	events, err := h.imageService.History(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err, "failed to get image history")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(img)
+	json.NewEncoder(w).Encode(events)
+}
+
+// GetStats reports image counts and stored bytes per status and format
+func (h *Handler) GetStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.imageService.Stats(r.Context())
+	if err != nil {
+		writeError(w, r, err, "failed to get stats")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func (h *Handler) VerifyImage(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		httpError(w, r, "image id is required", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.imageService.Verify(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err, "failed to verify image")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
 }
 
 func (h *Handler) ListImages(w http.ResponseWriter, r *http.Request) {
@@ -155,39 +759,341 @@ func (h *Handler) ListImages(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	images, err := h.imageService.List(r.Context(), limit, offset)
+	filter, err := parseImageFilter(r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to list images: %v", err), http.StatusInternalServerError)
+		httpError(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	total, err := h.imageService.Count(r.Context(), filter)
+	if err != nil {
+		writeError(w, r, err, "failed to list images")
+		return
+	}
+
+	// The page is streamed as {"items": [...], "total", "limit", "offset"},
+	// encoding images one by one as they're read from the DB cursor. The
+	// opening is written with the first image, so that a failing query can
+	// still be reported with an error status.
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(images)
+	enc := json.NewEncoder(w)
+	written := 0
+	err = h.imageService.ListEach(r.Context(), filter, limit, offset, func(img *domain.Image) error {
+		sep := ","
+		if written == 0 {
+			sep = `{"items":[`
+		}
+		if _, err := io.WriteString(w, sep); err != nil {
+			return err
+		}
+		written++
+		return enc.Encode(h.present(img))
+	})
+	if err != nil {
+		if written == 0 {
+			writeError(w, r, err, "failed to list images")
+			return
+		}
+		// Too late for an error status; the truncated body is invalid JSON
+		h.logger.Error("failed to stream images", "error", err, "request_id", requestIDFrom(r.Context()))
+		return
+	}
+	if written == 0 {
+		io.WriteString(w, `{"items":[`)
+	}
+	fmt.Fprintf(w, `],"total":%d,"limit":%d,"offset":%d}`, total, limit, offset)
+}
+
+// parseImageFilter reads listing filters from the query string
+func parseImageFilter(r *http.Request) (domain.ImageFilter, error) {
+	var filter domain.ImageFilter
+	if status := r.URL.Query().Get("status"); status != "" {
+		filter.Status = domain.ProcessingStatus(status)
+		if !filter.Status.Valid() {
+			return filter, fmt.Errorf("invalid status %q: must be one of pending, processing, completed, failed", status)
+		}
+	}
+	if format := r.URL.Query().Get("format"); format != "" {
+		filter.Format = domain.ImageFormat(format)
+		if !filter.Format.Valid() {
+			return filter, fmt.Errorf("invalid format %q: must be one of %s", format, strings.Join(config.ImageFormats, ", "))
+		}
+	}
+
+	var err error
+	if filter.MinSharpness, err = parseFloatParam(r, "min_sharpness"); err != nil {
+		return filter, err
+	}
+	if filter.MaxSharpness, err = parseFloatParam(r, "max_sharpness"); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+// parseFloatParam returns nil when the query parameter is absent
+func parseFloatParam(r *http.Request, name string) (*float64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: must be a number", name)
+	}
+	return &f, nil
+}
+
+func (h *Handler) ExportImagesCSV(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseImageFilter(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="images.csv"`)
+
+	cw := csv.NewWriter(w)
+	header := []string{
+		"id", "status", "format", "original_width", "original_height",
+		"processed_width", "processed_height", "original_size", "processed_size", "created_at",
+	}
+	if err := cw.Write(header); err != nil {
+		return
+	}
+
+	// Rows are streamed from the DB cursor and flushed as they go, so once
+	// the first row is written the status code can no longer change.
+	rowsWritten := 0
+	err = h.imageService.ForEach(r.Context(), filter, func(img *domain.Image) error {
+		record := []string{
+			img.ID,
+			string(img.Status),
+			string(img.Format),
+			strconv.Itoa(img.OriginalWidth),
+			strconv.Itoa(img.OriginalHeight),
+			strconv.Itoa(img.ProcessedWidth),
+			strconv.Itoa(img.ProcessedHeight),
+			strconv.FormatInt(img.OriginalSize, 10),
+			strconv.FormatInt(img.ProcessedSize, 10),
+			img.CreatedAt.UTC().Format(time.RFC3339),
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+		rowsWritten++
+		if rowsWritten%100 == 0 {
+			cw.Flush()
+		}
+		return cw.Error()
+	})
+	if err != nil && rowsWritten == 0 {
+		writeError(w, r, err, "failed to export images")
+		return
+	}
+	cw.Flush()
 }
 
 func (h *Handler) DeleteImage(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	if id == "" {
-		http.Error(w, "image id is required", http.StatusBadRequest)
+		httpError(w, r, "image id is required", http.StatusBadRequest)
 		return
 	}
 
 	if err := h.imageService.Delete(r.Context(), id); err != nil {
-		if err == domain.ErrImageNotFound {
-			http.Error(w, "image not found", http.StatusNotFound)
+		writeError(w, r, err, "failed to delete image")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) RestoreImage(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		httpError(w, r, "image id is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.imageService.Restore(r.Context(), id); err != nil {
+		if errors.Is(err, domain.ErrImageNotFound) {
+			writeJSONError(w, r, http.StatusNotFound, "image_not_found", "deleted image not found")
 			return
 		}
-		http.Error(w, fmt.Sprintf("failed to delete image: %v", err), http.StatusInternalServerError)
+		writeError(w, r, err, "failed to restore image")
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// ReprocessImage queues an image for processing again, e.g. after the
+// derivative sizes changed in config
+func (h *Handler) ReprocessImage(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		httpError(w, r, "image id is required", http.StatusBadRequest)
+		return
+	}
+	priority, err := domain.ParsePriority(r.FormValue("priority"))
+	if err != nil {
+		writeError(w, r, err, "invalid priority")
+		return
+	}
+
+	img, err := h.imageService.Reprocess(r.Context(), id, priority)
+	if err != nil {
+		writeError(w, r, err, "failed to reprocess image")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(h.present(img))
+}
+
+// RotateImage turns a processed image clockwise by the degrees field
+func (h *Handler) RotateImage(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		httpError(w, r, "image id is required", http.StatusBadRequest)
+		return
+	}
+	degrees, err := strconv.Atoi(r.FormValue("degrees"))
+	if err != nil || degrees == 0 || !domain.ValidRotation(degrees) {
+		writeError(w, r, domain.ErrInvalidRotation, "invalid rotation")
+		return
+	}
+
+	img, err := h.rotator.Rotate(r.Context(), id, degrees)
+	if err != nil {
+		writeError(w, r, err, "failed to rotate image")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.present(img))
+}
+
+// HardDeleteImage permanently removes an image and its files, whether or
+// not it was soft-deleted
+func (h *Handler) HardDeleteImage(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		httpError(w, r, "image id is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.imageService.HardDelete(r.Context(), id); err != nil {
+		if errors.Is(err, domain.ErrFilesNotDeleted) {
+			// The image is gone either way; report the leftover files
+			// without failing the request, since retrying would now 404
+			h.logger.Warn("image deleted with files left in storage",
+				"image_id", id, "error", err, "request_id", requestIDFrom(r.Context()))
+			writeJSONError(w, r, http.StatusMultiStatus, "files_not_deleted", err.Error())
+			return
+		}
+		writeError(w, r, err, "failed to delete image")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PurgeDeleted permanently removes images soft-deleted longer than the
+// older_than duration ago (default: all of them)
+func (h *Handler) PurgeDeleted(w http.ResponseWriter, r *http.Request) {
+	var olderThan time.Duration
+	if value := r.URL.Query().Get("older_than"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			httpError(w, r, "invalid older_than: must be a non-negative duration, e.g. 720h", http.StatusBadRequest)
+			return
+		}
+		olderThan = d
+	}
+
+	purged, err := h.imageService.PurgeDeleted(r.Context(), olderThan)
+	if err != nil {
+		writeError(w, r, err, "failed to purge images")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+}
+
+// DeleteImagesByStatus permanently removes every image with the status
+// given in the query, which is required so that nothing is deleted by accident
+func (h *Handler) DeleteImagesByStatus(w http.ResponseWriter, r *http.Request) {
+	status := domain.ProcessingStatus(r.URL.Query().Get("status"))
+	if !status.Valid() {
+		httpError(w, r, "invalid status: must be one of pending, processing, completed, failed", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := h.imageService.DeleteByStatus(r.Context(), status)
+	if err != nil {
+		writeError(w, r, err, "failed to delete images")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"deleted": deleted})
+}
+
+// present returns the API representation of an image. With a CDN configured,
+// storage paths are rewritten into absolute CDN URLs; the stored record keeps
+// the relative paths.
+func (h *Handler) present(img *domain.Image) *domain.Image {
+	base := strings.TrimRight(h.cfg.Storage.CDNBaseURL, "/")
+	if base == "" {
+		return img
+	}
+
+	toURL := func(path string) string {
+		if path == "" {
+			return ""
+		}
+		return base + "/" + filepath.ToSlash(path)
+	}
+
+	out := *img
+	out.OriginalPath = toURL(img.OriginalPath)
+	out.ProcessedPath = toURL(img.ProcessedPath)
+	out.ThumbnailPath = toURL(img.ThumbnailPath)
+	out.LQIPPath = toURL(img.LQIPPath)
+	if img.Thumbnails != nil {
+		out.Thumbnails = make(map[string]string, len(img.Thumbnails))
+		for label, path := range img.Thumbnails {
+			out.Thumbnails[label] = toURL(path)
+		}
+	}
+	return &out
+}
+
+func contentType(format domain.ImageFormat) string {
+	switch format {
+	case domain.FormatPNG:
+		return "image/png"
+	case domain.FormatGIF:
+		return "image/gif"
+	case domain.FormatWebP:
+		return "image/webp"
+	case domain.FormatTIFF:
+		return "image/tiff"
+	case domain.FormatBMP:
+		return "image/bmp"
+	default:
+		return "image/jpeg"
+	}
+}
+
 func (h *Handler) Index(w http.ResponseWriter, r *http.Request) {
 	indexFile, err := webFiles.Open("web/index.html")
 	if err != nil {
-		http.Error(w, "failed to load index.html", http.StatusInternalServerError)
+		httpError(w, r, "failed to load index.html", http.StatusInternalServerError)
 		return
 	}
 	defer indexFile.Close()
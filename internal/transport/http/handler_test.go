@@ -0,0 +1,484 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/oziev02/ImageProcessor/internal/config"
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+func TestGetImageContentType(t *testing.T) {
+	tests := []struct {
+		name  string
+		image domain.Image
+		want  string
+	}{
+		{
+			name:  "processed in another format",
+			image: domain.Image{Format: domain.FormatPNG, ProcessedPath: "processed/a.jpg", ProcessedFormat: domain.FormatJPEG},
+			want:  "image/jpeg",
+		},
+		{
+			name:  "webp source processed to the fallback",
+			image: domain.Image{Format: domain.FormatWebP, ProcessedPath: "processed/a.png", ProcessedFormat: domain.FormatPNG},
+			want:  "image/png",
+		},
+		{
+			name:  "not yet processed",
+			image: domain.Image{Format: domain.FormatWebP, OriginalPath: "original/a.webp"},
+			want:  "image/webp",
+		},
+		{
+			name:  "processed before processed_format was tracked",
+			image: domain.Image{Format: domain.FormatGIF, ProcessedPath: "processed/a.gif"},
+			want:  "image/gif",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := tt.image
+			img.ID = "a"
+			storage := &memStorage{files: map[string][]byte{
+				img.ProcessedPath: []byte("processed"),
+				img.OriginalPath:  []byte("original"),
+			}}
+			svc := &fakeImageService{images: map[string]*domain.Image{"a": &img}}
+			router := newTestRouter(svc, storage, testConfig(t))
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/image/a", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.want {
+				t.Errorf("Content-Type = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListImages(t *testing.T) {
+	svc := &fakeImageService{images: map[string]*domain.Image{
+		"a": {ID: "a", Status: domain.StatusCompleted, Format: domain.FormatJPEG},
+		"b": {ID: "b", Status: domain.StatusPending, Format: domain.FormatPNG},
+		"c": {ID: "c", Status: domain.StatusCompleted, Format: domain.FormatPNG},
+	}}
+
+	tests := []struct {
+		name      string
+		query     string
+		wantIDs   []string
+		wantTotal int
+		wantLimit int
+		wantOff   int
+	}{
+		{name: "all", query: "", wantIDs: []string{"a", "b", "c"}, wantTotal: 3, wantLimit: 50},
+		{name: "page", query: "?limit=2&offset=1", wantIDs: []string{"b", "c"}, wantTotal: 3, wantLimit: 2, wantOff: 1},
+		{name: "filtered", query: "?status=completed&format=png", wantIDs: []string{"c"}, wantTotal: 1, wantLimit: 50},
+		{name: "past the end", query: "?offset=10", wantIDs: []string{}, wantTotal: 3, wantLimit: 50, wantOff: 10},
+		{name: "no match", query: "?status=failed", wantIDs: []string{}, wantTotal: 0, wantLimit: 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := newTestRouter(svc, &memStorage{}, testConfig(t))
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/images"+tt.query, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+			}
+
+			var page struct {
+				Items  []map[string]any `json:"items"`
+				Total  int              `json:"total"`
+				Limit  int              `json:"limit"`
+				Offset int              `json:"offset"`
+			}
+			raw := rec.Body.String()
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatalf("invalid JSON %q: %v", raw, err)
+			}
+			if page.Items == nil {
+				t.Fatalf("items is null in %s, want an array", raw)
+			}
+			ids := make([]string, 0, len(page.Items))
+			for _, item := range page.Items {
+				ids = append(ids, item["id"].(string))
+			}
+			if !slices.Equal(ids, tt.wantIDs) {
+				t.Errorf("items = %v, want %v", ids, tt.wantIDs)
+			}
+			if page.Total != tt.wantTotal || page.Limit != tt.wantLimit || page.Offset != tt.wantOff {
+				t.Errorf("total, limit, offset = %d, %d, %d, want %d, %d, %d",
+					page.Total, page.Limit, page.Offset, tt.wantTotal, tt.wantLimit, tt.wantOff)
+			}
+		})
+	}
+}
+
+func TestListImagesInvalidFilter(t *testing.T) {
+	router := newTestRouter(&fakeImageService{}, &memStorage{}, testConfig(t))
+	for _, query := range []string{"?status=lost", "?format=svg", "?min_sharpness=high"} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/images"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestParseCrop(t *testing.T) {
+	tests := []struct {
+		name    string
+		form    url.Values
+		want    *domain.CropRect
+		wantErr bool
+	}{
+		{name: "absent", form: url.Values{}, want: nil},
+		{
+			name: "complete",
+			form: url.Values{"crop_x": {"1"}, "crop_y": {"2"}, "crop_w": {"30"}, "crop_h": {"40"}},
+			want: &domain.CropRect{X: 1, Y: 2, W: 30, H: 40},
+		},
+		{name: "partial", form: url.Values{"crop_x": {"1"}, "crop_w": {"30"}}, wantErr: true},
+		{name: "not a number", form: url.Values{"crop_x": {"a"}, "crop_y": {"2"}, "crop_w": {"30"}, "crop_h": {"40"}}, wantErr: true},
+		{name: "negative origin", form: url.Values{"crop_x": {"-1"}, "crop_y": {"2"}, "crop_w": {"30"}, "crop_h": {"40"}}, wantErr: true},
+		{name: "zero width", form: url.Values{"crop_x": {"1"}, "crop_y": {"2"}, "crop_w": {"0"}, "crop_h": {"40"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/upload?"+tt.form.Encode(), nil)
+			got, err := parseCrop(req)
+			if tt.wantErr {
+				if !errors.Is(err, domain.ErrInvalidCrop) {
+					t.Fatalf("err = %v, want ErrInvalidCrop", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCrop = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetImageETag(t *testing.T) {
+	tests := []struct {
+		name      string
+		image     domain.Image
+		wantCache string
+	}{
+		{
+			name:      "processed",
+			image:     domain.Image{ProcessedPath: "processed/a.jpg", ProcessedFormat: domain.FormatJPEG, ProcessedChecksum: "abc123"},
+			wantCache: "public, max-age=86400",
+		},
+		{
+			name:      "original standing in",
+			image:     domain.Image{OriginalPath: "original/a.jpg", Format: domain.FormatJPEG, UpdatedAt: time.Unix(1700000000, 0)},
+			wantCache: "no-cache",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := tt.image
+			img.ID = "a"
+			storage := &memStorage{files: map[string][]byte{"processed/a.jpg": []byte("processed"), "original/a.jpg": []byte("original")}}
+			cfg := testConfig(t)
+			cfg.Server.CacheMaxAge = 24 * time.Hour
+			router := newTestRouter(&fakeImageService{images: map[string]*domain.Image{"a": &img}}, storage, cfg)
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/image/a", nil))
+			etag := rec.Header().Get("ETag")
+			if rec.Code != http.StatusOK || etag == "" {
+				t.Fatalf("first request: status = %d, ETag = %q", rec.Code, etag)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != tt.wantCache {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.wantCache)
+			}
+
+			for _, inm := range []string{etag, `"other", ` + etag, "*"} {
+				req := httptest.NewRequest(http.MethodGet, "/image/a", nil)
+				req.Header.Set("If-None-Match", inm)
+				rec = httptest.NewRecorder()
+				router.ServeHTTP(rec, req)
+				if rec.Code != http.StatusNotModified {
+					t.Errorf("If-None-Match %s: status = %d, want %d", inm, rec.Code, http.StatusNotModified)
+				}
+				if rec.Body.Len() != 0 {
+					t.Errorf("If-None-Match %s: body = %q, want it empty", inm, rec.Body)
+				}
+				if rec.Header().Get("ETag") != etag {
+					t.Errorf("If-None-Match %s: ETag = %q, want %q", inm, rec.Header().Get("ETag"), etag)
+				}
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/image/a", nil)
+			req.Header.Set("If-None-Match", `"stale"`)
+			rec = httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+				t.Errorf("stale ETag: status = %d with %d bytes, want the image", rec.Code, rec.Body.Len())
+			}
+		})
+	}
+}
+
+func TestBatchUpload(t *testing.T) {
+	svc := &fakeImageService{uploadErrs: map[string]error{
+		"notes.txt": fmt.Errorf("unsupported format: %w", domain.ErrInvalidFormat),
+		"huge.jpg":  domain.ErrFileTooLarge,
+	}}
+	router := newTestRouter(svc, &memStorage{}, testConfig(t))
+
+	body, contentType := uploadForm(t, []string{"cat.jpg", "notes.txt", "huge.jpg"}, nil)
+	req := httptest.NewRequest(http.MethodPost, "/upload/batch", body)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	var results []struct {
+		Filename string         `json:"filename"`
+		Image    map[string]any `json:"image"`
+		Code     string         `json:"code"`
+		Error    string         `json:"error"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("%d results, want one per file", len(results))
+	}
+
+	// Results are in upload order, the failures not affecting the others
+	want := []struct{ filename, code string }{
+		{"cat.jpg", ""},
+		{"notes.txt", "invalid_format"},
+		{"huge.jpg", "file_too_large"},
+	}
+	for i, w := range want {
+		got := results[i]
+		if got.Filename != w.filename || got.Code != w.code {
+			t.Errorf("result %d = %s/%q, want %s/%q", i, got.Filename, got.Code, w.filename, w.code)
+		}
+		if succeeded := got.Image != nil; succeeded != (w.code == "") {
+			t.Errorf("result %d: image = %v, error = %q", i, got.Image, got.Error)
+		}
+	}
+	if !slices.Equal(svc.uploaded, []string{"content of cat.jpg"}) {
+		t.Errorf("uploaded %q, want only cat.jpg", svc.uploaded)
+	}
+}
+
+func TestUploadToneAdjustments(t *testing.T) {
+	tests := []struct {
+		name           string
+		fields         map[string]string
+		wantStatus     int
+		wantCode       string
+		wantBrightness int
+		wantContrast   int
+	}{
+		{name: "none", wantStatus: http.StatusOK},
+		{name: "in range", fields: map[string]string{"brightness": "20", "contrast": "-100"}, wantStatus: http.StatusOK, wantBrightness: 20, wantContrast: -100},
+		{name: "brightness too high", fields: map[string]string{"brightness": "101"}, wantStatus: http.StatusBadRequest, wantCode: "invalid_brightness"},
+		{name: "brightness too low", fields: map[string]string{"brightness": "-101"}, wantStatus: http.StatusBadRequest, wantCode: "invalid_brightness"},
+		{name: "brightness not a number", fields: map[string]string{"brightness": "bright"}, wantStatus: http.StatusBadRequest, wantCode: "invalid_brightness"},
+		{name: "contrast too high", fields: map[string]string{"contrast": "200"}, wantStatus: http.StatusBadRequest, wantCode: "invalid_contrast"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &fakeImageService{}
+			router := newTestRouter(svc, &memStorage{}, testConfig(t))
+
+			body, contentType := uploadForm(t, []string{"a.jpg"}, tt.fields)
+			req := httptest.NewRequest(http.MethodPost, "/upload", body)
+			req.Header.Set("Content-Type", contentType)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode != "" {
+				var resp errorResponse
+				if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.Error.Code != tt.wantCode {
+					t.Errorf("code = %q, want %q", resp.Error.Code, tt.wantCode)
+				}
+				if len(svc.uploaded) != 0 {
+					t.Error("rejected upload reached the service")
+				}
+				return
+			}
+			params := svc.images["a.jpg"].Params
+			if params.Brightness != tt.wantBrightness || params.Contrast != tt.wantContrast {
+				t.Errorf("brightness %d, contrast %d, want %d and %d",
+					params.Brightness, params.Contrast, tt.wantBrightness, tt.wantContrast)
+			}
+		})
+	}
+}
+
+func TestGetOriginalImage(t *testing.T) {
+	processed := &domain.Image{ID: "a", Status: domain.StatusCompleted, Format: domain.FormatPNG,
+		OriginalPath: "original/a.png", ProcessedPath: "processed/a.jpg", ProcessedFormat: domain.FormatJPEG}
+	lost := &domain.Image{ID: "lost", Status: domain.StatusCompleted, Format: domain.FormatPNG,
+		OriginalPath: "original/lost.png", ProcessedPath: "processed/lost.jpg", ProcessedFormat: domain.FormatJPEG}
+	svc := &fakeImageService{images: map[string]*domain.Image{"a": processed, "lost": lost}}
+	storage := &memStorage{files: map[string][]byte{
+		"original/a.png":     []byte("original bytes"),
+		"processed/a.jpg":    []byte("processed bytes"),
+		"processed/lost.jpg": []byte("processed bytes"),
+	}}
+	router := newTestRouter(svc, storage, testConfig(t))
+
+	tests := []struct {
+		name       string
+		id         string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "processed image", id: "a", wantStatus: http.StatusOK, wantBody: "original bytes"},
+		{name: "original missing", id: "lost", wantStatus: http.StatusNotFound},
+		{name: "unknown image", id: "missing", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/image/"+tt.id+"/original", nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			// The original, not the processed file that /image/{id} serves
+			if rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body, tt.wantBody)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "image/png" {
+				t.Errorf("Content-Type = %q, want image/png", got)
+			}
+			if got := rec.Header().Get("Content-Disposition"); got != `attachment; filename="a.png"` {
+				t.Errorf("Content-Disposition = %q", got)
+			}
+		})
+	}
+}
+
+func TestGetThumbnail(t *testing.T) {
+	done := &domain.Image{ID: "a", Status: domain.StatusCompleted, Format: domain.FormatPNG,
+		ThumbnailPath: "thumbnail/a.jpg", ThumbnailChecksum: "abc",
+		Thumbnails: map[string]string{"small": "thumbnail/small/a.jpg"}}
+	pending := &domain.Image{ID: "p", Status: domain.StatusPending, Format: domain.FormatPNG, OriginalPath: "original/p.png"}
+	svc := &fakeImageService{images: map[string]*domain.Image{"a": done, "p": pending}}
+	storage := &memStorage{files: map[string][]byte{
+		"thumbnail/a.jpg":       []byte("thumbnail bytes"),
+		"thumbnail/small/a.jpg": []byte("small bytes"),
+		"original/p.png":        []byte("original bytes"),
+	}}
+	cfg := testConfig(t)
+	cfg.Image.ThumbnailSizes = []config.ThumbnailSize{{Label: "small", Width: 64, Height: 64}, {Label: "large", Width: 800, Height: 800}}
+	router := newTestRouter(svc, storage, cfg)
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantBody   string
+		wantETag   string
+	}{
+		{name: "present", path: "/image/a/thumbnail", wantStatus: http.StatusOK, wantBody: "thumbnail bytes", wantETag: `"abc"`},
+		{name: "variant", path: "/image/a/thumbnail?size=small", wantStatus: http.StatusOK, wantBody: "small bytes", wantETag: `"abc-small"`},
+		{name: "variant not generated", path: "/image/a/thumbnail?size=large", wantStatus: http.StatusNotFound},
+		{name: "unknown size", path: "/image/a/thumbnail?size=huge", wantStatus: http.StatusBadRequest},
+		{name: "not yet processed", path: "/image/p/thumbnail", wantStatus: http.StatusNotFound},
+		{name: "unknown image", path: "/image/missing/thumbnail", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if got := rec.Header().Get("Content-Type"); got != "application/json" {
+					t.Errorf("error Content-Type = %q, want application/json", got)
+				}
+				return
+			}
+			if rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body, tt.wantBody)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "image/jpeg" {
+				t.Errorf("Content-Type = %q, want image/jpeg from the file", got)
+			}
+			if got := rec.Header().Get("ETag"); got != tt.wantETag {
+				t.Errorf("ETag = %q, want %q", got, tt.wantETag)
+			}
+		})
+	}
+}
+
+func TestHardDeleteImage(t *testing.T) {
+	leftover := fmt.Errorf("%w: processed/a.jpg: storage unavailable", domain.ErrFilesNotDeleted)
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "deleted", wantStatus: http.StatusNoContent},
+		{name: "files left behind", err: leftover, wantStatus: http.StatusMultiStatus, wantCode: "files_not_deleted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &fakeImageService{
+				images:         map[string]*domain.Image{"a": {ID: "a"}},
+				hardDeleteErrs: map[string]error{"a": tt.err},
+			}
+			router := newTestRouter(svc, &memStorage{}, testConfig(t))
+
+			// The second delete of the same image is a 404 either way
+			for i, want := range []struct {
+				status int
+				code   string
+			}{{tt.wantStatus, tt.wantCode}, {http.StatusNotFound, "image_not_found"}} {
+				rec := httptest.NewRecorder()
+				router.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/admin/image/a", nil))
+				if rec.Code != want.status {
+					t.Fatalf("delete %d: status = %d, want %d: %s", i+1, rec.Code, want.status, rec.Body)
+				}
+				if want.code == "" {
+					continue
+				}
+				var resp errorResponse
+				if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.Error.Code != want.code {
+					t.Errorf("delete %d: code = %q, want %q", i+1, resp.Error.Code, want.code)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// readinessTimeout bounds each dependency probe of the readiness check
+const readinessTimeout = 2 * time.Second
+
+// Pinger is a dependency checked by the readiness probe
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// readiness is the response of the readiness probe: "ok" or the error of
+// each dependency
+type readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Healthz reports that the process is up, without checking dependencies,
+// so that a dependency outage doesn't get the service restarted
+func (h *Handler) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// Readyz reports whether every dependency is reachable, answering 503 with
+// the failing ones otherwise
+func (h *Handler) Readyz(w http.ResponseWriter, r *http.Request) {
+	result := readiness{Status: "ok", Checks: make(map[string]string, len(h.dependencies))}
+	for name, dep := range h.dependencies {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		err := dep.Ping(ctx)
+		cancel()
+		if err != nil {
+			result.Status = "unavailable"
+			result.Checks[name] = err.Error()
+			continue
+		}
+		result.Checks[name] = "ok"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if result.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,255 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/oziev02/ImageProcessor/internal/config"
+)
+
+func TestRealIP(t *testing.T) {
+	proxies, err := config.ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{
+			name:       "direct client spoofing X-Forwarded-For",
+			remoteAddr: "203.0.113.7:5000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:       "203.0.113.7:5000",
+		},
+		{
+			name:       "direct client spoofing X-Real-IP",
+			remoteAddr: "203.0.113.7:5000",
+			headers:    map[string]string{"X-Real-IP": "198.51.100.1"},
+			want:       "203.0.113.7:5000",
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.1.2.3:5000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "forged hop left of the client",
+			remoteAddr: "10.1.2.3:5000",
+			headers:    map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "chain of trusted proxies",
+			remoteAddr: "192.0.2.1:5000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1, 10.0.0.5"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "trusted proxy with X-Real-IP",
+			remoteAddr: "10.1.2.3:5000",
+			headers:    map[string]string{"X-Real-IP": "198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "trusted proxy with garbage",
+			remoteAddr: "10.1.2.3:5000",
+			headers:    map[string]string{"X-Forwarded-For": "not-an-ip"},
+			want:       "10.1.2.3:5000",
+		},
+		{
+			name:       "trusted proxy without headers",
+			remoteAddr: "10.1.2.3:5000",
+			want:       "10.1.2.3:5000",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := realIP(proxies)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.RemoteAddr
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			if got != tt.want {
+				t.Errorf("RemoteAddr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitIgnoresUntrustedForwardedFor(t *testing.T) {
+	limit := rateLimit(config.RateLimitConfig{RequestsPerSecond: 1, Burst: 1}, false)
+	h := realIP(nil)(limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	for i, forwarded := range []string{"198.51.100.1", "198.51.100.2"} {
+		req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+		req.RemoteAddr = "203.0.113.7:5000"
+		req.Header.Set("X-Forwarded-For", forwarded)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		want := http.StatusOK
+		if i > 0 {
+			want = http.StatusTooManyRequests
+		}
+		if rec.Code != want {
+			t.Fatalf("request %d: status = %d, want %d", i, rec.Code, want)
+		}
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    []string
+		headers map[string]string
+		want    int
+	}{
+		{name: "auth disabled", keys: nil, want: http.StatusOK},
+		{name: "auth disabled ignores keys", keys: nil, headers: map[string]string{"X-API-Key": "anything"}, want: http.StatusOK},
+		{name: "X-API-Key", keys: []string{"k1", "k2"}, headers: map[string]string{"X-API-Key": "k2"}, want: http.StatusOK},
+		{name: "bearer token", keys: []string{"k1"}, headers: map[string]string{"Authorization": "Bearer k1"}, want: http.StatusOK},
+		{name: "missing key", keys: []string{"k1"}, want: http.StatusUnauthorized},
+		{name: "wrong key", keys: []string{"k1"}, headers: map[string]string{"X-API-Key": "k2"}, want: http.StatusUnauthorized},
+		{name: "prefix of a key", keys: []string{"k1"}, headers: map[string]string{"X-API-Key": "k"}, want: http.StatusUnauthorized},
+		{name: "other scheme", keys: []string{"k1"}, headers: map[string]string{"Authorization": "Basic k1"}, want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			h := apiKeyAuth(tt.keys)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			}))
+			req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if called != (tt.want == http.StatusOK) {
+				t.Errorf("handler called = %v", called)
+			}
+			if tt.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("WWW-Authenticate = %q, want Bearer", rec.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestAPIKeyAuthRoutes(t *testing.T) {
+	// Mutating routes need a key, reads only with RequireAll
+	for _, requireAll := range []bool{false, true} {
+		cfg := testConfig(t)
+		cfg.Auth.APIKeys = []string{"secret"}
+		cfg.Auth.RequireAll = requireAll
+		router := newTestRouter(&fakeImageService{}, &memStorage{}, cfg)
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/image/a", nil))
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("requireAll=%v: DELETE without key = %d, want %d", requireAll, rec.Code, http.StatusUnauthorized)
+		}
+
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/image/a", nil))
+		want := http.StatusNotFound // reaches the handler
+		if requireAll {
+			want = http.StatusUnauthorized
+		}
+		if rec.Code != want {
+			t.Errorf("requireAll=%v: GET without key = %d, want %d", requireAll, rec.Code, want)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	cfg := config.CORSConfig{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedMethods: []string{"GET", "POST"},
+		AllowedHeaders: []string{"Content-Type", "X-API-Key"},
+		MaxAge:         10 * time.Minute,
+	}
+	tests := []struct {
+		name        string
+		cfg         config.CORSConfig
+		method      string
+		origin      string
+		preflight   bool
+		wantStatus  int
+		wantAllow   string
+		wantHandler bool
+		wantMethods string
+	}{
+		{name: "allowed origin", cfg: cfg, method: http.MethodGet, origin: "https://app.example.com",
+			wantStatus: http.StatusOK, wantAllow: "https://app.example.com", wantHandler: true},
+		{name: "disallowed origin", cfg: cfg, method: http.MethodGet, origin: "https://evil.example.com",
+			wantStatus: http.StatusOK, wantHandler: true},
+		{name: "no origin", cfg: cfg, method: http.MethodGet,
+			wantStatus: http.StatusOK, wantHandler: true},
+		{name: "preflight", cfg: cfg, method: http.MethodOptions, origin: "https://app.example.com", preflight: true,
+			wantStatus: http.StatusNoContent, wantAllow: "https://app.example.com", wantMethods: "GET, POST"},
+		{name: "disallowed preflight", cfg: cfg, method: http.MethodOptions, origin: "https://evil.example.com", preflight: true,
+			wantStatus: http.StatusForbidden},
+		{name: "any origin", cfg: config.CORSConfig{AllowedOrigins: []string{"*"}}, method: http.MethodGet, origin: "https://evil.example.com",
+			wantStatus: http.StatusOK, wantAllow: "*", wantHandler: true},
+		{name: "disabled", method: http.MethodGet, origin: "https://app.example.com",
+			wantStatus: http.StatusOK, wantHandler: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			h := cors(tt.cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			}))
+			req := httptest.NewRequest(tt.method, "/api/images", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", "POST")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if called != tt.wantHandler {
+				t.Errorf("handler called = %v, want %v", called, tt.wantHandler)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantAllow {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantAllow)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Methods"); got != tt.wantMethods {
+				t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, tt.wantMethods)
+			}
+			if tt.wantMethods != "" {
+				if got := rec.Header().Get("Access-Control-Allow-Headers"); got != "Content-Type, X-API-Key" {
+					t.Errorf("Access-Control-Allow-Headers = %q", got)
+				}
+				if got := rec.Header().Get("Access-Control-Max-Age"); got != "600" {
+					t.Errorf("Access-Control-Max-Age = %q, want 600", got)
+				}
+			}
+			// Responses differing by origin mustn't be cached as one
+			if wantVary := tt.origin != "" && len(tt.cfg.AllowedOrigins) > 0; (rec.Header().Get("Vary") == "Origin") != wantVary {
+				t.Errorf("Vary = %q", rec.Header().Get("Vary"))
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package http
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/oziev02/ImageProcessor/internal/config"
+)
+
+// rateLimitSweepInterval is how often buckets that have refilled are dropped
+const rateLimitSweepInterval = time.Minute
+
+// rateLimit limits requests per client with a token bucket. Clients are told
+// apart by API key when keys are configured, and so verified by apiKeyAuth
+// first, otherwise by IP. Disabled when the rate is zero.
+func rateLimit(cfg config.RateLimitConfig, byAPIKey bool) func(http.Handler) http.Handler {
+	if cfg.RequestsPerSecond <= 0 {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	limiter := newRateLimiter(cfg.RequestsPerSecond, cfg.Burst)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			allowed, wait := limiter.allow(clientKey(r, byAPIKey), time.Now())
+			if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				httpError(w, r, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientKey identifies the client a request counts against
+func clientKey(r *http.Request, byAPIKey bool) string {
+	if byAPIKey {
+		if key := requestAPIKey(r); key != "" {
+			digest := sha256.Sum256([]byte(key))
+			return "key:" + hex.EncodeToString(digest[:])
+		}
+	}
+	// realIP has already replaced RemoteAddr with the client's address when
+	// a trusted proxy reported it; otherwise it's the connection's peer
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// rateLimiter keeps a token bucket per client: each holds up to burst
+// tokens, refilled at rate per second, and a request takes one
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from key's bucket, or reports how long until one is
+// available
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep drops the buckets that have refilled, which behave like new ones,
+// so that the map doesn't keep every client ever seen
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
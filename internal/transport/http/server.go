@@ -2,48 +2,87 @@ package http
 
 import (
 	"context"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/oziev02/ImageProcessor/internal/config"
 )
 
 type Server struct {
 	httpServer *http.Server
 	handler    *Handler
+	// inflight counts running handlers, which Shutdown waits for
+	inflight sync.WaitGroup
+	// cancel cancels the context of every request
+	cancel context.CancelFunc
 }
 
 func NewServer(addr string, handler *Handler) *Server {
+	s := &Server{handler: handler}
 	r := chi.NewRouter()
 
 	// Middleware
-	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
-	r.Use(middleware.Logger)
+	r.Use(s.track)
+	r.Use(tracing)
+	r.Use(requestID)
+	// Validated at config load
+	proxies, _ := config.ParseTrustedProxies(handler.cfg.Server.TrustedProxies)
+	r.Use(realIP(proxies))
+	r.Use(requestLogger(handler.logger))
+	r.Use(cors(handler.cfg.CORS))
+	if handler.cfg.Server.Compress {
+		r.Use(compress(handler.cfg.Server.CompressMinSize))
+	}
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Timeout(60 * time.Second))
 
 	// Register routes
 	handler.RegisterRoutes(r)
 
-	return &Server{
-		httpServer: &http.Server{
-			Addr:         addr,
-			Handler:      r,
-			ReadTimeout:  30 * time.Second,
-			WriteTimeout: 30 * time.Second,
-		},
-		handler: handler,
+	baseCtx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.httpServer = &http.Server{
+		Addr:         addr,
+		Handler:      r,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		BaseContext:  func(net.Listener) context.Context { return baseCtx },
 	}
+	// Event streams never go idle, so they're ended as soon as Shutdown starts
+	s.httpServer.RegisterOnShutdown(handler.stopStreams)
+	return s
+}
+
+// track counts the request as in flight until its handler returns
+func (s *Server) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.inflight.Add(1)
+		defer s.inflight.Done()
+		next.ServeHTTP(w, r)
+	})
 }
 
 func (s *Server) Start() error {
 	return s.httpServer.ListenAndServe()
 }
 
+// Shutdown stops accepting requests, ends the open event streams and waits
+// for the other running requests until ctx is done. Those still running then
+// are cancelled and their connections closed, so that uploads clean up after
+// themselves, and are waited for too: once Shutdown returns, no handler uses
+// the database any more.
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.httpServer.Shutdown(ctx)
+	err := s.httpServer.Shutdown(ctx)
+	s.cancel()
+	if err != nil {
+		s.httpServer.Close()
+	}
+	s.inflight.Wait()
+	return err
 }
 
 func (s *Server) Addr() string {
@@ -0,0 +1,138 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+	"github.com/oziev02/ImageProcessor/internal/observability"
+)
+
+// blockingImages holds GetByID until release is closed or the request is
+// cancelled, then records which happened
+type blockingImages struct {
+	fakeImageService
+	started   chan struct{}
+	release   chan struct{}
+	returned  atomic.Bool
+	cancelled atomic.Bool
+}
+
+func (b *blockingImages) GetByID(ctx context.Context, id string) (*domain.Image, error) {
+	close(b.started)
+	defer b.returned.Store(true)
+	select {
+	case <-b.release:
+		return &domain.Image{ID: id, Status: domain.StatusPending}, nil
+	case <-ctx.Done():
+		b.cancelled.Store(true)
+		return nil, ctx.Err()
+	}
+}
+
+func TestShutdownWaitsForInflightRequests(t *testing.T) {
+	tests := []struct {
+		name          string
+		releaseAfter  time.Duration // 0 never releases the request
+		timeout       time.Duration
+		wantErr       bool
+		wantStatus    int
+		wantCancelled bool
+	}{
+		{name: "finishes within the timeout", releaseAfter: 50 * time.Millisecond, timeout: 5 * time.Second, wantStatus: http.StatusOK},
+		{name: "outlasts the timeout", timeout: 50 * time.Millisecond, wantErr: true, wantCancelled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &blockingImages{started: make(chan struct{}), release: make(chan struct{})}
+			h := NewHandler(svc, nil, &memStorage{}, nil, observability.NewMetrics(), testConfig(t), discardLogger())
+			s := NewServer("127.0.0.1:0", h)
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go s.httpServer.Serve(ln)
+
+			type result struct {
+				status int
+				err    error
+			}
+			done := make(chan result, 1)
+			go func() {
+				resp, err := http.Get("http://" + ln.Addr().String() + "/api/image/a")
+				if err != nil {
+					done <- result{err: err}
+					return
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				done <- result{status: resp.StatusCode}
+			}()
+			<-svc.started
+
+			if tt.releaseAfter > 0 {
+				time.AfterFunc(tt.releaseAfter, func() { close(svc.release) })
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			err = s.Shutdown(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Shutdown = %v, want error %v", err, tt.wantErr)
+			}
+
+			// Once Shutdown returns, no handler is running any more
+			if !svc.returned.Load() {
+				t.Error("Shutdown returned while the handler was still running")
+			}
+			if svc.cancelled.Load() != tt.wantCancelled {
+				t.Errorf("request cancelled = %v, want %v", svc.cancelled.Load(), tt.wantCancelled)
+			}
+			res := <-done
+			if tt.wantStatus != 0 && (res.err != nil || res.status != tt.wantStatus) {
+				t.Errorf("in-flight request got %d, %v, want %d", res.status, res.err, tt.wantStatus)
+			}
+
+			// New requests are refused
+			if _, err := http.Get("http://" + ln.Addr().String() + "/healthz"); err == nil {
+				t.Error("request accepted after Shutdown")
+			}
+		})
+	}
+}
+
+func TestShutdownEndsEventStreams(t *testing.T) {
+	svc := &progressingImages{statuses: []domain.ProcessingStatus{domain.StatusProcessing}}
+	h := NewHandler(svc, nil, &memStorage{}, nil, observability.NewMetrics(), testConfig(t), discardLogger())
+	s := NewServer("127.0.0.1:0", h)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.httpServer.Serve(ln)
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/api/image/a/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// The first event means the stream is open
+	if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown = %v, want the stream ended without waiting for the timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Shutdown took %v with an open event stream", elapsed)
+	}
+}
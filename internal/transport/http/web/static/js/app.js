@@ -33,7 +33,8 @@ document.getElementById('uploadForm').addEventListener('submit', async function(
         });
 
         if (!response.ok) {
-            throw new Error('Ошибка загрузки');
+            const body = await response.json().catch(() => null);
+            throw new Error(body && body.error ? body.error.message : 'Ошибка загрузки');
         }
 
         const image = await response.json();
@@ -57,8 +58,8 @@ async function loadImages() {
         const response = await fetch(API_BASE + '/api/images?limit=50');
         if (!response.ok) throw new Error('Ошибка загрузки');
         
-        const images = await response.json();
-        renderImages(images);
+        const page = await response.json();
+        renderImages(page.items);
     } catch (error) {
         document.getElementById('imagesContainer').innerHTML = 
             '<div class="error">Ошибка загрузки изображений: ' + error.message + '</div>';
@@ -89,6 +90,10 @@ function renderImages(images) {
                         img.original_width + ' × ' + img.original_height + 'px' +
                         (img.processed_width ? ' → ' + img.processed_width + ' × ' + img.processed_height + 'px' : '') +
                     '</div>' +
+                    (img.original_size ? '<div class="image-dimensions">' +
+                        formatSize(img.original_size) +
+                        (img.processed_size ? ' → ' + formatSize(img.processed_size) : '') +
+                    '</div>' : '') +
                     '<button class="delete-btn" onclick="deleteImage(\'' + img.id + '\')">Удалить</button>' +
                 '</div>' +
             '</div>'
@@ -109,8 +114,8 @@ function renderImages(images) {
 
 // Get image preview
 function getImagePreview(img) {
-    if (img.status === 'completed' && img.processed_path) {
-        return '<img src="' + API_BASE + '/image/' + img.id + '" alt="Processed" style="width: 100%; height: 100%; object-fit: cover;">';
+    if (img.status === 'completed' && img.thumbnail_path) {
+        return '<img src="' + API_BASE + '/image/' + img.id + '/thumbnail" alt="Processed" style="width: 100%; height: 100%; object-fit: cover;">';
     } else if (img.status === 'processing' || img.status === 'pending') {
         return '<div style="text-align: center; color: #999;">⏳ Обработка...</div>';
     } else if (img.status === 'failed') {
@@ -120,6 +125,17 @@ function getImagePreview(img) {
     }
 }
 
+// Format a byte count for display
+function formatSize(bytes) {
+    if (bytes < 1024) {
+        return bytes + ' Б';
+    }
+    if (bytes < 1024 * 1024) {
+        return (bytes / 1024).toFixed(1) + ' КБ';
+    }
+    return (bytes / (1024 * 1024)).toFixed(1) + ' МБ';
+}
+
 // Get status text
 function getStatusText(status) {
     const statusMap = {
@@ -3,14 +3,40 @@ package kafka
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/oziev02/ImageProcessor/internal/domain"
+	"github.com/oziev02/ImageProcessor/internal/observability"
 	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	commitAttempts = 4
+	commitBackoff  = 200 * time.Millisecond
+	// fetchBackoff is the first delay after a failed fetch, doubled up to
+	// ConsumerOptions.FetchMaxBackoff while fetching keeps failing
+	fetchBackoff = 500 * time.Millisecond
+)
+
+// Headers added to dead-lettered messages
+const (
+	errorHeader       = "error"
+	attemptsHeader    = "attempts"
+	sourceTopicHeader = "source-topic"
 )
 
 type Processor interface {
 	ProcessImage(ctx context.Context, task *domain.ProcessingTask) error
+	// MarkFailed records that a task failed for good after its retries
+	MarkFailed(ctx context.Context, task *domain.ProcessingTask, cause error) error
 }
 
 type Consumer interface {
@@ -18,48 +44,308 @@ type Consumer interface {
 	Close() error
 }
 
+// ConsumerOptions tune how a consumer schedules and retries tasks
+type ConsumerOptions struct {
+	// QueueSize bounds how many fetched messages wait to be processed
+	QueueSize int
+	// Concurrency is how many workers process queued tasks in parallel
+	Concurrency int
+	// MaxAttempts is how many times a task is processed before giving up
+	MaxAttempts int
+	// RetryBackoff is the delay before the first retry, doubled after each
+	RetryBackoff time.Duration
+	// DLQTopic receives tasks that exhausted their attempts; empty to drop them
+	DLQTopic string
+	// FetchMaxBackoff caps the delay between retries of failed fetches
+	FetchMaxBackoff time.Duration
+}
+
+// messageReader is the part of *kafka.Reader the consumer uses
+type messageReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// messageWriter is the part of *kafka.Writer the consumer and producer use
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
 type consumer struct {
-	reader *kafka.Reader
+	reader  messageReader
+	dlq     messageWriter // nil without a dead-letter topic
+	opts    ConsumerOptions
+	metrics *observability.Metrics
+	logger  *slog.Logger
+
+	// Serializes commits so that a lower offset is never committed after a
+	// higher one of the same partition
+	commitMu sync.Mutex
 }
 
-func NewConsumer(brokers []string, topic, groupID string) Consumer {
-	reader := kafka.NewReader(kafka.ReaderConfig{
+// NewConsumer creates a consumer of one or more topics that buffers fetched
+// messages and processes them highest priority first, whichever topic they
+// came from
+func NewConsumer(brokers []string, topics []string, groupID string, opts ConsumerOptions, metrics *observability.Metrics, logger *slog.Logger) Consumer {
+	readerConfig := kafka.ReaderConfig{
 		Brokers: brokers,
-		Topic:   topic,
 		GroupID: groupID,
-	})
-	return &consumer{reader: reader}
+	}
+	if len(topics) == 1 {
+		readerConfig.Topic = topics[0]
+	} else {
+		readerConfig.GroupTopics = topics
+	}
+	reader := kafka.NewReader(readerConfig)
+
+	c := &consumer{reader: reader, opts: opts, metrics: metrics, logger: logger.With("topics", topics)}
+	if opts.DLQTopic != "" {
+		c.dlq = &kafka.Writer{
+			Addr:     kafka.TCP(brokers...),
+			Topic:    opts.DLQTopic,
+			Balancer: &kafka.LeastBytes{},
+		}
+	}
+	return c
 }
 
 func (c *consumer) Start(ctx context.Context, processor Processor) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := newPriorityQueue(c.opts.QueueSize)
+	offsets := newOffsetTracker()
+
+	fetchErr := make(chan error, 1)
+	go func() {
+		fetchErr <- c.fetch(ctx, queue, offsets)
+		cancel()
+	}()
+
+	// Workers share the queue, so tasks may complete out of fetch order; the
+	// offset tracker still commits each partition in order
+	g, gctx := errgroup.WithContext(ctx)
+	for range max(c.opts.Concurrency, 1) {
+		g.Go(func() error {
+			return c.work(gctx, processor, queue, offsets)
+		})
+	}
+
+	err := g.Wait()
+	select {
+	case err := <-fetchErr:
+		return err
+	default:
+		return err
+	}
+}
+
+// work processes queued tasks until ctx is cancelled or a task fails fatally
+func (c *consumer) work(ctx context.Context, processor Processor, queue *priorityQueue, offsets *offsetTracker) error {
 	for {
+		item, err := queue.Pop(ctx)
+		if err != nil {
+			return err
+		}
+
+		if item.task != nil {
+			if err := c.process(ctx, processor, item); err != nil {
+				return err
+			}
+		}
+
+		if err := c.done(ctx, offsets, item.msg); err != nil {
+			return err
+		}
+	}
+}
+
+// done marks msg processed and commits the partition's offset if it advanced
+func (c *consumer) done(ctx context.Context, offsets *offsetTracker, msg kafka.Message) error {
+	c.commitMu.Lock()
+	defer c.commitMu.Unlock()
+
+	if commit, ok := offsets.Done(msg); ok {
+		return c.commit(ctx, commit)
+	}
+	return nil
+}
+
+// process runs a task with retries. When every attempt fails the image is
+// marked failed and the message is moved to the dead-letter topic, if any,
+// so that it can be committed. Only context cancellation and failing to
+// dead-letter stop the consumer.
+func (c *consumer) process(ctx context.Context, processor Processor, item *queuedMessage) error {
+	task := item.task
+	backoff := c.opts.RetryBackoff
+	ctx = otel.GetTextMapPropagator().Extract(ctx, headerCarrier{&item.msg})
+	attempts := max(c.opts.MaxAttempts, 1)
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = processor.ProcessImage(ctx, task); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt == attempts {
+			break
+		}
+
+		c.logger.Warn("failed to process image, retrying",
+			"image_id", task.ImageID, "attempt", attempt, "error", err)
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		default:
-			msg, err := c.reader.FetchMessage(ctx)
-			if err != nil {
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	c.logger.Error("failed to process image, giving up",
+		"image_id", task.ImageID, "attempts", attempts, "error", err)
+	if markErr := processor.MarkFailed(ctx, task, err); markErr != nil {
+		c.logger.Error("failed to mark image failed", "image_id", task.ImageID, "error", markErr)
+	}
+
+	if c.dlq == nil {
+		return nil
+	}
+	return c.deadLetter(ctx, item.msg, err, attempts)
+}
+
+// deadLetter republishes msg to the dead-letter topic with the final error
+func (c *consumer) deadLetter(ctx context.Context, msg kafka.Message, cause error, attempts int) error {
+	headers := append([]kafka.Header{}, msg.Headers...)
+	headers = append(headers,
+		kafka.Header{Key: errorHeader, Value: []byte(cause.Error())},
+		kafka.Header{Key: attemptsHeader, Value: []byte(strconv.Itoa(attempts))},
+		kafka.Header{Key: sourceTopicHeader, Value: []byte(msg.Topic)},
+	)
+
+	dead := kafka.Message{Key: msg.Key, Value: msg.Value, Headers: headers}
+	if err := c.dlq.WriteMessages(ctx, dead); err != nil {
+		return fmt.Errorf("failed to publish to dead-letter topic: %w", err)
+	}
+	return nil
+}
+
+// fetch reads messages into the queue until ctx is cancelled or fetching
+// fails permanently. Transient failures, such as a broker restarting, are
+// retried with exponential backoff while the reader reconnects.
+func (c *consumer) fetch(ctx context.Context, queue *priorityQueue, offsets *offsetTracker) error {
+	backoff := fetchBackoff
+	for {
+		msg, err := c.reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if permanentFetchError(err) {
 				return fmt.Errorf("failed to fetch message: %w", err)
 			}
 
-			var task domain.ProcessingTask
-			if err := json.Unmarshal(msg.Value, &task); err != nil {
-				_ = c.reader.CommitMessages(ctx, msg)
-				continue
+			c.logger.Warn("failed to fetch message, retrying", "backoff", backoff, "error", err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
 			}
+			backoff = min(backoff*2, max(c.opts.FetchMaxBackoff, fetchBackoff))
+			continue
+		}
+		backoff = fetchBackoff
+		offsets.Add(msg)
+		c.metrics.ConsumerLag.
+			WithLabelValues(msg.Topic, strconv.Itoa(msg.Partition)).
+			Set(float64(max(msg.HighWaterMark-msg.Offset-1, 0)))
 
-			if err := processor.ProcessImage(ctx, &task); err != nil {
-				// Log error but continue processing
-				_ = err
-			}
+		item := &queuedMessage{msg: msg, priority: messagePriority(msg)}
+		var task domain.ProcessingTask
+		if err := json.Unmarshal(msg.Value, &task); err != nil {
+			c.logger.Error("failed to decode task", "offset", msg.Offset, "error", err)
+		} else {
+			task.Priority = item.priority
+			item.task = &task
+		}
 
-			if err := c.reader.CommitMessages(ctx, msg); err != nil {
-				return fmt.Errorf("failed to commit message: %w", err)
-			}
+		if err := queue.Push(ctx, item); err != nil {
+			return err
 		}
 	}
 }
 
+// permanentFetchError reports whether retrying a fetch can't help: the
+// reader was closed, or the broker rejected our credentials or permissions
+func permanentFetchError(err error) bool {
+	if errors.Is(err, io.EOF) {
+		return true
+	}
+	var kafkaErr kafka.Error
+	if errors.As(err, &kafkaErr) {
+		switch kafkaErr {
+		case kafka.TopicAuthorizationFailed, kafka.GroupAuthorizationFailed,
+			kafka.ClusterAuthorizationFailed, kafka.SASLAuthenticationFailed:
+			return true
+		}
+	}
+	return false
+}
+
+// messagePriority reads the priority header; missing or unknown values are
+// treated as normal so messages from older producers still flow
+func messagePriority(msg kafka.Message) domain.TaskPriority {
+	for _, h := range msg.Headers {
+		if h.Key == priorityHeader {
+			priority, _ := domain.ParsePriority(string(h.Value))
+			return priority
+		}
+	}
+	return domain.PriorityNormal
+}
+
+// commit retries transient commit failures with backoff. If every attempt
+// fails the message is left uncommitted and consumption continues: the next
+// successful commit covers its offset, and at worst it's redelivered after a
+// rebalance. Only context cancellation is treated as fatal.
+func (c *consumer) commit(ctx context.Context, msg kafka.Message) error {
+	backoff := commitBackoff
+	var err error
+	for attempt := 1; attempt <= commitAttempts; attempt++ {
+		if err = c.reader.CommitMessages(ctx, msg); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt == commitAttempts {
+			break
+		}
+
+		c.logger.Warn("failed to commit message, retrying",
+			"topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset, "attempt", attempt, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	c.logger.Error("giving up committing message",
+		"topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset, "attempts", commitAttempts, "error", err)
+	return nil
+}
+
 func (c *consumer) Close() error {
+	if c.dlq != nil {
+		if err := c.dlq.Close(); err != nil {
+			c.reader.Close()
+			return fmt.Errorf("failed to close dead-letter writer: %w", err)
+		}
+	}
 	return c.reader.Close()
 }
@@ -0,0 +1,382 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+	"github.com/oziev02/ImageProcessor/internal/observability"
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeProcessor fails the first failures calls of ProcessImage
+type fakeProcessor struct {
+	mu        sync.Mutex
+	failures  int
+	calls     int
+	processed []string
+	failed    []error
+}
+
+func (p *fakeProcessor) ProcessImage(ctx context.Context, task *domain.ProcessingTask) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls++
+	if p.calls <= p.failures {
+		return errors.New("processing failed")
+	}
+	p.processed = append(p.processed, task.ImageID)
+	return nil
+}
+
+func (p *fakeProcessor) MarkFailed(ctx context.Context, task *domain.ProcessingTask, cause error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failed = append(p.failed, cause)
+	return nil
+}
+
+// fakeWriter records the messages written
+type fakeWriter struct {
+	mu       sync.Mutex
+	messages []kafka.Message
+	err      error
+}
+
+func (w *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.messages = append(w.messages, msgs...)
+	return nil
+}
+
+func (w *fakeWriter) Close() error { return nil }
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func TestProcessRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		failures   int
+		dlq        bool
+		wantCalls  int
+		wantFailed bool
+	}{
+		{name: "first attempt succeeds", failures: 0, dlq: true, wantCalls: 1},
+		{name: "retry succeeds", failures: 2, dlq: true, wantCalls: 3},
+		{name: "attempts exhausted", failures: 3, dlq: true, wantCalls: 3, wantFailed: true},
+		{name: "attempts exhausted without dead-letter topic", failures: 3, wantCalls: 3, wantFailed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &consumer{
+				opts:   ConsumerOptions{MaxAttempts: 3, RetryBackoff: time.Millisecond},
+				logger: discardLogger(),
+			}
+			writer := &fakeWriter{}
+			if tt.dlq {
+				c.dlq = writer
+			}
+			processor := &fakeProcessor{failures: tt.failures}
+			item := &queuedMessage{
+				msg:  kafka.Message{Topic: "images", Key: []byte("a"), Value: []byte(`{"image_id":"a"}`)},
+				task: &domain.ProcessingTask{ImageID: "a"},
+			}
+
+			if err := c.process(context.Background(), processor, item); err != nil {
+				t.Fatal(err)
+			}
+			if processor.calls != tt.wantCalls {
+				t.Errorf("ProcessImage called %d times, want %d", processor.calls, tt.wantCalls)
+			}
+			if got := len(processor.failed) == 1; got != tt.wantFailed {
+				t.Errorf("MarkFailed called %d times, want failed = %v", len(processor.failed), tt.wantFailed)
+			}
+
+			wantDead := 0
+			if tt.wantFailed && tt.dlq {
+				wantDead = 1
+			}
+			if len(writer.messages) != wantDead {
+				t.Fatalf("%d messages dead-lettered, want %d", len(writer.messages), wantDead)
+			}
+			if wantDead == 0 {
+				return
+			}
+			dead := writer.messages[0]
+			if string(dead.Value) != string(item.msg.Value) || string(dead.Key) != "a" {
+				t.Errorf("dead-lettered %q/%q, want the original message", dead.Key, dead.Value)
+			}
+			headers := make(map[string]string)
+			for _, h := range dead.Headers {
+				headers[h.Key] = string(h.Value)
+			}
+			want := map[string]string{errorHeader: "processing failed", attemptsHeader: "3", sourceTopicHeader: "images"}
+			for k, v := range want {
+				if headers[k] != v {
+					t.Errorf("header %s = %q, want %q", k, headers[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessStopsWhenDeadLetteringFails(t *testing.T) {
+	c := &consumer{
+		opts:   ConsumerOptions{MaxAttempts: 1},
+		dlq:    &fakeWriter{err: errors.New("broker down")},
+		logger: discardLogger(),
+	}
+	item := &queuedMessage{task: &domain.ProcessingTask{ImageID: "a"}}
+	if err := c.process(context.Background(), &fakeProcessor{failures: 1}, item); err == nil {
+		t.Fatal("process succeeded, want the dead-letter error so the message isn't committed")
+	}
+}
+
+// fetchResult is what one FetchMessage call of a fakeReader returns
+type fetchResult struct {
+	msg kafka.Message
+	err error
+}
+
+// fakeReader returns its results in order, then blocks until the context is
+// done. It records when each fetch happened and what was committed.
+type fakeReader struct {
+	mu        sync.Mutex
+	results   []fetchResult
+	fetchedAt []time.Time
+	committed []kafka.Message
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	r.mu.Lock()
+	r.fetchedAt = append(r.fetchedAt, time.Now())
+	if len(r.results) > 0 {
+		result := r.results[0]
+		r.results = r.results[1:]
+		r.mu.Unlock()
+		return result.msg, result.err
+	}
+	r.mu.Unlock()
+	<-ctx.Done()
+	return kafka.Message{}, ctx.Err()
+}
+
+func (r *fakeReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.committed = append(r.committed, msgs...)
+	return nil
+}
+
+func (r *fakeReader) Close() error { return nil }
+
+func TestFetchBackoff(t *testing.T) {
+	transient := errors.New("broker unavailable")
+	msg := func(offset int64) fetchResult {
+		return fetchResult{msg: kafka.Message{Topic: "images", Offset: offset, Value: []byte(`{"image_id":"a"}`)}}
+	}
+	reader := &fakeReader{results: []fetchResult{
+		{err: transient}, {err: transient}, msg(0), {err: transient}, msg(1),
+	}}
+	c := &consumer{
+		reader:  reader,
+		opts:    ConsumerOptions{FetchMaxBackoff: 2 * fetchBackoff},
+		metrics: observability.NewMetrics(),
+		logger:  discardLogger(),
+	}
+	queue := newPriorityQueue(10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.fetch(ctx, queue, newOffsetTracker()) }()
+
+	// Both messages get through the failures
+	for range 2 {
+		popCtx, popCancel := context.WithTimeout(ctx, 5*time.Second)
+		if _, err := queue.Pop(popCtx); err != nil {
+			t.Fatalf("message not fetched: %v", err)
+		}
+		popCancel()
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("fetch = %v, want context.Canceled", err)
+	}
+
+	// The delay doubles while fetching fails and resets after a success
+	wantDelays := []time.Duration{fetchBackoff, 2 * fetchBackoff, 0, fetchBackoff}
+	reader.mu.Lock()
+	defer reader.mu.Unlock()
+	for i, want := range wantDelays {
+		got := reader.fetchedAt[i+1].Sub(reader.fetchedAt[i])
+		if got < want || got > want+fetchBackoff/2 {
+			t.Errorf("delay before fetch %d = %v, want about %v", i+2, got, want)
+		}
+	}
+}
+
+func TestFetchBackoffCapped(t *testing.T) {
+	transient := errors.New("broker unavailable")
+	reader := &fakeReader{results: []fetchResult{{err: transient}, {err: transient}, {err: transient}}}
+	// A cap below the first delay still waits the first delay
+	c := &consumer{reader: reader, opts: ConsumerOptions{FetchMaxBackoff: time.Millisecond}, metrics: observability.NewMetrics(), logger: discardLogger()}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.fetch(ctx, newPriorityQueue(1), newOffsetTracker()) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		reader.mu.Lock()
+		fetches := len(reader.fetchedAt)
+		reader.mu.Unlock()
+		if fetches == 4 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	reader.mu.Lock()
+	defer reader.mu.Unlock()
+	if len(reader.fetchedAt) < 4 {
+		t.Fatalf("%d fetches, want 4", len(reader.fetchedAt))
+	}
+	for i := 1; i < 4; i++ {
+		got := reader.fetchedAt[i].Sub(reader.fetchedAt[i-1])
+		if got < fetchBackoff || got > fetchBackoff+fetchBackoff/2 {
+			t.Errorf("delay before fetch %d = %v, want about %v", i+1, got, fetchBackoff)
+		}
+	}
+}
+
+func TestFetchPermanentError(t *testing.T) {
+	for _, err := range []error{io.EOF, kafka.TopicAuthorizationFailed, kafka.SASLAuthenticationFailed} {
+		reader := &fakeReader{results: []fetchResult{{err: err}}}
+		c := &consumer{reader: reader, metrics: observability.NewMetrics(), logger: discardLogger()}
+
+		start := time.Now()
+		got := c.fetch(context.Background(), newPriorityQueue(1), newOffsetTracker())
+		if !errors.Is(got, err) {
+			t.Errorf("fetch = %v, want %v", got, err)
+		}
+		if time.Since(start) >= fetchBackoff {
+			t.Errorf("%v was retried, want fetch to give up at once", err)
+		}
+	}
+}
+
+// concurrentProcessor records how many tasks it processed at once
+type concurrentProcessor struct {
+	fakeProcessor
+	inFlight, maxInFlight int
+	total                 chan struct{}
+}
+
+func (p *concurrentProcessor) ProcessImage(ctx context.Context, task *domain.ProcessingTask) error {
+	p.mu.Lock()
+	p.inFlight++
+	p.maxInFlight = max(p.maxInFlight, p.inFlight)
+	p.mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	p.mu.Lock()
+	p.inFlight--
+	p.processed = append(p.processed, task.ImageID)
+	p.mu.Unlock()
+	p.total <- struct{}{}
+	return nil
+}
+
+func TestStartConcurrent(t *testing.T) {
+	const messages = 12
+	reader := &fakeReader{}
+	for i := range messages {
+		reader.results = append(reader.results, fetchResult{msg: kafka.Message{
+			Topic:     "images",
+			Partition: i % 2,
+			Offset:    int64(i / 2),
+			Value:     []byte(fmt.Sprintf(`{"image_id":"img-%d"}`, i)),
+		}})
+	}
+	c := &consumer{
+		reader:  reader,
+		opts:    ConsumerOptions{QueueSize: messages, Concurrency: 4, MaxAttempts: 1},
+		metrics: observability.NewMetrics(),
+		logger:  discardLogger(),
+	}
+	processor := &concurrentProcessor{total: make(chan struct{}, messages)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Start(ctx, processor) }()
+	for range messages {
+		select {
+		case <-processor.total:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for messages to be processed")
+		}
+	}
+	// Let the last commits land before stopping
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		reader.mu.Lock()
+		last := lastCommitted(reader.committed)
+		reader.mu.Unlock()
+		if (last[0] == messages/2-1 && last[1] == messages/2-1) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Start = %v, want context.Canceled", err)
+	}
+
+	processor.mu.Lock()
+	defer processor.mu.Unlock()
+	if len(processor.processed) != messages {
+		t.Errorf("%d messages processed, want %d", len(processor.processed), messages)
+	}
+	if processor.maxInFlight < 2 {
+		t.Errorf("at most %d tasks processed at once, want concurrency", processor.maxInFlight)
+	}
+
+	reader.mu.Lock()
+	defer reader.mu.Unlock()
+	last := lastCommitted(reader.committed)
+	for partition := range 2 {
+		if last[partition] != messages/2-1 {
+			t.Errorf("partition %d committed through %d, want %d", partition, last[partition], messages/2-1)
+		}
+	}
+	// Commits of a partition never go backwards
+	seen := make(map[int]int64)
+	for _, msg := range reader.committed {
+		if prev, ok := seen[msg.Partition]; ok && msg.Offset <= prev {
+			t.Errorf("partition %d committed %d after %d", msg.Partition, msg.Offset, prev)
+		}
+		seen[msg.Partition] = msg.Offset
+	}
+}
+
+// lastCommitted returns the highest committed offset of each partition
+func lastCommitted(committed []kafka.Message) map[int]int64 {
+	last := map[int]int64{0: -1, 1: -1}
+	for _, msg := range committed {
+		last[msg.Partition] = max(last[msg.Partition], msg.Offset)
+	}
+	return last
+}
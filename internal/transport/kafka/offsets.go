@@ -0,0 +1,67 @@
+package kafka
+
+import (
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// offsetTracker turns out-of-order completions into in-order commits.
+// Committing an offset commits everything before it in the partition, so a
+// message is only committed once every earlier fetched message is done.
+type offsetTracker struct {
+	mu         sync.Mutex
+	partitions map[partitionKey]*partitionOffsets
+}
+
+// partitionKey identifies a partition across the topics of a consumer
+type partitionKey struct {
+	topic     string
+	partition int
+}
+
+type partitionOffsets struct {
+	pending []kafka.Message // in fetch order
+	done    map[int64]bool
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: make(map[partitionKey]*partitionOffsets)}
+}
+
+// Add records a fetched message. Messages of a partition are added in offset order.
+func (t *offsetTracker) Add(msg kafka.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := partitionKey{msg.Topic, msg.Partition}
+	p, ok := t.partitions[key]
+	if !ok {
+		p = &partitionOffsets{done: make(map[int64]bool)}
+		t.partitions[key] = p
+	}
+	p.pending = append(p.pending, msg)
+}
+
+// Done marks msg as processed and returns the message to commit, if the
+// contiguous completed prefix of its partition advanced
+func (t *offsetTracker) Done(msg kafka.Message) (kafka.Message, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.partitions[partitionKey{msg.Topic, msg.Partition}]
+	if !ok {
+		return kafka.Message{}, false
+	}
+	p.done[msg.Offset] = true
+
+	var commit kafka.Message
+	advanced := false
+	for len(p.pending) > 0 && p.done[p.pending[0].Offset] {
+		commit = p.pending[0]
+		delete(p.done, commit.Offset)
+		p.pending = p.pending[1:]
+		advanced = true
+	}
+	return commit, advanced
+}
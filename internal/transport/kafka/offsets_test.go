@@ -0,0 +1,47 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestOffsetTrackerOutOfOrder(t *testing.T) {
+	tracker := newOffsetTracker()
+	msg := func(topic string, partition int, offset int64) kafka.Message {
+		return kafka.Message{Topic: topic, Partition: partition, Offset: offset}
+	}
+	for offset := range int64(3) {
+		tracker.Add(msg("images", 0, offset))
+	}
+	tracker.Add(msg("images", 1, 10))
+	tracker.Add(msg("thumbnails", 0, 0))
+
+	steps := []struct {
+		done       kafka.Message
+		wantCommit bool
+		wantOffset int64
+	}{
+		// Offset 1 can't be committed while 0 is still in progress
+		{done: msg("images", 0, 1), wantCommit: false},
+		// Other partitions, and the same partition of another topic, are independent
+		{done: msg("images", 1, 10), wantCommit: true, wantOffset: 10},
+		{done: msg("thumbnails", 0, 0), wantCommit: true, wantOffset: 0},
+		// Completing 0 commits through 1
+		{done: msg("images", 0, 0), wantCommit: true, wantOffset: 1},
+		{done: msg("images", 0, 2), wantCommit: true, wantOffset: 2},
+		// Unknown partitions are ignored
+		{done: msg("images", 7, 0), wantCommit: false},
+	}
+	for i, step := range steps {
+		commit, ok := tracker.Done(step.done)
+		if ok != step.wantCommit {
+			t.Fatalf("step %d: Done(%s/%d@%d) committed = %v, want %v",
+				i, step.done.Topic, step.done.Partition, step.done.Offset, ok, step.wantCommit)
+		}
+		if ok && (commit.Offset != step.wantOffset || commit.Topic != step.done.Topic || commit.Partition != step.done.Partition) {
+			t.Errorf("step %d: committed %s/%d@%d, want %s/%d@%d", i, commit.Topic, commit.Partition, commit.Offset,
+				step.done.Topic, step.done.Partition, step.wantOffset)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Prober checks broker connectivity for readiness probes
+type Prober interface {
+	Ping(ctx context.Context) error
+}
+
+type prober struct {
+	brokers []string
+}
+
+func NewProber(brokers []string) Prober {
+	return &prober{brokers: brokers}
+}
+
+// Ping succeeds when any broker answers a metadata request
+func (p *prober) Ping(ctx context.Context) error {
+	var errs []error
+	for _, broker := range p.brokers {
+		conn, err := kafka.DialContext(ctx, "tcp", broker)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		_, err = conn.Brokers()
+		conn.Close()
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return fmt.Errorf("no kafka broker reachable: %w", errors.Join(errs...))
+}
@@ -7,24 +7,41 @@ import (
 
 	"github.com/oziev02/ImageProcessor/internal/domain"
 	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
 )
 
+// priorityHeader carries the task priority so the consumer can schedule a
+// message without decoding its payload
+const priorityHeader = "priority"
+
 type Producer interface {
 	SendTask(ctx context.Context, task *domain.ProcessingTask) error
 	Close() error
 }
 
+// Topics name the topics tasks are published to. Thumbnail and Reprocess
+// are optional; without them those tasks go to Processing.
+type Topics struct {
+	Processing string
+	Thumbnail  string
+	Reprocess  string
+}
+
 type producer struct {
-	writer *kafka.Writer
+	writer messageWriter
+	topics Topics
 }
 
-func NewProducer(brokers []string, topic string) Producer {
+// NewProducer creates a producer publishing each task to its topic
+func NewProducer(brokers []string, topics Topics) Producer {
 	writer := &kafka.Writer{
 		Addr:     kafka.TCP(brokers...),
-		Topic:    topic,
 		Balancer: &kafka.LeastBytes{},
 	}
-	return &producer{writer: writer}
+	return &producer{
+		writer: writer,
+		topics: topics,
+	}
 }
 
 func (p *producer) SendTask(ctx context.Context, task *domain.ProcessingTask) error {
@@ -34,9 +51,14 @@ func (p *producer) SendTask(ctx context.Context, task *domain.ProcessingTask) er
 	}
 
 	msg := kafka.Message{
+		Topic: p.topicFor(task),
 		Key:   []byte(task.ImageID),
 		Value: data,
+		Headers: []kafka.Header{
+			{Key: priorityHeader, Value: []byte(task.Priority.String())},
+		},
 	}
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier{&msg})
 
 	if err := p.writer.WriteMessages(ctx, msg); err != nil {
 		return fmt.Errorf("failed to write message: %w", err)
@@ -45,6 +67,18 @@ func (p *producer) SendTask(ctx context.Context, task *domain.ProcessingTask) er
 	return nil
 }
 
+// topicFor routes reprocessing to its own topic first, so that all of it,
+// thumbnails included, stays out of the way of uploads
+func (p *producer) topicFor(task *domain.ProcessingTask) string {
+	if task.Origin == domain.TaskOriginReprocess && p.topics.Reprocess != "" {
+		return p.topics.Reprocess
+	}
+	if task.Kind == domain.TaskKindThumbnail && p.topics.Thumbnail != "" {
+		return p.topics.Thumbnail
+	}
+	return p.topics.Processing
+}
+
 func (p *producer) Close() error {
 	return p.writer.Close()
 }
@@ -0,0 +1,64 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+func TestSendTaskTopic(t *testing.T) {
+	all := Topics{Processing: "images", Thumbnail: "thumbnails", Reprocess: "reprocess"}
+	upload := &domain.ProcessingTask{ImageID: "a", Kind: domain.TaskKindAll, Origin: domain.TaskOriginUpload}
+	uploadThumb := &domain.ProcessingTask{ImageID: "a", Kind: domain.TaskKindThumbnail, Origin: domain.TaskOriginUpload}
+	reprocess := &domain.ProcessingTask{ImageID: "a", Kind: domain.TaskKindAll, Origin: domain.TaskOriginReprocess, Priority: domain.PriorityLow}
+	reprocessThumb := &domain.ProcessingTask{ImageID: "a", Kind: domain.TaskKindThumbnail, Origin: domain.TaskOriginReprocess}
+
+	tests := []struct {
+		name   string
+		topics Topics
+		task   *domain.ProcessingTask
+		want   string
+	}{
+		{name: "upload", topics: all, task: upload, want: "images"},
+		{name: "upload thumbnail", topics: all, task: uploadThumb, want: "thumbnails"},
+		{name: "reprocess", topics: all, task: reprocess, want: "reprocess"},
+		// Reprocessing stays on its topic, thumbnails included
+		{name: "reprocess thumbnail", topics: all, task: reprocessThumb, want: "reprocess"},
+		{name: "reprocess without its topic", topics: Topics{Processing: "images", Thumbnail: "thumbnails"}, task: reprocess, want: "images"},
+		{name: "reprocess thumbnail without its topic", topics: Topics{Processing: "images", Thumbnail: "thumbnails"}, task: reprocessThumb, want: "thumbnails"},
+		{name: "thumbnail without its topic", topics: Topics{Processing: "images", Reprocess: "reprocess"}, task: uploadThumb, want: "images"},
+		{name: "single topic", topics: Topics{Processing: "images"}, task: reprocessThumb, want: "images"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer := &fakeWriter{}
+			p := &producer{writer: writer, topics: tt.topics}
+			if err := p.SendTask(context.Background(), tt.task); err != nil {
+				t.Fatal(err)
+			}
+			if len(writer.messages) != 1 {
+				t.Fatalf("wrote %d messages, want 1", len(writer.messages))
+			}
+
+			msg := writer.messages[0]
+			if msg.Topic != tt.want {
+				t.Errorf("topic = %q, want %q", msg.Topic, tt.want)
+			}
+			if string(msg.Key) != tt.task.ImageID {
+				t.Errorf("key = %q, want the image ID", msg.Key)
+			}
+			var got domain.ProcessingTask
+			if err := json.Unmarshal(msg.Value, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Kind != tt.task.Kind || got.Origin != tt.task.Origin {
+				t.Errorf("payload kind %q, origin %q, want %q, %q", got.Kind, got.Origin, tt.task.Kind, tt.task.Origin)
+			}
+			if priority := messagePriority(msg); priority != tt.task.Priority {
+				t.Errorf("priority header = %d, want %d", priority, tt.task.Priority)
+			}
+		})
+	}
+}
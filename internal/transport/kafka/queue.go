@@ -0,0 +1,88 @@
+package kafka
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+	"github.com/segmentio/kafka-go"
+)
+
+// queuedMessage is a fetched message waiting to be processed. task is nil
+// when the payload couldn't be decoded; the message is then only committed.
+type queuedMessage struct {
+	msg      kafka.Message
+	task     *domain.ProcessingTask
+	priority domain.TaskPriority
+	seq      uint64
+}
+
+// messageHeap orders by priority, then by fetch order within a priority
+type messageHeap []*queuedMessage
+
+func (h messageHeap) Len() int { return len(h) }
+func (h messageHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h messageHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *messageHeap) Push(x any)   { *h = append(*h, x.(*queuedMessage)) }
+func (h *messageHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// priorityQueue is a bounded queue between the fetch loop and processing.
+// Push blocks while the queue is full, Pop while it's empty.
+type priorityQueue struct {
+	mu    sync.Mutex
+	items messageHeap
+	seq   uint64
+	slots chan struct{} // one token per occupied slot
+	ready chan struct{} // one token per queued item
+}
+
+func newPriorityQueue(size int) *priorityQueue {
+	return &priorityQueue{
+		slots: make(chan struct{}, size),
+		ready: make(chan struct{}, size),
+	}
+}
+
+func (q *priorityQueue) Push(ctx context.Context, item *queuedMessage) error {
+	select {
+	case q.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	q.mu.Lock()
+	item.seq = q.seq
+	q.seq++
+	heap.Push(&q.items, item)
+	q.mu.Unlock()
+
+	q.ready <- struct{}{}
+	return nil
+}
+
+func (q *priorityQueue) Pop(ctx context.Context) (*queuedMessage, error) {
+	select {
+	case <-q.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	q.mu.Lock()
+	item := heap.Pop(&q.items).(*queuedMessage)
+	q.mu.Unlock()
+
+	<-q.slots
+	return item, nil
+}
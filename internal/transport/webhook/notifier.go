@@ -0,0 +1,94 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+// SignatureHeader carries the hex HMAC-SHA256 of the request body, keyed
+// by the shared secret, as "sha256=<hex>"
+const SignatureHeader = "X-Webhook-Signature"
+
+// Notifier tells an external service that an image finished processing
+type Notifier interface {
+	Notify(ctx context.Context, img *domain.Image) error
+}
+
+// Payload is the JSON body posted to the webhook
+type Payload struct {
+	ImageID       string                  `json:"image_id"`
+	Status        domain.ProcessingStatus `json:"status"`
+	ProcessedPath string                  `json:"processed_path,omitempty"`
+	ThumbnailPath string                  `json:"thumbnail_path,omitempty"`
+	Thumbnails    map[string]string       `json:"thumbnails,omitempty"`
+	FailureReason string                  `json:"failure_reason,omitempty"`
+}
+
+type notifier struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+// NewNotifier creates a notifier posting to url. Requests are signed when
+// secret is not empty.
+func NewNotifier(url, secret string, timeout time.Duration) Notifier {
+	return &notifier{
+		url:    url,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (n *notifier) Notify(ctx context.Context, img *domain.Image) error {
+	body, err := json.Marshal(Payload{
+		ImageID:       img.ID,
+		Status:        img.Status,
+		ProcessedPath: img.ProcessedPath,
+		ThumbnailPath: img.ThumbnailPath,
+		Thumbnails:    img.Thumbnails,
+		FailureReason: img.FailureReason,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(n.secret) > 0 {
+		req.Header.Set(SignatureHeader, "sha256="+Sign(n.secret, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the hex HMAC-SHA256 of body keyed by secret, as receivers
+// should compute it to verify a request
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
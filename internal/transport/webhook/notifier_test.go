@@ -0,0 +1,85 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/oziev02/ImageProcessor/internal/domain"
+)
+
+func TestNotify(t *testing.T) {
+	img := &domain.Image{
+		ID:            "a",
+		Status:        domain.StatusCompleted,
+		ProcessedPath: "processed/a.jpg",
+		ThumbnailPath: "thumbnails/a.jpg",
+		Thumbnails:    map[string]string{"small": "thumbnails/small/a.jpg"},
+	}
+	want := Payload{
+		ImageID:       "a",
+		Status:        domain.StatusCompleted,
+		ProcessedPath: "processed/a.jpg",
+		ThumbnailPath: "thumbnails/a.jpg",
+		Thumbnails:    map[string]string{"small": "thumbnails/small/a.jpg"},
+	}
+
+	for _, secret := range []string{"", "s3cret"} {
+		var body []byte
+		var header http.Header
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = io.ReadAll(r.Body)
+			header = r.Header.Clone()
+		}))
+
+		if err := NewNotifier(server.URL, secret, time.Second).Notify(context.Background(), img); err != nil {
+			t.Fatal(err)
+		}
+		server.Close()
+
+		if got := header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", got)
+		}
+		var got Payload
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("payload = %+v, want %+v", got, want)
+		}
+
+		signature := header.Get(SignatureHeader)
+		if secret == "" {
+			if signature != "" {
+				t.Errorf("unsigned webhook carries signature %q", signature)
+			}
+			continue
+		}
+		// Verify as a receiver would, independently of Sign
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		if wantSig := "sha256=" + hex.EncodeToString(mac.Sum(nil)); signature != wantSig {
+			t.Errorf("signature = %q, want %q", signature, wantSig)
+		}
+	}
+}
+
+func TestNotifyErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	err := NewNotifier(server.URL, "", time.Second).Notify(context.Background(), &domain.Image{ID: "a"})
+	if err == nil {
+		t.Fatal("Notify succeeded, want an error for a 502")
+	}
+}